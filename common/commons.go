@@ -24,10 +24,23 @@ const (
 
 	DOMAIN_BLACK_LIST = true
 	DOMAIN_WHITE_LIST = false
+
+	// key prefix of domain rule matching subdomains only
+	DOMAIN_WILDCARD_PREFIX = "*."
 )
 
 type DNSServerInterface interface {
-	ServerDNSPacket(msg *dns.Msg) ([]byte, error)
+	ServerDNSPacket(msg *dns.Msg, srcAddr net.Addr) ([]byte, error)
+}
+
+// PacCheckerInterface tells whether a domain or ip should go through proxy, or be dialed directly
+type PacCheckerInterface interface {
+	CheckDomain(domain string) bool
+	CheckIP(ip string) bool
+	CheckDirectDomain(domain string) bool
+	CheckDirectIP(ip string) bool
+	// counts connection to host, domain or ip, for pac rule deciding it
+	CountConnection(host string)
 }
 
 type ProxyClientInterface interface {
@@ -36,4 +49,6 @@ type ProxyClientInterface interface {
 	HandleUDP(buffer []byte, srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, dataLen int)
 	GetUDPBuffer() []byte
 	PutUDPBuffer(buffer []byte)
+	LearnDomainIP(domain string, ip net.IP)
+	LearnDirectIP(ip net.IP)
 }
@@ -0,0 +1,16 @@
+package common
+
+// SOCKS5 protocol values as RFC 1928 and RFC 1929
+const (
+	SOCKS5_VERSION          = 5
+	SOCKS5_AUTH_NONE        = 0
+	SOCKS5_AUTH_PASSWORD    = 2
+	SOCKS5_AUTH_NO_ACCEPT   = 0xff
+	SOCKS5_AUTH_PASSWORD_V1 = 1
+	SOCKS5_CMD_CONNECT      = 1
+
+	SOCKS5_REPLY_SUCCEEDED         = 0
+	SOCKS5_REPLY_FAILURE           = 1
+	SOCKS5_REPLY_HOST_UNREACHABLE  = 4
+	SOCKS5_REPLY_CMD_NOT_SUPPORTED = 7
+)
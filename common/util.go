@@ -16,6 +16,8 @@ import (
 const (
 	AtTypeUdpIpv4 = 51
 	AtTypeUdpIpv6 = 52
+	// rest of the stream is a smux session, each stream of it starts with its own header
+	AtTypeMux = 53
 )
 
 func GenerateDomainStubs(domain string) []string {
@@ -39,6 +41,51 @@ func GenerateDomainStubs(domain string) []string {
 	return stubs
 }
 
+// MatchDomainRule looks up domain in rules keyed as pac list stores them, "example.com" matches itself only and
+// "*.example.com" matches its subdomains, rule of domain itself wins and then that of the closest parent, it costs one
+// map lookup per label whatever the size of rules
+func MatchDomainRule(rules map[string]bool, domain string) (flag bool, ok bool) {
+	_, _, flag, ok = matchDomainRule(rules, domain)
+	return
+}
+
+// MatchDomainRuleKey is MatchDomainRule also returning key of the rule matched, e.g. "*.example.com"
+func MatchDomainRuleKey(rules map[string]bool, domain string) (key string, flag bool, ok bool) {
+	matched, wildcard, flag, ok := matchDomainRule(rules, domain)
+	if ok && wildcard {
+		return DOMAIN_WILDCARD_PREFIX + matched, flag, ok
+	}
+	return matched, flag, ok
+}
+
+// matchDomainRule returns domain or parent matched, with wildcard set for parent, no key is composed on the way so
+// a lookup does not allocate
+func matchDomainRule(rules map[string]bool, domain string) (matched string, wildcard bool, flag bool, ok bool) {
+	if len(domain) == 0 || domain[0] == '.' || domain[len(domain)-1] == '.' || strings.Contains(domain, "..") {
+		// empty labels are dropped, the same as GenerateDomainStubs
+		domain = strings.Join(strings.FieldsFunc(domain, func(r rune) bool { return r == '.' }), ".")
+		if len(domain) == 0 {
+			return "", false, false, false
+		}
+	}
+	if flag, ok = rules[domain]; ok {
+		return domain, false, flag, ok
+	}
+	// parents are suffixes of domain, so no stub is composed except the wildcard key
+	for i := strings.IndexByte(domain, '.'); i >= 0; {
+		parent := domain[i+1:]
+		if flag, ok = rules[DOMAIN_WILDCARD_PREFIX+parent]; ok {
+			return parent, true, flag, ok
+		}
+		next := strings.IndexByte(parent, '.')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return "", false, false, false
+}
+
 func PipeCommand(cmds ...*exec.Cmd) (output []byte, err error) {
 
 	length := len(cmds)
@@ -104,6 +151,8 @@ func ReadShadowsocksHeader(r io.Reader) (bool, socks.Addr, error) {
 	case AtTypeUdpIpv6:
 		_, err = io.ReadFull(r, b[1:1+net.IPv6len+2])
 		return true, b[:1+net.IPv6len+2], err
+	case AtTypeMux:
+		return false, b[:1], nil
 	}
 
 	return false, nil, socks.ErrAddressNotSupported
@@ -171,3 +220,35 @@ func AddrToString(a socks.Addr) string {
 
 	return net.JoinHostPort(host, port)
 }
+
+// DnsmasqRule is a domain rule of dnsmasq conf, e.g. "server=/example.com/1.2.3.4" or "ipset=/a.com/b.com/gfwlist"
+type DnsmasqRule struct {
+	Option string
+	// lower cased, leading "." dropped, "*." kept for subdomains only, "#" matching any domain is left out
+	Domains []string
+	// server, ipset name or address after the last "/", may be empty
+	Value string
+}
+
+// ParseDnsmasqRule parses line of "option=/domain/.../value" form, ok is false for other lines, comments included
+func ParseDnsmasqRule(line string) (ret DnsmasqRule, ok bool) {
+	line = strings.TrimSpace(line)
+	i := strings.Index(line, "=/")
+	if i <= 0 || strings.ContainsAny(line[:i], "#!/ \t") {
+		return ret, false
+	}
+	rest := line[i+2:]
+	last := strings.LastIndexByte(rest, '/')
+	if last < 0 {
+		return ret, false
+	}
+	ret.Option = strings.ToLower(line[:i])
+	ret.Value = strings.TrimSpace(rest[last+1:])
+	for _, domain := range strings.Split(rest[:last], "/") {
+		domain = strings.ToLower(strings.TrimLeft(strings.TrimSpace(domain), "."))
+		if len(domain) > 0 && domain != "#" {
+			ret.Domains = append(ret.Domains, domain)
+		}
+	}
+	return ret, true
+}
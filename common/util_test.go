@@ -3,6 +3,8 @@ package common
 import (
 	"bytes"
 	"os/exec"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -55,3 +57,58 @@ func TestExtractAddrExtraLine(t *testing.T) {
 		}
 	}
 }
+
+func TestMatchDomainRule(t *testing.T) {
+	rules := map[string]bool{"exact.com": true, "*.sub.com": true, "*.google.com": true, "maps.google.com": false, "*.com": false}
+	for domain, expected := range map[string][2]bool{
+		"exact.com":       {true, true},
+		"www.exact.com":   {false, true},
+		"sub.com":         {false, true},
+		"a.b.sub.com":     {true, true},
+		"maps.google.com": {false, true},
+		"www.google.com":  {true, true},
+		"www.google.com.": {true, true},
+		"www..google.com": {true, true},
+		"other.org":       {false, false},
+		"":                {false, false},
+		".":               {false, false},
+	} {
+		if flag, ok := MatchDomainRule(rules, domain); flag != expected[0] || ok != expected[1] {
+			t.Errorf("MatchDomainRule(%q) got %v %v, expected %v", domain, flag, ok, expected)
+		}
+	}
+}
+
+// matching cost stays flat from a small custom list to a full gfwlist and beyond
+func BenchmarkMatchDomainRule(b *testing.B) {
+	for _, size := range []int{100, 10000, 100000} {
+		rules := make(map[string]bool, size)
+		for i := 0; i < size; i++ {
+			rules[DOMAIN_WILDCARD_PREFIX+strconv.Itoa(i)+"example.com"] = true
+		}
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				MatchDomainRule(rules, "a.b.c.1234example.com")
+			}
+		})
+	}
+}
+
+func TestParseDnsmasqRule(t *testing.T) {
+	for line, expected := range map[string]DnsmasqRule{
+		"server=/google.com/127.0.0.1#5353":      {"server", []string{"google.com"}, "127.0.0.1#5353"},
+		"ipset=/.Google.com/youtube.com/gfwlist": {"ipset", []string{"google.com", "youtube.com"}, "gfwlist"},
+		"server=/*.example.com/#":                {"server", []string{"*.example.com"}, "#"},
+		"address=/ad.com/":                       {"address", []string{"ad.com"}, ""},
+		"ipset=/#/all":                           {"ipset", nil, "all"},
+	} {
+		if rule, ok := ParseDnsmasqRule(line); !ok || !reflect.DeepEqual(rule, expected) {
+			t.Errorf("ParseDnsmasqRule(%s) got %v, %v, expected %v", line, rule, ok, expected)
+		}
+	}
+	for _, line := range []string{"#server=/google.com/8.8.8.8", "google.com", "||google.com/path", "cache-size=1000", "server=8.8.8.8"} {
+		if rule, ok := ParseDnsmasqRule(line); ok {
+			t.Errorf("%s is not dnsmasq domain rule, got %v", line, rule)
+		}
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 )
 
 type KcptunConfig struct {
@@ -36,6 +38,19 @@ type KcptunConfig struct {
 	ScavengeTTL       int    `yaml:"scavenge-ttl"`
 	ListenAddr        string `yaml:"listen-addr"`
 	ThreadCount       int    `yaml:"thread"`
+	// relay UDP flows and proxied DNS in smux streams too, which udp-over-tcp already does, false leaves them to
+	// udp-over-tcp
+	Udp bool `yaml:"udp"`
+	// switch mode between adaptive-min and adaptive-max by measured retransmission, mode is the starting one
+	Adaptive    bool   `yaml:"adaptive"`
+	AdaptiveMin string `yaml:"adaptive-min"`
+	AdaptiveMax string `yaml:"adaptive-max"`
+	// smux protocol 1 or 2, client and server must agree, receive buffers in bytes, 0 max-receive-buffer uses sock-buf
+	SmuxVersion      int `yaml:"smux-version"`
+	MaxReceiveBuffer int `yaml:"max-receive-buffer"`
+	MaxStreamBuffer  int `yaml:"max-stream-buffer"`
+	// streams per session before client opens another session, 0 means unlimited
+	MaxStreams int `yaml:"max-streams"`
 }
 
 func (c *KcptunConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -61,6 +76,10 @@ func (c *KcptunConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		Resend:            0,
 		NoCongestion:      0,
 		ScavengeTTL:       600,
+		AdaptiveMin:       "normal",
+		AdaptiveMax:       "fast3",
+		SmuxVersion:       1,
+		MaxStreamBuffer:   65536,
 	}
 	if err := unmarshal(&raw); err != nil {
 		return err
@@ -69,6 +88,63 @@ func (c *KcptunConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	*c = KcptunConfig(raw)
 	return nil
 }
+
+// TcpMuxConfig multiplexes flows over a few shadowsocks TCP connections with smux, server must support it
+type TcpMuxConfig struct {
+	Enable bool `yaml:"enable"`
+	// number of multiplexed connections
+	Conn              int `yaml:"conn"`
+	KeepAliveInterval int `yaml:"keep-alive-interval"`
+	KeepAliveTimeout  int `yaml:"keep-alive-timeout"`
+}
+
+func (c *TcpMuxConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawConfig TcpMuxConfig
+	raw := rawConfig{
+		Conn:              2,
+		KeepAliveInterval: 10,
+		KeepAliveTimeout:  30,
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	if raw.Conn <= 0 {
+		raw.Conn = 1
+	}
+	*c = TcpMuxConfig(raw)
+	return nil
+}
+
+// WebsocketConfig wraps shadowsocks TCP in WebSocket so it can pass CDN or reverse proxy, remote-server is the
+// address dialed, e.g. CDN edge, while Host and Sni name the site
+type WebsocketConfig struct {
+	Enable bool   `yaml:"enable"`
+	Host   string `yaml:"host"`
+	Path   string `yaml:"path"`
+	Tls    bool   `yaml:"tls"`
+	// default to host
+	Sni      string `yaml:"sni"`
+	Insecure bool   `yaml:"insecure"`
+}
+
+func (c *WebsocketConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawConfig WebsocketConfig
+	raw := rawConfig{
+		Path: "/",
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*c = WebsocketConfig(raw)
+	return nil
+}
+
+// PluginConfig is a SIP003 plugin, e.g. v2ray-plugin or obfs-local, with its options string
+type PluginConfig struct {
+	Plugin     string `yaml:"plugin"`
+	PluginOpts string `yaml:"plugin-opts"`
+}
+
 func (c *KcptunConfig) Equal(other *KcptunConfig) bool {
 	if c.Enable == other.Enable &&
 		c.Server == other.Server &&
@@ -92,7 +168,15 @@ func (c *KcptunConfig) Equal(other *KcptunConfig) bool {
 		c.NoCongestion == other.NoCongestion &&
 		c.ScavengeTTL == other.ScavengeTTL &&
 		c.ListenAddr == other.ListenAddr &&
-		c.ThreadCount == other.ThreadCount {
+		c.ThreadCount == other.ThreadCount &&
+		c.Udp == other.Udp &&
+		c.Adaptive == other.Adaptive &&
+		c.AdaptiveMin == other.AdaptiveMin &&
+		c.AdaptiveMax == other.AdaptiveMax &&
+		c.SmuxVersion == other.SmuxVersion &&
+		c.MaxReceiveBuffer == other.MaxReceiveBuffer &&
+		c.MaxStreamBuffer == other.MaxStreamBuffer &&
+		c.MaxStreams == other.MaxStreams {
 		return true
 	}
 
@@ -108,60 +192,473 @@ type RemoteServerConfig struct {
 	Password     string       `yaml:"password"`
 	UdpOverTcp   bool         `yaml:"udp-over-tcp"`
 	Kcptun       KcptunConfig `yaml:"kcptun"`
+	// seconds to wait for dial to server, 0 waits as long as kernel does, while udp-timeout and tcp-timeout are idle
+	// timeouts of UDP flows and UDP over TCP flows
+	ConnectTimeout int `yaml:"connect-timeout"`
+	// seconds to wait for DNS answer relayed by this backend, 0 uses dns timeout
+	DnsTimeout int `yaml:"dns-timeout"`
+	// relative share of traffic under weighted balance strategy
+	Weight int `yaml:"weight"`
+	// label referred by backend policy, default to remote-server
+	Name string `yaml:"name"`
+	// total bandwidth cap of this backend in kbit/s, 0 means unlimited
+	UploadLimit   int `yaml:"upload-limit"`
+	DownloadLimit int `yaml:"download-limit"`
+	// dialed connections kept ready for new flows, 0 disables, pooled conn older than pool-idle seconds is redialed
+	PoolSize int `yaml:"pool-size"`
+	PoolIdle int `yaml:"pool-idle"`
+	// dial server with TCP Fast Open, needs net.ipv4.tcp_fastopen client bit and server support
+	TcpFastOpen bool `yaml:"tcp-fast-open"`
+	// ignored when kcptun is enabled
+	TcpMux TcpMuxConfig `yaml:"tcp-mux"`
+	// UDP needs udp-over-tcp to pass CDN
+	Websocket WebsocketConfig `yaml:"websocket"`
+	// SIP003 plugin run locally, plugins chains several with first one nearest to us, ignored when kcptun is enabled
+	Plugin     string         `yaml:"plugin"`
+	PluginOpts string         `yaml:"plugin-opts"`
+	Plugins    []PluginConfig `yaml:"plugins"`
+	// failed dial is retried dial-retry times, backoff in ms doubles each retry
+	DialRetry   int `yaml:"dial-retry"`
+	DialBackoff int `yaml:"dial-backoff"`
+	// backend is skipped for breaker-cooldown seconds after breaker-threshold consecutive dial failures, 0 disables
+	BreakerThreshold int `yaml:"breaker-threshold"`
+	BreakerCooldown  int `yaml:"breaker-cooldown"`
+	// egress through this interface or source ip whatever default route is, not applied to kcptun and plugins
+	BindInterface string `yaml:"bind-interface"`
+	BindAddress   string `yaml:"bind-address"`
+	// datagram to server larger than max-udp-size bytes, IP and UDP headers excluded, is fragmented or dropped by
+	// udp-oversize, 0 disables the check
+	MaxUdpSize  int    `yaml:"max-udp-size"`
+	UdpOversize string `yaml:"udp-oversize"`
+	// seconds without packet in either direction before UDP flow expires, 0 uses udp-timeout, or tcp-timeout for UDP
+	// over TCP, which then only bound each write
+	UdpIdleTimeout int `yaml:"udp-idle-timeout"`
+	// simultaneous TCP relays and UDP flows on this backend, 0 means unlimited, full backend is skipped by selection,
+	// relay picking it anyway since all are full waits max-conns-wait ms for a slot
+	MaxConns     int `yaml:"max-conns"`
+	MaxConnsWait int `yaml:"max-conns-wait"`
+	// send PROXY protocol v2 header with LAN client address on each plain TCP connection to server, e.g. haproxy in
+	// front of it, not sent over kcptun, tcp-mux and plugins which carry no single client
+	ProxyProtocol bool `yaml:"proxy-protocol"`
 }
 
 func (c *RemoteServerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type rawConfig RemoteServerConfig
 	raw := rawConfig{
-		TcpTimeout: 120,
-		UdpTimeout: 60,
+		TcpTimeout:       120,
+		UdpTimeout:       60,
+		ConnectTimeout:   10,
+		Weight:           1,
+		PoolIdle:         30,
+		DialRetry:        2,
+		DialBackoff:      100,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30,
+		MaxUdpSize:       1472,
+		UdpOversize:      "fragment",
+		MaxConnsWait:     500,
 	}
 
 	if err := unmarshal(&raw); err != nil {
 		return err
 	}
+	if raw.Weight <= 0 {
+		raw.Weight = 1
+	}
+	if raw.PoolIdle <= 0 {
+		raw.PoolIdle = 30
+	}
 	*c = RemoteServerConfig(raw)
 	return nil
 }
 func (c *RemoteServerConfig) Equal(other *RemoteServerConfig) bool {
-	if c.Enable == other.Enable &&
+	if c.EqualTransport(other) &&
 		c.UdpTimeout == other.UdpTimeout &&
 		c.TcpTimeout == other.TcpTimeout &&
+		c.ConnectTimeout == other.ConnectTimeout &&
+		c.DnsTimeout == other.DnsTimeout &&
+		c.UdpIdleTimeout == other.UdpIdleTimeout &&
+		c.Kcptun.Equal(&other.Kcptun) {
+		return true
+	}
+	return false
+}
+
+// EqualTransport compares only settings which require backend to reconnect when changed
+func (c *RemoteServerConfig) EqualTransport(other *RemoteServerConfig) bool {
+	if c.Enable == other.Enable &&
 		c.RemoteServer == other.RemoteServer &&
 		c.Crypt == other.Crypt &&
 		c.Password == other.Password &&
-		c.Kcptun.Equal(&other.Kcptun) {
+		c.UdpOverTcp == other.UdpOverTcp &&
+		c.PoolSize == other.PoolSize &&
+		c.PoolIdle == other.PoolIdle &&
+		c.TcpFastOpen == other.TcpFastOpen &&
+		c.ProxyProtocol == other.ProxyProtocol &&
+		c.BindInterface == other.BindInterface &&
+		c.BindAddress == other.BindAddress &&
+		c.TcpMux == other.TcpMux &&
+		c.Websocket == other.Websocket &&
+		equalPlugins(c.GetPlugins(), other.GetPlugins()) &&
+		// other kcptun settings are reloaded in place
+		c.Kcptun.Enable == other.Kcptun.Enable {
 		return true
 	}
 	return false
 }
 
+// GetPlugins returns plugin chain, plugins if set, else the single plugin
+func (c *RemoteServerConfig) GetPlugins() []PluginConfig {
+	if len(c.Plugins) > 0 {
+		return c.Plugins
+	}
+	if len(c.Plugin) > 0 {
+		return []PluginConfig{{Plugin: c.Plugin, PluginOpts: c.PluginOpts}}
+	}
+	return nil
+}
+
+func equalPlugins(a []PluginConfig, b []PluginConfig) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type BackendPolicyConfig struct {
+	Backend string   `yaml:"backend"`
+	Domains []string `yaml:"domains"`
+	Cidr    []string `yaml:"cidr"`
+}
+
+type Socks5InboundConfig struct {
+	Enable     bool   `yaml:"enable"`
+	ListenAddr string `yaml:"listen-addr"`
+	// username and password auth as RFC 1929, no auth if username is empty
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+func (c *Socks5InboundConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawConfig Socks5InboundConfig
+	raw := rawConfig{
+		ListenAddr: "0.0.0.0:1080",
+	}
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*c = Socks5InboundConfig(raw)
+	return nil
+}
+
+type HttpInboundConfig struct {
+	Enable     bool   `yaml:"enable"`
+	ListenAddr string `yaml:"listen-addr"`
+	// basic proxy auth, no auth if username is empty
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+func (c *HttpInboundConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawConfig HttpInboundConfig
+	raw := rawConfig{
+		ListenAddr: "0.0.0.0:8118",
+	}
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*c = HttpInboundConfig(raw)
+	return nil
+}
+
+// PacServerConfig serves pac lists as proxy auto-config script, at /proxy.pac and at /wpad.dat for WPAD
+type PacServerConfig struct {
+	Enable     bool   `yaml:"enable"`
+	ListenAddr string `yaml:"listen-addr"`
+	// pac result of proxied hosts, e.g. "PROXY 192.168.1.1:8118; SOCKS5 192.168.1.1:1080", an unspecified host is
+	// replaced by the one script is requested from, empty uses enabled inbounds
+	Proxy string `yaml:"proxy"`
+	// resolve unlisted domains in browser to check ip rules, which blocks browser on each lookup
+	Resolve bool `yaml:"resolve"`
+}
+
+func (c *PacServerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawConfig PacServerConfig
+	raw := rawConfig{
+		ListenAddr: "0.0.0.0:80",
+	}
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*c = PacServerConfig(raw)
+	return nil
+}
+
+type BufferConfig struct {
+	UdpBufferSize int `yaml:"udp-buffer-size"`
+	UdpPoolSize   int `yaml:"udp-pool-size"`
+	TcpBufferSize int `yaml:"tcp-buffer-size"`
+	TcpPoolSize   int `yaml:"tcp-pool-size"`
+}
+
+const (
+	// UDP buffer holds a whole datagram of ethernet MTU at least, relay panics on empty buffer
+	BUFFER_MIN_UDP_SIZE = 1500
+	BUFFER_MIN_TCP_SIZE = 1024
+	BUFFER_MIN_POOL     = 1
+)
+
+func (c *BufferConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawConfig BufferConfig
+	defaults := rawConfig{
+		UdpBufferSize: 1024 * 4,
+		UdpPoolSize:   1024 * 10,
+		TcpBufferSize: 1024 * 32,
+		TcpPoolSize:   256,
+	}
+	raw := defaults
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	for _, value := range []struct {
+		name     string
+		value    *int
+		min      int
+		fallback int
+	}{
+		{"udp-buffer-size", &raw.UdpBufferSize, BUFFER_MIN_UDP_SIZE, defaults.UdpBufferSize},
+		{"udp-pool-size", &raw.UdpPoolSize, BUFFER_MIN_POOL, defaults.UdpPoolSize},
+		{"tcp-buffer-size", &raw.TcpBufferSize, BUFFER_MIN_TCP_SIZE, defaults.TcpBufferSize},
+		{"tcp-pool-size", &raw.TcpPoolSize, BUFFER_MIN_POOL, defaults.TcpPoolSize},
+	} {
+		if *value.value < value.min {
+			log.GetLogger().Warn("Buffer config is below minimum, so use default", zap.String("name", value.name),
+				zap.Int("value", *value.value), zap.Int("min", value.min), zap.Int("default", value.fallback))
+			*value.value = value.fallback
+		}
+	}
+	*c = BufferConfig(raw)
+	return nil
+}
+
 type ShadowsocksConfig struct {
 	Servers []RemoteServerConfig `yaml:"servers"`
+	// backend selection strategy: random, round-robin, weighted, least-conn, lowest-rtt or fastest
+	Balance string `yaml:"balance"`
+	// seconds between connect probes of every backend under fastest strategy
+	ProbeInterval int `yaml:"probe-interval"`
+	// pin domains or destination cidrs to named backend, bypassing balance strategy
+	Policies []BackendPolicyConfig `yaml:"policy"`
+	// number of SO_REUSEPORT UDP listener sockets each with its own read loop, 0 means one per cpu
+	UdpListeners int `yaml:"udp-listeners"`
+	// datagrams read per recvmmsg syscall on each UDP listener, 1 disables batching
+	UdpBatch int `yaml:"udp-batch"`
+	// accept TCP Fast Open on transparent listener, needs net.ipv4.tcp_fastopen server bit, applied on restart
+	TcpFastOpen bool `yaml:"tcp-fast-open"`
+	// relay buffer sizes in bytes and pool capacities, pools only keep idle buffers up to capacity
+	Buffer BufferConfig `yaml:"buffer"`
+	// cap of each TCP connection or UDP flow in kbit/s per direction, 0 means unlimited
+	ConnRateLimit int `yaml:"conn-rate-limit"`
+	// cap of simultaneous TCP connections and UDP flows of each LAN client, 0 means unlimited
+	ClientConnLimit int `yaml:"client-conn-limit"`
+	ClientUdpLimit  int `yaml:"client-udp-limit"`
+	// nameservers resolving hostname remote-server, default to dns local-resolver, since system resolver may be us
+	ServerResolver []string `yaml:"server-resolver"`
+	// seconds between re-resolving hostname remote-server, dial failure also triggers it, 0 resolves only at start
+	ServerResolveInterval int `yaml:"server-resolve-interval"`
+	// fwmark set on backend sockets, marked packets are never intercepted, must not match packet-mask, 0 disables
+	OutboundMark int `yaml:"outbound-mark"`
+	// cap of UDP NAT table, least recently used flow is evicted and its socket closed beyond it, 0 means no cap
+	UdpMaxFlows int `yaml:"udp-max-flows"`
+	// one remote socket per client source port accepting replies from any peer, only for plain UDP backends
+	UdpFullCone bool `yaml:"udp-full-cone"`
+	// log one record for every finished TCP relay and UDP flow with source, destination, backend, bytes and duration
+	RelayLog bool `yaml:"relay-log"`
+	// bond backends to aggregate uplinks or mask loss on one of them
+	Multipath MultipathConfig `yaml:"multipath"`
+}
+
+// MultipathConfig bonds named backends, TCP flows picking any of them are balanced by least connections across all,
+// UDP datagrams of plain UDP flows are duplicated or striped over them, so for UDP the backends should be the same
+// server reached over different uplinks, e.g. with bind-interface
+type MultipathConfig struct {
+	Enable   bool     `yaml:"enable"`
+	Backends []string `yaml:"backends"`
+	// "duplicate" sends every datagram over each backend and drops repeated replies, "stripe" sends each one over
+	// next backend in turn, empty keeps UDP flow on one backend
+	Udp string `yaml:"udp"`
+}
+
+func (c *ShadowsocksConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawConfig ShadowsocksConfig
+	raw := rawConfig{
+		Balance:               "random",
+		UdpListeners:          1,
+		UdpBatch:              1,
+		ServerResolveInterval: 600,
+		ProbeInterval:         30,
+		Buffer: BufferConfig{
+			UdpBufferSize: 1024 * 4,
+			UdpPoolSize:   1024 * 10,
+			TcpBufferSize: 1024 * 32,
+			TcpPoolSize:   256,
+		},
+	}
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	if raw.ProbeInterval <= 0 {
+		raw.ProbeInterval = 30
+	}
+	*c = ShadowsocksConfig(raw)
+	return nil
 }
 
 type DnsFilterConfig struct {
 	Enable     bool     `yaml:"enable"`
 	WhiteLists []string `yaml:"white-list"`
 	BlackLists []string `yaml:"black-list"`
+	// queried domain answered as target domain or ip, keyed as pac rules, applied whether lists are enabled or not
+	Rewrite map[string]string `yaml:"rewrite"`
+}
+
+type DnsEdnsConfig struct {
+	Enable              bool   `yaml:"enable"`
+	UdpSize             int    `yaml:"udp-size"`
+	ClientSubnet        string `yaml:"client-subnet"`
+	ForwardClientSubnet bool   `yaml:"forward-client-subnet"`
+}
+
+func (c *DnsEdnsConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawConfig DnsEdnsConfig
+	raw := rawConfig{
+		Enable:  true,
+		UdpSize: 1232,
+	}
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*c = DnsEdnsConfig(raw)
+	return nil
+}
+
+type DnsSecConfig struct {
+	Enable      bool     `yaml:"enable"`
+	Strict      bool     `yaml:"strict"`
+	TrustAnchor []string `yaml:"trust-anchor"`
+}
+
+type DnsDns64Config struct {
+	Enable bool   `yaml:"enable"`
+	Prefix string `yaml:"prefix"`
+}
+
+func (c *DnsDns64Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawConfig DnsDns64Config
+	raw := rawConfig{
+		Prefix: "64:ff9b::/96",
+	}
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*c = DnsDns64Config(raw)
+	return nil
+}
+
+type DnsClientRuleConfig struct {
+	Subnet  []string            `yaml:"subnet"`
+	Resolve string              `yaml:"resolve"`
+	Hosts   map[string][]string `yaml:"hosts"`
+}
+
+type DnsSocks5Config struct {
+	Addr     string `yaml:"addr"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type DnsAuditConfig struct {
+	Enable     bool   `yaml:"enable"`
+	Path       string `yaml:"path"`
+	MaxSize    int    `yaml:"max-size"`
+	MaxBackups int    `yaml:"max-backups"`
+}
+
+func (c *DnsAuditConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawConfig DnsAuditConfig
+	raw := rawConfig{
+		Path:       "dns_query.log",
+		MaxSize:    10,
+		MaxBackups: 3,
+	}
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*c = DnsAuditConfig(raw)
+	return nil
 }
 
 type DnsConfig struct {
-	ListenAddr    string          `yaml:"listen-addr"`
-	LocalResolver []string        `yaml:"local-resolver"`
-	ProxyResolver []string        `yaml:"proxy-resolver"`
-	SendNum       int             `yaml:"send-num"`
-	Timeout       int             `yaml:"timeout"`
-	Cache         bool            `yaml:"cache"`
-	FilterConfig  DnsFilterConfig `yaml:"filter"`
+	ListenAddr           string                `yaml:"listen-addr"`
+	Tcp                  bool                  `yaml:"tcp"`
+	LocalResolver        []string              `yaml:"local-resolver"`
+	ProxyResolver        []string              `yaml:"proxy-resolver"`
+	ResolverPolicy       string                `yaml:"resolver-policy"`
+	ResolverWeight       map[string]int        `yaml:"resolver-weight"`
+	BogusIP              []string              `yaml:"bogus-ip"`
+	EnableIPv6           bool                  `yaml:"enable-ipv6"`
+	CaseRandomize        bool                  `yaml:"case-randomize"`
+	ProxyFallbackLocal   bool                  `yaml:"proxy-fallback-local"`
+	ProxyTtl             int                   `yaml:"proxy-ttl"`
+	Retry                int                   `yaml:"retry"`
+	RetryBackoff         int                   `yaml:"retry-backoff"`
+	RefuseType           map[string]string     `yaml:"refuse-type"`
+	RefuseExternalPTR    bool                  `yaml:"refuse-external-ptr"`
+	SendNum              int                   `yaml:"send-num"`
+	Timeout              int                   `yaml:"timeout"`
+	Cache                bool                  `yaml:"cache"`
+	CacheLocal           bool                  `yaml:"cache-local"`
+	CachePersist         string                `yaml:"cache-persist"`
+	CachePersistInterval int                   `yaml:"cache-persist-interval"`
+	FilterConfig         DnsFilterConfig       `yaml:"filter"`
+	EdnsConfig           DnsEdnsConfig         `yaml:"edns"`
+	DnssecConfig         DnsSecConfig          `yaml:"dnssec"`
+	AuditConfig          DnsAuditConfig        `yaml:"audit"`
+	Dns64Config          DnsDns64Config        `yaml:"dns64"`
+	Socks5Config         DnsSocks5Config       `yaml:"proxy-resolver-socks5"`
+	ClientRules          []DnsClientRuleConfig `yaml:"client-rules"`
 }
 
 func (c *DnsConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type rawConfig DnsConfig
 	raw := rawConfig{
-		SendNum: 1,
-		Cache:   true,
-		Timeout: 10,
+		SendNum:              1,
+		Cache:                true,
+		Tcp:                  true,
+		CachePersistInterval: 300,
+		Timeout:              10,
+		ResolverPolicy:       "random",
+		Retry:                1,
+		RetryBackoff:         100,
+		EdnsConfig:           DnsEdnsConfig{Enable: true, UdpSize: 1232},
+		AuditConfig:          DnsAuditConfig{Path: "dns_query.log", MaxSize: 10, MaxBackups: 3},
+		Dns64Config:          DnsDns64Config{Prefix: "64:ff9b::/96"},
 	}
 
 	if err := unmarshal(&raw); err != nil {
@@ -183,16 +680,51 @@ type Config struct {
 	PacList      []string          `yaml:"pac-list"`
 	RoutingTable int               `yaml:"routing-table"`
 	IPSet        bool              `yaml:"ipset"`
+	// experimental, destination sets are BPF maps matched by xt_bpf instead of ipsets
+	EBPF bool `yaml:"ebpf"`
+	// LAN devices intercepted, all if empty, and those never intercepted, as ips or CIDRs
+	IncludeSource []string `yaml:"include-source"`
+	ExcludeSource []string `yaml:"exclude-source"`
+	// pac-list URLs are downloaded into pac-cache, relative to working dir, and again every pac-refresh seconds
+	PacCache   string `yaml:"pac-cache"`
+	PacRefresh int    `yaml:"pac-refresh"`
+	// reload pac lists when a local list file changes, without reload signal
+	PacWatch bool `yaml:"pac-watch"`
+	// proxy everything except domains and ips in pac lists, requires ipset
+	PacWhitelist bool `yaml:"pac-whitelist"`
+	// log iptables, ipset and policy routing changes instead of applying them
+	RoutingDryRun bool `yaml:"routing-dry-run"`
+	// CIDR list, e.g. chnroute, whose destinations are never intercepted, requires ipset
+	DirectList string `yaml:"direct-list"`
+	// ips learned from DNS answers leave routing table after answer TTL, but no sooner than this many seconds
+	RouteTTLFloor int `yaml:"route-ttl-floor"`
+	// learned mappings are saved this often in seconds besides on stop, and restored on start
+	RoutePersistInterval int `yaml:"route-persist-interval"`
+	// MaxMind country database for GEOIP rules of pac lists
+	GeoIPDatabase string `yaml:"geoip-database"`
+	// unix socket for runtime commands, empty to disable
+	ControlSocket string `yaml:"control-socket"`
+	// explicit SOCKS5 proxy for hosts which can not be transparently redirected
+	Socks5Inbound Socks5InboundConfig `yaml:"socks5-inbound"`
+	// explicit HTTP proxy, proxied or connected directly by pac list
+	HttpInbound HttpInboundConfig `yaml:"http-inbound"`
+	// proxy auto-config of pac lists for devices not intercepted
+	PacServer PacServerConfig `yaml:"pac-server"`
 }
 
 func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type rawConfig Config
 	raw := rawConfig{
-		PacketMask:   "0x1/0x1",
-		RoutingTable: 100,
-		IgnoreIP:     []string{"127.0.0.0/8", "192.168.0.0/16", "172.16.0.0/12", "10.0.0.0/8", "100.64.0.0/10", "198.18.0.0/15"},
-		IgnoreIPv6:   []string{"::1/128", "fe80::/10", "fc00::/7"},
-		IPSet:        true,
+		PacketMask:           "0x1/0x1",
+		RoutingTable:         100,
+		IgnoreIP:             []string{"127.0.0.0/8", "192.168.0.0/16", "172.16.0.0/12", "10.0.0.0/8", "100.64.0.0/10", "198.18.0.0/15"},
+		IgnoreIPv6:           []string{"::1/128", "fe80::/10", "fc00::/7"},
+		IPSet:                true,
+		PacCache:             "pac_cache",
+		PacRefresh:           86400,
+		PacWatch:             true,
+		RouteTTLFloor:        3600,
+		RoutePersistInterval: 300,
 	}
 
 	if err := unmarshal(&raw); err != nil {
@@ -263,5 +795,33 @@ func ParseClientConfig(path string) (ret Config, err error) {
 			return
 		}
 	}
+	if len(ret.Shadowsocks.ServerResolver) == 0 {
+		ret.Shadowsocks.ServerResolver = ret.Dns.LocalResolver
+	}
+	if err = checkOutboundMark(ret.Shadowsocks.OutboundMark, ret.PacketMask); err != nil {
+		return
+	}
 	return
 }
+
+// checkOutboundMark rejects outbound mark matching packet mask, tunnel traffic would be routed back to us
+func checkOutboundMark(outboundMark int, packetMask string) error {
+	if outboundMark == 0 {
+		return nil
+	}
+	stubs := strings.SplitN(packetMask, "/", 2)
+	value, err := strconv.ParseUint(stubs[0], 0, 32)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid packet-mask %s", packetMask)
+	}
+	mask := uint64(0xffffffff)
+	if len(stubs) == 2 {
+		if mask, err = strconv.ParseUint(stubs[1], 0, 32); err != nil {
+			return errors.Wrapf(err, "Invalid packet-mask %s", packetMask)
+		}
+	}
+	if uint64(outboundMark)&mask == value&mask {
+		return errors.Errorf("outbound-mark 0x%x matches packet-mask %s", outboundMark, packetMask)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"github.com/weishi258/redfrog-core/log"
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+func TestCheckOutboundMark(t *testing.T) {
+	tests := []struct {
+		mark  int
+		mask  string
+		valid bool
+	}{
+		{0, "0x1/0x1", true},
+		{0x2, "0x1/0x1", true},
+		{0x3, "0x1/0x1", false},
+		{0x1, "1", false},
+		{0x100, "0x1", true},
+		{0x100, "bad", false},
+	}
+	for _, test := range tests {
+		if err := checkOutboundMark(test.mark, test.mask); (err == nil) != test.valid {
+			t.Errorf("mark 0x%x with packet-mask %s expected valid %v, got %v", test.mark, test.mask, test.valid, err)
+		}
+	}
+}
+
+func TestBufferConfigMinimum(t *testing.T) {
+	log.InitLogger("", "error", false)
+	var buffer BufferConfig
+	if err := yaml.Unmarshal([]byte("udp-buffer-size: 0\nudp-pool-size: -1\ntcp-buffer-size: 0\ntcp-pool-size: 16\n"), &buffer); err != nil {
+		t.Fatal(err)
+	}
+	expected := BufferConfig{UdpBufferSize: 1024 * 4, UdpPoolSize: 1024 * 10, TcpBufferSize: 1024 * 32, TcpPoolSize: 16}
+	if buffer != expected {
+		t.Errorf("got %+v, expected %+v", buffer, expected)
+	}
+	if err := yaml.Unmarshal([]byte("udp-buffer-size: 1500\ntcp-buffer-size: 1024\n"), &buffer); err != nil {
+		t.Fatal(err)
+	}
+	if buffer.UdpBufferSize != 1500 || buffer.TcpBufferSize != 1024 {
+		t.Errorf("minimum sizes should be kept, got %+v", buffer)
+	}
+}
+
+func TestKcptunUdpDefault(t *testing.T) {
+	var kcptun KcptunConfig
+	if err := yaml.Unmarshal([]byte("enable: true\n"), &kcptun); err != nil {
+		t.Fatal(err)
+	}
+	if kcptun.Udp {
+		t.Error("kcptun udp should be off unless configured")
+	}
+}
@@ -18,6 +18,27 @@ type ServerConfig struct {
 	Crypt      string       `yaml:"crypt"`
 	Password   string       `yaml:"password"`
 	Kcptun     KcptunConfig `yaml:"kcptun"`
+	// accept shadowsocks TCP wrapped in WebSocket, usually behind CDN or TLS terminating reverse proxy
+	Websocket ServerWebsocketConfig `yaml:"websocket"`
+}
+
+type ServerWebsocketConfig struct {
+	Enable     bool   `yaml:"enable"`
+	ListenAddr string `yaml:"listen-addr"`
+	Path       string `yaml:"path"`
+}
+
+func (c *ServerWebsocketConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawConfig ServerWebsocketConfig
+	raw := rawConfig{
+		ListenAddr: "127.0.0.1:8080",
+		Path:       "/",
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*c = ServerWebsocketConfig(raw)
+	return nil
 }
 
 func (c *ServerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -0,0 +1,115 @@
+package control
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CONTROL_READ_TIMEOUT = 10 * time.Second
+)
+
+// CommandHandler handles one control command, returned text is written back to client
+type CommandHandler func(args []string) string
+
+// ControlServer accepts line based commands from a unix socket, e.g. "echo dns-dump | socat - UNIX:/var/run/redfrog.sock"
+type ControlServer struct {
+	path     string
+	listener net.Listener
+
+	handlerMux sync.RWMutex
+	handlers   map[string]CommandHandler
+}
+
+func StartControlServer(path string) (ret *ControlServer, err error) {
+	logger := log.GetLogger()
+	// remove stale socket left by previous run
+	os.Remove(path)
+	ret = &ControlServer{path: path, handlers: make(map[string]CommandHandler)}
+	if ret.listener, err = net.Listen("unix", path); err != nil {
+		return nil, errors.Wrapf(err, "Listen control socket %s failed", path)
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		ret.listener.Close()
+		return nil, errors.Wrapf(err, "Chmod control socket %s failed", path)
+	}
+	ret.Register("help", ret.help)
+	go ret.serve()
+	logger.Info("Control server started", zap.String("path", path))
+	return
+}
+
+func (c *ControlServer) Register(cmd string, handler CommandHandler) {
+	c.handlerMux.Lock()
+	defer c.handlerMux.Unlock()
+	c.handlers[cmd] = handler
+}
+
+func (c *ControlServer) help(args []string) string {
+	c.handlerMux.RLock()
+	defer c.handlerMux.RUnlock()
+	cmds := make([]string, 0, len(c.handlers))
+	for cmd := range c.handlers {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+	return strings.Join(cmds, "\n")
+}
+
+func (c *ControlServer) serve() {
+	logger := log.GetLogger()
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			if ee, ok := err.(net.Error); ok && ee.Temporary() {
+				continue
+			}
+			logger.Info("Control server stop accepting", zap.String("error", err.Error()))
+			return
+		}
+		go c.handleConn(conn)
+	}
+}
+
+func (c *ControlServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(CONTROL_READ_TIMEOUT))
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		c.handlerMux.RLock()
+		handler, ok := c.handlers[fields[0]]
+		c.handlerMux.RUnlock()
+		var response string
+		if ok {
+			response = handler(fields[1:])
+		} else {
+			response = fmt.Sprintf("unknown command %s, try help", fields[0])
+		}
+		if _, err := conn.Write([]byte(strings.TrimSuffix(response, "\n") + "\n")); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(CONTROL_READ_TIMEOUT))
+	}
+}
+
+func (c *ControlServer) Stop() {
+	logger := log.GetLogger()
+	if err := c.listener.Close(); err != nil {
+		logger.Error("Stop control server failed", zap.String("error", err.Error()))
+	}
+	os.Remove(c.path)
+	logger.Info("Control server stopped")
+}
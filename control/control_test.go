@@ -0,0 +1,61 @@
+package control
+
+import (
+	"bufio"
+	"github.com/weishi258/redfrog-core/log"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestControlServer(t *testing.T) {
+	log.InitLogger("", "error", false)
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "redfrog.sock")
+	server, err := StartControlServer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.Register("echo", func(args []string) string {
+		return strings.Join(args, " ") + "\n"
+	})
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	command := func(line string, lines int) string {
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		response := make([]string, 0, lines)
+		for i := 0; i < lines; i++ {
+			text, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			response = append(response, strings.TrimSuffix(text, "\n"))
+		}
+		return strings.Join(response, "\n")
+	}
+	if got := command("echo hello  world", 1); got != "hello world" {
+		t.Errorf("echo got %q", got)
+	}
+	if got := command("dump", 1); got != "unknown command dump, try help" {
+		t.Errorf("unknown command got %q", got)
+	}
+	// blank line is skipped, so next response is the one of help
+	if got := command("\nhelp", 2); got != "echo\nhelp" {
+		t.Errorf("help got %q", got)
+	}
+}
@@ -0,0 +1,38 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"math/rand"
+	"strings"
+)
+
+// randomizeCase flips case of letters in name randomly (draft-vixie-dnsext-dns0x20), spoofed response has to guess it
+func randomizeCase(name string) string {
+	ret := []byte(name)
+	for i, ch := range ret {
+		if (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') {
+			if rand.Intn(2) == 0 {
+				ret[i] = ch | 0x20
+			} else {
+				ret[i] = ch &^ 0x20
+			}
+		}
+	}
+	return string(ret)
+}
+
+// restoreCase verifies response echoes the randomized name exactly, then puts back the name client asked for
+func restoreCase(resDns *dns.Msg, original string, randomized string) bool {
+	if len(resDns.Question) == 0 || resDns.Question[0].Name != randomized {
+		return false
+	}
+	resDns.Question[0].Name = original
+	for _, rrs := range [][]dns.RR{resDns.Answer, resDns.Ns, resDns.Extra} {
+		for _, rr := range rrs {
+			if strings.EqualFold(rr.Header().Name, original) {
+				rr.Header().Name = original
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,32 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+)
+
+func TestQueryCaseRandomization(t *testing.T) {
+	original := "www.example-0x20.com."
+	randomized := randomizeCase(original)
+	if !strings.EqualFold(original, randomized) {
+		t.Fatalf("randomized name %s does not match %s", randomized, original)
+	}
+
+	resDns := new(dns.Msg)
+	resDns.SetQuestion(randomized, dns.TypeA)
+	rr, _ := dns.NewRR(randomized + " 60 IN A 192.0.2.1")
+	resDns.Answer = append(resDns.Answer, rr)
+	if !restoreCase(resDns, original, randomized) {
+		t.Fatalf("echoed name should pass verification")
+	}
+	if resDns.Question[0].Name != original || resDns.Answer[0].Header().Name != original {
+		t.Errorf("name is not restored: %s, %s", resDns.Question[0].Name, resDns.Answer[0].Header().Name)
+	}
+
+	spoofed := new(dns.Msg)
+	spoofed.SetQuestion(strings.ToUpper(original), dns.TypeA)
+	if restoreCase(spoofed, original, "WwW.eXample-0x20.CoM.") {
+		t.Errorf("mismatched case should fail verification")
+	}
+}
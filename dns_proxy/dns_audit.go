@@ -0,0 +1,108 @@
+package dns_proxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	AUDIT_MB = 1024 * 1024
+)
+
+// dnsQueryInfo carries per query details collected along the resolving path
+type dnsQueryInfo struct {
+	client   net.Addr
+	start    time.Time
+	resolver string
+	proxied  bool
+	cached   bool
+	blocked  bool
+	fallback bool
+	rule     *clientRule
+	// rewrite rules followed, bounded so rules rewriting to each other do not loop
+	rewrites int
+}
+
+type dnsAuditLogger struct {
+	writer *log.RotateWriter
+	logger *zap.Logger
+}
+
+func newDnsAuditLogger(auditConfig config.DnsAuditConfig) *dnsAuditLogger {
+	logger := log.GetLogger()
+	if !auditConfig.Enable {
+		return nil
+	}
+	path := config.GetPathFromWorkingDir(auditConfig.Path)
+	writer, err := log.NewRotateWriter(path, int64(auditConfig.MaxSize)*AUDIT_MB, auditConfig.MaxBackups)
+	if err != nil {
+		logger.Error("Start DNS audit log failed", zap.String("path", path), zap.String("error", err.Error()))
+		return nil
+	}
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), writer, zapcore.InfoLevel)
+
+	logger.Info("DNS audit log enabled", zap.String("path", path), zap.Int("max size", auditConfig.MaxSize), zap.Int("max backups", auditConfig.MaxBackups))
+	return &dnsAuditLogger{writer: writer, logger: zap.New(core)}
+}
+
+func (c *dnsAuditLogger) record(r *dns.Msg, resDns *dns.Msg, info *dnsQueryInfo, err error) {
+	if c == nil || r == nil {
+		return
+	}
+	fields := make([]zap.Field, 0, 10)
+	if info.client != nil {
+		fields = append(fields, zap.String("client", info.client.String()))
+	} else {
+		fields = append(fields, zap.String("client", ""))
+	}
+	if len(r.Question) > 0 {
+		fields = append(fields, zap.String("domain", strings.TrimSuffix(r.Question[0].Name, ".")),
+			zap.String("type", dns.TypeToString[r.Question[0].Qtype]))
+	}
+	fields = append(fields, zap.String("resolver", info.resolver),
+		zap.Bool("proxy", info.proxied),
+		zap.Bool("cached", info.cached),
+		zap.Bool("blocked", info.blocked),
+		zap.Bool("fallback", info.fallback),
+		zap.Duration("duration", time.Since(info.start)))
+	if err != nil {
+		fields = append(fields, zap.String("error", err.Error()))
+	} else if resDns != nil {
+		fields = append(fields, zap.String("rcode", dns.RcodeToString[resDns.Rcode]), zap.String("answer", summarizeAnswer(resDns)))
+	}
+	c.logger.Info("query", fields...)
+}
+
+func (c *dnsAuditLogger) close() {
+	if c == nil {
+		return
+	}
+	c.logger.Sync()
+	c.writer.Close()
+}
+
+func summarizeAnswer(resDns *dns.Msg) string {
+	stubs := make([]string, 0, len(resDns.Answer))
+	for _, a := range resDns.Answer {
+		switch rr := a.(type) {
+		case *dns.A:
+			stubs = append(stubs, fmt.Sprintf("A %s", rr.A.String()))
+		case *dns.AAAA:
+			stubs = append(stubs, fmt.Sprintf("AAAA %s", rr.AAAA.String()))
+		case *dns.CNAME:
+			stubs = append(stubs, fmt.Sprintf("CNAME %s", strings.TrimSuffix(rr.Target, ".")))
+		default:
+			stubs = append(stubs, dns.TypeToString[a.Header().Rrtype])
+		}
+	}
+	return strings.Join(stubs, ", ")
+}
@@ -0,0 +1,85 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"net"
+	"strings"
+)
+
+// bogusIPFilter detects answers carrying known poisoned ip, which usually means the domain is being hijacked
+type bogusIPFilter struct {
+	ipNets []*net.IPNet
+}
+
+func newBogusIPFilter(bogusList []string) *bogusIPFilter {
+	logger := log.GetLogger()
+	if len(bogusList) == 0 {
+		return nil
+	}
+	ret := &bogusIPFilter{ipNets: make([]*net.IPNet, 0, len(bogusList))}
+	for _, entry := range bogusList {
+		if ipNet := parseIPOrCIDR(entry); ipNet != nil {
+			ret.ipNets = append(ret.ipNets, ipNet)
+		} else if logger != nil {
+			logger.Warn("Bogus ip format is invalid, so ignore", zap.String("ip", entry))
+		}
+	}
+	if len(ret.ipNets) == 0 {
+		return nil
+	}
+	if logger != nil {
+		logger.Info("Load bogus ip filter successful", zap.Int("count", len(ret.ipNets)))
+	}
+	return ret
+}
+
+func parseIPOrCIDR(input string) *net.IPNet {
+	input = strings.TrimSpace(input)
+	if strings.Index(input, "/") >= 0 {
+		if _, ipNet, err := net.ParseCIDR(input); err == nil {
+			return ipNet
+		}
+		return nil
+	}
+	if ip := net.ParseIP(input); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+	}
+	return nil
+}
+
+func (c *bogusIPFilter) contains(ip net.IP) bool {
+	for _, ipNet := range c.ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns the first bogus ip found in answer section
+func (c *bogusIPFilter) check(resDns *dns.Msg) (net.IP, bool) {
+	if c == nil || resDns == nil {
+		return nil, false
+	}
+	for _, a := range resDns.Answer {
+		if a.Header().Class != dns.ClassINET {
+			continue
+		}
+		switch rr := a.(type) {
+		case *dns.A:
+			if c.contains(rr.A) {
+				return rr.A, true
+			}
+		case *dns.AAAA:
+			if c.contains(rr.AAAA) {
+				return rr.AAAA, true
+			}
+		}
+	}
+	return nil, false
+}
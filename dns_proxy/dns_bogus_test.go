@@ -0,0 +1,33 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestBogusIPFilter(t *testing.T) {
+	filter := &bogusIPFilter{}
+	for _, entry := range []string{"243.185.187.39", "4.36.66.0/24", "2001:db8::1", "not an ip"} {
+		if ipNet := parseIPOrCIDR(entry); ipNet != nil {
+			filter.ipNets = append(filter.ipNets, ipNet)
+		}
+	}
+	if len(filter.ipNets) != 3 {
+		t.Fatalf("parse bogus ip failed, got %d entries", len(filter.ipNets))
+	}
+
+	resDns := new(dns.Msg)
+	resDns.Answer = append(resDns.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP("1.2.3.4")})
+	if ip, ok := filter.check(resDns); ok {
+		t.Errorf("clean answer is reported as bogus: %s", ip)
+	}
+	resDns.Answer = append(resDns.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP("4.36.66.178")})
+	if _, ok := filter.check(resDns); !ok {
+		t.Errorf("bogus ip in cidr is not detected")
+	}
+	resDns.Answer = []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET}, AAAA: net.ParseIP("2001:db8::1")}}
+	if _, ok := filter.check(resDns); !ok {
+		t.Errorf("bogus ipv6 is not detected")
+	}
+}
@@ -0,0 +1,104 @@
+package dns_proxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// must be power of 2
+	DNS_CACHE_SHARDS = 32
+)
+
+type dnsCacheEntry struct {
+	response *dns.Msg
+	halfTtl  time.Time
+	ttl      time.Time
+}
+
+type dnsCacheShard struct {
+	sync.RWMutex
+	caches map[string]*dnsCacheEntry
+}
+
+// dnsCache is sharded by hash of domain, so lookups of different domains do not fight for one lock
+type dnsCache struct {
+	shards [DNS_CACHE_SHARDS]*dnsCacheShard
+}
+
+// dnsCacheKey keys answer by domain and query type, so A and AAAA answers of a domain are cached apart
+func dnsCacheKey(q dns.Question) string {
+	return fmt.Sprintf("%s/%s", strings.ToLower(strings.TrimSuffix(q.Name, ".")), dns.TypeToString[q.Qtype])
+}
+
+func newDnsCache() *dnsCache {
+	ret := &dnsCache{}
+	for i := range ret.shards {
+		ret.shards[i] = &dnsCacheShard{caches: make(map[string]*dnsCacheEntry)}
+	}
+	return ret
+}
+
+func (c *dnsCache) shard(domain string) *dnsCacheShard {
+	// inline fnv-1a, avoid allocating hasher on every lookup
+	h := uint32(2166136261)
+	for i := 0; i < len(domain); i++ {
+		h ^= uint32(domain[i])
+		h *= 16777619
+	}
+	return c.shards[h&(DNS_CACHE_SHARDS-1)]
+}
+
+func (c *dnsCache) get(domain string) *dnsCacheEntry {
+	shard := c.shard(domain)
+	shard.RLock()
+	defer shard.RUnlock()
+	if res, ok := shard.caches[domain]; ok {
+		return res
+	} else {
+		return nil
+	}
+}
+
+func (c *dnsCache) set(domain string, entry *dnsCacheEntry) {
+	shard := c.shard(domain)
+	shard.Lock()
+	defer shard.Unlock()
+	shard.caches[domain] = entry
+}
+
+// del removes domain, returns true if it was cached
+func (c *dnsCache) del(domain string) bool {
+	shard := c.shard(domain)
+	shard.Lock()
+	defer shard.Unlock()
+	_, ok := shard.caches[domain]
+	delete(shard.caches, domain)
+	return ok
+}
+
+// flush removes everything, returns number of entries removed
+func (c *dnsCache) flush() int {
+	ret := 0
+	for _, shard := range c.shards {
+		shard.Lock()
+		ret += len(shard.caches)
+		shard.caches = make(map[string]*dnsCacheEntry)
+		shard.Unlock()
+	}
+	return ret
+}
+
+// each calls fn for every entry, fn must not modify the cache
+func (c *dnsCache) each(fn func(domain string, entry *dnsCacheEntry)) {
+	for _, shard := range c.shards {
+		shard.RLock()
+		for domain, entry := range shard.caches {
+			fn(domain, entry)
+		}
+		shard.RUnlock()
+	}
+}
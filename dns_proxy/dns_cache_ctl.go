@@ -0,0 +1,74 @@
+package dns_proxy
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// DnsCacheInfo describes one cached answer, Domain is suffixed with query type, e.g. "example.com/AAAA"
+type DnsCacheInfo struct {
+	Domain string
+	Answer string
+	TTL    time.Duration
+}
+
+// FlushDnsCache removes cached answer of domain, or everything if domain is empty, returns number of entries removed
+func (c *DnsServer) FlushDnsCache(domain string) int {
+	c.dnsCacheMux.RLock()
+	cache := c.dnsCaches
+	localCache := c.localCaches
+	c.dnsCacheMux.RUnlock()
+	ret := 0
+	if len(domain) == 0 {
+		if cache != nil {
+			ret += cache.flush()
+		}
+		if localCache != nil {
+			ret += localCache.flush()
+		}
+		return ret
+	}
+	// answers of every query type of domain
+	prefix := strings.ToLower(strings.TrimSuffix(domain, ".")) + "/"
+	for _, cache := range []*dnsCache{cache, localCache} {
+		if cache == nil {
+			continue
+		}
+		keys := make([]string, 0)
+		cache.each(func(key string, entry *dnsCacheEntry) {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		})
+		for _, key := range keys {
+			if cache.del(key) {
+				ret++
+			}
+		}
+	}
+	return ret
+}
+
+// DumpDnsCache returns all unexpired cached answers sorted by domain
+func (c *DnsServer) DumpDnsCache() []DnsCacheInfo {
+	c.dnsCacheMux.RLock()
+	caches := []*dnsCache{c.dnsCaches, c.localCaches}
+	c.dnsCacheMux.RUnlock()
+	ret := make([]DnsCacheInfo, 0)
+	now := time.Now()
+	for _, cache := range caches {
+		if cache == nil {
+			continue
+		}
+		cache.each(func(domain string, entry *dnsCacheEntry) {
+			if now.Before(entry.ttl) {
+				ret = append(ret, DnsCacheInfo{Domain: domain, Answer: summarizeAnswer(entry.response), TTL: entry.ttl.Sub(now)})
+			}
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Domain < ret[j].Domain
+	})
+	return ret
+}
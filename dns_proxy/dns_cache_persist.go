@@ -0,0 +1,147 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/common"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+type dnsCacheRecord struct {
+	Domain string `yaml:"domain"`
+	// query type, A if missing as only A answers were cached before
+	Type   string    `yaml:"type,omitempty"`
+	Expire time.Time `yaml:"expire"`
+	Answer []string  `yaml:"answer"`
+}
+
+// saveDnsCache writes proxy resolved answers to path, so they are answered from cache after restart, routes of them are
+// restored by routing manager from its own cache
+func (c *DnsServer) saveDnsCache(path string) error {
+	c.dnsCacheMux.RLock()
+	cache := c.dnsCaches
+	c.dnsCacheMux.RUnlock()
+	if cache == nil {
+		return nil
+	}
+	records := make([]dnsCacheRecord, 0)
+	cache.each(func(key string, entry *dnsCacheEntry) {
+		if len(entry.response.Question) == 0 {
+			return
+		}
+		q := entry.response.Question[0]
+		record := dnsCacheRecord{Domain: strings.TrimSuffix(q.Name, "."), Type: dns.TypeToString[q.Qtype], Expire: entry.ttl,
+			Answer: make([]string, 0, len(entry.response.Answer))}
+		for _, a := range entry.response.Answer {
+			record.Answer = append(record.Answer, a.String())
+		}
+		records = append(records, record)
+	})
+	data, err := yaml.Marshal(records)
+	if err != nil {
+		return errors.Wrap(err, "Marshal DNS cache failed")
+	}
+	// write to temp file first so a crash in the middle never leaves half a file
+	tempPath := path + ".tmp"
+	if err = ioutil.WriteFile(tempPath, data, 0644); err != nil {
+		return errors.Wrapf(err, "Write DNS cache file %s failed", tempPath)
+	}
+	if err = os.Rename(tempPath, path); err != nil {
+		return errors.Wrapf(err, "Rename DNS cache file %s failed", path)
+	}
+	return nil
+}
+
+func loadDnsCacheRecords(path string) ([]dnsCacheRecord, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Read DNS cache file %s failed", path)
+	}
+	records := make([]dnsCacheRecord, 0)
+	if err = yaml.Unmarshal(data, &records); err != nil {
+		return nil, errors.Wrapf(err, "Unmarshal DNS cache file %s failed", path)
+	}
+	return records, nil
+}
+
+// restoreDnsCache puts unexpired persisted answers back into DNS cache, CNAME targets in them are learned again since
+// cached answers skip resolving which learns them
+func (c *DnsServer) restoreDnsCache(path string) {
+	logger := log.GetLogger()
+	records, err := loadDnsCacheRecords(path)
+	if err != nil {
+		logger.Info("Load DNS cache failed", zap.String("error", err.Error()))
+		return
+	}
+	now := time.Now()
+	cached := 0
+	for _, record := range records {
+		if !now.Before(record.Expire) {
+			continue
+		}
+		qType, ok := dns.StringToType[record.Type]
+		if !ok {
+			qType = dns.TypeA
+		}
+		response := new(dns.Msg)
+		response.SetQuestion(dns.Fqdn(record.Domain), qType)
+		response.Response = true
+		remain := uint32(record.Expire.Sub(now) / time.Second)
+		for _, line := range record.Answer {
+			rr, err := dns.NewRR(line)
+			if err != nil || rr == nil {
+				continue
+			}
+			rr.Header().Ttl = remain
+			response.Answer = append(response.Answer, rr)
+			if cname, ok := rr.(*dns.CNAME); ok {
+				c.pacMgr.AddDomain(strings.TrimSuffix(cname.Target, "."), common.DOMAIN_BLACK_LIST)
+			}
+		}
+		if len(response.Answer) > 0 {
+			c.AddDnsCache(response.Question[0], response, remain)
+			cached++
+		}
+	}
+	logger.Info("Restore DNS cache successful", zap.String("path", path), zap.Int("cached", cached))
+}
+
+func (c *DnsServer) startCachePersist(path string, interval time.Duration) {
+	logger := log.GetLogger()
+	c.persistPath = path
+	c.persistStop = make(chan bool)
+	c.restoreDnsCache(path)
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.saveDnsCache(path); err != nil {
+					logger.Warn("Persist DNS cache failed", zap.String("error", err.Error()))
+				}
+			case <-c.persistStop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *DnsServer) stopCachePersist() {
+	if c.persistStop == nil {
+		return
+	}
+	close(c.persistStop)
+	if err := c.saveDnsCache(c.persistPath); err != nil {
+		log.GetLogger().Warn("Persist DNS cache failed", zap.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,68 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"github.com/weishi258/redfrog-core/log"
+	"github.com/weishi258/redfrog-core/pac"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDnsCachePersist(t *testing.T) {
+	log.InitLogger("", "error", false)
+	dir, err := ioutil.TempDir("", "dns_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dns_cache.yaml")
+
+	answer := func(qType uint16, lines ...string) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("www.google.com.", qType)
+		resDns := new(dns.Msg)
+		resDns.SetReply(r)
+		for _, line := range lines {
+			rr, _ := dns.NewRR(line)
+			resDns.Answer = append(resDns.Answer, rr)
+		}
+		return resDns
+	}
+	saved := &DnsServer{dnsCaches: newDnsCache()}
+	resA := answer(dns.TypeA, "www.google.com. 300 IN CNAME www.l.google.com.", "www.l.google.com. 300 IN A 142.250.1.1")
+	resAAAA := answer(dns.TypeAAAA, "www.google.com. 300 IN AAAA 2404:6800::1")
+	saved.AddDnsCache(resA.Question[0], resA, 300)
+	saved.AddDnsCache(resAAAA.Question[0], resAAAA, 300)
+	expired := answer(dns.TypeA, "www.google.com. 0 IN A 142.250.1.2")
+	expired.Question[0].Name = "expired.com."
+	saved.AddDnsCache(expired.Question[0], expired, 0)
+	if err := saved.saveDnsCache(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &DnsServer{dnsCaches: newDnsCache(), pacMgr: &pac.PacListMgr{}}
+	restored.restoreDnsCache(path)
+	for _, expected := range []*dns.Msg{resA, resAAAA} {
+		r := new(dns.Msg)
+		r.SetQuestion("www.google.com.", expected.Question[0].Qtype)
+		cached, _ := restored.checkCache(r)
+		if cached == nil || len(cached.Answer) != len(expected.Answer) {
+			t.Fatalf("%s answer should be restored, got %v", dns.TypeToString[expected.Question[0].Qtype], cached)
+		}
+		for i, rr := range cached.Answer {
+			if !dns.IsDuplicate(rr, expected.Answer[i]) {
+				t.Errorf("restored answer %s, expected %s", rr, expected.Answer[i])
+			}
+		}
+	}
+	r := new(dns.Msg)
+	r.SetQuestion("expired.com.", dns.TypeA)
+	if cached, _ := restored.checkCache(r); cached != nil {
+		t.Errorf("expired answer should not be restored, got %v", cached)
+	}
+	if !restored.pacMgr.CheckDomain("www.l.google.com") {
+		t.Errorf("CNAME target of restored answer should be learned")
+	}
+}
@@ -0,0 +1,119 @@
+package dns_proxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/weishi258/redfrog-core/log"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDnsCacheShard(t *testing.T) {
+	cache := newDnsCache()
+	for i := 0; i < 100; i++ {
+		cache.set(fmt.Sprintf("domain%d.com", i), &dnsCacheEntry{ttl: time.Now().Add(time.Minute)})
+	}
+	if cache.get("domain42.com") == nil || cache.get("domain100.com") != nil {
+		t.Errorf("cache get is wrong")
+	}
+	if !cache.del("domain42.com") || cache.del("domain42.com") {
+		t.Errorf("cache del is wrong")
+	}
+	count := 0
+	cache.each(func(domain string, entry *dnsCacheEntry) {
+		count++
+	})
+	if count != 99 {
+		t.Errorf("expect 99 entries, got %d", count)
+	}
+	if flushed := cache.flush(); flushed != 99 || cache.get("domain1.com") != nil {
+		t.Errorf("cache flush is wrong, flushed %d", flushed)
+	}
+}
+
+func TestDnsCacheByQueryType(t *testing.T) {
+	log.InitLogger("", "error", false)
+	server := &DnsServer{dnsCaches: newDnsCache()}
+	answer := func(qType uint16, line string) (*dns.Msg, *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetQuestion("www.google.com.", qType)
+		resDns := new(dns.Msg)
+		resDns.SetReply(r)
+		rr, _ := dns.NewRR(line)
+		resDns.Answer = append(resDns.Answer, rr)
+		return r, resDns
+	}
+	rA, resA := answer(dns.TypeA, "www.google.com. 300 IN A 142.250.1.1")
+	rAAAA, resAAAA := answer(dns.TypeAAAA, "www.google.com. 300 IN AAAA 2404:6800::1")
+
+	server.AddDnsCache(rA.Question[0], resA, 300)
+	if cached, _ := server.checkCache(rA); cached != resA {
+		t.Errorf("A answer should be cached")
+	}
+	if cached, _ := server.checkCache(rAAAA); cached != nil {
+		t.Errorf("AAAA query should not be answered by cached A answer, got %v", cached)
+	}
+	server.AddDnsCache(rAAAA.Question[0], resAAAA, 300)
+	if cached, _ := server.checkCache(rAAAA); cached != resAAAA {
+		t.Errorf("AAAA answer should be cached apart from A answer")
+	}
+	if cached, _ := server.checkCache(rA); cached != resA {
+		t.Errorf("A answer should stay cached")
+	}
+	if flushed := server.FlushDnsCache("www.google.com"); flushed != 2 {
+		t.Errorf("flush should remove answers of both types, got %d", flushed)
+	}
+}
+
+// compare with single lock map, which is what cache used to be
+type lockedDnsCache struct {
+	sync.RWMutex
+	caches map[string]*dnsCacheEntry
+}
+
+func benchmarkDomains() []string {
+	domains := make([]string, 1024)
+	for i := range domains {
+		domains[i] = fmt.Sprintf("www.domain%d.com", i)
+	}
+	return domains
+}
+
+func BenchmarkDnsCacheSharded(b *testing.B) {
+	cache := newDnsCache()
+	domains := benchmarkDomains()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			domain := domains[i%len(domains)]
+			if i%10 == 0 {
+				cache.set(domain, &dnsCacheEntry{})
+			} else {
+				cache.get(domain)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkDnsCacheSingleLock(b *testing.B) {
+	cache := &lockedDnsCache{caches: make(map[string]*dnsCacheEntry)}
+	domains := benchmarkDomains()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			domain := domains[i%len(domains)]
+			if i%10 == 0 {
+				cache.Lock()
+				cache.caches[domain] = &dnsCacheEntry{}
+				cache.Unlock()
+			} else {
+				cache.RLock()
+				_ = cache.caches[domain]
+				cache.RUnlock()
+			}
+			i++
+		}
+	})
+}
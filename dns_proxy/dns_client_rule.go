@@ -0,0 +1,122 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"net"
+	"strings"
+)
+
+const (
+	CLIENT_RULE_RESOLVE_DEFAULT = "default"
+	CLIENT_RULE_RESOLVE_LOCAL   = "local"
+	CLIENT_RULE_RESOLVE_PROXY   = "proxy"
+
+	CLIENT_RULE_HOST_TTL = 60
+)
+
+// clientRule changes how queries from a set of LAN subnets are answered
+type clientRule struct {
+	ipNets  []*net.IPNet
+	resolve string
+	hosts   map[string][]net.IP
+}
+
+type clientRules []*clientRule
+
+func newClientRules(ruleConfigs []config.DnsClientRuleConfig) clientRules {
+	logger := log.GetLogger()
+	ret := make(clientRules, 0, len(ruleConfigs))
+	for _, ruleConfig := range ruleConfigs {
+		rule := &clientRule{resolve: ruleConfig.Resolve, hosts: make(map[string][]net.IP)}
+		switch rule.resolve {
+		case CLIENT_RULE_RESOLVE_DEFAULT, CLIENT_RULE_RESOLVE_LOCAL, CLIENT_RULE_RESOLVE_PROXY:
+		default:
+			if logger != nil {
+				logger.Warn("Unknown client rule resolve mode, so use default", zap.String("resolve", rule.resolve))
+			}
+			rule.resolve = CLIENT_RULE_RESOLVE_DEFAULT
+		}
+		for _, subnet := range ruleConfig.Subnet {
+			if ipNet := parseIPOrCIDR(subnet); ipNet != nil {
+				rule.ipNets = append(rule.ipNets, ipNet)
+			} else if logger != nil {
+				logger.Warn("Client rule subnet format is invalid, so ignore", zap.String("subnet", subnet))
+			}
+		}
+		if len(rule.ipNets) == 0 {
+			continue
+		}
+		for domain, ips := range ruleConfig.Hosts {
+			domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+			for _, entry := range ips {
+				if ip := net.ParseIP(entry); ip != nil {
+					rule.hosts[domain] = append(rule.hosts[domain], ip)
+				} else if logger != nil {
+					logger.Warn("Client rule host ip format is invalid, so ignore", zap.String("domain", domain), zap.String("ip", entry))
+				}
+			}
+		}
+		ret = append(ret, rule)
+		if logger != nil {
+			logger.Info("Load DNS client rule", zap.Strings("subnet", ruleConfig.Subnet), zap.String("resolve", rule.resolve), zap.Int("hosts", len(rule.hosts)))
+		}
+	}
+	return ret
+}
+
+// match returns first rule containing client address, nil if none
+func (c clientRules) match(addr net.Addr) *clientRule {
+	var ip net.IP
+	switch clientAddr := addr.(type) {
+	case *net.UDPAddr:
+		ip = clientAddr.IP
+	case *net.TCPAddr:
+		ip = clientAddr.IP
+	default:
+		return nil
+	}
+	for _, rule := range c {
+		for _, ipNet := range rule.ipNets {
+			if ipNet.Contains(ip) {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+// answer returns static answer if query domain is in rule hosts, nil otherwise
+func (c *clientRule) answer(r *dns.Msg) *dns.Msg {
+	if len(c.hosts) == 0 || len(r.Question) == 0 {
+		return nil
+	}
+	q := r.Question[0]
+	ips, ok := c.hosts[strings.ToLower(strings.TrimSuffix(q.Name, "."))]
+	if !ok || q.Qclass != dns.ClassINET {
+		return nil
+	}
+	return hostsAnswer(r, ips)
+}
+
+// hostsAnswer replies first question with ips of its family, an empty answer if there are none
+func hostsAnswer(r *dns.Msg, ips []net.IP) *dns.Msg {
+	q := r.Question[0]
+	ret := new(dns.Msg)
+	ret.SetReply(r)
+	ret.Authoritative = true
+	ret.RecursionAvailable = true
+	for _, ip := range ips {
+		hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: CLIENT_RULE_HOST_TTL}
+		if ipv4 := ip.To4(); ipv4 != nil && q.Qtype == dns.TypeA {
+			hdr.Rrtype = dns.TypeA
+			ret.Answer = append(ret.Answer, &dns.A{Hdr: hdr, A: ipv4})
+		} else if ipv4 == nil && q.Qtype == dns.TypeAAAA {
+			hdr.Rrtype = dns.TypeAAAA
+			ret.Answer = append(ret.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return ret
+}
@@ -0,0 +1,38 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"github.com/weishi258/redfrog-core/config"
+	"net"
+	"testing"
+)
+
+func TestClientRules(t *testing.T) {
+	rules := newClientRules([]config.DnsClientRuleConfig{
+		{Subnet: []string{"192.168.10.0/24"}, Resolve: CLIENT_RULE_RESOLVE_LOCAL, Hosts: map[string][]string{"NAS.lan.": {"192.168.10.5", "fd00::5"}}},
+		{Subnet: []string{"192.168.0.0/16", "bad"}, Resolve: CLIENT_RULE_RESOLVE_PROXY},
+	})
+	if len(rules) != 2 {
+		t.Fatalf("expect 2 rules, got %d", len(rules))
+	}
+	if rule := rules.match(&net.UDPAddr{IP: net.ParseIP("192.168.10.20"), Port: 5353}); rule != rules[0] {
+		t.Errorf("guest subnet should match first rule")
+	}
+	if rule := rules.match(&net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 5353}); rule != rules[1] {
+		t.Errorf("main subnet should match second rule")
+	}
+	if rule := rules.match(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5353}); rule != nil {
+		t.Errorf("unknown subnet should not match")
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("nas.lan.", dns.TypeA)
+	resDns := rules[0].answer(r)
+	if resDns == nil || len(resDns.Answer) != 1 || !resDns.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.168.10.5")) {
+		t.Errorf("client rule host answer is wrong: %v", resDns)
+	}
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	if resDns = rules[0].answer(r); resDns != nil {
+		t.Errorf("domain not in hosts should not be answered")
+	}
+}
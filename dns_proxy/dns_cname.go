@@ -0,0 +1,88 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"strings"
+)
+
+const (
+	CNAME_MAX_DEPTH = 8
+)
+
+// cnameChainEnd follows CNAME records in answer starting from qname, returns last name of the chain
+// and whether answer already contains record of qType for it
+func cnameChainEnd(resDns *dns.Msg, qName string, qType uint16) (string, bool) {
+	cnames := make(map[string]string)
+	for _, a := range resDns.Answer {
+		if cname, ok := a.(*dns.CNAME); ok {
+			cnames[strings.ToLower(cname.Hdr.Name)] = cname.Target
+		}
+	}
+	name := qName
+	for i := 0; i < CNAME_MAX_DEPTH; i++ {
+		target, ok := cnames[strings.ToLower(name)]
+		if !ok {
+			break
+		}
+		name = target
+	}
+	for _, a := range resDns.Answer {
+		if a.Header().Rrtype == qType && strings.EqualFold(a.Header().Name, name) {
+			return name, true
+		}
+	}
+	return name, false
+}
+
+// completeCNAMEChain re-queries the end of CNAME chain through proxy resolver when upstream only returned part of it,
+// so every address in the chain can be routed before client connects, records fetched are validated as the answer was
+// if validator is set, chain stops at bogus one so it never reaches routing table
+func (c *DnsServer) completeCNAMEChain(r *dns.Msg, resDns *dns.Msg, validator *dnssecValidator) *dns.Msg {
+	return followCNAMEChain(r, resDns, func(query *dns.Msg) (*dns.Msg, error) {
+		return c.exchangeProxyDNS(c.getEdnsSetting().apply(query))
+	}, validator)
+}
+
+func followCNAMEChain(r *dns.Msg, resDns *dns.Msg, exchange func(query *dns.Msg) (*dns.Msg, error), validator *dnssecValidator) *dns.Msg {
+	if len(r.Question) == 0 || resDns.Rcode != dns.RcodeSuccess {
+		return resDns
+	}
+	q := r.Question[0]
+	if q.Qclass != dns.ClassINET || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) {
+		return resDns
+	}
+	ret := resDns
+	for depth := 0; depth < CNAME_MAX_DEPTH; depth++ {
+		target, resolved := cnameChainEnd(ret, q.Name, q.Qtype)
+		if resolved || strings.EqualFold(target, q.Name) {
+			return ret
+		}
+		query := new(dns.Msg)
+		query.SetQuestion(target, q.Qtype)
+		query.RecursionDesired = true
+		if validator != nil {
+			query = validator.prepare(query)
+		}
+		res, err := exchange(query)
+		if err != nil {
+			log.GetLogger().Debug("Follow CNAME chain failed", zap.String("domain", q.Name), zap.String("target", target), zap.String("error", err.Error()))
+			return ret
+		}
+		if res.Rcode != dns.RcodeSuccess || len(res.Answer) == 0 {
+			return ret
+		}
+		if validator != nil {
+			if err = validator.validate(res); err != nil {
+				log.GetLogger().Warn("DNSSEC validation of CNAME target failed", zap.String("domain", q.Name), zap.String("target", target), zap.String("error", err.Error()))
+				return ret
+			}
+		}
+		if ret == resDns {
+			ret = resDns.Copy()
+		}
+		ret.Answer = append(ret.Answer, res.Answer...)
+	}
+	return ret
+}
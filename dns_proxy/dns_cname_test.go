@@ -0,0 +1,51 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"github.com/weishi258/redfrog-core/log"
+	"testing"
+)
+
+func TestCnameChainEnd(t *testing.T) {
+	resDns := new(dns.Msg)
+	for _, line := range []string{
+		"www.example.com. 300 IN CNAME cdn.example.net.",
+		"cdn.example.net. 300 IN CNAME Edge.example.org.",
+	} {
+		rr, _ := dns.NewRR(line)
+		resDns.Answer = append(resDns.Answer, rr)
+	}
+	if name, resolved := cnameChainEnd(resDns, "www.example.com.", dns.TypeA); name != "Edge.example.org." || resolved {
+		t.Errorf("chain end got %s %v, expect unresolved Edge.example.org.", name, resolved)
+	}
+	rr, _ := dns.NewRR("edge.example.org. 60 IN A 192.0.2.1")
+	resDns.Answer = append(resDns.Answer, rr)
+	if _, resolved := cnameChainEnd(resDns, "WWW.example.com.", dns.TypeA); !resolved {
+		t.Errorf("chain should be resolved")
+	}
+}
+
+func TestFollowCNAMEChainValidated(t *testing.T) {
+	log.InitLogger("", "error", false)
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	resDns := new(dns.Msg)
+	resDns.SetReply(r)
+	rr, _ := dns.NewRR("www.example.com. 300 IN CNAME cdn.example.net.")
+	resDns.Answer = append(resDns.Answer, rr)
+	exchange := func(query *dns.Msg) (*dns.Msg, error) {
+		res := new(dns.Msg)
+		res.SetReply(query)
+		a, _ := dns.NewRR("cdn.example.net. 60 IN A 192.0.2.1")
+		res.Answer = append(res.Answer, a)
+		return res, nil
+	}
+	if ret := followCNAMEChain(r, resDns, exchange, nil); len(ret.Answer) != 2 {
+		t.Errorf("chain should be completed, got %v", ret.Answer)
+	}
+	// unsigned tail is bogus in strict mode, so it is not appended
+	validator := &dnssecValidator{strict: true, keys: make(map[string]*dnssecKeyEntry)}
+	if ret := followCNAMEChain(r, resDns, exchange, validator); len(ret.Answer) != 1 {
+		t.Errorf("unvalidated tail should not be appended, got %v", ret.Answer)
+	}
+}
@@ -0,0 +1,69 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"github.com/weishi258/redfrog-core/network"
+	"go.uber.org/zap"
+	"net"
+)
+
+type dns64Setting struct {
+	prefix *net.IPNet
+}
+
+func newDns64Setting(dns64Config config.DnsDns64Config) *dns64Setting {
+	logger := log.GetLogger()
+	if !dns64Config.Enable {
+		network.SetNAT64Prefix(nil)
+		return nil
+	}
+	_, prefix, err := net.ParseCIDR(dns64Config.Prefix)
+	if err != nil || prefix.IP.To4() != nil || network.NAT64Embed(prefix, net.IPv4zero) == nil {
+		logger.Error("DNS64 prefix is invalid, must be ipv6 prefix with length 32, 40, 48, 56, 64 or 96, so disable DNS64", zap.String("prefix", dns64Config.Prefix))
+		network.SetNAT64Prefix(nil)
+		return nil
+	}
+	network.SetNAT64Prefix(prefix)
+	logger.Info("DNS64 is enabled", zap.String("prefix", prefix.String()))
+	return &dns64Setting{prefix: prefix}
+}
+
+// needSynthesis returns true if it is an AAAA query and response has no AAAA answer
+func (c *dns64Setting) needSynthesis(r *dns.Msg, resDns *dns.Msg) bool {
+	if c == nil || len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeAAAA || r.Question[0].Qclass != dns.ClassINET {
+		return false
+	}
+	if resDns.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	for _, a := range resDns.Answer {
+		if a.Header().Rrtype == dns.TypeAAAA {
+			return false
+		}
+	}
+	return true
+}
+
+// synthesize builds AAAA response for query r from A response, CNAME records are kept as is
+func (c *dns64Setting) synthesize(r *dns.Msg, aRes *dns.Msg) *dns.Msg {
+	ret := new(dns.Msg)
+	ret.SetReply(r)
+	ret.RecursionAvailable = aRes.RecursionAvailable
+	ret.Rcode = aRes.Rcode
+	for _, a := range aRes.Answer {
+		switch rr := a.(type) {
+		case *dns.CNAME:
+			ret.Answer = append(ret.Answer, dns.Copy(rr))
+		case *dns.A:
+			if ip := network.NAT64Embed(c.prefix, rr.A); ip != nil {
+				hdr := rr.Hdr
+				hdr.Rrtype = dns.TypeAAAA
+				hdr.Rdlength = 0
+				ret.Answer = append(ret.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,40 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestDns64Synthesize(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("64:ff9b::/96")
+	setting := &dns64Setting{prefix: prefix}
+
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.com.", dns.TypeAAAA)
+	empty := new(dns.Msg)
+	empty.SetReply(r)
+	if !setting.needSynthesis(r, empty) {
+		t.Fatalf("empty AAAA answer should need synthesis")
+	}
+
+	aQuery := new(dns.Msg)
+	aQuery.SetQuestion("www.example.com.", dns.TypeA)
+	aRes := new(dns.Msg)
+	aRes.SetReply(aQuery)
+	cname, _ := dns.NewRR("www.example.com. 300 IN CNAME example.com.")
+	a, _ := dns.NewRR("example.com. 60 IN A 192.0.2.1")
+	aRes.Answer = []dns.RR{cname, a}
+
+	resDns := setting.synthesize(r, aRes)
+	if len(resDns.Answer) != 2 {
+		t.Fatalf("expect 2 answers, got %d", len(resDns.Answer))
+	}
+	aaaa, ok := resDns.Answer[1].(*dns.AAAA)
+	if !ok || !aaaa.AAAA.Equal(net.ParseIP("64:ff9b::c000:201")) || aaaa.Hdr.Ttl != 60 || aaaa.Hdr.Name != "example.com." {
+		t.Errorf("synthesized AAAA is wrong: %v", resDns.Answer[1])
+	}
+	if resDns.Question[0].Qtype != dns.TypeAAAA || setting.needSynthesis(r, resDns) {
+		t.Errorf("synthesized response should answer AAAA question")
+	}
+}
@@ -0,0 +1,296 @@
+package dns_proxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// IANA root zone KSK-2017
+	DNSSEC_ROOT_TRUST_ANCHOR = ". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBB683457104237C7F8EC8D"
+
+	DNSSEC_MAX_CHAIN_DEPTH = 16
+	DNSSEC_UDP_SIZE        = 1232
+	DNSSEC_MIN_KEY_TTL     = 60
+	DNSSEC_MAX_KEY_TTL     = 3600 * 24
+)
+
+var errDnssecInsecure = errors.New("DNSSEC insecure delegation")
+
+type dnssecRRSetKey struct {
+	name   string
+	rrType uint16
+}
+
+type dnssecKeyEntry struct {
+	keys   []*dns.DNSKEY
+	expire time.Time
+}
+
+type dnssecValidator struct {
+	strict   bool
+	anchors  []*dns.DS
+	exchange func(query *dns.Msg) (*dns.Msg, error)
+
+	keyMux sync.RWMutex
+	keys   map[string]*dnssecKeyEntry
+}
+
+func newDnssecValidator(dnssecConfig config.DnsSecConfig, exchange func(query *dns.Msg) (*dns.Msg, error)) *dnssecValidator {
+	logger := log.GetLogger()
+	if !dnssecConfig.Enable {
+		return nil
+	}
+	ret := &dnssecValidator{strict: dnssecConfig.Strict, exchange: exchange, keys: make(map[string]*dnssecKeyEntry)}
+
+	anchors := dnssecConfig.TrustAnchor
+	if len(anchors) == 0 {
+		anchors = []string{DNSSEC_ROOT_TRUST_ANCHOR}
+	}
+	for _, anchor := range anchors {
+		if rr, err := dns.NewRR(anchor); err != nil {
+			logger.Warn("DNSSEC trust anchor format is invalid, so ignore", zap.String("anchor", anchor), zap.String("error", err.Error()))
+		} else if ds, ok := rr.(*dns.DS); !ok || ds.Hdr.Name != "." {
+			logger.Warn("DNSSEC trust anchor must be root DS record, so ignore", zap.String("anchor", anchor))
+		} else {
+			ret.anchors = append(ret.anchors, ds)
+		}
+	}
+	if len(ret.anchors) == 0 {
+		logger.Error("DNSSEC has no valid trust anchor, so disable validation")
+		return nil
+	}
+	logger.Info("DNSSEC validation is enabled", zap.Bool("strict", ret.strict), zap.Int("anchors", len(ret.anchors)))
+	return ret
+}
+
+// prepare returns a copy of query with DO bit set so upstream resolver will send us signatures
+func (c *dnssecValidator) prepare(query *dns.Msg) *dns.Msg {
+	ret := query.Copy()
+	if opt := ret.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		ret.SetEdns0(DNSSEC_UDP_SIZE, true)
+	}
+	return ret
+}
+
+func (c *dnssecValidator) query(name string, qType uint16) (*dns.Msg, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), qType)
+	query.SetEdns0(DNSSEC_UDP_SIZE, true)
+	resDns, err := c.exchange(query)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DNSSEC query %s for %s failed", dns.TypeToString[qType], name)
+	}
+	if resDns.Rcode != dns.RcodeSuccess {
+		return nil, errors.New(fmt.Sprintf("DNSSEC query %s for %s failed with rcode %s", dns.TypeToString[qType], name, dns.RcodeToString[resDns.Rcode]))
+	}
+	return resDns, nil
+}
+
+func splitRRSet(rrs []dns.RR) (map[dnssecRRSetKey][]dns.RR, map[dnssecRRSetKey][]*dns.RRSIG) {
+	sets := make(map[dnssecRRSetKey][]dns.RR)
+	sigs := make(map[dnssecRRSetKey][]*dns.RRSIG)
+	for _, rr := range rrs {
+		if rr.Header().Class != dns.ClassINET {
+			continue
+		}
+		name := strings.ToLower(rr.Header().Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := dnssecRRSetKey{name, sig.TypeCovered}
+			sigs[key] = append(sigs[key], sig)
+		} else if rr.Header().Rrtype != dns.TypeOPT {
+			key := dnssecRRSetKey{name, rr.Header().Rrtype}
+			sets[key] = append(sets[key], rr)
+		}
+	}
+	return sets, sigs
+}
+
+func verifyRRSet(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) error {
+	now := time.Now()
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err := sig.Verify(key, rrset); err == nil {
+				return nil
+			}
+		}
+	}
+	return errors.New("no valid signature found")
+}
+
+func (c *dnssecValidator) getCachedKeys(zone string) []*dns.DNSKEY {
+	c.keyMux.RLock()
+	defer c.keyMux.RUnlock()
+	if entry, ok := c.keys[zone]; ok && time.Now().Before(entry.expire) {
+		return entry.keys
+	}
+	return nil
+}
+
+func (c *dnssecValidator) putCachedKeys(zone string, keys []*dns.DNSKEY, ttl uint32) {
+	if ttl < DNSSEC_MIN_KEY_TTL {
+		ttl = DNSSEC_MIN_KEY_TTL
+	} else if ttl > DNSSEC_MAX_KEY_TTL {
+		ttl = DNSSEC_MAX_KEY_TTL
+	}
+	c.keyMux.Lock()
+	defer c.keyMux.Unlock()
+	c.keys[zone] = &dnssecKeyEntry{keys: keys, expire: time.Now().Add(time.Duration(ttl) * time.Second)}
+}
+
+// zoneKeys returns validated DNSKEY of zone, by walking DS chain up to the trust anchor
+func (c *dnssecValidator) zoneKeys(zone string, depth int) ([]*dns.DNSKEY, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	if keys := c.getCachedKeys(zone); keys != nil {
+		return keys, nil
+	}
+	if depth > DNSSEC_MAX_CHAIN_DEPTH {
+		return nil, errors.New(fmt.Sprintf("DNSSEC chain too deep for zone %s", zone))
+	}
+
+	// collect trusted DS for zone
+	var dsList []*dns.DS
+	if zone == "." {
+		dsList = c.anchors
+	} else {
+		dsRes, err := c.query(zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		dsSets, dsSigs := splitRRSet(dsRes.Answer)
+		key := dnssecRRSetKey{zone, dns.TypeDS}
+		if len(dsSets[key]) == 0 {
+			return nil, errDnssecInsecure
+		}
+		if len(dsSigs[key]) == 0 {
+			return nil, errors.New(fmt.Sprintf("DNSSEC DS of zone %s is not signed", zone))
+		}
+		parentKeys, err := c.zoneKeys(dsSigs[key][0].SignerName, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if err = verifyRRSet(dsSets[key], dsSigs[key], parentKeys); err != nil {
+			return nil, errors.Wrapf(err, "DNSSEC verify DS of zone %s failed", zone)
+		}
+		for _, rr := range dsSets[key] {
+			dsList = append(dsList, rr.(*dns.DS))
+		}
+	}
+
+	keyRes, err := c.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	keySets, keySigs := splitRRSet(keyRes.Answer)
+	key := dnssecRRSetKey{zone, dns.TypeDNSKEY}
+	if len(keySets[key]) == 0 {
+		return nil, errors.New(fmt.Sprintf("DNSSEC zone %s has no DNSKEY", zone))
+	}
+	keys := make([]*dns.DNSKEY, 0, len(keySets[key]))
+	trusted := make([]*dns.DNSKEY, 0)
+	for _, rr := range keySets[key] {
+		dnsKey := rr.(*dns.DNSKEY)
+		keys = append(keys, dnsKey)
+		for _, ds := range dsList {
+			if dnsKey.KeyTag() != ds.KeyTag || dnsKey.Algorithm != ds.Algorithm {
+				continue
+			}
+			if keyDs := dnsKey.ToDS(ds.DigestType); keyDs != nil && strings.EqualFold(keyDs.Digest, ds.Digest) {
+				trusted = append(trusted, dnsKey)
+				break
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, errors.New(fmt.Sprintf("DNSSEC zone %s has no DNSKEY matching DS", zone))
+	}
+	if err = verifyRRSet(keySets[key], keySigs[key], trusted); err != nil {
+		return nil, errors.Wrapf(err, "DNSSEC verify DNSKEY of zone %s failed", zone)
+	}
+
+	c.putCachedKeys(zone, keys, keySets[key][0].Header().Ttl)
+	log.GetLogger().Debug("DNSSEC zone keys validated", zap.String("zone", zone), zap.Int("keys", len(keys)))
+	return keys, nil
+}
+
+// validate checks every signed RRSet in answer section, bogus answer returns error
+// unsigned answer is only rejected in strict mode
+func (c *dnssecValidator) validate(resDns *dns.Msg) error {
+	sets, sigs := splitRRSet(resDns.Answer)
+	for key, rrset := range sets {
+		rrsigs := sigs[key]
+		if len(rrsigs) == 0 {
+			if c.strict {
+				return errors.New(fmt.Sprintf("DNSSEC %s %s is not signed", key.name, dns.TypeToString[key.rrType]))
+			}
+			continue
+		}
+		signer := rrsigs[0].SignerName
+		if !dns.IsSubDomain(signer, key.name) {
+			return errors.New(fmt.Sprintf("DNSSEC %s %s signed by out of zone signer %s", key.name, dns.TypeToString[key.rrType], signer))
+		}
+		keys, err := c.zoneKeys(signer, 0)
+		if err == errDnssecInsecure && !c.strict {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err = verifyRRSet(rrset, rrsigs, keys); err != nil {
+			return errors.Wrapf(err, "DNSSEC verify %s %s failed", key.name, dns.TypeToString[key.rrType])
+		}
+	}
+	return nil
+}
+
+// stripDnssec removes DNSSEC records from response if client did not set DO bit
+func stripDnssec(r *dns.Msg, resDns *dns.Msg) *dns.Msg {
+	if opt := r.IsEdns0(); opt != nil && opt.Do() {
+		return resDns
+	}
+	isDnssecRR := func(rr dns.RR) bool {
+		switch rr.Header().Rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			return true
+		}
+		return false
+	}
+	found := false
+	for _, rrs := range [][]dns.RR{resDns.Answer, resDns.Ns} {
+		for _, rr := range rrs {
+			if isDnssecRR(rr) {
+				found = true
+			}
+		}
+	}
+	if !found {
+		return resDns
+	}
+	ret := resDns.Copy()
+	filter := func(rrs []dns.RR) []dns.RR {
+		filtered := make([]dns.RR, 0, len(rrs))
+		for _, rr := range rrs {
+			if !isDnssecRR(rr) {
+				filtered = append(filtered, rr)
+			}
+		}
+		return filtered
+	}
+	ret.Answer = filter(ret.Answer)
+	ret.Ns = filter(ret.Ns)
+	return ret
+}
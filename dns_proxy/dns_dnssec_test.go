@@ -0,0 +1,122 @@
+package dns_proxy
+
+import (
+	"crypto"
+	"github.com/miekg/dns"
+	"github.com/weishi258/redfrog-core/log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type dnssecTestZone struct {
+	key    *dns.DNSKEY
+	signer crypto.Signer
+}
+
+func newDnssecTestZone(t *testing.T, zone string) *dnssecTestZone {
+	key := &dns.DNSKEY{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags: 257, Protocol: 3, Algorithm: dns.ECDSAP256SHA256}
+	private, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dnssecTestZone{key: key, signer: private.(crypto.Signer)}
+}
+
+func (c *dnssecTestZone) sign(t *testing.T, rrset ...dns.RR) []dns.RR {
+	now := time.Now()
+	sig := &dns.RRSIG{Hdr: dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+		KeyTag: c.key.KeyTag(), SignerName: c.key.Hdr.Name, Algorithm: c.key.Algorithm,
+		Inception: uint32(now.Add(-time.Hour).Unix()), Expiration: uint32(now.Add(time.Hour).Unix())}
+	if err := sig.Sign(c.signer, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrset, sig)
+}
+
+// newDnssecTestValidator serves a signed root and example. zone, insecure. has no DS so is an insecure delegation
+func newDnssecTestValidator(t *testing.T, strict bool) (*dnssecValidator, *dnssecTestZone) {
+	root := newDnssecTestZone(t, ".")
+	example := newDnssecTestZone(t, "example.")
+	records := map[dnssecRRSetKey][]dns.RR{
+		{".", dns.TypeDNSKEY}:        root.sign(t, root.key),
+		{"example.", dns.TypeDS}:     root.sign(t, example.key.ToDS(dns.SHA256)),
+		{"example.", dns.TypeDNSKEY}: example.sign(t, example.key),
+	}
+	exchange := func(query *dns.Msg) (*dns.Msg, error) {
+		res := new(dns.Msg)
+		res.SetReply(query)
+		res.Answer = records[dnssecRRSetKey{strings.ToLower(query.Question[0].Name), query.Question[0].Qtype}]
+		return res, nil
+	}
+	return &dnssecValidator{strict: strict, anchors: []*dns.DS{root.key.ToDS(dns.SHA256)}, exchange: exchange,
+		keys: make(map[string]*dnssecKeyEntry)}, example
+}
+
+func dnssecTestAnswer(name string) *dns.A {
+	return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("192.0.2.1").To4()}
+}
+
+func TestDnssecValidate(t *testing.T) {
+	log.InitLogger("", "error", false)
+	validator, example := newDnssecTestValidator(t, false)
+	signed := &dns.Msg{Answer: example.sign(t, dnssecTestAnswer("www.example."))}
+	if err := validator.validate(signed); err != nil {
+		t.Errorf("signed answer should validate, got %v", err)
+	}
+	if validator.getCachedKeys("example.") == nil {
+		t.Errorf("validated zone keys should be cached")
+	}
+
+	tampered := signed.Copy()
+	tampered.Answer[0].(*dns.A).A = net.ParseIP("192.0.2.2").To4()
+	if err := validator.validate(tampered); err == nil {
+		t.Errorf("answer not matching RRSIG should fail")
+	}
+	tampered = signed.Copy()
+	tampered.Answer[1].(*dns.RRSIG).Signature = strings.Repeat("A", len(tampered.Answer[1].(*dns.RRSIG).Signature))
+	if err := validator.validate(tampered); err == nil {
+		t.Errorf("tampered RRSIG should fail")
+	}
+}
+
+func TestDnssecMissingKey(t *testing.T) {
+	log.InitLogger("", "error", false)
+	validator, example := newDnssecTestValidator(t, false)
+	exchange := validator.exchange
+	validator.exchange = func(query *dns.Msg) (*dns.Msg, error) {
+		res, err := exchange(query)
+		if query.Question[0].Qtype == dns.TypeDNSKEY && query.Question[0].Name == "example." {
+			res.Answer = nil
+		}
+		return res, err
+	}
+	if err := validator.validate(&dns.Msg{Answer: example.sign(t, dnssecTestAnswer("www.example."))}); err == nil {
+		t.Errorf("answer of zone without DNSKEY should fail")
+	}
+
+	// signed by key other than the one DS points to
+	other := newDnssecTestZone(t, "example.")
+	validator, _ = newDnssecTestValidator(t, false)
+	if err := validator.validate(&dns.Msg{Answer: other.sign(t, dnssecTestAnswer("www.example."))}); err == nil {
+		t.Errorf("answer signed by unknown key should fail")
+	}
+}
+
+func TestDnssecInsecure(t *testing.T) {
+	log.InitLogger("", "error", false)
+	insecure := newDnssecTestZone(t, "insecure.")
+	for _, strict := range []bool{false, true} {
+		validator, _ := newDnssecTestValidator(t, strict)
+		unsigned := &dns.Msg{Answer: []dns.RR{dnssecTestAnswer("www.example.")}}
+		if err := validator.validate(unsigned); (err != nil) != strict {
+			t.Errorf("unsigned answer in strict %v got %v", strict, err)
+		}
+		delegated := &dns.Msg{Answer: insecure.sign(t, dnssecTestAnswer("www.insecure."))}
+		if err := validator.validate(delegated); (err != nil) != strict {
+			t.Errorf("answer of insecure delegation in strict %v got %v", strict, err)
+		}
+	}
+}
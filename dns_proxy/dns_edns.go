@@ -0,0 +1,124 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"net"
+)
+
+const (
+	EDNS_MIN_UDP_SIZE = 512
+	EDNS_MAX_UDP_SIZE = 4096
+
+	ECS_FAMILY_IPV4 = 1
+	ECS_FAMILY_IPV6 = 2
+)
+
+type ednsSetting struct {
+	udpSize       uint16
+	clientSubnet  *dns.EDNS0_SUBNET
+	forwardSubnet bool
+}
+
+func newEdnsSetting(ednsConfig config.DnsEdnsConfig) *ednsSetting {
+	logger := log.GetLogger()
+	if !ednsConfig.Enable {
+		logger.Info("EDNS0 is disabled")
+		return nil
+	}
+	ret := &ednsSetting{forwardSubnet: ednsConfig.ForwardClientSubnet}
+	udpSize := ednsConfig.UdpSize
+	if udpSize < EDNS_MIN_UDP_SIZE {
+		udpSize = EDNS_MIN_UDP_SIZE
+	} else if udpSize > EDNS_MAX_UDP_SIZE {
+		udpSize = EDNS_MAX_UDP_SIZE
+	}
+	ret.udpSize = uint16(udpSize)
+
+	if len(ednsConfig.ClientSubnet) > 0 {
+		if subnet, err := parseClientSubnet(ednsConfig.ClientSubnet); err != nil {
+			logger.Warn("EDNS client subnet format is invalid, so ignore", zap.String("subnet", ednsConfig.ClientSubnet), zap.String("error", err.Error()))
+		} else {
+			ret.clientSubnet = subnet
+		}
+	}
+	logger.Info("EDNS0 is enabled", zap.Uint16("udp size", ret.udpSize), zap.String("client subnet", ednsConfig.ClientSubnet), zap.Bool("forward client subnet", ret.forwardSubnet))
+	return ret
+}
+
+func parseClientSubnet(input string) (*dns.EDNS0_SUBNET, error) {
+	var ipNet *net.IPNet
+	if ip := net.ParseIP(input); ip != nil {
+		// single ip, so treat it as host subnet
+		if ip.To4() != nil {
+			ipNet = &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+		} else {
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+		}
+	} else {
+		var err error
+		if _, ipNet, err = net.ParseCIDR(input); err != nil {
+			return nil, err
+		}
+	}
+	ones, _ := ipNet.Mask.Size()
+	ret := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, SourceNetmask: uint8(ones), SourceScope: 0}
+	if ip4 := ipNet.IP.To4(); ip4 != nil {
+		ret.Family = ECS_FAMILY_IPV4
+		ret.Address = ip4
+	} else {
+		ret.Family = ECS_FAMILY_IPV6
+		ret.Address = ipNet.IP
+	}
+	return ret, nil
+}
+
+// apply returns a copy of query carrying the OPT record we want to send upstream, original query is left untouched
+func (c *ednsSetting) apply(r *dns.Msg) *dns.Msg {
+	if c == nil {
+		return r
+	}
+	query := r.Copy()
+	opt := query.IsEdns0()
+	if opt == nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		query.Extra = append(query.Extra, opt)
+	}
+	opt.SetUDPSize(c.udpSize)
+
+	options := make([]dns.EDNS0, 0, len(opt.Option)+1)
+	for _, option := range opt.Option {
+		if _, ok := option.(*dns.EDNS0_SUBNET); ok {
+			// client subnet from LAN client is dropped unless forward is enabled and not overridden
+			if c.clientSubnet != nil || !c.forwardSubnet {
+				continue
+			}
+		}
+		options = append(options, option)
+	}
+	if c.clientSubnet != nil {
+		subnet := *c.clientSubnet
+		options = append(options, &subnet)
+	}
+	opt.Option = options
+
+	return query
+}
+
+// stripEdns removes OPT record from response if client did not ask for EDNS0
+func stripEdns(r *dns.Msg, resDns *dns.Msg) *dns.Msg {
+	if r.IsEdns0() != nil || resDns.IsEdns0() == nil {
+		return resDns
+	}
+	ret := resDns.Copy()
+	extra := make([]dns.RR, 0, len(ret.Extra))
+	for _, rr := range ret.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	ret.Extra = extra
+	return ret
+}
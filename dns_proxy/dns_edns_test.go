@@ -0,0 +1,106 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"net"
+	"testing"
+)
+
+func ednsTestQuery(options ...dns.EDNS0) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion("www.google.com.", dns.TypeA)
+	if options != nil {
+		r.SetEdns0(1232, true)
+		opt := r.IsEdns0()
+		opt.Option = options
+	}
+	return r
+}
+
+func countOpt(r *dns.Msg) int {
+	count := 0
+	for _, rr := range r.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			count++
+		}
+	}
+	return count
+}
+
+func TestEdnsApplyAddsOpt(t *testing.T) {
+	log.InitLogger("", "error", false)
+	var disabled *ednsSetting
+	r := ednsTestQuery()
+	if disabled.apply(r) != r {
+		t.Errorf("disabled setting should leave query as is")
+	}
+	setting := newEdnsSetting(config.DnsEdnsConfig{Enable: true, UdpSize: 100000})
+	query := setting.apply(r)
+	if opt := query.IsEdns0(); opt == nil || opt.UDPSize() != EDNS_MAX_UDP_SIZE || countOpt(query) != 1 {
+		t.Errorf("OPT with clamped udp size should be added, got %v", query.Extra)
+	}
+	if r.IsEdns0() != nil {
+		t.Errorf("original query should not be changed")
+	}
+}
+
+func TestEdnsApplyClientSubnet(t *testing.T) {
+	log.InitLogger("", "error", false)
+	for _, c := range []struct {
+		subnet  string
+		family  uint16
+		netmask uint8
+		address net.IP
+	}{
+		{"1.2.3.0/24", ECS_FAMILY_IPV4, 24, net.ParseIP("1.2.3.0").To4()},
+		{"1.2.3.4", ECS_FAMILY_IPV4, 32, net.ParseIP("1.2.3.4").To4()},
+		{"2404:6800::/56", ECS_FAMILY_IPV6, 56, net.ParseIP("2404:6800::")},
+	} {
+		setting := newEdnsSetting(config.DnsEdnsConfig{Enable: true, UdpSize: 1232, ClientSubnet: c.subnet})
+		opt := setting.apply(ednsTestQuery()).IsEdns0()
+		if opt == nil || len(opt.Option) != 1 {
+			t.Fatalf("ECS of %s should be added, got %v", c.subnet, opt)
+		}
+		subnet, ok := opt.Option[0].(*dns.EDNS0_SUBNET)
+		if !ok || subnet.Family != c.family || subnet.SourceNetmask != c.netmask || !subnet.Address.Equal(c.address) {
+			t.Errorf("ECS of %s got %v", c.subnet, opt.Option[0])
+		}
+	}
+}
+
+func TestEdnsApplyClientOpt(t *testing.T) {
+	log.InitLogger("", "error", false)
+	clientSubnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: ECS_FAMILY_IPV4, SourceNetmask: 24, Address: net.ParseIP("10.0.0.0").To4()}
+	cookie := &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"}
+
+	subnetOf := func(opt *dns.OPT) *dns.EDNS0_SUBNET {
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				return subnet
+			}
+		}
+		return nil
+	}
+	// client OPT is replaced in place, keeping DO bit and other options
+	setting := newEdnsSetting(config.DnsEdnsConfig{Enable: true, UdpSize: 1400})
+	query := setting.apply(ednsTestQuery(cookie, clientSubnet))
+	opt := query.IsEdns0()
+	if countOpt(query) != 1 || opt.UDPSize() != 1400 || !opt.Do() {
+		t.Fatalf("client OPT should be updated in place, got %v", query.Extra)
+	}
+	if len(opt.Option) != 1 || opt.Option[0].String() != cookie.String() {
+		t.Errorf("client subnet should be dropped and cookie kept, got %v", opt.Option)
+	}
+
+	setting = newEdnsSetting(config.DnsEdnsConfig{Enable: true, UdpSize: 1232, ForwardClientSubnet: true})
+	if subnet := subnetOf(setting.apply(ednsTestQuery(cookie, clientSubnet)).IsEdns0()); subnet == nil || subnet.String() != clientSubnet.String() {
+		t.Errorf("client subnet should be forwarded, got %v", subnet)
+	}
+	setting = newEdnsSetting(config.DnsEdnsConfig{Enable: true, UdpSize: 1232, ForwardClientSubnet: true, ClientSubnet: "1.2.3.0/24"})
+	if subnet := subnetOf(setting.apply(ednsTestQuery(cookie, clientSubnet)).IsEdns0()); subnet == nil || subnet.SourceNetmask != 24 ||
+		!subnet.Address.Equal(net.ParseIP("1.2.3.0")) {
+		t.Errorf("configured subnet should override client one, got %v", subnet)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"go.uber.org/zap"
 	"os"
 	"regexp"
+	"strings"
 	"sync"
 )
 
@@ -23,6 +24,13 @@ const (
 	FILTER_WHITE = true
 )
 
+// domain rule of Adblock Plus list, e.g. "||ads.example.com^" or "@@||example.com^$important"
+var adblockDomainRule = regexp.MustCompile("^(@@)?\\|\\|([0-9\\p{L}_-]+(?:\\.[0-9\\p{L}_-]+)+)\\^?\\|?(?:\\$(.*))?$")
+
+// options of Adblock Plus rule which still apply to whole domain, rules with other options, e.g. $third-party or
+// $script, block some requests only and are skipped
+var adblockDomainOptions = map[string]bool{"important": true, "all": true, "document": true, "doc": true}
+
 type dnsFilter struct {
 	blackMux       sync.RWMutex
 	blackedDomains map[string]bool
@@ -100,22 +108,71 @@ func (c *dnsFilter) readList(path string, flag bool) (err error) {
 }
 
 func (c *dnsFilter) parseFilterListLine(line []byte, flag bool) error {
+	// dnsmasq block list, e.g. "address=/ad.com/0.0.0.0" or "server=/ad.com/", lists its domains with subdomains
+	if rule, ok := common.ParseDnsmasqRule(string(line)); ok {
+		for _, domain := range rule.Domains {
+			c.addDomain(strings.TrimPrefix(domain, common.DOMAIN_WILDCARD_PREFIX), flag)
+		}
+		return nil
+	}
+	if domain, exception, ok := parseAdblockLine(string(line)); ok {
+		if len(domain) > 0 {
+			c.addDomain(domain, flag || exception)
+		}
+		return nil
+	}
 	line = filterComment(line)
 	domain, err := extractDomain(line)
 	if err != nil {
 		return err
 	}
+	c.addDomain(string(domain[:]), flag)
+	return nil
+}
+
+func (c *dnsFilter) addDomain(domain string, flag bool) {
 	if flag == FILTER_WHITE {
 		c.whiteMux.Lock()
 		defer c.whiteMux.Unlock()
-		c.whiteDomains[string(domain[:])] = true
+		c.whiteDomains[domain] = true
 	} else {
 		c.blackMux.Lock()
 		defer c.blackMux.Unlock()
-		c.blackedDomains[string(domain[:])] = true
+		c.blackedDomains[domain] = true
 	}
+}
 
-	return nil
+// parseAdblockLine returns domain of Adblock Plus domain rule, exception is set for "@@" rule, ok is false for line
+// not in Adblock Plus syntax, and domain is empty for comment, element hiding or URL rule which can not be applied
+// by domain
+func parseAdblockLine(line string) (domain string, exception bool, ok bool) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 {
+		return "", false, false
+	}
+	// "!" comment and "[Adblock Plus 2.0]" header
+	if line[0] == '!' || (line[0] == '[' && line[len(line)-1] == ']') {
+		return "", false, true
+	}
+	// element hiding, e.g. "example.com##.banner", names a site which must not be blocked
+	for _, separator := range []string{"##", "#@#", "#?#", "#$#", "#%#"} {
+		if strings.Contains(line, separator) {
+			return "", false, true
+		}
+	}
+	if matches := adblockDomainRule.FindStringSubmatch(line); matches != nil {
+		for _, option := range strings.Split(matches[3], ",") {
+			if option = strings.ToLower(strings.TrimSpace(option)); len(option) > 0 && !adblockDomainOptions[option] {
+				return "", false, true
+			}
+		}
+		return strings.ToLower(matches[2]), len(matches[1]) > 0, true
+	}
+	// URL rules, e.g. "/banner/*/ad.js" or "@@|https://example.com/ad$script"
+	if strings.ContainsAny(line, "|^$*/") || strings.HasPrefix(line, "@@") {
+		return "", false, true
+	}
+	return "", false, false
 }
 
 func filterComment(line []byte) []byte {
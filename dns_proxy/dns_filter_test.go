@@ -2,6 +2,7 @@ package dns_proxy
 
 import (
 	"bytes"
+	"github.com/weishi258/redfrog-core/log"
 	"strconv"
 	"strings"
 	"testing"
@@ -76,3 +77,45 @@ func TestDomainExtraction(t *testing.T) {
 		}
 	}
 }
+
+func TestParseFilterListLineDnsmasq(t *testing.T) {
+	log.InitLogger("", "error", false)
+	filter := &dnsFilter{blackedDomains: make(map[string]bool), whiteDomains: make(map[string]bool)}
+	for _, line := range []string{"address=/ads.example.com/0.0.0.0", "server=/tracker.com/*.metrics.com/", "127.0.0.1 hosts.com"} {
+		if err := filter.parseFilterListLine([]byte(line), FILTER_BLACK); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := filter.parseFilterListLine([]byte("server=/ok.tracker.com/#"), FILTER_WHITE); err != nil {
+		t.Fatal(err)
+	}
+	for domain, expected := range map[string]uint8{"ads.example.com": FILTER_ACTION_BLOCK, "a.ads.example.com": FILTER_ACTION_BLOCK,
+		"www.tracker.com": FILTER_ACTION_BLOCK, "x.metrics.com": FILTER_ACTION_BLOCK, "hosts.com": FILTER_ACTION_BLOCK,
+		"ok.tracker.com": FILTER_ACTION_PASS, "example.com": FILTER_ACTION_UNSPECIFIC} {
+		if action := filter.CheckDomain(domain); action != expected {
+			t.Errorf("CheckDomain(%s) got %d, expected %d", domain, action, expected)
+		}
+	}
+}
+
+func TestParseFilterListLineAdblock(t *testing.T) {
+	log.InitLogger("", "error", false)
+	filter := &dnsFilter{blackedDomains: make(map[string]bool), whiteDomains: make(map[string]bool)}
+	for _, line := range []string{"[Adblock Plus 2.0]", "! Title: EasyList", "||Ads.example.com^", "||tracker.com^$important",
+		"||cdn.tracker.com^$third-party", "@@||ok.tracker.com^", "||site.com/ads/*", "example.org##.banner", "/banner/*/ad.js",
+		"@@|https://site.com/ad.js$script", "0.0.0.0 hosts.com"} {
+		if err := filter.parseFilterListLine([]byte(line), FILTER_BLACK); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for domain, expected := range map[string]uint8{"ads.example.com": FILTER_ACTION_BLOCK, "a.ads.example.com": FILTER_ACTION_BLOCK,
+		"www.tracker.com": FILTER_ACTION_BLOCK, "ok.tracker.com": FILTER_ACTION_PASS, "cdn.tracker.com": FILTER_ACTION_BLOCK,
+		"site.com": FILTER_ACTION_UNSPECIFIC, "example.org": FILTER_ACTION_UNSPECIFIC, "hosts.com": FILTER_ACTION_BLOCK} {
+		if action := filter.CheckDomain(domain); action != expected {
+			t.Errorf("CheckDomain(%s) got %d, expected %d", domain, action, expected)
+		}
+	}
+	if _, ok := filter.blackedDomains["cdn.tracker.com"]; ok {
+		t.Errorf("rule with $third-party should be skipped")
+	}
+}
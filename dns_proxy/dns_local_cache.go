@@ -0,0 +1,83 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"time"
+)
+
+const (
+	// upper bound of cached local answer, and TTL used for negative answer without SOA
+	LOCAL_CACHE_MAX_TTL      = 3600 * 24
+	LOCAL_CACHE_NEGATIVE_TTL = 60
+)
+
+// answerTtl returns how long response can be cached, negative answer uses SOA minimum as RFC 2308
+func answerTtl(resDns *dns.Msg) (uint32, bool) {
+	if resDns.Truncated || (resDns.Rcode != dns.RcodeSuccess && resDns.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+	var ttl uint32 = LOCAL_CACHE_MAX_TTL
+	if resDns.Rcode == dns.RcodeSuccess && len(resDns.Answer) > 0 {
+		for _, a := range resDns.Answer {
+			if a.Header().Ttl < ttl {
+				ttl = a.Header().Ttl
+			}
+		}
+	} else {
+		ttl = LOCAL_CACHE_NEGATIVE_TTL
+		for _, ns := range resDns.Ns {
+			if soa, ok := ns.(*dns.SOA); ok {
+				ttl = soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+			}
+		}
+	}
+	return ttl, ttl > 0
+}
+
+func (c *DnsServer) getLocalCache() *dnsCache {
+	c.dnsCacheMux.RLock()
+	defer c.dnsCacheMux.RUnlock()
+	return c.localCaches
+}
+
+// checkLocalCache returns a copy of cached local answer with remaining TTL, and whether it needs refresh
+func (c *DnsServer) checkLocalCache(r *dns.Msg) (*dns.Msg, bool) {
+	cache := c.getLocalCache()
+	if cache == nil || len(r.Question) != 1 || r.Question[0].Qclass != dns.ClassINET {
+		return nil, false
+	}
+	key := dnsCacheKey(r.Question[0])
+	entry := cache.get(key)
+	if entry == nil {
+		return nil, false
+	}
+	now := time.Now()
+	if !now.Before(entry.ttl) {
+		cache.del(key)
+		return nil, false
+	}
+	ret := entry.response.Copy()
+	remain := uint32(entry.ttl.Sub(now) / time.Second)
+	for _, rrs := range [][]dns.RR{ret.Answer, ret.Ns, ret.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > remain {
+				rr.Header().Ttl = remain
+			}
+		}
+	}
+	return ret, now.After(entry.halfTtl)
+}
+
+func (c *DnsServer) addLocalCache(r *dns.Msg, resDns *dns.Msg) {
+	cache := c.getLocalCache()
+	if cache == nil || len(r.Question) != 1 || r.Question[0].Qclass != dns.ClassINET {
+		return
+	}
+	if ttl, ok := answerTtl(resDns); ok {
+		now := time.Now()
+		cache.set(dnsCacheKey(r.Question[0]), &dnsCacheEntry{response: resDns.Copy(), halfTtl: now.Add(time.Duration(ttl>>1) * time.Second), ttl: now.Add(time.Duration(ttl) * time.Second)})
+	}
+}
@@ -0,0 +1,34 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestAnswerTtl(t *testing.T) {
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	resDns := new(dns.Msg)
+	resDns.SetReply(r)
+	for _, line := range []string{"www.example.com. 300 IN CNAME example.com.", "example.com. 60 IN A 192.0.2.1"} {
+		rr, _ := dns.NewRR(line)
+		resDns.Answer = append(resDns.Answer, rr)
+	}
+	if ttl, ok := answerTtl(resDns); !ok || ttl != 60 {
+		t.Errorf("positive answer ttl got %d, expect 60", ttl)
+	}
+
+	negative := new(dns.Msg)
+	negative.SetRcode(r, dns.RcodeNameError)
+	soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 120")
+	negative.Ns = append(negative.Ns, soa)
+	if ttl, ok := answerTtl(negative); !ok || ttl != 120 {
+		t.Errorf("negative answer ttl got %d, expect 120", ttl)
+	}
+
+	failed := new(dns.Msg)
+	failed.SetRcode(r, dns.RcodeServerFailure)
+	if _, ok := answerTtl(failed); ok {
+		t.Errorf("SERVFAIL should not be cached")
+	}
+}
@@ -0,0 +1,158 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	QTYPE_ACTION_REFUSED = "refused"
+	QTYPE_ACTION_NOTIMP  = "notimp"
+	QTYPE_ACTION_DROP    = "drop"
+)
+
+var errDnsQueryDropped = errors.New("DNS query dropped")
+
+var privateReverseNets = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8", "169.254.0.0/16", "100.64.0.0/10",
+	"::1/128", "fe80::/10", "fc00::/7"}
+
+// queryTypeFilter refuses or drops configured query types before they reach any resolver
+type queryTypeFilter struct {
+	actions           map[uint16]string
+	refuseExternalPTR bool
+	privateNets       []*net.IPNet
+}
+
+func newQueryTypeFilter(refuseTypes map[string]string, refuseExternalPTR bool) *queryTypeFilter {
+	logger := log.GetLogger()
+	if len(refuseTypes) == 0 && !refuseExternalPTR {
+		return nil
+	}
+	ret := &queryTypeFilter{actions: make(map[uint16]string), refuseExternalPTR: refuseExternalPTR}
+	for typeName, action := range refuseTypes {
+		qType, ok := parseQueryType(typeName)
+		if !ok {
+			if logger != nil {
+				logger.Warn("Refuse query type is unknown, so ignore", zap.String("type", typeName))
+			}
+			continue
+		}
+		action = strings.ToLower(action)
+		switch action {
+		case QTYPE_ACTION_REFUSED, QTYPE_ACTION_NOTIMP, QTYPE_ACTION_DROP:
+		default:
+			if logger != nil {
+				logger.Warn("Refuse query action is unknown, so use refused", zap.String("type", typeName), zap.String("action", action))
+			}
+			action = QTYPE_ACTION_REFUSED
+		}
+		ret.actions[qType] = action
+	}
+	for _, cidr := range privateReverseNets {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		ret.privateNets = append(ret.privateNets, ipNet)
+	}
+	if logger != nil {
+		logger.Info("Load DNS query type filter successful", zap.Int("types", len(ret.actions)), zap.Bool("refuse external ptr", refuseExternalPTR))
+	}
+	return ret
+}
+
+// parseQueryType accepts type mnemonic like ANY or generic form like TYPE0
+func parseQueryType(typeName string) (uint16, bool) {
+	typeName = strings.ToUpper(strings.TrimSpace(typeName))
+	if qType, ok := dns.StringToType[typeName]; ok {
+		return qType, true
+	}
+	if strings.HasPrefix(typeName, "TYPE") {
+		if qType, err := strconv.ParseUint(typeName[4:], 10, 16); err == nil {
+			return uint16(qType), true
+		}
+	}
+	return 0, false
+}
+
+// reverseNameToIP converts name in in-addr.arpa or ip6.arpa to ip, missing labels are treated as zero
+func reverseNameToIP(name string) net.IP {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if strings.HasSuffix(name, ".in-addr.arpa") {
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) > net.IPv4len {
+			return nil
+		}
+		ret := make(net.IP, net.IPv4len)
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ret[len(labels)-1-i] = byte(octet)
+		}
+		return ret
+	} else if strings.HasSuffix(name, ".ip6.arpa") {
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(labels) > 2*net.IPv6len {
+			return nil
+		}
+		ret := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+			pos := len(labels) - 1 - i
+			if pos%2 == 0 {
+				ret[pos/2] |= byte(nibble) << 4
+			} else {
+				ret[pos/2] |= byte(nibble)
+			}
+		}
+		return ret
+	}
+	return nil
+}
+
+// check returns action for query, empty if query should be resolved
+func (c *queryTypeFilter) check(r *dns.Msg) string {
+	if c == nil {
+		return ""
+	}
+	for _, q := range r.Question {
+		if action, ok := c.actions[q.Qtype]; ok {
+			return action
+		}
+		if q.Qtype == dns.TypePTR && c.refuseExternalPTR {
+			ip := reverseNameToIP(q.Name)
+			if ip == nil {
+				return QTYPE_ACTION_REFUSED
+			}
+			private := false
+			for _, ipNet := range c.privateNets {
+				if ipNet.Contains(ip) {
+					private = true
+					break
+				}
+			}
+			if !private {
+				return QTYPE_ACTION_REFUSED
+			}
+		}
+	}
+	return ""
+}
+
+// reply builds response for refused query, nil for drop
+func (c *queryTypeFilter) reply(r *dns.Msg, action string) *dns.Msg {
+	switch action {
+	case QTYPE_ACTION_REFUSED:
+		return new(dns.Msg).SetRcode(r, dns.RcodeRefused)
+	case QTYPE_ACTION_NOTIMP:
+		return new(dns.Msg).SetRcode(r, dns.RcodeNotImplemented)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestReverseNameToIP(t *testing.T) {
+	cases := map[string]string{
+		"1.0.168.192.in-addr.arpa.": "192.168.0.1",
+		"168.192.in-addr.arpa":      "192.168.0.0",
+		"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.": "4321:0:1:2:3:4:567:89ab",
+	}
+	for name, expect := range cases {
+		if ip := reverseNameToIP(name); !ip.Equal(net.ParseIP(expect)) {
+			t.Errorf("reverse name %s got %s, expect %s", name, ip, expect)
+		}
+	}
+	if ip := reverseNameToIP("300.1.in-addr.arpa"); ip != nil {
+		t.Errorf("invalid reverse name should be nil, got %s", ip)
+	}
+}
+
+func TestQueryTypeFilter(t *testing.T) {
+	filter := newQueryTypeFilter(map[string]string{"any": "notimp", "TYPE0": "drop", "BOGUS": "refused"}, true)
+	if len(filter.actions) != 2 {
+		t.Fatalf("expect 2 actions, got %d", len(filter.actions))
+	}
+	cases := []struct {
+		name   string
+		qType  uint16
+		action string
+	}{
+		{"example.com.", dns.TypeANY, QTYPE_ACTION_NOTIMP},
+		{"example.com.", 0, QTYPE_ACTION_DROP},
+		{"example.com.", dns.TypeA, ""},
+		{"1.0.168.192.in-addr.arpa.", dns.TypePTR, ""},
+		{"8.8.8.8.in-addr.arpa.", dns.TypePTR, QTYPE_ACTION_REFUSED},
+	}
+	for _, c := range cases {
+		r := new(dns.Msg)
+		r.SetQuestion(c.name, c.qType)
+		if action := filter.check(r); action != c.action {
+			t.Errorf("query %s %d got action %q, expect %q", c.name, c.qType, action, c.action)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package dns_proxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RESOLVER_POLICY_RANDOM         = "random"
+	RESOLVER_POLICY_ROUND_ROBIN    = "round-robin"
+	RESOLVER_POLICY_WEIGHTED       = "weighted"
+	RESOLVER_POLICY_LOWEST_LATENCY = "lowest-latency"
+
+	// smoothing factor for resolver latency EWMA, higher value react faster to latency change
+	RESOLVER_LATENCY_EWMA_ALPHA = 0.3
+)
+
+// ResolverStats is a snapshot of outcome counters of one upstream resolver
+type ResolverStats struct {
+	Group      string
+	Addr       string
+	NoError    uint64
+	NXDomain   uint64
+	ServFail   uint64
+	OtherRcode uint64
+	Timeout    uint64
+	Error      uint64
+	// average response time of answered queries
+	AvgLatency time.Duration
+	// smoothed latency used by lowest-latency policy, failures are counted with timeout as penalty
+	Latency time.Duration
+}
+
+type dnsResolverStats struct {
+	noError      uint64
+	nxDomain     uint64
+	servFail     uint64
+	otherRcode   uint64
+	timeout      uint64
+	error        uint64
+	totalLatency uint64
+}
+
+type dnsResolver struct {
+	addr   string
+	client *dns.Client
+	weight int
+	stats  *dnsResolverStats
+
+	latencyMux sync.RWMutex
+	latency    time.Duration
+	sampled    bool
+}
+
+// update latency EWMA, failed query should be recorded with timeout value as penalty
+func (c *dnsResolver) updateLatency(rtt time.Duration) {
+	c.latencyMux.Lock()
+	defer c.latencyMux.Unlock()
+	if !c.sampled {
+		c.latency = rtt
+		c.sampled = true
+	} else {
+		c.latency = time.Duration(RESOLVER_LATENCY_EWMA_ALPHA*float64(rtt) + (1-RESOLVER_LATENCY_EWMA_ALPHA)*float64(c.latency))
+	}
+}
+
+// recordResponse updates outcome counters and latency for an answered query
+func (c *dnsResolver) recordResponse(resDns *dns.Msg, rtt time.Duration) {
+	switch resDns.Rcode {
+	case dns.RcodeSuccess:
+		atomic.AddUint64(&c.stats.noError, 1)
+	case dns.RcodeNameError:
+		atomic.AddUint64(&c.stats.nxDomain, 1)
+	case dns.RcodeServerFailure:
+		atomic.AddUint64(&c.stats.servFail, 1)
+	default:
+		atomic.AddUint64(&c.stats.otherRcode, 1)
+	}
+	atomic.AddUint64(&c.stats.totalLatency, uint64(rtt))
+	c.updateLatency(rtt)
+}
+
+// recordFailure updates counters for a query without answer, timeout value is recorded as latency penalty
+func (c *dnsResolver) recordFailure(isTimeout bool, timeout time.Duration) {
+	if isTimeout {
+		atomic.AddUint64(&c.stats.timeout, 1)
+	} else {
+		atomic.AddUint64(&c.stats.error, 1)
+	}
+	c.updateLatency(timeout)
+}
+
+func (c *dnsResolver) getStats(group string) ResolverStats {
+	ret := ResolverStats{
+		Group:      group,
+		Addr:       c.addr,
+		NoError:    atomic.LoadUint64(&c.stats.noError),
+		NXDomain:   atomic.LoadUint64(&c.stats.nxDomain),
+		ServFail:   atomic.LoadUint64(&c.stats.servFail),
+		OtherRcode: atomic.LoadUint64(&c.stats.otherRcode),
+		Timeout:    atomic.LoadUint64(&c.stats.timeout),
+		Error:      atomic.LoadUint64(&c.stats.error),
+	}
+	if answered := ret.NoError + ret.NXDomain + ret.ServFail + ret.OtherRcode; answered > 0 {
+		ret.AvgLatency = time.Duration(atomic.LoadUint64(&c.stats.totalLatency) / answered)
+	}
+	ret.Latency, _ = c.getLatency()
+	return ret
+}
+
+func (c *dnsResolver) getLatency() (time.Duration, bool) {
+	c.latencyMux.RLock()
+	defer c.latencyMux.RUnlock()
+	return c.latency, c.sampled
+}
+
+type dnsResolverGroup struct {
+	name        string
+	policy      string
+	resolvers   []*dnsResolver
+	totalWeight int
+	counter     uint32
+}
+
+func newDnsResolver(addr string, weights map[string]int) *dnsResolver {
+	ret := &dnsResolver{client: &dns.Client{Net: "udp"}, weight: 1, stats: &dnsResolverStats{}}
+	if strings.Index(addr, ":") >= 0 {
+		ret.addr = addr
+	} else {
+		ret.addr = fmt.Sprintf("%s:53", addr)
+	}
+	// weight can be keyed by either the original config addr or the normalized one
+	if weight, ok := weights[addr]; ok && weight > 0 {
+		ret.weight = weight
+	} else if weight, ok := weights[ret.addr]; ok && weight > 0 {
+		ret.weight = weight
+	}
+	return ret
+}
+
+func newDnsResolverGroup(name string, addrs []string, policy string, weights map[string]int) *dnsResolverGroup {
+	logger := log.GetLogger()
+	ret := &dnsResolverGroup{name: name, policy: policy, resolvers: make([]*dnsResolver, 0)}
+	switch policy {
+	case RESOLVER_POLICY_RANDOM, RESOLVER_POLICY_ROUND_ROBIN, RESOLVER_POLICY_WEIGHTED, RESOLVER_POLICY_LOWEST_LATENCY:
+	default:
+		if len(policy) > 0 {
+			logger.Warn("Unknown DNS resolver policy, so fallback to random", zap.String("policy", policy))
+		}
+		ret.policy = RESOLVER_POLICY_RANDOM
+	}
+	for _, addr := range addrs {
+		resolver := newDnsResolver(addr, weights)
+		ret.resolvers = append(ret.resolvers, resolver)
+		ret.totalWeight += resolver.weight
+		logger.Info(fmt.Sprintf("DNS %s resolver", name), zap.String("addr", resolver.addr), zap.Int("weight", resolver.weight), zap.String("policy", ret.policy))
+	}
+	return ret
+}
+
+// inherit keeps counters of resolvers which still exist after reload
+func (c *dnsResolverGroup) inherit(old *dnsResolverGroup) {
+	if old == nil {
+		return
+	}
+	for _, resolver := range c.resolvers {
+		for _, oldResolver := range old.resolvers {
+			if resolver.addr == oldResolver.addr {
+				resolver.stats = oldResolver.stats
+				break
+			}
+		}
+	}
+}
+
+func (c *dnsResolverGroup) getStats() []ResolverStats {
+	ret := make([]ResolverStats, 0, len(c.resolvers))
+	for _, resolver := range c.resolvers {
+		ret = append(ret, resolver.getStats(c.name))
+	}
+	return ret
+}
+
+// pickExcept picks resolver by policy but prefers one not in tried, falls back to normal pick when all are tried
+func (c *dnsResolverGroup) pickExcept(tried map[*dnsResolver]bool) *dnsResolver {
+	if len(tried) == 0 {
+		return c.pick()
+	}
+	for i := 0; i < len(c.resolvers); i++ {
+		if resolver := c.pick(); !tried[resolver] {
+			return resolver
+		}
+	}
+	for _, resolver := range c.resolvers {
+		if !tried[resolver] {
+			return resolver
+		}
+	}
+	return c.pick()
+}
+
+func (c *dnsResolverGroup) pick() *dnsResolver {
+	length := len(c.resolvers)
+	if length == 0 {
+		return nil
+	} else if length == 1 {
+		return c.resolvers[0]
+	}
+
+	switch c.policy {
+	case RESOLVER_POLICY_ROUND_ROBIN:
+		idx := atomic.AddUint32(&c.counter, 1) - 1
+		return c.resolvers[idx%uint32(length)]
+	case RESOLVER_POLICY_WEIGHTED:
+		if c.totalWeight <= 0 {
+			return c.resolvers[rand.Int31n(int32(length))]
+		}
+		n := rand.Intn(c.totalWeight)
+		for _, resolver := range c.resolvers {
+			if n < resolver.weight {
+				return resolver
+			}
+			n -= resolver.weight
+		}
+		return c.resolvers[length-1]
+	case RESOLVER_POLICY_LOWEST_LATENCY:
+		var ret *dnsResolver
+		var best time.Duration
+		for _, resolver := range c.resolvers {
+			latency, sampled := resolver.getLatency()
+			// resolver which never been used gets tried first, so we can have a sample of it
+			if !sampled {
+				return resolver
+			}
+			if ret == nil || latency < best {
+				ret = resolver
+				best = latency
+			}
+		}
+		return ret
+	default:
+		return c.resolvers[rand.Int31n(int32(length))]
+	}
+}
@@ -0,0 +1,118 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/log"
+	"testing"
+	"time"
+)
+
+func TestResolverRoundRobin(t *testing.T) {
+	group := &dnsResolverGroup{policy: RESOLVER_POLICY_ROUND_ROBIN, resolvers: []*dnsResolver{
+		newDnsResolver("1.1.1.1", nil),
+		newDnsResolver("8.8.8.8", nil),
+		newDnsResolver("9.9.9.9:53", nil),
+	}}
+	for i := 0; i < 6; i++ {
+		if resolver := group.pick(); resolver != group.resolvers[i%3] {
+			t.Errorf("round robin pick %d got %s, expect %s", i, resolver.addr, group.resolvers[i%3].addr)
+		}
+	}
+}
+
+func TestResolverWeighted(t *testing.T) {
+	weights := map[string]int{"1.1.1.1": 0, "8.8.8.8:53": 9}
+	group := &dnsResolverGroup{policy: RESOLVER_POLICY_WEIGHTED, resolvers: []*dnsResolver{
+		newDnsResolver("1.1.1.1", weights),
+		newDnsResolver("8.8.8.8", weights),
+	}}
+	for _, resolver := range group.resolvers {
+		group.totalWeight += resolver.weight
+	}
+	if group.resolvers[0].weight != 1 || group.resolvers[1].weight != 9 {
+		t.Fatalf("resolver weight parse failed: %d, %d", group.resolvers[0].weight, group.resolvers[1].weight)
+	}
+	hits := 0
+	for i := 0; i < 1000; i++ {
+		if group.pick() == group.resolvers[1] {
+			hits++
+		}
+	}
+	if hits < 800 {
+		t.Errorf("weighted pick is not weighted: %d of 1000", hits)
+	}
+}
+
+func TestResolverLowestLatency(t *testing.T) {
+	group := &dnsResolverGroup{policy: RESOLVER_POLICY_LOWEST_LATENCY, resolvers: []*dnsResolver{
+		newDnsResolver("1.1.1.1", nil),
+		newDnsResolver("8.8.8.8", nil),
+	}}
+	group.resolvers[0].updateLatency(100 * time.Millisecond)
+	// un-sampled resolver should be tried first
+	if resolver := group.pick(); resolver != group.resolvers[1] {
+		t.Errorf("un-sampled resolver should be picked, got %s", resolver.addr)
+	}
+	group.resolvers[1].updateLatency(300 * time.Millisecond)
+	if resolver := group.pick(); resolver != group.resolvers[0] {
+		t.Errorf("lowest latency resolver should be picked, got %s", resolver.addr)
+	}
+	// ewma should move toward new sample
+	group.resolvers[0].updateLatency(time.Second)
+	if latency, _ := group.resolvers[0].getLatency(); latency <= 100*time.Millisecond || latency >= time.Second {
+		t.Errorf("latency ewma is wrong: %s", latency)
+	}
+}
+
+func TestResolverStats(t *testing.T) {
+	group := newTestResolverGroup("1.1.1.1")
+	resolver := group.resolvers[0]
+	res := new(dns.Msg)
+	resolver.recordResponse(res, 10*time.Millisecond)
+	res.Rcode = dns.RcodeNameError
+	resolver.recordResponse(res, 30*time.Millisecond)
+	resolver.recordFailure(true, time.Second)
+	resolver.recordFailure(false, time.Second)
+
+	// counters survive reload when resolver is still configured
+	reloaded := newTestResolverGroup("1.1.1.1:53")
+	reloaded.inherit(group)
+	stats := reloaded.getStats()
+	if len(stats) != 1 {
+		t.Fatalf("expect 1 stats, got %d", len(stats))
+	}
+	if stats[0].NoError != 1 || stats[0].NXDomain != 1 || stats[0].Timeout != 1 || stats[0].Error != 1 {
+		t.Errorf("resolver counters are wrong: %+v", stats[0])
+	}
+	if stats[0].AvgLatency != 20*time.Millisecond {
+		t.Errorf("average latency is wrong: %s", stats[0].AvgLatency)
+	}
+}
+
+func newTestResolverGroup(addr string) *dnsResolverGroup {
+	return &dnsResolverGroup{name: "test", policy: RESOLVER_POLICY_RANDOM, resolvers: []*dnsResolver{newDnsResolver(addr, nil)}}
+}
+
+func TestRetryResolveBackoff(t *testing.T) {
+	log.InitLogger("", "error", false)
+	for attempt, expected := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond,
+		5: time.Second, 100: time.Second} {
+		if delay := dnsRetryDelay(attempt, 100*time.Millisecond, time.Second); delay != expected {
+			t.Errorf("retry %d delay got %v, expect %v", attempt, delay, expected)
+		}
+	}
+
+	// large retry count stops once query timeout has passed
+	server := &DnsServer{retry: 1000, retryBackoff: 20 * time.Millisecond, timeout: 100 * time.Millisecond,
+		remoteResolver: &dnsResolverGroup{policy: RESOLVER_POLICY_ROUND_ROBIN, resolvers: []*dnsResolver{newDnsResolver("1.1.1.1", nil)}}}
+	attempts := 0
+	start := time.Now()
+	_, err := server.retryResolve(true, &dnsQueryInfo{start: start}, func(resolver *dnsResolver) (*dns.Msg, error) {
+		attempts++
+		return nil, errors.New("refused")
+	})
+	if err == nil || attempts > 4 || time.Since(start) > 150*time.Millisecond {
+		t.Errorf("retry should stop at query timeout, got %d attempts in %v, err %v", attempts, time.Since(start), err)
+	}
+}
@@ -0,0 +1,92 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/common"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"net"
+	"strings"
+)
+
+// dnsRewriter answers queried domain as another one, keyed as pac list rules are, "example.com" for the domain
+// only and "*.example.com" for its subdomains
+type dnsRewriter struct {
+	keys map[string]bool
+	// target domain, or ips answered as is
+	targets map[string]string
+	ips     map[string][]net.IP
+}
+
+// newDnsRewriter returns nil if there is no rule
+func newDnsRewriter(rules map[string]string) *dnsRewriter {
+	logger := log.GetLogger()
+	if len(rules) == 0 {
+		return nil
+	}
+	ret := &dnsRewriter{keys: make(map[string]bool), targets: make(map[string]string), ips: make(map[string][]net.IP)}
+	for source, target := range rules {
+		source = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(source), "."))
+		target = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(target), "."))
+		if len(source) == 0 || len(target) == 0 {
+			logger.Warn("DNS rewrite rule is invalid, so ignore", zap.String("domain", source), zap.String("target", target))
+			continue
+		}
+		if ip := net.ParseIP(target); ip != nil {
+			ret.ips[source] = []net.IP{ip}
+		} else if _, ok := dns.IsDomainName(target); ok && !strings.ContainsAny(target, " \t/") {
+			ret.targets[source] = target
+		} else {
+			logger.Warn("DNS rewrite target is neither domain nor ip, so ignore", zap.String("domain", source), zap.String("target", target))
+			continue
+		}
+		ret.keys[source] = true
+	}
+	logger.Info("Load DNS rewrite rules", zap.Int("rules", len(ret.keys)))
+	return ret
+}
+
+// match returns target domain or ips of rule matching domain, rule of domain itself wins over that of a parent
+func (c *dnsRewriter) match(domain string) (target string, ips []net.IP, ok bool) {
+	if c == nil {
+		return "", nil, false
+	}
+	key, _, ok := common.MatchDomainRuleKey(c.keys, strings.ToLower(domain))
+	if !ok {
+		return "", nil, false
+	}
+	return c.targets[key], c.ips[key], true
+}
+
+func (c *DnsServer) getRewriter() *dnsRewriter {
+	c.dnsFilterMux.RLock()
+	defer c.dnsFilterMux.RUnlock()
+	return c.rewriter
+}
+
+// resolveRewrite answers query rewritten to target as CNAME of it followed by answer of target, which goes through
+// filters, pac list and routing like any query, ips of rule are answered as is
+func (c *DnsServer) resolveRewrite(r *dns.Msg, target string, ips []net.IP, info *dnsQueryInfo) (*dns.Msg, error) {
+	q := r.Question[0]
+	if len(ips) > 0 {
+		info.resolver = "rewrite"
+		return hostsAnswer(r, ips), nil
+	}
+	if info.rewrites++; info.rewrites > CNAME_MAX_DEPTH {
+		return nil, errors.Errorf("DNS rewrite of %s loops", q.Name)
+	}
+	log.GetLogger().Debug("Rewrite DNS query", zap.String("domain", q.Name), zap.String("target", target))
+	query := r.Copy()
+	query.Question[0].Name = dns.Fqdn(target)
+	resDns, err := c.resolveQuery(query, info)
+	if err != nil {
+		return nil, err
+	}
+	ret := resDns.Copy()
+	ret.Question = r.Question
+	cname := &dns.CNAME{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: CLIENT_RULE_HOST_TTL},
+		Target: dns.Fqdn(target)}
+	ret.Answer = append([]dns.RR{cname}, resDns.Answer...)
+	return ret, nil
+}
@@ -0,0 +1,55 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"github.com/weishi258/redfrog-core/log"
+	"testing"
+)
+
+func TestDnsRewriterMatch(t *testing.T) {
+	log.InitLogger("", "error", false)
+	rewriter := newDnsRewriter(map[string]string{"tracker.com": "0.0.0.0", "*.tracker.com": "sinkhole.lan.", "nas.home": "nas.example.com",
+		"invalid.com": "not a domain"})
+	for domain, expected := range map[string]string{"tracker.com": "", "a.Tracker.com": "sinkhole.lan", "nas.home": "nas.example.com"} {
+		if target, _, ok := rewriter.match(domain); !ok || target != expected {
+			t.Errorf("match(%s) got %s, %v, expected %s", domain, target, ok, expected)
+		}
+	}
+	if _, ips, _ := rewriter.match("tracker.com"); len(ips) != 1 || !ips[0].IsUnspecified() {
+		t.Errorf("ip target not parsed, got %v", ips)
+	}
+	for _, domain := range []string{"www.nas.home", "invalid.com", "other.com"} {
+		if _, _, ok := rewriter.match(domain); ok {
+			t.Errorf("%s should not be rewritten", domain)
+		}
+	}
+	if newDnsRewriter(nil) != nil {
+		t.Error("rewriter without rules should be nil")
+	}
+}
+
+func TestResolveRewrite(t *testing.T) {
+	log.InitLogger("", "error", false)
+	server := &DnsServer{rewriter: newDnsRewriter(map[string]string{"alias.home": "nas.home", "nas.home": "192.168.1.10",
+		"loop-a.com": "loop-b.com", "loop-b.com": "loop-a.com"})}
+	query := new(dns.Msg)
+	query.SetQuestion("alias.home.", dns.TypeA)
+	resDns, err := server.resolveQuery(query, &dnsQueryInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resDns.Answer) != 2 || resDns.Question[0].Name != "alias.home." {
+		t.Fatalf("unexpected answer %v", resDns)
+	}
+	if cname, ok := resDns.Answer[0].(*dns.CNAME); !ok || cname.Hdr.Name != "alias.home." || cname.Target != "nas.home." {
+		t.Errorf("answer should start with CNAME to target, got %v", resDns.Answer[0])
+	}
+	if a, ok := resDns.Answer[1].(*dns.A); !ok || a.Hdr.Name != "nas.home." || a.A.String() != "192.168.1.10" {
+		t.Errorf("unexpected address of target %v", resDns.Answer[1])
+	}
+
+	query.SetQuestion("loop-a.com.", dns.TypeA)
+	if _, err = server.resolveQuery(query, &dnsQueryInfo{}); err == nil {
+		t.Error("rewrite loop should fail")
+	}
+}
@@ -0,0 +1,187 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// installed mapping is pushed to routing manager again after this, in case routing table was reloaded meanwhile
+	ROUTE_DEDUP_TTL      = time.Hour
+	ROUTE_DEDUP_SCAVENGE = 10 * time.Minute
+)
+
+// routeDedup remembers (domain, ip) pairs already pushed to routing manager
+type routeDedup struct {
+	sync.Mutex
+	installed map[string]time.Time
+	scavenged time.Time
+}
+
+func newRouteDedup() *routeDedup {
+	return &routeDedup{installed: make(map[string]time.Time), scavenged: time.Now()}
+}
+
+// add returns true if pair is new or expired, so caller should push it to routing manager, pair is remembered for
+// window
+func (c *routeDedup) add(domain string, ip net.IP, window time.Duration) bool {
+	key := domain + "|" + ip.String()
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	if now.Sub(c.scavenged) > ROUTE_DEDUP_SCAVENGE {
+		for k, expire := range c.installed {
+			if now.After(expire) {
+				delete(c.installed, k)
+			}
+		}
+		c.scavenged = now
+	}
+	if expire, ok := c.installed[key]; ok && now.Before(expire) {
+		return false
+	}
+	c.installed[key] = now.Add(window)
+	return true
+}
+
+// routeBatch collects mappings of one DNS response, so routing manager installs them at once
+type routeBatch struct {
+	ips map[string][]net.IP
+	// TTL of answers, routes expire after it
+	ttl time.Duration
+}
+
+// newRouteBatch takes TTL of address records of msg, nil msg leaves expiry to floor of routing manager
+func newRouteBatch(msg *dns.Msg) *routeBatch {
+	ret := &routeBatch{ips: make(map[string][]net.IP)}
+	if msg != nil {
+		for _, a := range msg.Answer {
+			if rrtype := a.Header().Rrtype; rrtype == dns.TypeA || rrtype == dns.TypeAAAA {
+				if ttl := time.Duration(a.Header().Ttl) * time.Second; ttl > ret.ttl {
+					ret.ttl = ttl
+				}
+			}
+		}
+	}
+	return ret
+}
+
+func (c *DnsServer) flushRoutes(batch *routeBatch) {
+	if len(batch.ips) > 0 {
+		c.routingMgr.AddIps(batch.ips, batch.ttl)
+		// intercepted connections to them are counted for rules of the domains
+		c.pacMgr.AttributeIPs(batch.ips, batch.ttl)
+	}
+}
+
+// addRoute queues mapping into batch only if it was not installed recently
+func (c *DnsServer) addRoute(batch *routeBatch, domain string, ip net.IP) bool {
+	// backend policy learns every answer, it is cheap and keeps pinned ips from expiring
+	if proxyClient := c.proxyClient; proxyClient != nil {
+		proxyClient.LearnDomainIP(domain, ip)
+	}
+	// everything not in routing table is intercepted in whitelist mode already, unless country rule sends it direct
+	if c.routingMgr.IsWhitelist() {
+		if proxy, ok := c.pacMgr.CheckGeoIP(ip); ok && !proxy && !c.pacMgr.IsListedDomain(domain) {
+			return c.installRoute(batch, domain, ip)
+		}
+		return false
+	}
+	// exception rule keeps domain out of routing even if it is answered for a proxied query, e.g. as CNAME target
+	if c.pacMgr.CheckExceptionDomain(domain) {
+		return false
+	}
+	return c.installRoute(batch, domain, ip)
+}
+
+func (c *DnsServer) installRoute(batch *routeBatch, domain string, ip net.IP) bool {
+	// pair is remembered for half of the expiry routing manager gives it, so it is pushed again and its expiry
+	// refreshed before route expires, answers of a domain kept being queried stay routed
+	window := ROUTE_DEDUP_TTL
+	if expire := c.routingMgr.RouteTTL(batch.ttl); expire > 0 && expire/2 < window {
+		window = expire / 2
+	}
+	if !c.routeDedup.add(domain, ip, window) {
+		return false
+	}
+	batch.ips[domain] = append(batch.ips[domain], ip)
+	return true
+}
+
+// routeListed puts answer of listed domain into routing table in whitelist mode, so its traffic is not intercepted,
+// answers are recorded under queried domain which is what the list matches on reload
+func (c *DnsServer) routeListed(r *dns.Msg, resDns *dns.Msg) {
+	if !c.routingMgr.IsWhitelist() || len(r.Question) == 0 {
+		return
+	}
+	domain := strings.TrimSuffix(r.Question[0].Name, ".")
+	if c.pacMgr.CheckDomain(domain) {
+		return
+	}
+	batch := newRouteBatch(resDns)
+	for _, a := range resDns.Answer {
+		switch rr := a.(type) {
+		case *dns.A:
+			c.installRoute(batch, domain, rr.A)
+		case *dns.AAAA:
+			c.installRoute(batch, domain, rr.AAAA)
+		}
+	}
+	c.flushRoutes(batch)
+}
+
+// routeGeoIP puts answers of domain no domain rule matches into routing table by country rules, proxied ones normally
+// and direct ones in whitelist mode
+func (c *DnsServer) routeGeoIP(r *dns.Msg, resDns *dns.Msg) {
+	if len(r.Question) == 0 || !c.pacMgr.HasGeoIPRules() {
+		return
+	}
+	domain := strings.TrimSuffix(r.Question[0].Name, ".")
+	if c.pacMgr.IsListedDomain(domain) {
+		return
+	}
+	whitelist := c.routingMgr.IsWhitelist()
+	batch := newRouteBatch(resDns)
+	for _, a := range resDns.Answer {
+		var ip net.IP
+		switch rr := a.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if proxy, ok := c.pacMgr.CheckGeoIP(ip); ok && proxy != whitelist {
+			c.installRoute(batch, domain, ip)
+		}
+	}
+	c.flushRoutes(batch)
+}
+
+// learnDirect tells proxy client ips of domain with $direct rule, so intercepted traffic to them is not tunneled
+func (c *DnsServer) learnDirect(r *dns.Msg, resDns *dns.Msg) {
+	proxyClient := c.proxyClient
+	if proxyClient == nil || len(r.Question) == 0 {
+		return
+	}
+	domain := strings.TrimSuffix(r.Question[0].Name, ".")
+	if !c.pacMgr.CheckDirectDomain(domain) {
+		return
+	}
+	batch := newRouteBatch(resDns)
+	for _, a := range resDns.Answer {
+		switch rr := a.(type) {
+		case *dns.A:
+			proxyClient.LearnDirectIP(rr.A)
+			batch.ips[domain] = append(batch.ips[domain], rr.A)
+		case *dns.AAAA:
+			proxyClient.LearnDirectIP(rr.AAAA)
+			batch.ips[domain] = append(batch.ips[domain], rr.AAAA)
+		}
+	}
+	c.pacMgr.AttributeIPs(batch.ips, batch.ttl)
+}
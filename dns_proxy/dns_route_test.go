@@ -0,0 +1,71 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"github.com/weishi258/redfrog-core/routing"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRouteDedup(t *testing.T) {
+	dedup := newRouteDedup()
+	ip := net.ParseIP("192.0.2.1")
+	if !dedup.add("www.example.com", ip, ROUTE_DEDUP_TTL) {
+		t.Errorf("first mapping should be added")
+	}
+	if dedup.add("www.example.com", ip, ROUTE_DEDUP_TTL) {
+		t.Errorf("repeated mapping should be suppressed")
+	}
+	if !dedup.add("cdn.example.com", ip, ROUTE_DEDUP_TTL) {
+		t.Errorf("same ip of another domain should be added")
+	}
+	dedup.installed["www.example.com|192.0.2.1"] = time.Now().Add(-time.Second)
+	if !dedup.add("www.example.com", ip, ROUTE_DEDUP_TTL) {
+		t.Errorf("expired mapping should be added again")
+	}
+	// short window of route expiring soon
+	if !dedup.add("api.example.com", ip, time.Millisecond) {
+		t.Errorf("first mapping should be added")
+	}
+	time.Sleep(2 * time.Millisecond)
+	if !dedup.add("api.example.com", ip, time.Millisecond) {
+		t.Errorf("mapping should be added again after window")
+	}
+}
+
+func TestInstallRouteWindow(t *testing.T) {
+	routingMgr := &routing.RoutingMgr{}
+	routingMgr.SetRouteTTLFloor(60)
+	server := &DnsServer{routingMgr: routingMgr, routeDedup: newRouteDedup()}
+	ip := net.ParseIP("192.0.2.1")
+	batch := &routeBatch{ips: make(map[string][]net.IP), ttl: 30 * time.Second}
+	if !server.installRoute(batch, "www.example.com", ip) || server.installRoute(batch, "www.example.com", ip) {
+		t.Fatal("repeated answer should be queued once")
+	}
+	if len(batch.ips["www.example.com"]) != 1 {
+		t.Errorf("unexpected batch %v", batch.ips)
+	}
+	// remembered for half of the route expiry, which is raised to floor
+	if remain := time.Until(server.routeDedup.installed["www.example.com|192.0.2.1"]); remain > 30*time.Second || remain < 29*time.Second {
+		t.Errorf("pair should be remembered for half of route expiry, got %v", remain)
+	}
+}
+
+func TestNewRouteBatch(t *testing.T) {
+	msg := new(dns.Msg)
+	for _, line := range []string{"www.example.com. 30 IN CNAME cdn.example.com.", "cdn.example.com. 120 IN A 192.0.2.1",
+		"cdn.example.com. 60 IN A 192.0.2.2"} {
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+	if batch := newRouteBatch(msg); batch.ttl != 120*time.Second {
+		t.Errorf("batch ttl should be longest of address records, got %v", batch.ttl)
+	}
+	if batch := newRouteBatch(nil); batch.ttl != 0 {
+		t.Errorf("batch without answer should leave ttl to floor, got %v", batch.ttl)
+	}
+}
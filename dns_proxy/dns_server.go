@@ -11,25 +11,35 @@ import (
 	"github.com/weishi258/redfrog-core/pac"
 	"github.com/weishi258/redfrog-core/routing"
 	"go.uber.org/zap"
-	"math/rand"
 	"net"
 	"strings"
 	"sync"
 	"time"
 )
 
-type dnsResolver struct {
-	addr   string
-	client *dns.Client
-}
+const (
+	// TTL cap of answer from local resolver used as fallback for black domain
+	FALLBACK_TTL = 30
+)
 
 type DnsServer struct {
 	routingMgr *routing.RoutingMgr
 	pacMgr     *pac.PacListMgr
 	server     *dns.Server
-
-	localResolver  []*dnsResolver
-	remoteResolver []*dnsResolver
+	tcpServer  *dns.Server
+
+	localResolver  *dnsResolverGroup
+	remoteResolver *dnsResolverGroup
+	edns           *ednsSetting
+	dnssec         *dnssecValidator
+	enableIPv6     bool
+	dns64          *dns64Setting
+	caseRandomize  bool
+	fallbackLocal  bool
+	proxyTtl       uint32
+	socks5         *socks5Resolver
+	retry          int
+	retryBackoff   time.Duration
 
 	proxyClient common.ProxyClientInterface
 
@@ -37,66 +47,52 @@ type DnsServer struct {
 
 	sendNum     int32
 	dnsCaches   *dnsCache
+	localCaches *dnsCache
 	dnsCacheMux sync.RWMutex
+	persistPath string
+	persistStop chan bool
 
 	timeout time.Duration
 
 	filter       *dnsFilter
+	bogusFilter  *bogusIPFilter
+	clientRules  clientRules
+	qtypeFilter  *queryTypeFilter
+	rewriter     *dnsRewriter
 	dnsFilterMux sync.RWMutex
 
+	audit    *dnsAuditLogger
+	auditMux sync.RWMutex
+
+	inflight   *dnsSingleflight
+	routeDedup *routeDedup
+
 	dnsSyncResolver common.DnsSyncResolver
 	localDnsConn    *net.UDPConn
 	localDnsMux     sync.Mutex
 }
 
-type dnsCacheEntry struct {
-	response *dns.Msg
-	halfTtl  time.Time
-	ttl      time.Time
-}
-
-type dnsCache struct {
-	sync.RWMutex
-	caches map[string]*dnsCacheEntry
-}
-
-func (c *DnsServer) AddDnsCache(domain string, response *dns.Msg, ttl uint32) {
+// AddDnsCache caches proxy resolved answer of question, answers of a domain are cached by query type
+func (c *DnsServer) AddDnsCache(q dns.Question, response *dns.Msg, ttl uint32) {
 	c.dnsCacheMux.RLock()
 	cache := c.dnsCaches
 	c.dnsCacheMux.RUnlock()
 
 	if cache != nil {
-		cache.Lock()
-		defer cache.Unlock()
-		cache.caches[domain] = &dnsCacheEntry{response: response, halfTtl: time.Now().Add(time.Duration(ttl>>1) * time.Second), ttl: time.Now().Add(time.Duration(ttl) * time.Second)}
+		cache.set(dnsCacheKey(q), &dnsCacheEntry{response: response, halfTtl: time.Now().Add(time.Duration(ttl>>1) * time.Second), ttl: time.Now().Add(time.Duration(ttl) * time.Second)})
 	}
 }
 
-func (c *dnsCache) get(domain string) *dnsCacheEntry {
-	c.RLock()
-	defer c.RUnlock()
-	if res, ok := c.caches[domain]; ok {
-		return res
-	} else {
-		return nil
-	}
-}
-func (c *dnsCache) del(domain string) {
-	c.Lock()
-	defer c.Unlock()
-	delete(c.caches, domain)
-}
-
-func (c *dnsCache) GetDnsCache(domain string) (*dns.Msg, bool) {
-	if entry := c.get(domain); entry != nil {
-		log.GetLogger().Debug("Get cache hit", zap.String("domain", domain))
+func (c *dnsCache) GetDnsCache(key string) (*dns.Msg, bool) {
+	if entry := c.get(key); entry != nil {
+		log.GetLogger().Debug("Get cache hit", zap.String("key", key))
 		now := time.Now()
 		if now.Before(entry.ttl) {
 			// we used halfTtl as an test to determine if we need to refresh the cache
 			// it the current time + timeout > current time we will need to refresh cache even we hit cache to minimize dns lost
 			return entry.response, now.After(entry.halfTtl)
 		} else {
-			c.del(domain)
+			c.del(key)
 		}
 	}
 
@@ -106,7 +102,7 @@ func (c *dnsCache) GetDnsCache(domain string) (*dns.Msg, bool) {
 func StartDnsServer(dnsConfig config.DnsConfig, pacMgr *pac.PacListMgr, routingMgr *routing.RoutingMgr, proxyClient common.ProxyClientInterface) (ret *DnsServer, err error) {
 	logger := log.GetLogger()
 
-	ret = &DnsServer{}
+	ret = &DnsServer{inflight: newDnsSingleflight(), routeDedup: newRouteDedup()}
 	ret.dnsSyncResolver.Start()
 	ret.proxyClient = proxyClient
 	if routingMgr == nil {
@@ -126,35 +122,39 @@ func StartDnsServer(dnsConfig config.DnsConfig, pacMgr *pac.PacListMgr, routingM
 			logger.Error("Dns server start failed", zap.String("error", err.Error()))
 		}
 	}()
-
-	// create dns exchange client
-	ret.localResolver = make([]*dnsResolver, 0)
-	for _, addr := range dnsConfig.LocalResolver {
-		var resolver *dnsResolver
-		if strings.Index(addr, ":") >= 0 {
-			resolver = &dnsResolver{addr, &dns.Client{Net: "udp"}}
-		} else {
-			resolver = &dnsResolver{fmt.Sprintf("%s:53", addr), &dns.Client{Net: "udp"}}
-		}
-		ret.localResolver = append(ret.localResolver, resolver)
-		logger.Debug("DNS local resolver", zap.String("addr", resolver.addr))
+	if dnsConfig.Tcp {
+		// client retries truncated answer over TCP
+		ret.tcpServer = &dns.Server{Addr: dnsConfig.ListenAddr, Net: "tcp", Handler: ret}
+		logger.Info("Dns TCP server starting", zap.String("addr", dnsConfig.ListenAddr))
+		go func() {
+			if err := ret.tcpServer.ListenAndServe(); err != nil {
+				logger.Error("Dns TCP server start failed", zap.String("error", err.Error()))
+			}
+		}()
 	}
 
-	ret.remoteResolver = make([]*dnsResolver, 0)
-	for _, addr := range dnsConfig.ProxyResolver {
-		var resolver *dnsResolver
-		if strings.Index(addr, ":") >= 0 {
-			resolver = &dnsResolver{addr, &dns.Client{Net: "udp"}}
-		} else {
-			resolver = &dnsResolver{fmt.Sprintf("%s:53", addr), &dns.Client{Net: "udp"}}
-		}
-		ret.remoteResolver = append(ret.remoteResolver, resolver)
-		logger.Debug("DNS proxy resolver", zap.String("addr", resolver.addr))
-	}
+	// create dns exchange client
+	ret.localResolver = newDnsResolverGroup("local", dnsConfig.LocalResolver, dnsConfig.ResolverPolicy, dnsConfig.ResolverWeight)
+	ret.remoteResolver = newDnsResolverGroup("proxy", dnsConfig.ProxyResolver, dnsConfig.ResolverPolicy, dnsConfig.ResolverWeight)
+	ret.edns = newEdnsSetting(dnsConfig.EdnsConfig)
+	ret.dnssec = newDnssecValidator(dnsConfig.DnssecConfig, ret.exchangeProxyDNS)
+	ret.enableIPv6 = dnsConfig.EnableIPv6
+	ret.dns64 = newDns64Setting(dnsConfig.Dns64Config)
+	ret.caseRandomize = dnsConfig.CaseRandomize
+	ret.fallbackLocal = dnsConfig.ProxyFallbackLocal
+	ret.proxyTtl = uint32(dnsConfig.ProxyTtl)
+	ret.socks5 = newSocks5Resolver(dnsConfig.Socks5Config)
+	ret.retry = dnsConfig.Retry
+	ret.retryBackoff = time.Duration(dnsConfig.RetryBackoff) * time.Millisecond
+	logger.Info("DNS IPv6 proxy routing", zap.Bool("enable", ret.enableIPv6))
 
 	if dnsConfig.Cache {
 		logger.Info("Enable DNS cache")
-		ret.dnsCaches = &dnsCache{caches: make(map[string]*dnsCacheEntry)}
+		ret.dnsCaches = newDnsCache()
+		if dnsConfig.CacheLocal {
+			logger.Info("Enable DNS cache for local resolver")
+			ret.localCaches = newDnsCache()
+		}
 	}
 	ret.sendNum = int32(dnsConfig.SendNum)
 	if ret.sendNum < 1 {
@@ -170,6 +170,14 @@ func StartDnsServer(dnsConfig config.DnsConfig, pacMgr *pac.PacListMgr, routingM
 			logger.Info("Start DNS filter successful")
 		}
 	}
+	ret.bogusFilter = newBogusIPFilter(dnsConfig.BogusIP)
+	if dnsConfig.Cache && len(dnsConfig.CachePersist) > 0 {
+		ret.startCachePersist(config.GetPathFromWorkingDir(dnsConfig.CachePersist), time.Duration(dnsConfig.CachePersistInterval)*time.Second)
+	}
+	ret.clientRules = newClientRules(dnsConfig.ClientRules)
+	ret.qtypeFilter = newQueryTypeFilter(dnsConfig.RefuseType, dnsConfig.RefuseExternalPTR)
+	ret.rewriter = newDnsRewriter(dnsConfig.FilterConfig.Rewrite)
+	ret.audit = newDnsAuditLogger(dnsConfig.AuditConfig)
 	//logger.Info("Set DNS send number", zap.Int("num", dnsConfig.SendNum))
 	//aa := ret.(proxy_client.DNSServerInterface)
 	ret.proxyClient.SetDNSProcessor(ret)
@@ -180,33 +188,27 @@ func (c *DnsServer) Reload(dnsConfig config.DnsConfig) {
 
 	// reload resolver
 
-	localResolver := make([]*dnsResolver, 0)
-	for _, addr := range dnsConfig.LocalResolver {
-		var resolver *dnsResolver
-		if strings.Index(addr, ":") >= 0 {
-			resolver = &dnsResolver{addr, &dns.Client{Net: "udp"}}
-		} else {
-			resolver = &dnsResolver{fmt.Sprintf("%s:53", addr), &dns.Client{Net: "udp"}}
-		}
-		localResolver = append(localResolver, resolver)
-		logger.Info("DNS local resolver", zap.String("addr", resolver.addr))
-	}
-
-	remoteResolver := make([]*dnsResolver, 0)
-	for _, addr := range dnsConfig.ProxyResolver {
-		var resolver *dnsResolver
-		if strings.Index(addr, ":") >= 0 {
-			resolver = &dnsResolver{addr, &dns.Client{Net: "udp"}}
-		} else {
-			resolver = &dnsResolver{fmt.Sprintf("%s:53", addr), &dns.Client{Net: "udp"}}
-		}
-		remoteResolver = append(remoteResolver, resolver)
-		logger.Info("DNS proxy resolver", zap.String("addr", resolver.addr))
-	}
+	localResolver := newDnsResolverGroup("local", dnsConfig.LocalResolver, dnsConfig.ResolverPolicy, dnsConfig.ResolverWeight)
+	remoteResolver := newDnsResolverGroup("proxy", dnsConfig.ProxyResolver, dnsConfig.ResolverPolicy, dnsConfig.ResolverWeight)
+	edns := newEdnsSetting(dnsConfig.EdnsConfig)
+	dnssec := newDnssecValidator(dnsConfig.DnssecConfig, c.exchangeProxyDNS)
+	dns64 := newDns64Setting(dnsConfig.Dns64Config)
 	c.dnsResolverMux.Lock()
 	defer c.dnsResolverMux.Unlock()
+	localResolver.inherit(c.localResolver)
+	remoteResolver.inherit(c.remoteResolver)
 	c.localResolver = localResolver
 	c.remoteResolver = remoteResolver
+	c.edns = edns
+	c.dnssec = dnssec
+	c.enableIPv6 = dnsConfig.EnableIPv6
+	c.dns64 = dns64
+	c.caseRandomize = dnsConfig.CaseRandomize
+	c.fallbackLocal = dnsConfig.ProxyFallbackLocal
+	c.proxyTtl = uint32(dnsConfig.ProxyTtl)
+	c.socks5 = newSocks5Resolver(dnsConfig.Socks5Config)
+	c.retry = dnsConfig.Retry
+	c.retryBackoff = time.Duration(dnsConfig.RetryBackoff) * time.Millisecond
 
 	// reload DNS cache
 	c.dnsCacheMux.Lock()
@@ -214,7 +216,7 @@ func (c *DnsServer) Reload(dnsConfig config.DnsConfig) {
 	if dnsConfig.Cache {
 		if c.dnsCaches == nil {
 			logger.Info("Enable DNS cache")
-			c.dnsCaches = &dnsCache{caches: make(map[string]*dnsCacheEntry)}
+			c.dnsCaches = newDnsCache()
 		}
 	} else {
 		if c.dnsCaches != nil {
@@ -223,6 +225,15 @@ func (c *DnsServer) Reload(dnsConfig config.DnsConfig) {
 		}
 
 	}
+	if dnsConfig.Cache && dnsConfig.CacheLocal {
+		if c.localCaches == nil {
+			logger.Info("Enable DNS cache for local resolver")
+			c.localCaches = newDnsCache()
+		}
+	} else if c.localCaches != nil {
+		c.localCaches = nil
+		logger.Info("Disable DNS cache for local resolver")
+	}
 	c.dnsCacheMux.Unlock()
 
 	c.dnsFilterMux.Lock()
@@ -238,9 +249,20 @@ func (c *DnsServer) Reload(dnsConfig config.DnsConfig) {
 		c.filter = nil
 		logger.Info("Disable DNS filter")
 	}
+	c.bogusFilter = newBogusIPFilter(dnsConfig.BogusIP)
+	c.clientRules = newClientRules(dnsConfig.ClientRules)
+	c.qtypeFilter = newQueryTypeFilter(dnsConfig.RefuseType, dnsConfig.RefuseExternalPTR)
+	c.rewriter = newDnsRewriter(dnsConfig.FilterConfig.Rewrite)
 
 	c.dnsFilterMux.Unlock()
 
+	audit := newDnsAuditLogger(dnsConfig.AuditConfig)
+	c.auditMux.Lock()
+	oldAudit := c.audit
+	c.audit = audit
+	c.auditMux.Unlock()
+	oldAudit.close()
+
 	// reload Send Num
 	//sendNum := dnsConfig.SendNum
 	//if sendNum < 1{
@@ -255,12 +277,22 @@ func (c *DnsServer) Reload(dnsConfig config.DnsConfig) {
 func (c *DnsServer) Stop() {
 	logger := log.GetLogger()
 
+	c.stopCachePersist()
 	c.proxyClient = nil
 	c.routingMgr = nil
 	c.pacMgr = nil
 	if err := c.server.Shutdown(); err != nil {
 		logger.Error("Stop DNS server failed", zap.String("error", err.Error()))
 	}
+	if c.tcpServer != nil {
+		if err := c.tcpServer.Shutdown(); err != nil {
+			logger.Error("Stop DNS TCP server failed", zap.String("error", err.Error()))
+		}
+	}
+	c.auditMux.Lock()
+	c.audit.close()
+	c.audit = nil
+	c.auditMux.Unlock()
 
 	logger.Info("Dns server stopped")
 }
@@ -269,24 +301,176 @@ func (c *DnsServer) getResolver(bIsRemote bool) *dnsResolver {
 	c.dnsResolverMux.RLock()
 	defer c.dnsResolverMux.RUnlock()
 	if bIsRemote {
-		length := len(c.remoteResolver)
-		if length == 0 {
-			return nil
-		} else if length == 1 {
-			return c.remoteResolver[0]
-		} else {
-			return c.remoteResolver[rand.Int31n(int32(length))]
+		return c.remoteResolver.pick()
+	} else {
+		return c.localResolver.pick()
+	}
+}
+
+// retryResolve runs exchange with resolvers picked by policy, each retry prefers a resolver not tried yet and waits with exponential backoff
+// no retry starts once query timeout since client asked has passed, client has given up by then
+func (c *DnsServer) retryResolve(bIsRemote bool, info *dnsQueryInfo, exchange func(resolver *dnsResolver) (*dns.Msg, error)) (resDns *dns.Msg, err error) {
+	c.dnsResolverMux.RLock()
+	retry, backoff := c.retry, c.retryBackoff
+	c.dnsResolverMux.RUnlock()
+	deadline := time.Now().Add(c.timeout)
+	if info != nil && !info.start.IsZero() {
+		deadline = info.start.Add(c.timeout)
+	}
+
+	tried := make(map[*dnsResolver]bool)
+	for attempt := 0; attempt <= retry; attempt++ {
+		if attempt > 0 {
+			delay := dnsRetryDelay(attempt, backoff, c.timeout)
+			if time.Now().Add(delay).After(deadline) {
+				return
+			}
+			time.Sleep(delay)
 		}
+		resolver := c.getResolverExcept(bIsRemote, tried)
+		if resolver == nil {
+			if bIsRemote {
+				return nil, errors.New("can not get proxy dns resolver")
+			}
+			return nil, errors.New("can not get local dns resolver")
+		}
+		tried[resolver] = true
+		if info != nil {
+			info.resolver = resolver.addr
+		}
+		if resDns, err = exchange(resolver); err == nil {
+			return
+		}
+		if attempt < retry {
+			log.GetLogger().Debug("DNS exchange failed, so retry", zap.String("resolver", resolver.addr), zap.Int("attempt", attempt+1), zap.String("error", err.Error()))
+		}
+	}
+	return
+}
+
+// dnsRetryDelay is backoff doubled for each retry after the first, no longer than max
+func dnsRetryDelay(attempt int, backoff time.Duration, max time.Duration) time.Duration {
+	delay := backoff
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func (c *DnsServer) getResolverExcept(bIsRemote bool, tried map[*dnsResolver]bool) *dnsResolver {
+	c.dnsResolverMux.RLock()
+	defer c.dnsResolverMux.RUnlock()
+	if bIsRemote {
+		return c.remoteResolver.pickExcept(tried)
 	} else {
-		length := len(c.localResolver)
-		if length == 0 {
-			return nil
-		} else if length == 1 {
-			return c.localResolver[0]
-		} else {
-			return c.localResolver[rand.Int31n(int32(length))]
+		return c.localResolver.pickExcept(tried)
+	}
+}
+
+// GetResolverStats returns outcome counters of every configured resolver
+func (c *DnsServer) GetResolverStats() []ResolverStats {
+	c.dnsResolverMux.RLock()
+	defer c.dnsResolverMux.RUnlock()
+	return append(c.localResolver.getStats(), c.remoteResolver.getStats()...)
+}
+
+func (c *DnsServer) getEdnsSetting() *ednsSetting {
+	c.dnsResolverMux.RLock()
+	defer c.dnsResolverMux.RUnlock()
+	return c.edns
+}
+
+func (c *DnsServer) isIPv6Enabled() bool {
+	c.dnsResolverMux.RLock()
+	defer c.dnsResolverMux.RUnlock()
+	return c.enableIPv6
+}
+
+func (c *DnsServer) getProxyTtl() uint32 {
+	c.dnsResolverMux.RLock()
+	defer c.dnsResolverMux.RUnlock()
+	return c.proxyTtl
+}
+
+// capTtl returns copy of response with TTL of every record no more than ttl, response may be shared by cache
+func capTtl(resDns *dns.Msg, ttl uint32) *dns.Msg {
+	ret := resDns.Copy()
+	for _, rrs := range [][]dns.RR{ret.Answer, ret.Ns, ret.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > ttl {
+				rr.Header().Ttl = ttl
+			}
 		}
 	}
+	return ret
+}
+
+func (c *DnsServer) isProxyFallbackLocal() bool {
+	c.dnsResolverMux.RLock()
+	defer c.dnsResolverMux.RUnlock()
+	return c.fallbackLocal
+}
+
+// resolveFallbackDNS answers black domain from local resolver when proxy resolver failed, answer may be poisoned,
+// so it is neither routed nor cached, and TTL is cut short to make client ask again soon
+func (c *DnsServer) resolveFallbackDNS(r *dns.Msg, domainName string, info *dnsQueryInfo, proxyErr error) (*dns.Msg, error) {
+	resDns, err := c.resolveLocalDNS(r, info)
+	if err != nil {
+		return nil, proxyErr
+	}
+	if ip, isBogus := c.getBogusFilter().check(resDns); isBogus {
+		log.GetLogger().Info("Fallback DNS answer contains bogus ip, so drop it", zap.String("domain", domainName), zap.String("ip", ip.String()))
+		return nil, proxyErr
+	}
+	log.GetLogger().Warn("Proxy DNS failed, so fallback to local resolver, answer may be poisoned", zap.String("domain", domainName), zap.String("error", proxyErr.Error()))
+	info.proxied = false
+	info.fallback = true
+	return capTtl(resDns, FALLBACK_TTL), nil
+}
+
+func (c *DnsServer) isCaseRandomize() bool {
+	c.dnsResolverMux.RLock()
+	defer c.dnsResolverMux.RUnlock()
+	return c.caseRandomize
+}
+
+func (c *DnsServer) getDns64Setting() *dns64Setting {
+	c.dnsResolverMux.RLock()
+	defer c.dnsResolverMux.RUnlock()
+	return c.dns64
+}
+
+func (c *DnsServer) getDnssecValidator() *dnssecValidator {
+	c.dnsResolverMux.RLock()
+	defer c.dnsResolverMux.RUnlock()
+	return c.dnssec
+}
+
+// exchangeProxyDNS sends an internal query through proxy resolver, used by DNSSEC validator to fetch keys
+func (c *DnsServer) exchangeProxyDNS(query *dns.Msg) (*dns.Msg, error) {
+	resolver := c.getResolver(true)
+	if resolver == nil {
+		return nil, errors.New("can not get proxy dns resolver")
+	}
+	data, err := query.Pack()
+	if err != nil {
+		return nil, errors.Wrap(err, "Pack DNS query for proxy failed")
+	}
+	return c.exchangeProxy(resolver.addr, data)
+}
+
+// exchangeProxy sends query to proxy resolver through external SOCKS5 if configured, otherwise through proxy backend
+func (c *DnsServer) exchangeProxy(resolverAddr string, data []byte) (*dns.Msg, error) {
+	c.dnsResolverMux.RLock()
+	socks5 := c.socks5
+	c.dnsResolverMux.RUnlock()
+	if socks5 != nil {
+		return socks5.exchange(resolverAddr, data, c.timeout)
+	}
+	return c.proxyClient.ExchangeDNS(resolverAddr, data, c.timeout)
 }
 
 func (c *DnsServer) applyFilterChain(r *dns.Msg) bool {
@@ -318,6 +502,30 @@ func (c *DnsServer) applyFilterChain(r *dns.Msg) bool {
 	return false
 }
 
+func (c *DnsServer) getAuditLogger() *dnsAuditLogger {
+	c.auditMux.RLock()
+	defer c.auditMux.RUnlock()
+	return c.audit
+}
+
+func (c *DnsServer) getBogusFilter() *bogusIPFilter {
+	c.dnsFilterMux.RLock()
+	defer c.dnsFilterMux.RUnlock()
+	return c.bogusFilter
+}
+
+func (c *DnsServer) getClientRules() clientRules {
+	c.dnsFilterMux.RLock()
+	defer c.dnsFilterMux.RUnlock()
+	return c.clientRules
+}
+
+func (c *DnsServer) getQueryTypeFilter() *queryTypeFilter {
+	c.dnsFilterMux.RLock()
+	defer c.dnsFilterMux.RUnlock()
+	return c.qtypeFilter
+}
+
 func (c *DnsServer) checkCache(r *dns.Msg) (*dns.Msg, bool) {
 	c.dnsCacheMux.RLock()
 	dnsCache := c.dnsCaches
@@ -325,8 +533,7 @@ func (c *DnsServer) checkCache(r *dns.Msg) (*dns.Msg, bool) {
 	if dnsCache != nil {
 		for _, q := range r.Question {
 			if q.Qclass == dns.ClassINET {
-				domain := strings.TrimSuffix(q.Name, ".")
-				if resDns, needRefreshCache := dnsCache.GetDnsCache(domain); resDns != nil {
+				if resDns, needRefreshCache := dnsCache.GetDnsCache(dnsCacheKey(q)); resDns != nil {
 					return resDns, needRefreshCache
 				}
 			}
@@ -335,128 +542,192 @@ func (c *DnsServer) checkCache(r *dns.Msg) (*dns.Msg, bool) {
 	return nil, false
 }
 
-func (c *DnsServer) resolveProxyDNS(r *dns.Msg, domainName string, isBlock bool) (resDns *dns.Msg, err error) {
+func (c *DnsServer) resolveProxyDNS(r *dns.Msg, domainName string, isBlock bool, info *dnsQueryInfo) (resDns *dns.Msg, err error) {
 	logger := log.GetLogger()
-	if resolver := c.getResolver(true); resolver != nil {
-		var data []byte
-		if data, err = r.Pack(); err != nil {
-			err = errors.Wrap(err, "Pack DNS query for proxy failed")
-			return
-		}
+	query := c.getEdnsSetting().apply(r)
+	validator := c.getDnssecValidator()
+	if validator != nil {
+		query = validator.prepare(query)
+	}
+	var data []byte
+	if data, err = query.Pack(); err != nil {
+		err = errors.Wrap(err, "Pack DNS query for proxy failed")
+		return
+	}
 
-		if resDns, err = c.proxyClient.ExchangeDNS(resolver.addr, data, c.timeout); err != nil {
-			err = errors.Wrapf(err, "DNS proxy resolve failed, domain %s", domainName)
+	if info != nil {
+		info.proxied = true
+	}
+	if resDns, err, _ = c.inflight.do(singleflightKey("proxy", query), func() (*dns.Msg, error) {
+		return c.retryResolve(true, info, func(resolver *dnsResolver) (*dns.Msg, error) {
+			start := time.Now()
+			res, err := c.exchangeProxy(resolver.addr, data)
+			if err != nil {
+				resolver.recordFailure(time.Since(start) >= c.timeout, c.timeout)
+				return nil, errors.Wrapf(err, "DNS proxy resolve failed, domain %s", domainName)
+			}
+			resolver.recordResponse(res, time.Since(start))
+			return res, nil
+		})
+	}); err != nil {
+		return
+	}
+	if validator != nil {
+		if ee := validator.validate(resDns); ee != nil {
+			// never install ip from bogus answer into routing table, reply SERVFAIL instead
+			logger.Warn("DNSSEC validation failed", zap.String("domain", domainName), zap.String("error", ee.Error()))
+			resDns = new(dns.Msg)
+			resDns.SetRcode(r, dns.RcodeServerFailure)
 			return
 		}
-		// if its blocked then we dont deal with it with normal procedure
-		if !isBlock {
-			hasIPv4 := false
-			var ttl uint32
-			for _, a := range resDns.Answer {
-				if a.Header().Class == dns.ClassINET {
-					if a.Header().Ttl > ttl {
-						ttl = a.Header().Ttl
-					}
-					if a.Header().Rrtype == dns.TypeA {
-						hasIPv4 = true
-						name := strings.TrimSuffix(a.Header().Name, ".")
-						c.routingMgr.AddIp(name, a.(*dns.A).A)
+	}
+	resDns = c.completeCNAMEChain(r, resDns, validator)
+	// if its blocked then we dont deal with it with normal procedure
+	if !isBlock {
+		enableIPv6 := c.isIPv6Enabled()
+		hasIPv4, hasIPv6 := false, false
+		var ttl uint32
+		batch := newRouteBatch(resDns)
+		for _, a := range resDns.Answer {
+			if a.Header().Class == dns.ClassINET {
+				if a.Header().Ttl > ttl {
+					ttl = a.Header().Ttl
+				}
+				if a.Header().Rrtype == dns.TypeA {
+					hasIPv4 = true
+					name := strings.TrimSuffix(a.Header().Name, ".")
+					if c.addRoute(batch, name, a.(*dns.A).A) {
 						logger.Debug("ipv4 ip query", zap.String("domain", name), zap.String("ip", a.(*dns.A).A.String()), zap.Uint32("ttl", ttl))
+					}
 
-						// ipv6 is not fully support yet, so ignore now
-					} else if a.Header().Rrtype == dns.TypeAAAA {
-
-						//shouldAddCache = true
-						name := strings.TrimSuffix(a.Header().Name, ".")
-						c.routingMgr.AddIp(name, a.(*dns.AAAA).AAAA)
+				} else if a.Header().Rrtype == dns.TypeAAAA && enableIPv6 {
+					hasIPv6 = true
+					name := strings.TrimSuffix(a.Header().Name, ".")
+					if c.addRoute(batch, name, a.(*dns.AAAA).AAAA) {
 						logger.Debug("ipv6 ip query", zap.String("domain", name), zap.String("ip", a.(*dns.AAAA).AAAA.String()), zap.Uint32("ttl", ttl))
-					} else if a.Header().Rrtype == dns.TypeCNAME {
-						cname := strings.TrimSuffix(a.(*dns.CNAME).Target, ".")
-						c.pacMgr.AddDomain(cname, common.DOMAIN_BLACK_LIST)
-						logger.Debug("Add CNAME to list", zap.String("CNAME", cname))
 					}
-
+				} else if a.Header().Rrtype == dns.TypeCNAME {
+					cname := strings.TrimSuffix(a.(*dns.CNAME).Target, ".")
+					c.pacMgr.AddDomain(cname, common.DOMAIN_BLACK_LIST)
+					logger.Debug("Add CNAME to list", zap.String("CNAME", cname))
+				} else if svcb, ok := svcbFromRR(a); ok {
+					// browsers may connect to hint address directly without asking A record
+					name := strings.TrimSuffix(a.Header().Name, ".")
+					for _, ip := range svcb.hints {
+						if ip.To4() != nil || enableIPv6 {
+							if c.addRoute(batch, name, ip) {
+								logger.Debug("svcb hint query", zap.String("domain", name), zap.String("ip", ip.String()))
+							}
+						}
+					}
+					if svcb.target != "." {
+						c.pacMgr.AddDomain(strings.TrimSuffix(svcb.target, "."), common.DOMAIN_BLACK_LIST)
+					}
 				}
-			}
-			if hasIPv4 {
-				c.AddDnsCache(domainName, resDns, ttl)
+
 			}
 		}
-	} else {
-		err = errors.New("can not get proxy dns resolver")
+		c.flushRoutes(batch)
+		if (hasIPv4 || hasIPv6) && len(r.Question) > 0 {
+			c.AddDnsCache(r.Question[0], resDns, ttl)
+		}
 	}
 	return
 }
 
-func (c *DnsServer) resolveLocalDNS(r *dns.Msg) (*dns.Msg, error) {
+func (c *DnsServer) resolveLocalDNS(r *dns.Msg, info *dnsQueryInfo) (*dns.Msg, error) {
+	resDns, err, _ := c.inflight.do(singleflightKey("local", c.getEdnsSetting().apply(r)), func() (*dns.Msg, error) {
+		return c.retryResolve(false, info, func(resolver *dnsResolver) (*dns.Msg, error) {
+			return c.exchangeLocalDNS(r, resolver)
+		})
+	})
+	return resDns, err
+}
+
+func (c *DnsServer) exchangeLocalDNS(r *dns.Msg, resolver *dnsResolver) (*dns.Msg, error) {
 	logger := log.GetLogger()
-	if resolver := c.getResolver(false); resolver != nil {
-		addr, err := net.ResolveUDPAddr("udp", resolver.addr)
-		if err != nil {
-			return nil, err
+	addr, err := net.ResolveUDPAddr("udp", resolver.addr)
+	if err != nil {
+		return nil, err
+	}
+	query := c.getEdnsSetting().apply(r)
+	var originalName, randomizedName string
+	if c.isCaseRandomize() && len(query.Question) == 1 {
+		if query == r {
+			query = r.Copy()
 		}
-		payload, err := r.Pack()
-		if err != nil {
+		originalName = r.Question[0].Name
+		randomizedName = randomizeCase(originalName)
+		query.Question[0].Name = randomizedName
+	}
+	payload, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	c.localDnsMux.Lock()
+	if c.localDnsConn == nil {
+		// connection is null, so lets create one
+		if c.localDnsConn, err = net.ListenUDP("udp", nil); err != nil {
+			c.localDnsMux.Unlock()
 			return nil, err
 		}
-
-		c.localDnsMux.Lock()
-		if c.localDnsConn == nil {
-			// connection is null, so lets create one
-			if c.localDnsConn, err = net.ListenUDP("udp", nil); err != nil {
+		go func() {
+			defer func() {
+				c.localDnsMux.Lock()
+				c.localDnsConn.Close()
+				c.localDnsConn = nil
 				c.localDnsMux.Unlock()
-				return nil, err
-			}
-			go func() {
-				defer func() {
-					c.localDnsMux.Lock()
-					c.localDnsConn.Close()
-					c.localDnsConn = nil
-					c.localDnsMux.Unlock()
-				}()
-				buffer := make([]byte, common.UDP_BUFFER_SIZE)
-				for {
-
-					n, _, err := c.localDnsConn.ReadFrom(buffer)
-					if err != nil {
-						// we don't log timeout error
-						if ee, ok := err.(net.Error); !ok || !ee.Timeout() {
-							logger.Error("DNS read from local failed", zap.String("error", err.Error()))
-							return
-						}
+			}()
+			buffer := make([]byte, common.UDP_BUFFER_SIZE)
+			for {
+
+				n, _, err := c.localDnsConn.ReadFrom(buffer)
+				if err != nil {
+					// we don't log timeout error
+					if ee, ok := err.(net.Error); !ok || !ee.Timeout() {
+						logger.Error("DNS read from local failed", zap.String("error", err.Error()))
+						return
 					}
-					c.dnsSyncResolver.ProcessDnsResponse(logger, buffer[:n])
-					// restore buffer size
-					buffer = buffer[:cap(buffer)]
 				}
-			}()
-		}
-		oldId := r.Id
-		// swap id
-		dnsId := c.dnsSyncResolver.GetDnsId()
-		binary.BigEndian.PutUint16(payload, dnsId)
+				c.dnsSyncResolver.ProcessDnsResponse(logger, buffer[:n])
+				// restore buffer size
+				buffer = buffer[:cap(buffer)]
+			}
+		}()
+	}
+	oldId := r.Id
+	// swap id
+	dnsId := c.dnsSyncResolver.GetDnsId()
+	binary.BigEndian.PutUint16(payload, dnsId)
 
-		if _, err = c.localDnsConn.WriteTo(payload, addr); err != nil {
-			c.localDnsMux.Unlock()
-			// make sure id is recycled
-			c.dnsSyncResolver.PutDnsId(dnsId)
-			return nil, err
-		}
+	if _, err = c.localDnsConn.WriteTo(payload, addr); err != nil {
 		c.localDnsMux.Unlock()
+		// make sure id is recycled
+		c.dnsSyncResolver.PutDnsId(dnsId)
+		return nil, err
+	}
+	c.localDnsMux.Unlock()
 
-		if response, err := c.dnsSyncResolver.WaitResponse(dnsId, c.timeout); err != nil {
-			return nil, err
-		} else {
-			// switch to old id
-			response.Id = oldId
-			return response, nil
-		}
+	start := time.Now()
+	if response, err := c.dnsSyncResolver.WaitResponse(dnsId, c.timeout); err != nil {
+		resolver.recordFailure(time.Since(start) >= c.timeout, c.timeout)
+		return nil, err
 	} else {
-		return nil, errors.New("can not get local dns resolver")
+		resolver.recordResponse(response, time.Since(start))
+		if len(randomizedName) > 0 && !restoreCase(response, originalName, randomizedName) {
+			return nil, errors.New(fmt.Sprintf("DNS response from %s does not echo query name case, maybe spoofed: %s", resolver.addr, randomizedName))
+		}
+		// switch to old id
+		response.Id = oldId
+		return response, nil
 	}
 }
 
 func (c *DnsServer) writeResponse(w dns.ResponseWriter, r *dns.Msg, resDns *dns.Msg, isBlocked bool) ([]byte, error) {
+	// we may add OPT record to upstream query, so make sure client does not see it when not asking for
+	resDns = stripEdns(r, resDns)
+	resDns = stripDnssec(r, resDns)
 	if isBlocked {
 		// well we need to block it, so replace all ip address to 0.0.0.0
 		for i := 0; i < len(resDns.Answer); i++ {
@@ -477,6 +748,12 @@ func (c *DnsServer) writeResponse(w dns.ResponseWriter, r *dns.Msg, resDns *dns.
 	}
 	// replace id with request so avoid mis-match
 	resDns.Id = r.Id
+	// packet from gateway filter is always udp
+	if w == nil {
+		resDns = truncateForUDP(r, resDns)
+	} else if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+		resDns = truncateForUDP(r, resDns)
+	}
 	// we need to pack the response since its from gateway filter
 	if w == nil {
 		if data, err := resDns.Pack(); err != nil {
@@ -490,44 +767,168 @@ func (c *DnsServer) writeResponse(w dns.ResponseWriter, r *dns.Msg, resDns *dns.
 	return nil, w.WriteMsg(resDns)
 }
 
-func (c *DnsServer) ServerDNSPacket(msg *dns.Msg) ([]byte, error) {
+func (c *DnsServer) ServerDNSPacket(msg *dns.Msg, srcAddr net.Addr) ([]byte, error) {
 	//r := new(dns.Msg)
 	//if err := r.Unpack(data); err != nil{
 	//	return nil, errors.Wrapf(err, "unpack DNS packet failed")
 	//}
-	return c.processDNSRequest(nil, msg)
+	return c.processDNSRequest(nil, msg, srcAddr)
+}
+
+func (c *DnsServer) processDNSRequest(w dns.ResponseWriter, r *dns.Msg, clientAddr net.Addr) ([]byte, error) {
+	info := &dnsQueryInfo{client: clientAddr, start: time.Now()}
+	if clientAddr != nil {
+		info.rule = c.getClientRules().match(clientAddr)
+	}
+	resDns, err := c.resolveRequest(r, info)
+	c.getAuditLogger().record(r, resDns, info, err)
+	if err == errDnsQueryDropped {
+		return nil, err
+	} else if err != nil {
+		// tell client we failed instead of leaving it waiting until timeout
+		log.GetLogger().Warn("Resolve DNS failed, so reply SERVFAIL", zap.String("error", err.Error()))
+		resDns = new(dns.Msg)
+		resDns.SetRcode(r, dns.RcodeServerFailure)
+	} else if proxyTtl := c.getProxyTtl(); proxyTtl > 0 && info.proxied {
+		// keep client asking often for black domain, so new ip gets routed quickly
+		resDns = capTtl(resDns, proxyTtl)
+	}
+	return c.writeResponse(w, r, resDns, info.blocked)
+}
+
+func (c *DnsServer) resolveRequest(r *dns.Msg, info *dnsQueryInfo) (*dns.Msg, error) {
+	qtypeFilter := c.getQueryTypeFilter()
+	if action := qtypeFilter.check(r); len(action) > 0 {
+		info.resolver = action
+		if resDns := qtypeFilter.reply(r, action); resDns != nil {
+			return resDns, nil
+		}
+		return nil, errDnsQueryDropped
+	}
+	resDns, err := c.resolveQuery(r, info)
+	if err != nil {
+		return nil, err
+	}
+	if dns64 := c.getDns64Setting(); dns64.needSynthesis(r, resDns) {
+		aQuery := r.Copy()
+		aQuery.Question[0].Qtype = dns.TypeA
+		aRes, err := c.resolveQuery(aQuery, info)
+		if err != nil {
+			log.GetLogger().Debug("DNS64 resolve A record failed", zap.String("domain", r.Question[0].Name), zap.String("error", err.Error()))
+			return resDns, nil
+		}
+		resDns = dns64.synthesize(r, aRes)
+		if info.proxied && !info.blocked {
+			// synthesized address is mapped back to ipv4 by proxy client, so route it like the ipv4 one
+			batch := newRouteBatch(resDns)
+			for _, a := range resDns.Answer {
+				if aaaa, ok := a.(*dns.AAAA); ok {
+					c.addRoute(batch, strings.TrimSuffix(aaaa.Hdr.Name, "."), aaaa.AAAA)
+				}
+			}
+			c.flushRoutes(batch)
+		}
+	}
+	return resDns, nil
 }
 
-func (c *DnsServer) processDNSRequest(w dns.ResponseWriter, r *dns.Msg) ([]byte, error) {
+func (c *DnsServer) resolveQuery(r *dns.Msg, info *dnsQueryInfo) (*dns.Msg, error) {
+	// rewrite comes first, so target is blocked, proxied and routed by its own rules
+	if len(r.Question) > 0 && r.Question[0].Qclass == dns.ClassINET {
+		if target, ips, ok := c.getRewriter().match(strings.TrimSuffix(r.Question[0].Name, ".")); ok {
+			return c.resolveRewrite(r, target, ips, info)
+		}
+	}
 	isBlocked := c.applyFilterChain(r)
+	info.blocked = isBlocked
 	log.GetLogger().Debug("Domain filter status", zap.Bool("block", isBlocked))
+	resolveMode := CLIENT_RULE_RESOLVE_DEFAULT
+	if info.rule != nil {
+		if resDns := info.rule.answer(r); resDns != nil {
+			info.resolver = "client-rule"
+			return resDns, nil
+		}
+		resolveMode = info.rule.resolve
+	}
 	for _, q := range r.Question {
 		domainName := strings.TrimSuffix(q.Name, ".")
 		// if its black then do proxy resolve
-		if c.pacMgr.CheckDomain(domainName) {
+		if resolveMode == CLIENT_RULE_RESOLVE_PROXY || (resolveMode == CLIENT_RULE_RESOLVE_DEFAULT && c.pacMgr.CheckQueryDomain(domainName)) {
+			if q.Qtype == dns.TypeAAAA && !c.isIPv6Enabled() {
+				// ipv6 of black domain can not be routed through proxy, so reply empty answer and let client fallback to ipv4
+				resDns := new(dns.Msg)
+				resDns.SetReply(r)
+				info.proxied = true
+				return resDns, nil
+			}
 			if resDns, bRefreshCache := c.checkCache(r); resDns != nil {
 				if bRefreshCache {
-					go c.resolveProxyDNS(r, domainName, isBlocked)
+					go c.resolveProxyDNS(r, domainName, isBlocked, nil)
 				}
-				return c.writeResponse(w, r, resDns, isBlocked)
+				info.proxied = true
+				info.cached = true
+				return resDns, nil
 			}
-			if resDns, err := c.resolveProxyDNS(r, domainName, isBlocked); err == nil {
-				return c.writeResponse(w, r, resDns, isBlocked)
-			} else {
-				return nil, err
+			resDns, err := c.resolveProxyDNS(r, domainName, isBlocked, info)
+			if err != nil && c.isProxyFallbackLocal() {
+				return c.resolveFallbackDNS(r, domainName, info, err)
 			}
+			return resDns, err
 		}
 	}
 
-	if resDns, err := c.resolveLocalDNS(r); err == nil {
-		return c.writeResponse(w, r, resDns, isBlocked)
-	} else {
+	if resDns, bRefreshCache := c.checkLocalCache(r); resDns != nil {
+		if bRefreshCache {
+			go c.refreshLocalCache(r, resolveMode)
+		}
+		c.learnDirect(r, resDns)
+		c.routeListed(r, resDns)
+		c.routeGeoIP(r, resDns)
+		info.cached = true
+		return resDns, nil
+	}
+	resDns, err := c.resolveLocalDNS(r, info)
+	if err != nil {
 		return nil, err
 	}
+	if resolveMode == CLIENT_RULE_RESOLVE_LOCAL {
+		c.addLocalCache(r, resDns)
+		c.learnDirect(r, resDns)
+		c.routeListed(r, resDns)
+		c.routeGeoIP(r, resDns)
+		return resDns, nil
+	}
+	if ip, isBogus := c.getBogusFilter().check(resDns); isBogus && len(r.Question) > 0 {
+		// local answer is poisoned, so treat the domain as black from now on and resolve it through proxy
+		domainName := strings.TrimSuffix(r.Question[0].Name, ".")
+		log.GetLogger().Info("Local DNS answer contains bogus ip, so retry with proxy resolver", zap.String("domain", domainName), zap.String("ip", ip.String()))
+		c.pacMgr.AddDomain(domainName, common.DOMAIN_BLACK_LIST)
+		return c.resolveProxyDNS(r, domainName, isBlocked, info)
+	}
+	c.addLocalCache(r, resDns)
+	c.learnDirect(r, resDns)
+	c.routeListed(r, resDns)
+	c.routeGeoIP(r, resDns)
+	return resDns, nil
+}
+
+func (c *DnsServer) refreshLocalCache(r *dns.Msg, resolveMode string) {
+	resDns, err := c.resolveLocalDNS(r, nil)
+	if err != nil {
+		return
+	}
+	if _, isBogus := c.getBogusFilter().check(resDns); isBogus && resolveMode != CLIENT_RULE_RESOLVE_LOCAL {
+		// let next query go through bogus handling
+		if cache := c.getLocalCache(); cache != nil {
+			cache.del(dnsCacheKey(r.Question[0]))
+		}
+		return
+	}
+	c.addLocalCache(r, resDns)
 }
 
 func (c *DnsServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	if _, err := c.processDNSRequest(w, r); err != nil {
+	if _, err := c.processDNSRequest(w, r, w.RemoteAddr()); err != nil && err != errDnsQueryDropped {
 		log.GetLogger().Error("Server local DNS failed", zap.String("error", err.Error()))
 	}
 }
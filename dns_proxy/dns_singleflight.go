@@ -0,0 +1,81 @@
+package dns_proxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"sync"
+)
+
+type dnsCall struct {
+	wg     sync.WaitGroup
+	resDns *dns.Msg
+	err    error
+	dups   int
+}
+
+// dnsSingleflight coalesces identical in-flight queries into one upstream exchange
+type dnsSingleflight struct {
+	sync.Mutex
+	calls map[string]*dnsCall
+}
+
+func newDnsSingleflight() *dnsSingleflight {
+	return &dnsSingleflight{calls: make(map[string]*dnsCall)}
+}
+
+// singleflightKey identifies queries which can share one answer, name is case sensitive so 0x20 echo is kept
+func singleflightKey(path string, r *dns.Msg) string {
+	if len(r.Question) != 1 {
+		return ""
+	}
+	q := r.Question[0]
+	key := fmt.Sprintf("%s|%s|%d|%d|%v", path, q.Name, q.Qtype, q.Qclass, r.CheckingDisabled)
+	if opt := r.IsEdns0(); opt != nil {
+		key = fmt.Sprintf("%s|%v", key, opt.Do())
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				key = fmt.Sprintf("%s|%s", key, subnet.String())
+			}
+		}
+	}
+	return key
+}
+
+// do runs fn once for concurrent callers with same key, every caller gets its own copy of response
+// since response will be modified when writing back to client
+func (c *dnsSingleflight) do(key string, fn func() (*dns.Msg, error)) (*dns.Msg, error, bool) {
+	if len(key) == 0 {
+		resDns, err := fn()
+		return resDns, err, false
+	}
+	c.Lock()
+	if call, ok := c.calls[key]; ok {
+		call.dups++
+		c.Unlock()
+		call.wg.Wait()
+		if call.err != nil {
+			return nil, call.err, true
+		}
+		return call.resDns.Copy(), nil, true
+	}
+	call := &dnsCall{}
+	call.wg.Add(1)
+	c.calls[key] = call
+	c.Unlock()
+
+	call.resDns, call.err = fn()
+
+	c.Lock()
+	delete(c.calls, key)
+	shared := call.dups > 0
+	c.Unlock()
+	call.wg.Done()
+
+	if call.err != nil {
+		return nil, call.err, shared
+	}
+	if shared {
+		return call.resDns.Copy(), nil, true
+	}
+	return call.resDns, nil, false
+}
@@ -0,0 +1,55 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDnsSingleflight(t *testing.T) {
+	group := newDnsSingleflight()
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	key := singleflightKey("proxy", r)
+
+	var calls int32
+	release := make(chan bool)
+	fn := func() (*dns.Msg, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		resDns := new(dns.Msg)
+		resDns.SetReply(r)
+		return resDns, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*dns.Msg, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _, _ = group.do(key, fn)
+		}(i)
+	}
+	// let every caller join the flight before releasing
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("expect 1 upstream exchange, got %d", calls)
+	}
+	for i := 1; i < len(results); i++ {
+		if results[i] == nil || results[i] == results[0] {
+			t.Errorf("caller %d should get its own copy of response", i)
+		}
+	}
+
+	r2 := r.Copy()
+	r2.Question[0].Qtype = dns.TypeAAAA
+	if singleflightKey("proxy", r2) == key || singleflightKey("local", r) == key {
+		t.Errorf("different qtype or path should not share key")
+	}
+}
@@ -0,0 +1,122 @@
+package dns_proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/weishi258/redfrog-core/common"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"time"
+)
+
+// socks5Resolver sends proxy resolver queries as DNS over TCP through an external SOCKS5 proxy
+type socks5Resolver struct {
+	addr     string
+	username string
+	password string
+}
+
+func newSocks5Resolver(socks5Config config.DnsSocks5Config) *socks5Resolver {
+	if len(socks5Config.Addr) == 0 {
+		return nil
+	}
+	if logger := log.GetLogger(); logger != nil {
+		logger.Info("DNS proxy resolver goes through SOCKS5", zap.String("addr", socks5Config.Addr), zap.Bool("auth", len(socks5Config.Username) > 0))
+	}
+	return &socks5Resolver{addr: socks5Config.Addr, username: socks5Config.Username, password: socks5Config.Password}
+}
+
+func (c *socks5Resolver) handshake(conn net.Conn, target string) error {
+	method := byte(common.SOCKS5_AUTH_NONE)
+	if len(c.username) > 0 {
+		method = common.SOCKS5_AUTH_PASSWORD
+	}
+	if _, err := conn.Write([]byte{common.SOCKS5_VERSION, 1, method}); err != nil {
+		return errors.Wrap(err, "SOCKS5 write greeting failed")
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return errors.Wrap(err, "SOCKS5 read greeting failed")
+	}
+	if reply[0] != common.SOCKS5_VERSION || reply[1] != method {
+		return errors.New(fmt.Sprintf("SOCKS5 server does not accept auth method %d", method))
+	}
+	if method == common.SOCKS5_AUTH_PASSWORD {
+		if len(c.username) > 255 || len(c.password) > 255 {
+			return errors.New("SOCKS5 username or password too long")
+		}
+		auth := []byte{common.SOCKS5_AUTH_PASSWORD_V1, byte(len(c.username))}
+		auth = append(auth, c.username...)
+		auth = append(auth, byte(len(c.password)))
+		auth = append(auth, c.password...)
+		if _, err := conn.Write(auth); err != nil {
+			return errors.Wrap(err, "SOCKS5 write auth failed")
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return errors.Wrap(err, "SOCKS5 read auth failed")
+		}
+		if reply[1] != 0 {
+			return errors.New("SOCKS5 auth rejected")
+		}
+	}
+
+	targetAddr := socks.ParseAddr(target)
+	if targetAddr == nil {
+		return errors.New(fmt.Sprintf("SOCKS5 target address %s invalid", target))
+	}
+	request := append([]byte{common.SOCKS5_VERSION, common.SOCKS5_CMD_CONNECT, 0}, targetAddr...)
+	if _, err := conn.Write(request); err != nil {
+		return errors.Wrap(err, "SOCKS5 write connect failed")
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return errors.Wrap(err, "SOCKS5 read connect reply failed")
+	}
+	if header[1] != common.SOCKS5_REPLY_SUCCEEDED {
+		return errors.New(fmt.Sprintf("SOCKS5 connect %s failed with reply %d", target, header[1]))
+	}
+	// bound address is not used
+	if _, err := socks.ReadAddr(conn); err != nil {
+		return errors.Wrap(err, "SOCKS5 read bound address failed")
+	}
+	return nil
+}
+
+// exchange sends packed query to resolver through SOCKS5 tunnel, DNS over TCP framing as RFC 1035 4.2.2
+func (c *socks5Resolver) exchange(resolverAddr string, data []byte, timeout time.Duration) (*dns.Msg, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, timeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "SOCKS5 dial %s failed", c.addr)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err = c.handshake(conn, resolverAddr); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(payload, uint16(len(data)))
+	copy(payload[2:], data)
+	if _, err = conn.Write(payload); err != nil {
+		return nil, errors.Wrap(err, "SOCKS5 write DNS query failed")
+	}
+	length := make([]byte, 2)
+	if _, err = io.ReadFull(conn, length); err != nil {
+		return nil, errors.Wrap(err, "SOCKS5 read DNS response failed")
+	}
+	buffer := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err = io.ReadFull(conn, buffer); err != nil {
+		return nil, errors.Wrap(err, "SOCKS5 read DNS response failed")
+	}
+	response := new(dns.Msg)
+	if err = response.Unpack(buffer); err != nil {
+		return nil, errors.Wrap(err, "Unpack DNS response from SOCKS5 failed")
+	}
+	return response, nil
+}
@@ -0,0 +1,72 @@
+package dns_proxy
+
+import (
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/weishi258/redfrog-core/common"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeSocks5DNS accepts one SOCKS5 connect with password auth and answers one DNS query
+func fakeSocks5DNS(t *testing.T, listener net.Listener, target chan string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	buf := make([]byte, 512)
+	io.ReadFull(conn, buf[:3])
+	conn.Write([]byte{common.SOCKS5_VERSION, common.SOCKS5_AUTH_PASSWORD})
+	io.ReadFull(conn, buf[:2])
+	userLen := int(buf[1])
+	io.ReadFull(conn, buf[:userLen+1])
+	io.ReadFull(conn, buf[:int(buf[userLen])])
+	conn.Write([]byte{1, 0})
+	io.ReadFull(conn, buf[:3])
+	addr, _ := socks.ReadAddr(conn)
+	target <- addr.String()
+	conn.Write(append([]byte{common.SOCKS5_VERSION, common.SOCKS5_REPLY_SUCCEEDED, 0}, socks.ParseAddr("127.0.0.1:0")...))
+
+	io.ReadFull(conn, buf[:2])
+	query := make([]byte, binary.BigEndian.Uint16(buf))
+	io.ReadFull(conn, query)
+	r := new(dns.Msg)
+	r.Unpack(query)
+	resDns := new(dns.Msg)
+	resDns.SetReply(r)
+	rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+	resDns.Answer = append(resDns.Answer, rr)
+	data, _ := resDns.Pack()
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(data)))
+	conn.Write(append(length, data...))
+}
+
+func TestSocks5Resolver(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err.Error())
+	}
+	defer listener.Close()
+	target := make(chan string, 1)
+	go fakeSocks5DNS(t, listener, target)
+
+	resolver := &socks5Resolver{addr: listener.Addr().String(), username: "user", password: "pass"}
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	data, _ := r.Pack()
+	resDns, err := resolver.exchange("8.8.8.8:53", data, 2*time.Second)
+	if err != nil {
+		t.Fatalf("exchange through SOCKS5 failed: %s", err.Error())
+	}
+	if addr := <-target; addr != "8.8.8.8:53" {
+		t.Errorf("SOCKS5 connect target got %s", addr)
+	}
+	if len(resDns.Answer) != 1 || resDns.Id != r.Id {
+		t.Errorf("DNS response through SOCKS5 is wrong: %v", resDns)
+	}
+}
@@ -0,0 +1,84 @@
+package dns_proxy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"net"
+)
+
+const (
+	// miekg/dns in use does not know these types yet, so they come as RFC3597 generic records
+	DNS_TYPE_SVCB  = 64
+	DNS_TYPE_HTTPS = 65
+
+	SVCB_KEY_IPV4HINT = 4
+	SVCB_KEY_IPV6HINT = 6
+)
+
+// svcbRecord holds the parts of SVCB/HTTPS rdata we care about
+type svcbRecord struct {
+	priority uint16
+	target   string
+	hints    []net.IP
+}
+
+func init() {
+	dns.TypeToString[DNS_TYPE_SVCB] = "SVCB"
+	dns.TypeToString[DNS_TYPE_HTTPS] = "HTTPS"
+}
+
+// parseSvcb parses rdata of SVCB/HTTPS record as RFC 9460, target name is never compressed
+func parseSvcb(rdata []byte) (*svcbRecord, error) {
+	if len(rdata) < 3 {
+		return nil, errors.New("SVCB rdata too short")
+	}
+	ret := &svcbRecord{priority: binary.BigEndian.Uint16(rdata)}
+	target, off, err := dns.UnpackDomainName(rdata, 2)
+	if err != nil {
+		return nil, errors.Wrap(err, "SVCB target name invalid")
+	}
+	ret.target = target
+	for off < len(rdata) {
+		if off+4 > len(rdata) {
+			return nil, errors.New("SVCB param header truncated")
+		}
+		key := binary.BigEndian.Uint16(rdata[off:])
+		length := int(binary.BigEndian.Uint16(rdata[off+2:]))
+		off += 4
+		if off+length > len(rdata) {
+			return nil, errors.New("SVCB param value truncated")
+		}
+		value := rdata[off : off+length]
+		off += length
+		switch key {
+		case SVCB_KEY_IPV4HINT:
+			for i := 0; i+net.IPv4len <= len(value); i += net.IPv4len {
+				ret.hints = append(ret.hints, net.IP(append([]byte{}, value[i:i+net.IPv4len]...)))
+			}
+		case SVCB_KEY_IPV6HINT:
+			for i := 0; i+net.IPv6len <= len(value); i += net.IPv6len {
+				ret.hints = append(ret.hints, net.IP(append([]byte{}, value[i:i+net.IPv6len]...)))
+			}
+		}
+	}
+	return ret, nil
+}
+
+// svcbFromRR returns parsed record if rr is SVCB or HTTPS
+func svcbFromRR(rr dns.RR) (*svcbRecord, bool) {
+	generic, ok := rr.(*dns.RFC3597)
+	if !ok || (generic.Hdr.Rrtype != DNS_TYPE_SVCB && generic.Hdr.Rrtype != DNS_TYPE_HTTPS) {
+		return nil, false
+	}
+	rdata, err := hex.DecodeString(generic.Rdata)
+	if err != nil {
+		return nil, false
+	}
+	record, err := parseSvcb(rdata)
+	if err != nil {
+		return nil, false
+	}
+	return record, true
+}
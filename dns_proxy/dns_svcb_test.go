@@ -0,0 +1,38 @@
+package dns_proxy
+
+import (
+	"encoding/hex"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestSvcbHints(t *testing.T) {
+	rdata := []byte{0, 1}
+	// target "."
+	rdata = append(rdata, 0)
+	// alpn h2
+	rdata = append(rdata, 0, 1, 0, 3, 2, 'h', '2')
+	// ipv4hint 192.0.2.1, 192.0.2.2
+	rdata = append(rdata, 0, 4, 0, 8, 192, 0, 2, 1, 192, 0, 2, 2)
+	// ipv6hint 2001:db8::1
+	rdata = append(rdata, 0, 6, 0, 16)
+	rdata = append(rdata, net.ParseIP("2001:db8::1")...)
+
+	rr := &dns.RFC3597{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: DNS_TYPE_HTTPS, Class: dns.ClassINET, Ttl: 60}, Rdata: hex.EncodeToString(rdata)}
+	record, ok := svcbFromRR(rr)
+	if !ok {
+		t.Fatalf("parse HTTPS record failed")
+	}
+	if record.priority != 1 || record.target != "." || len(record.hints) != 3 {
+		t.Fatalf("HTTPS record parsed wrong: %+v", record)
+	}
+	if !record.hints[1].Equal(net.ParseIP("192.0.2.2")) || !record.hints[2].Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("HTTPS hints parsed wrong: %v", record.hints)
+	}
+
+	// truncated param must be rejected instead of read past the end
+	if _, err := parseSvcb(rdata[:len(rdata)-4]); err == nil {
+		t.Errorf("truncated rdata should fail")
+	}
+}
@@ -0,0 +1,26 @@
+package dns_proxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+// clientUDPSize returns max UDP payload client can take, 512 if it did not advertise with EDNS0
+func clientUDPSize(r *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	return size
+}
+
+// truncateForUDP returns response fit in client UDP payload size with TC bit set when cut, so client retries with TCP
+// original response is left untouched since it may be shared by cache, Truncate tries compression before cutting
+func truncateForUDP(r *dns.Msg, resDns *dns.Msg) *dns.Msg {
+	size := clientUDPSize(r)
+	if resDns.Len() <= size {
+		return resDns
+	}
+	ret := resDns.Copy()
+	ret.Truncate(size)
+	return ret
+}
@@ -0,0 +1,50 @@
+package dns_proxy
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestTruncateForUDP(t *testing.T) {
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.com.", dns.TypeTXT)
+	resDns := new(dns.Msg)
+	resDns.SetReply(r)
+	for i := 0; i < 20; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("www.example.com. 60 IN TXT \"%080d\"", i))
+		resDns.Answer = append(resDns.Answer, rr)
+	}
+
+	ret := truncateForUDP(r, resDns)
+	if !ret.Truncated || ret.Len() > dns.MinMsgSize {
+		t.Errorf("response should be truncated to %d, got %d bytes, tc %v", dns.MinMsgSize, ret.Len(), ret.Truncated)
+	}
+	if resDns.Truncated || len(resDns.Answer) != 20 {
+		t.Errorf("original response should not be modified")
+	}
+
+	r.SetEdns0(4096, false)
+	if ret = truncateForUDP(r, resDns); ret != resDns {
+		t.Errorf("response fits advertised size should be returned as is")
+	}
+
+	// too big only without compression
+	r = new(dns.Msg)
+	r.SetQuestion("a-rather-long-host-name.example.com.", dns.TypeA)
+	resDns = new(dns.Msg)
+	resDns.SetReply(r)
+	for i := 1; i <= 20; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("a-rather-long-host-name.example.com. 60 IN A 192.0.2.%d", i))
+		resDns.Answer = append(resDns.Answer, rr)
+	}
+	if resDns.Len() <= dns.MinMsgSize {
+		t.Fatalf("uncompressed response should not fit, got %d bytes", resDns.Len())
+	}
+	if ret = truncateForUDP(r, resDns); ret.Truncated || len(ret.Answer) != 20 || !ret.Compress || ret.Len() > dns.MinMsgSize {
+		t.Errorf("compression should make response fit, got %d answers, %d bytes, tc %v", len(ret.Answer), ret.Len(), ret.Truncated)
+	}
+	if resDns.Compress {
+		t.Errorf("original response should not be modified")
+	}
+}
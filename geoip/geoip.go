@@ -0,0 +1,312 @@
+// Package geoip looks up country of ip in a MaxMind DB file, e.g. GeoLite2-Country.mmdb
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// metadata follows the last occurrence of this marker
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// data section starts after search tree and 16 zero bytes
+const dataSectionSeparator = 16
+
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// Reader holds whole database in memory, it is safe for concurrent lookups
+type Reader struct {
+	buf        []byte
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// node where ipv4 addresses start in ipv6 tree
+	ipv4Start uint
+}
+
+// Open reads database file
+func Open(path string) (*Reader, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Read GeoIP database %s failed", path)
+	}
+	return FromBytes(buf)
+}
+
+// FromBytes parses database content
+func FromBytes(buf []byte) (*Reader, error) {
+	markerIndex := bytes.LastIndex(buf, metadataMarker)
+	if markerIndex < 0 {
+		return nil, errors.New("Invalid GeoIP database, metadata not found")
+	}
+	metadataStart := markerIndex + len(metadataMarker)
+	metadata, _, err := (&Reader{data: buf[metadataStart:]}).decode(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "Decode GeoIP metadata failed")
+	}
+	fields, ok := metadata.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Invalid GeoIP metadata")
+	}
+	ret := &Reader{buf: buf}
+	ret.nodeCount = toUint(fields["node_count"])
+	ret.recordSize = toUint(fields["record_size"])
+	ret.ipVersion = toUint(fields["ip_version"])
+	if ret.recordSize != 24 && ret.recordSize != 28 && ret.recordSize != 32 {
+		return nil, errors.Errorf("Unsupported GeoIP record size %d", ret.recordSize)
+	}
+	if ret.ipVersion != 4 && ret.ipVersion != 6 {
+		return nil, errors.Errorf("Unsupported GeoIP ip version %d", ret.ipVersion)
+	}
+	treeSize := int(ret.nodeCount * ret.recordSize / 4)
+	if treeSize+dataSectionSeparator > markerIndex {
+		return nil, errors.New("Invalid GeoIP database, search tree is truncated")
+	}
+	ret.tree = buf[:treeSize]
+	ret.data = buf[treeSize+dataSectionSeparator : markerIndex]
+	if ret.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < ret.nodeCount; i++ {
+			node = ret.readNode(node, 0)
+		}
+		ret.ipv4Start = node
+	}
+	return ret, nil
+}
+
+func toUint(value interface{}) uint {
+	switch v := value.(type) {
+	case uint64:
+		return uint(v)
+	case uint32:
+		return uint(v)
+	case uint16:
+		return uint(v)
+	}
+	return 0
+}
+
+// readNode returns left record of node for bit 0 and right one for bit 1
+func (c *Reader) readNode(node uint, bit uint) uint {
+	switch c.recordSize {
+	case 24:
+		offset := node*6 + bit*3
+		b := c.tree[offset : offset+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := c.tree[node*7 : node*7+7]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		offset := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(c.tree[offset : offset+4]))
+	}
+}
+
+// Lookup returns record of ip, nil if ip is not in database
+func (c *Reader) Lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	bitCount := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bitCount = 32
+		node = c.ipv4Start
+	} else if c.ipVersion == 4 {
+		return nil, nil
+	} else if ip = ip.To16(); ip == nil {
+		return nil, errors.New("Invalid ip")
+	}
+	for i := 0; i < bitCount && node < c.nodeCount; i++ {
+		node = c.readNode(node, uint(ip[i>>3]>>(7-uint(i&7)))&1)
+	}
+	if node == c.nodeCount {
+		return nil, nil
+	}
+	if node < c.nodeCount {
+		return nil, errors.New("Invalid GeoIP database, search tree is too deep")
+	}
+	offset := node - c.nodeCount - dataSectionSeparator
+	if offset >= uint(len(c.data)) {
+		return nil, errors.New("Invalid GeoIP database, record is out of data section")
+	}
+	value, _, err := c.decode(offset)
+	return value, err
+}
+
+// Country returns ISO code of country ip is located in, or registered in if location is unknown, empty if ip is not
+// in database
+func (c *Reader) Country(ip net.IP) (string, error) {
+	record, err := c.Lookup(ip)
+	if err != nil || record == nil {
+		return "", err
+	}
+	fields, _ := record.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := fields[key].(map[string]interface{}); ok {
+			if code, ok := country["iso_code"].(string); ok {
+				return code, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// decode returns value at offset of data section and offset following it
+func (c *Reader) decode(offset uint) (value interface{}, next uint, err error) {
+	if offset >= uint(len(c.data)) {
+		return nil, 0, errors.New("Unexpected end of GeoIP data")
+	}
+	ctrl := c.data[offset]
+	offset++
+	dataType := uint(ctrl >> 5)
+	if dataType == typePointer {
+		pointer, next, err := c.decodePointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err = c.decode(pointer)
+		return value, next, err
+	}
+	if dataType == typeExtended {
+		if offset >= uint(len(c.data)) {
+			return nil, 0, errors.New("Unexpected end of GeoIP data")
+		}
+		dataType = 7 + uint(c.data[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		if offset+extra > uint(len(c.data)) {
+			return nil, 0, errors.New("Unexpected end of GeoIP data")
+		}
+		n := uint(0)
+		for _, b := range c.data[offset : offset+extra] {
+			n = n<<8 | uint(b)
+		}
+		offset += extra
+		switch size {
+		case 29:
+			size = 29 + n
+		case 30:
+			size = 285 + n
+		default:
+			size = 65821 + n
+		}
+	}
+
+	switch dataType {
+	case typeMap:
+		ret := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, item interface{}
+			if key, offset, err = c.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			if item, offset, err = c.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			keyStr, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("Invalid GeoIP map key")
+			}
+			ret[keyStr] = item
+		}
+		return ret, offset, nil
+	case typeArray:
+		ret := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var item interface{}
+			if item, offset, err = c.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			ret = append(ret, item)
+		}
+		return ret, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	case typeContainer, typeEndMarker:
+		return nil, offset, nil
+	}
+
+	if offset+size > uint(len(c.data)) {
+		return nil, 0, errors.New("Unexpected end of GeoIP data")
+	}
+	payload := c.data[offset : offset+size]
+	next = offset + size
+	switch dataType {
+	case typeString:
+		return string(payload), next, nil
+	case typeBytes:
+		return payload, next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("Invalid GeoIP double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("Invalid GeoIP float")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(payload)), next, nil
+	case typeUint16, typeUint32, typeUint64, typeInt32:
+		n := uint64(0)
+		for _, b := range payload {
+			n = n<<8 | uint64(b)
+		}
+		if dataType == typeInt32 {
+			return int32(n), next, nil
+		}
+		return n, next, nil
+	case typeUint128:
+		// only kept as raw bytes, no rule needs its value
+		return payload, next, nil
+	}
+	return nil, 0, errors.Errorf("Unknown GeoIP data type %d", dataType)
+}
+
+func (c *Reader) decodePointer(ctrl byte, offset uint) (pointer uint, next uint, err error) {
+	size := uint(ctrl>>3)&0x3 + 1
+	if offset+size > uint(len(c.data)) {
+		return 0, 0, errors.New("Unexpected end of GeoIP data")
+	}
+	n := uint(0)
+	if size < 4 {
+		n = uint(ctrl & 0x7)
+	}
+	for _, b := range c.data[offset : offset+size] {
+		n = n<<8 | uint(b)
+	}
+	switch size {
+	case 2:
+		n += 2048
+	case 3:
+		n += 526336
+	}
+	return n, offset + size, nil
+}
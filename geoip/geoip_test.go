@@ -0,0 +1,123 @@
+package geoip
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// encodeString and encodeMap write the subset of data section format test database needs
+func encodeString(s string) []byte {
+	return append([]byte{byte(typeString<<5 | len(s))}, s...)
+}
+
+func encodeUint16(n int) []byte {
+	return []byte{byte(typeUint16<<5 | 2), byte(n >> 8), byte(n)}
+}
+
+func encodeMap(pairs ...[]byte) []byte {
+	ret := []byte{byte(typeMap<<5 | len(pairs)/2)}
+	for _, pair := range pairs {
+		ret = append(ret, pair...)
+	}
+	return ret
+}
+
+func countryRecord(code string) []byte {
+	return encodeMap(encodeString("country"), encodeMap(encodeString("iso_code"), encodeString(code)))
+}
+
+// buildDatabase builds ipv6 database with 24 bit records, networks map CIDR to country
+func buildDatabase(t *testing.T, networks map[string]string) []byte {
+	nodes := [][2]int{{-1, -1}}
+	data := make([]byte, 0)
+	// leaf records hold negative data offset until node count is known
+	leaves := make(map[string]int)
+	for cidr, code := range networks {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := ipNet.IP.To16()
+		ones, _ := ipNet.Mask.Size()
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			// ipv4 lives in ::/96 of ipv6 database
+			ip = append(make(net.IP, 12), ip4...)
+			ones += 96
+		}
+		if _, ok := leaves[code]; !ok {
+			leaves[code] = len(data)
+			data = append(data, countryRecord(code)...)
+		}
+		node := 0
+		for i := 0; i < ones-1; i++ {
+			bit := ip[i>>3] >> (7 - uint(i&7)) & 1
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+		bit := ip[(ones-1)>>3] >> (7 - uint((ones-1)&7)) & 1
+		nodes[node][bit] = -2 - leaves[code]
+	}
+	nodeCount := len(nodes)
+	tree := make([]byte, 0, nodeCount*6)
+	for _, node := range nodes {
+		for _, record := range node {
+			value := nodeCount
+			if record >= 0 {
+				value = record
+			} else if record <= -2 {
+				value = nodeCount + dataSectionSeparator + (-2 - record)
+			}
+			tree = append(tree, byte(value>>16), byte(value>>8), byte(value))
+		}
+	}
+	metadata := encodeMap(encodeString("node_count"), []byte{byte(typeUint32<<5 | 2), byte(nodeCount >> 8), byte(nodeCount)},
+		encodeString("record_size"), encodeUint16(24), encodeString("ip_version"), encodeUint16(6))
+	ret := append(tree, make([]byte, dataSectionSeparator)...)
+	ret = append(ret, data...)
+	ret = append(ret, metadataMarker...)
+	return append(ret, metadata...)
+}
+
+func TestCountry(t *testing.T) {
+	reader, err := FromBytes(buildDatabase(t, map[string]string{
+		"1.0.1.0/24":     "CN",
+		"8.8.8.0/24":     "US",
+		"240e::/20":      "CN",
+		"2001:4860::/32": "US",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, expected := range map[string]string{
+		"1.0.1.1":              "CN",
+		"8.8.8.8":              "US",
+		"8.8.9.8":              "",
+		"240e:1::1":            "CN",
+		"2001:4860:4860::8888": "US",
+		"2001:db8::1":          "",
+	} {
+		if code, err := reader.Country(net.ParseIP(ip)); err != nil || code != expected {
+			t.Errorf("Country(%s) got %q %v, expected %q", ip, code, err, expected)
+		}
+	}
+}
+
+func TestPointerAndLongString(t *testing.T) {
+	long := bytes.Repeat([]byte("a"), 300)
+	// size 30 takes two more bytes, 285 added
+	data := append([]byte{byte(typeString<<5 | 30), byte((300 - 285) >> 8), byte(300 - 285)}, long...)
+	// pointer back to offset 0
+	pointerOffset := uint(len(data))
+	data = append(data, byte(typePointer<<5), 0)
+	reader := &Reader{data: data}
+	if value, next, err := reader.decode(pointerOffset); err != nil || value != string(long) || next != pointerOffset+2 {
+		t.Errorf("decode pointer got len %d next %d err %v", len(value.(string)), next, err)
+	}
+	if _, err := FromBytes([]byte("not a database")); err == nil {
+		t.Error("invalid database should fail")
+	}
+}
@@ -17,9 +17,10 @@ require (
 	github.com/vishvananda/netns v0.0.0-20191106174202-0a2b9b5464df // indirect
 	github.com/weishi258/go-iptables v0.4.1
 	github.com/weishi258/kcp-go-ng v0.0.0-20191205054520-39a714713c69
-	github.com/xtaci/smux v1.4.6
+	github.com/xtaci/smux v1.5.12
 	go.uber.org/zap v1.13.0
 	golang.org/x/crypto v0.0.0-20191202143827-86a70503ff7e
+	golang.org/x/net v0.0.0-20191204025024-5ee1b9f4859a
 	golang.org/x/sys v0.0.0-20191204072324-ce4227a45e2e
 	gopkg.in/airbrake/gobrake.v2 v2.0.9 // indirect
 	gopkg.in/gemnasium/logrus-airbrake-hook.v2 v2.1.2 // indirect
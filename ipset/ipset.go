@@ -4,6 +4,7 @@ package ipset
 import (
 	"errors"
 	"fmt"
+	"net"
 	"os/exec"
 	"regexp"
 	"strconv"
@@ -117,11 +118,12 @@ func (s *IPSet) Refresh(entries []string) error {
 	if err != nil {
 		return err
 	}
-	for _, entry := range entries {
-		out, err := exec.Command(ipsetPath, "add", tempName, entry, "-exist").CombinedOutput()
-		if err != nil {
-			log.Errorf("error adding entry %s to set %s: %v (%s)", entry, tempName, err, out)
+	if err = restore(tempName, "add", entries, ""); err != nil {
+		// keep serving the old set rather than swapping in a partly filled one
+		if destroyErr := destroyIPSet(tempName); destroyErr != nil {
+			log.Errorf("error destroying set %s: %v", tempName, destroyErr)
 		}
+		return err
 	}
 	err = Swap(tempName, s.Name)
 	if err != nil {
@@ -171,6 +173,66 @@ func (s *IPSet) AddOption(entry string, option string, timeout int) error {
 	return nil
 }
 
+// AddList is used to add the specified entries to the set in one batch.
+// A timeout of 0 means that the entries will be stored permanently in the set.
+func (s *IPSet) AddList(entries []string, timeout int) error {
+	return restore(s.Name, "add", entries, "timeout "+strconv.Itoa(timeout))
+}
+
+// DelList is used to delete the specified entries from the set in one batch.
+func (s *IPSet) DelList(entries []string) error {
+	return restore(s.Name, "del", entries, "")
+}
+
+// restore feeds one command per entry to a single ipset process, which is much faster than one exec per entry
+// when the set is loaded with thousands of entries.
+func restore(name string, command string, entries []string, option string) error {
+	script, count := restoreScript(name, command, entries, option)
+	if count == 0 {
+		return nil
+	}
+	cmd := exec.Command(ipsetPath, "restore", "-exist")
+	cmd.Stdin = strings.NewReader(script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error running %s of %d entries on set %s: %v (%s)", command, count, name, err, out)
+	}
+	return nil
+}
+
+// restoreScript builds the ipset restore input for entries and returns how many lines it has. ipset restore stops
+// at the first bad line, so entries which are not an ip or cidr are skipped here.
+func restoreScript(name string, command string, entries []string, option string) (string, int) {
+	var script strings.Builder
+	count := 0
+	for _, entry := range entries {
+		if !validEntry(entry) {
+			log.Warnf("skip invalid entry %q of set %s", entry, name)
+			continue
+		}
+		script.WriteString(command)
+		script.WriteByte(' ')
+		script.WriteString(name)
+		script.WriteByte(' ')
+		script.WriteString(entry)
+		if len(option) > 0 {
+			script.WriteByte(' ')
+			script.WriteString(option)
+		}
+		script.WriteByte('\n')
+		count++
+	}
+	return script.String(), count
+}
+
+func validEntry(entry string) bool {
+	if net.ParseIP(entry) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(entry)
+	return err == nil
+}
+
 // Del is used to delete the specified entry from the set.
 func (s *IPSet) Del(entry string) error {
 	out, err := exec.Command(ipsetPath, "del", s.Name, entry, "-exist").CombinedOutput()
@@ -219,6 +281,26 @@ func DestroyAll() error {
 	return nil
 }
 
+// ListNames returns names of all existing sets.
+func ListNames() ([]string, error) {
+	if err := initCheck(); err != nil {
+		return nil, err
+	}
+	out, err := exec.Command(ipsetPath, "list", "-n").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("error listing set names: %v (%s)", err, out)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// DestroyByName is used to destroy a set which has no IPSet, e.g. one left by another process.
+func DestroyByName(name string) error {
+	if err := initCheck(); err != nil {
+		return err
+	}
+	return destroyIPSet(name)
+}
+
 // Swap is used to hot swap two sets on-the-fly. Use with names of existing sets of the same type.
 func Swap(from, to string) error {
 	out, err := exec.Command(ipsetPath, "swap", from, to).Output()
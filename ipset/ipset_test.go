@@ -0,0 +1,23 @@
+package ipset
+
+import (
+	"testing"
+)
+
+func TestRestoreScript(t *testing.T) {
+	entries := []string{"1.1.1.1", "bad entry", "10.0.0.0/8", "2404:6800::1", "1.1.1.1\nflush", "300.1.1.1", "2404:6800::/32"}
+	script, count := restoreScript("redfrog", "add", entries, "timeout 0")
+	expected := "add redfrog 1.1.1.1 timeout 0\n" +
+		"add redfrog 10.0.0.0/8 timeout 0\n" +
+		"add redfrog 2404:6800::1 timeout 0\n" +
+		"add redfrog 2404:6800::/32 timeout 0\n"
+	if script != expected || count != 4 {
+		t.Errorf("unexpected script of %d lines:\n%s", count, script)
+	}
+	if script, count = restoreScript("redfrog", "del", []string{"1.1.1.1"}, ""); script != "del redfrog 1.1.1.1\n" || count != 1 {
+		t.Errorf("unexpected script of %d lines:\n%s", count, script)
+	}
+	if script, count = restoreScript("redfrog", "add", []string{"bad"}, ""); script != "" || count != 0 {
+		t.Errorf("script of invalid entries should be empty, got %q", script)
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"github.com/golang/snappy"
 	"github.com/pkg/errors"
 	"github.com/weishi258/kcp-go-ng"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/xtaci/smux"
 	"golang.org/x/crypto/pbkdf2"
 	"net"
+	"time"
 )
 
 func GetCipher(name string, password string) (ret kcp.AheadCipher, err error) {
@@ -58,6 +61,40 @@ func (c *CompStream) Close() error {
 	return c.conn.Close()
 }
 
+// GetSmuxConfig builds smux config of kcptun block, used by both client and server
+func GetSmuxConfig(kcpConfig config.KcptunConfig) (*smux.Config, error) {
+	ret := smux.DefaultConfig()
+	if kcpConfig.SmuxVersion > 0 {
+		ret.Version = kcpConfig.SmuxVersion
+	}
+	ret.MaxReceiveBuffer = kcpConfig.Sockbuf
+	if kcpConfig.MaxReceiveBuffer > 0 {
+		ret.MaxReceiveBuffer = kcpConfig.MaxReceiveBuffer
+	}
+	if kcpConfig.MaxStreamBuffer > 0 {
+		ret.MaxStreamBuffer = kcpConfig.MaxStreamBuffer
+	}
+	ret.KeepAliveInterval = time.Duration(kcpConfig.KeepAliveInterval) * time.Second
+	ret.KeepAliveTimeout = time.Duration(kcpConfig.KeepAliveTimeout) * time.Second
+	if err := smux.VerifyConfig(ret); err != nil {
+		return nil, errors.Wrap(err, "Invalid smux config")
+	}
+	return ret, nil
+}
+
+// KCP_MODES are presets from least to most aggressive retransmission
+var KCP_MODES = []string{"normal", "fast", "fast2", "fast3"}
+
+// ModeIndex returns position of mode in KCP_MODES, -1 for manual mode
+func ModeIndex(mode string) int {
+	for idx, m := range KCP_MODES {
+		if m == mode {
+			return idx
+		}
+	}
+	return -1
+}
+
 //
 func GetModeSetting(mode string, noDelay, interval, resend, noCongestion int) (int, int, int, int) {
 	switch mode {
@@ -0,0 +1,105 @@
+package log
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"sync"
+)
+
+// RotateWriter is a size based rotating file writer, backups are named as path.1, path.2 ... with path.1 the newest
+type RotateWriter struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+	// set by Close, file is nil then but must not be opened again
+	closed bool
+}
+
+func NewRotateWriter(path string, maxSize int64, maxBackups int) (ret *RotateWriter, err error) {
+	ret = &RotateWriter{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err = ret.open(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (c *RotateWriter) open() (err error) {
+	if c.file, err = os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return errors.Wrapf(err, "Open log file %s failed", c.path)
+	}
+	var info os.FileInfo
+	if info, err = c.file.Stat(); err != nil {
+		c.file.Close()
+		c.file = nil
+		return errors.Wrapf(err, "Stat log file %s failed", c.path)
+	}
+	c.size = info.Size()
+	return nil
+}
+
+func (c *RotateWriter) rotate() error {
+	if err := c.file.Close(); err != nil {
+		return errors.Wrapf(err, "Close log file %s failed", c.path)
+	}
+	c.file = nil
+	if c.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", c.path, c.maxBackups))
+		for i := c.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", c.path, i), fmt.Sprintf("%s.%d", c.path, i+1))
+		}
+		if err := os.Rename(c.path, fmt.Sprintf("%s.1", c.path)); err != nil {
+			return errors.Wrapf(err, "Rotate log file %s failed", c.path)
+		}
+	} else if err := os.Remove(c.path); err != nil {
+		return errors.Wrapf(err, "Remove log file %s failed", c.path)
+	}
+	return c.open()
+}
+
+func (c *RotateWriter) Write(p []byte) (n int, err error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return 0, errors.Errorf("Log file %s is closed", c.path)
+	}
+	if c.file == nil {
+		// failed rotation left no file
+		if err = c.open(); err != nil {
+			return
+		}
+	}
+	if c.maxSize > 0 && c.size+int64(len(p)) > c.maxSize && c.size > 0 {
+		if err = c.rotate(); err != nil {
+			return
+		}
+	}
+	n, err = c.file.Write(p)
+	c.size += int64(n)
+	return
+}
+
+func (c *RotateWriter) Sync() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	return c.file.Sync()
+}
+
+func (c *RotateWriter) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
@@ -0,0 +1,49 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotateWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "redfrog.log")
+	writer, err := NewRotateWriter(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"line 1\n", "line 2\n", "line 3\n", "line 4\n"} {
+		if _, err = writer.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// each line exceeds max size with the one before, only max backups are kept
+	for path, expected := range map[string]string{path: "line 4\n", path + ".1": "line 3\n", path + ".2": "line 2\n"} {
+		if data, err := ioutil.ReadFile(path); err != nil || string(data) != expected {
+			t.Errorf("%s got %q, expected %q", path, data, expected)
+		}
+	}
+	if _, err = os.Stat(fmt.Sprintf("%s.3", path)); !os.IsNotExist(err) {
+		t.Errorf("backup over max backups should be removed")
+	}
+
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = writer.Write([]byte("line 5\n")); err == nil {
+		t.Errorf("write after close should fail")
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "line 4\n" {
+		t.Errorf("write after close should not reopen file, got %q", data)
+	}
+	if err = writer.Close(); err != nil {
+		t.Errorf("close twice should be no op, got %v", err)
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/pkg/errors"
 	. "github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/control"
 	"github.com/weishi258/redfrog-core/dns_proxy"
 	"github.com/weishi258/redfrog-core/log"
 	"github.com/weishi258/redfrog-core/pac"
@@ -12,10 +14,12 @@ import (
 	"github.com/weishi258/redfrog-core/routing"
 	"go.uber.org/zap"
 	"math/rand"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -133,29 +137,40 @@ func StartService(configFile string) {
 		logger.Info("Read config file successful", zap.String("file", configFile))
 	}
 
-	if err = addTProxyRoutingIPv4(config.PacketMask, strconv.Itoa(config.RoutingTable)); err != nil {
-		logger.Error("Add TProxy ipv4 route failed", zap.String("error", err.Error()))
-		return
-	}
-	if err = addTProxyRoutingIPv6(config.PacketMask, strconv.Itoa(config.RoutingTable)); err != nil {
-		logger.Error("Add TProxy ipv6 route failed", zap.String("error", err.Error()))
-		return
+	if config.RoutingDryRun {
+		logger.Warn("Routing dry run, interception is not set up, changes are only logged")
+	} else {
+		if err = addTProxyRoutingIPv4(config.PacketMask, strconv.Itoa(config.RoutingTable)); err != nil {
+			logger.Error("Add TProxy ipv4 route failed", zap.String("error", err.Error()))
+			return
+		}
+		if err = addTProxyRoutingIPv6(config.PacketMask, strconv.Itoa(config.RoutingTable)); err != nil {
+			logger.Error("Add TProxy ipv6 route failed", zap.String("error", err.Error()))
+			return
+		}
 	}
 	// init routing mgr
 	var routingMgr *routing.RoutingMgr
-	if routingMgr, err = routing.StartRoutingMgr(config.ListenPort, config.PacketMask, config.RoutingTable, config.IgnoreIP, config.Interface, config.IPSet); err != nil {
+	if routingMgr, err = routing.StartRoutingMgr(config.ListenPort, config.PacketMask, config.Shadowsocks.OutboundMark, config.RoutingTable, append(config.IgnoreIP, config.IgnoreIPv6...), config.Interface, config.IncludeSource, config.ExcludeSource, config.IPSet, config.EBPF, config.PacWhitelist, config.RoutingDryRun); err != nil {
 		logger.Error("Start routing manager failed", zap.String("error", err.Error()))
 		return
 	}
 	defer routingMgr.Stop()
+	routingMgr.SetRouteTTLFloor(config.RouteTTLFloor)
+	routingMgr.SetPersistInterval(config.RoutePersistInterval)
+	if err = routingMgr.LoadDirectList(config.DirectList); err != nil {
+		logger.Error("Load direct list failed", zap.String("error", err.Error()))
+	}
 
 	// init pac list
 	var pacListMgr *pac.PacListMgr
-	if pacListMgr, err = pac.StartPacListMgr(routingMgr); err != nil {
+	if pacListMgr, err = pac.StartPacListMgr(routingMgr, config.PacCache, config.PacRefresh, config.PacWatch); err != nil {
 		logger.Error("Start pac list manager failed", zap.String("error", err.Error()))
 	}
 	defer pacListMgr.Stop()
-	pacListMgr.ReadPacList(config.PacList)
+	if err = pacListMgr.LoadGeoIP(config.GeoIPDatabase); err != nil {
+		logger.Error("Load GeoIP database failed", zap.String("error", err.Error()))
+	}
 
 	var proxyClient *proxy_client.ProxyClient
 	if proxyClient, err = proxy_client.StartProxyClient(config.Dns.Timeout*DNS_MOCK_TIMEOUT_MUTIPLIER, config.Shadowsocks, fmt.Sprintf("0.0.0.0:%d", config.ListenPort)); err != nil {
@@ -164,6 +179,36 @@ func StartService(configFile string) {
 	}
 	defer proxyClient.Stop()
 
+	proxyClient.SetPacChecker(pacListMgr)
+	pacListMgr.SetDialer(proxyClient.DialTCP)
+	// read after dialer is set, so remote list without cache can be downloaded through proxy backend
+	pacListMgr.ReadPacList(config.PacList)
+
+	if config.Socks5Inbound.Enable {
+		if err = proxyClient.StartSocks5Server(config.Socks5Inbound); err != nil {
+			logger.Error("Start SOCKS5 inbound failed", zap.String("error", err.Error()))
+			return
+		}
+	}
+	if config.HttpInbound.Enable {
+		if err = proxyClient.StartHttpProxyServer(config.HttpInbound, pacListMgr); err != nil {
+			logger.Error("Start HTTP proxy inbound failed", zap.String("error", err.Error()))
+			return
+		}
+	}
+
+	if config.PacServer.Enable {
+		if len(config.PacServer.Proxy) == 0 {
+			config.PacServer.Proxy = inboundPacProxy(config.HttpInbound, config.Socks5Inbound)
+		}
+		var pacServer *pac.PacServer
+		if pacServer, err = pacListMgr.StartPacServer(config.PacServer); err != nil {
+			logger.Error("Start pac server failed", zap.String("error", err.Error()))
+			return
+		}
+		defer pacServer.Stop()
+	}
+
 	// Start Dns Server
 
 	var dnsServer *dns_proxy.DnsServer
@@ -173,6 +218,18 @@ func StartService(configFile string) {
 	}
 	defer dnsServer.Stop()
 
+	if len(config.ControlSocket) > 0 {
+		var controlServer *control.ControlServer
+		if controlServer, err = control.StartControlServer(config.ControlSocket); err != nil {
+			logger.Error("Start control server failed", zap.String("error", err.Error()))
+		} else {
+			defer controlServer.Stop()
+			registerDnsCommands(controlServer, dnsServer)
+			registerProxyCommands(controlServer, proxyClient, routingMgr)
+			registerRoutingCommands(controlServer, routingMgr, pacListMgr)
+		}
+	}
+
 	status = true
 
 	logger.Info(fmt.Sprintf("%s service is up and running", appName))
@@ -183,6 +240,10 @@ func StartService(configFile string) {
 	reloadSignal := make(chan os.Signal, 1)
 	signal.Notify(reloadSignal,
 		syscall.SIGHUP)
+	// dump runtime stats
+	statsSignal := make(chan os.Signal, 1)
+	signal.Notify(statsSignal,
+		syscall.SIGUSR1)
 	for {
 		select {
 		case <-reloadSignal:
@@ -194,6 +255,14 @@ func StartService(configFile string) {
 				continue
 			}
 			logger.Info("Read config file successful", zap.String("file", configFile))
+			routingMgr.SetRouteTTLFloor(newConfig.RouteTTLFloor)
+			routingMgr.SetPersistInterval(newConfig.RoutePersistInterval)
+			if err = routingMgr.LoadDirectList(newConfig.DirectList); err != nil {
+				logger.Error("Reload direct list failed", zap.String("error", err.Error()))
+			}
+			if err = pacListMgr.LoadGeoIP(newConfig.GeoIPDatabase); err != nil {
+				logger.Error("Reload GeoIP database failed", zap.String("error", err.Error()))
+			}
 			pacListMgr.ReloadPacList(newConfig.PacList)
 
 			dnsServer.Reload(newConfig.Dns)
@@ -205,6 +274,13 @@ func StartService(configFile string) {
 			}
 
 			//pacListMgr.ReadPacList()
+		case <-statsSignal:
+			for _, stats := range dnsServer.GetResolverStats() {
+				logger.Info("DNS resolver stats", zap.String("group", stats.Group), zap.String("addr", stats.Addr),
+					zap.Uint64("noerror", stats.NoError), zap.Uint64("nxdomain", stats.NXDomain), zap.Uint64("servfail", stats.ServFail),
+					zap.Uint64("other rcode", stats.OtherRcode), zap.Uint64("timeout", stats.Timeout), zap.Uint64("error", stats.Error),
+					zap.Duration("avg latency", stats.AvgLatency), zap.Duration("latency", stats.Latency))
+			}
 		case <-serviceStopSignal:
 			logger.Info(fmt.Sprintf("%s service is stopped", appName))
 			return
@@ -213,6 +289,132 @@ func StartService(configFile string) {
 
 }
 
+// inboundPacProxy returns pac result pointing to enabled inbounds, HTTP proxy first since every browser supports it
+func inboundPacProxy(httpInbound HttpInboundConfig, socks5Inbound Socks5InboundConfig) string {
+	var proxies []string
+	if httpInbound.Enable {
+		proxies = append(proxies, "PROXY "+httpInbound.ListenAddr)
+	}
+	if socks5Inbound.Enable {
+		proxies = append(proxies, "SOCKS5 "+socks5Inbound.ListenAddr, "SOCKS "+socks5Inbound.ListenAddr)
+	}
+	return strings.Join(proxies, "; ")
+}
+
+func registerDnsCommands(controlServer *control.ControlServer, dnsServer *dns_proxy.DnsServer) {
+	// dns-flush without domain flushes whole cache
+	controlServer.Register("dns-flush", func(args []string) string {
+		if len(args) == 0 {
+			return fmt.Sprintf("flushed %d entries", dnsServer.FlushDnsCache(""))
+		}
+		count := 0
+		for _, domain := range args {
+			count += dnsServer.FlushDnsCache(domain)
+		}
+		return fmt.Sprintf("flushed %d entries", count)
+	})
+	controlServer.Register("dns-dump", func(args []string) string {
+		var builder strings.Builder
+		for _, entry := range dnsServer.DumpDnsCache() {
+			builder.WriteString(fmt.Sprintf("%s\t%s\t%s\n", entry.Domain, entry.TTL.Truncate(time.Second), entry.Answer))
+		}
+		return builder.String()
+	})
+	controlServer.Register("dns-stats", func(args []string) string {
+		var builder strings.Builder
+		for _, stats := range dnsServer.GetResolverStats() {
+			builder.WriteString(fmt.Sprintf("%s\t%s\tnoerror=%d nxdomain=%d servfail=%d other=%d timeout=%d error=%d avg=%s latency=%s\n",
+				stats.Group, stats.Addr, stats.NoError, stats.NXDomain, stats.ServFail, stats.OtherRcode, stats.Timeout, stats.Error,
+				stats.AvgLatency, stats.Latency))
+		}
+		return builder.String()
+	})
+}
+
+func registerProxyCommands(controlServer *control.ControlServer, proxyClient *proxy_client.ProxyClient, routingMgr *routing.RoutingMgr) {
+	// destinations are reported by domain when the ip was learned from DNS answer
+	controlServer.Register("traffic-dest", func(args []string) string {
+		var builder strings.Builder
+		for _, info := range proxyClient.GetDestinationTraffic(routingMgr.GetIPDomains()) {
+			builder.WriteString(fmt.Sprintf("%s\tin=%d out=%d\n", info.Key, info.Inbound, info.Outbound))
+		}
+		return builder.String()
+	})
+	controlServer.Register("traffic-client", func(args []string) string {
+		var builder strings.Builder
+		for _, info := range proxyClient.GetClientTraffic() {
+			builder.WriteString(fmt.Sprintf("%s\tin=%d out=%d\n", info.Key, info.Inbound, info.Outbound))
+		}
+		return builder.String()
+	})
+	controlServer.Register("relay-errors", func(args []string) string {
+		var builder strings.Builder
+		for _, stats := range proxyClient.GetRelayErrorStats() {
+			builder.WriteString(fmt.Sprintf("%s\tdial=%d handshake=%d timeout=%d reset=%d oversize=%d other=%d\n", stats.Server,
+				stats.Dial, stats.Handshake, stats.Timeout, stats.Reset, stats.Oversize, stats.Other))
+		}
+		return builder.String()
+	})
+}
+
+// routingDump is routing-dump output, domains and ips are only those asked for
+type routingDump struct {
+	Time      time.Time            `json:"time"`
+	Whitelist bool                 `json:"whitelist"`
+	Domains   []pac.DomainState    `json:"domains,omitempty"`
+	IPs       []ipState            `json:"ips,omitempty"`
+	Routes    []routing.RouteState `json:"routes"`
+}
+
+type ipState struct {
+	IP    string `json:"ip"`
+	Proxy bool   `json:"proxy"`
+	// in direct list, never intercepted
+	DirectList bool `json:"direct-list"`
+}
+
+func registerRoutingCommands(controlServer *control.ControlServer, routingMgr *routing.RoutingMgr, pacListMgr *pac.PacListMgr) {
+	// routing-dump without argument dumps whole routing table, with domains or ips only their rules and routes, a
+	// domain includes its subdomains
+	controlServer.Register("routing-dump", func(args []string) string {
+		dump := routingDump{Time: time.Now(), Whitelist: routingMgr.IsWhitelist(), Routes: make([]routing.RouteState, 0)}
+		for _, arg := range args {
+			if ip := net.ParseIP(arg); ip != nil {
+				dump.IPs = append(dump.IPs, ipState{IP: arg, Proxy: pacListMgr.CheckIP(ip.String()), DirectList: routingMgr.IsDirectIP(ip)})
+			} else {
+				dump.Domains = append(dump.Domains, pacListMgr.GetDomainState(arg))
+			}
+		}
+		for _, route := range routingMgr.DumpRoutes() {
+			matched := len(args) == 0
+			for _, arg := range args {
+				if route.Domain == arg || route.IP == arg || strings.HasSuffix(route.Domain, "."+arg) {
+					matched = true
+					break
+				}
+			}
+			if matched {
+				dump.Routes = append(dump.Routes, route)
+			}
+		}
+		data, err := json.MarshalIndent(dump, "", "  ")
+		if err != nil {
+			return fmt.Sprintf("encode routing dump failed: %s", err.Error())
+		}
+		return string(data)
+	})
+	// pac-hits lists hits of pac list rules, most hit first, with unused only rules never hit, which can be pruned
+	controlServer.Register("pac-hits", func(args []string) string {
+		unused := len(args) > 0 && args[0] == "unused"
+		var builder strings.Builder
+		for _, hits := range pacListMgr.GetRuleHits(unused) {
+			builder.WriteString(fmt.Sprintf("%s\tqueries=%d conns=%d\t%s:%d\n", hits.Key, hits.Queries, hits.Conns,
+				hits.Origin.File, hits.Origin.Line))
+		}
+		return builder.String()
+	})
+}
+
 func addTProxyRoutingIPv4(mark string, table string) (err error) {
 	cmd := exec.Command("ip", "rule", "list", "fwmark", mark, "lookup", table)
 	var response []byte
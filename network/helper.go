@@ -1,7 +1,7 @@
 package network
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
@@ -11,7 +11,7 @@ import (
 	"regexp"
 	"strconv"
 	"syscall"
-	"unsafe"
+	"time"
 
 	//"strings"
 	"github.com/pkg/errors"
@@ -26,6 +26,20 @@ const (
 	SOL_IP             = 0
 	IP_TRANSPARENT     = 0x13
 	IP_RECVORIGDSTADDR = 0x14
+
+	// not defined by syscall package on linux
+	SO_REUSEPORT = 0xf
+
+	SOL_IPV6         = 0x29
+	IPV6_V6ONLY      = 0x1a
+	IPV6_TRANSPARENT = 0x4b
+	// also type of control message carrying original dst, i.e. IPV6_ORIGDSTADDR
+	IPV6_RECVORIGDSTADDR = 0x4a
+
+	TCP_FASTOPEN         = 0x17
+	TCP_FASTOPEN_CONNECT = 0x1e
+	// pending TFO requests queued by listener
+	TCP_FASTOPEN_QLEN = 256
 )
 const (
 	ShadowSocksAtypIPv4       = 1
@@ -134,7 +148,17 @@ func ListenTransparentTCP(addr string, isIPv6 bool) (ln net.Listener, err error)
 	}
 	defer syscall.Close(socketFD)
 
-	if err = syscall.SetsockoptInt(socketFD, SOL_IP, IP_TRANSPARENT, 1); err != nil {
+	if isIPv6 {
+		// TPROXY of ip6tables only delivers to socket with IPV6_TRANSPARENT, v6 only so it can share port with ipv4 listener
+		if err = syscall.SetsockoptInt(socketFD, SOL_IPV6, IPV6_TRANSPARENT, 1); err != nil {
+			err = errors.Wrap(err, "Set sockopt IPV6_TRANSPARENT failed")
+			return
+		}
+		if err = syscall.SetsockoptInt(socketFD, SOL_IPV6, IPV6_V6ONLY, 1); err != nil {
+			err = errors.Wrap(err, "Set sockopt IPV6_V6ONLY failed")
+			return
+		}
+	} else if err = syscall.SetsockoptInt(socketFD, SOL_IP, IP_TRANSPARENT, 1); err != nil {
 		err = errors.Wrap(err, "Set sockopt IP_TRANSPARENT failed")
 		return
 	}
@@ -170,6 +194,15 @@ func ListenTransparentTCP(addr string, isIPv6 bool) (ln net.Listener, err error)
 }
 
 func ListenTransparentUDP(addr string, isIPv6 bool) (ln *net.UDPConn, err error) {
+	return listenTransparentUDP(addr, isIPv6, false)
+}
+
+// ListenTransparentUDPReusePort opens one of several sockets sharing addr, kernel spreads flows among them by hash
+func ListenTransparentUDPReusePort(addr string, isIPv6 bool) (ln *net.UDPConn, err error) {
+	return listenTransparentUDP(addr, isIPv6, true)
+}
+
+func listenTransparentUDP(addr string, isIPv6 bool, reusePort bool) (ln *net.UDPConn, err error) {
 
 	socketType := syscall.AF_INET
 	if isIPv6 {
@@ -183,14 +216,29 @@ func ListenTransparentUDP(addr string, isIPv6 bool) (ln *net.UDPConn, err error)
 	}
 	defer syscall.Close(socketFD)
 
-	if err = syscall.SetsockoptInt(socketFD, SOL_IP, IP_TRANSPARENT, 1); err != nil {
-		err = errors.Wrap(err, "Set sockopt IP_TRANSPARENT failed")
+	if err = setTransparent(socketFD, isIPv6); err != nil {
 		return
 	}
-	if err = syscall.SetsockoptInt(socketFD, SOL_IP, IP_RECVORIGDSTADDR, 1); err != nil {
+	if isIPv6 {
+		if err = syscall.SetsockoptInt(socketFD, SOL_IPV6, IPV6_RECVORIGDSTADDR, 1); err != nil {
+			err = errors.Wrap(err, "Set sockopt IPV6_RECVORIGDSTADDR failed")
+			return
+		}
+		// v6 only so it can share port with ipv4 listener
+		if err = syscall.SetsockoptInt(socketFD, SOL_IPV6, IPV6_V6ONLY, 1); err != nil {
+			err = errors.Wrap(err, "Set sockopt IPV6_V6ONLY failed")
+			return
+		}
+	} else if err = syscall.SetsockoptInt(socketFD, SOL_IP, IP_RECVORIGDSTADDR, 1); err != nil {
 		err = errors.Wrap(err, "Set sockopt IP_RECVORIGDSTADDR failed")
 		return
 	}
+	if reusePort {
+		if err = syscall.SetsockoptInt(socketFD, syscall.SOL_SOCKET, SO_REUSEPORT, 1); err != nil {
+			err = errors.Wrap(err, "Set sockopt SO_REUSEPORT failed")
+			return
+		}
+	}
 
 	if isIPv6 {
 		var socketAddr syscall.SockaddrInet6
@@ -232,32 +280,9 @@ func ExtractOrigDstFromUDP(oobLen int, oobBuffer []byte) (dst *net.UDPAddr, err
 	}
 
 	for _, msg := range socketControlMsgs {
-		if msg.Header.Level == SOL_IP && msg.Header.Type == IP_RECVORIGDSTADDR {
-			originalDstRaw := &syscall.RawSockaddrInet4{}
-			if err = binary.Read(bytes.NewReader(msg.Data), binary.LittleEndian, originalDstRaw); err != nil {
-				err = errors.Wrap(err, "Reading UDP original dst failed")
-				return
-			}
-			switch originalDstRaw.Family {
-			case syscall.AF_INET:
-				pp := (*syscall.RawSockaddrInet4)(unsafe.Pointer(originalDstRaw))
-				p := (*[2]byte)(unsafe.Pointer(&pp.Port))
-				dst = &net.UDPAddr{
-					IP:   net.IPv4(pp.Addr[0], pp.Addr[1], pp.Addr[2], pp.Addr[3]),
-					Port: int(p[0])<<8 + int(p[1]),
-				}
-
-			case syscall.AF_INET6:
-				pp := (*syscall.RawSockaddrInet6)(unsafe.Pointer(originalDstRaw))
-				p := (*[2]byte)(unsafe.Pointer(&pp.Port))
-				dst = &net.UDPAddr{
-					IP:   net.IP(pp.Addr[:]),
-					Port: int(p[0])<<8 + int(p[1]),
-					Zone: strconv.Itoa(int(pp.Scope_id)),
-				}
-
-			default:
-				err = errors.Wrapf(err, fmt.Sprintf("UDP original dst is an unsupported network family: %v", originalDstRaw.Family))
+		if (msg.Header.Level == SOL_IP && msg.Header.Type == IP_RECVORIGDSTADDR) ||
+			(msg.Header.Level == SOL_IPV6 && msg.Header.Type == IPV6_RECVORIGDSTADDR) {
+			if dst, err = parseOrigDst(msg.Data); err != nil {
 				return
 			}
 		}
@@ -269,6 +294,46 @@ func ExtractOrigDstFromUDP(oobLen int, oobBuffer []byte) (dst *net.UDPAddr, err
 	return
 }
 
+// parseOrigDst decodes sockaddr_in or sockaddr_in6 carried by IP_ORIGDSTADDR or IPV6_ORIGDSTADDR control message
+func parseOrigDst(data []byte) (*net.UDPAddr, error) {
+	if len(data) < 2 {
+		return nil, errors.New("UDP original dst is truncated")
+	}
+	// family is in host order while port is in network order
+	switch family := binary.LittleEndian.Uint16(data); family {
+	case syscall.AF_INET:
+		if len(data) < syscall.SizeofSockaddrInet4 {
+			return nil, errors.New("UDP original dst is truncated")
+		}
+		return &net.UDPAddr{
+			IP:   net.IPv4(data[4], data[5], data[6], data[7]),
+			Port: int(binary.BigEndian.Uint16(data[2:])),
+		}, nil
+	case syscall.AF_INET6:
+		if len(data) < syscall.SizeofSockaddrInet6 {
+			return nil, errors.New("UDP original dst is truncated")
+		}
+		dst := &net.UDPAddr{
+			IP:   append(net.IP(nil), data[8:24]...),
+			Port: int(binary.BigEndian.Uint16(data[2:])),
+		}
+		if scopeID := binary.LittleEndian.Uint32(data[24:]); scopeID != 0 {
+			dst.Zone = strconv.Itoa(int(scopeID))
+		}
+		return dst, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("UDP original dst is an unsupported network family: %d", family))
+	}
+}
+
+// setTransparent lets socket bind or receive non local address, TPROXY of ip6tables needs IPV6_TRANSPARENT
+func setTransparent(socketFD int, isIPv6 bool) error {
+	if isIPv6 {
+		return errors.Wrap(syscall.SetsockoptInt(socketFD, SOL_IPV6, IPV6_TRANSPARENT, 1), "Set sockopt IPV6_TRANSPARENT failed")
+	}
+	return errors.Wrap(syscall.SetsockoptInt(socketFD, SOL_IP, IP_TRANSPARENT, 1), "Set sockopt IP_TRANSPARENT failed")
+}
+
 func DialTransparentUDP(addr *net.UDPAddr) (ln *net.UDPConn, err error) {
 
 	isIPv6 := addr.IP.To4() == nil
@@ -285,8 +350,7 @@ func DialTransparentUDP(addr *net.UDPAddr) (ln *net.UDPConn, err error) {
 	}
 	defer syscall.Close(socketFD)
 
-	if err = syscall.SetsockoptInt(socketFD, SOL_IP, IP_TRANSPARENT, 1); err != nil {
-		err = errors.Wrap(err, "Set sockopt IP_TRANSPARENT failed")
+	if err = setTransparent(socketFD, isIPv6); err != nil {
 		return
 	}
 
@@ -321,6 +385,129 @@ func DialTransparentUDP(addr *net.UDPAddr) (ln *net.UDPConn, err error) {
 	return
 }
 
+// DialTCPFastOpen connects addr with TCP_FASTOPEN_CONNECT, SYN is held back and carries the first write, kernel
+// falls back to regular handshake if server or path does not support TFO
+func DialTCPFastOpen(addr *net.TCPAddr, opts *SocketOptions, timeout time.Duration) (*net.TCPConn, error) {
+	dialer := opts.Dialer(timeout, func(fd int) error {
+		return errors.Wrap(syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, TCP_FASTOPEN_CONNECT, 1), "Set sockopt TCP_FASTOPEN_CONNECT failed")
+	})
+	conn, err := dialer.Dial("tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+// EnableTCPFastOpen lets listener accept data in SYN from TFO clients
+func EnableTCPFastOpen(ln net.Listener) error {
+	tcpListener, ok := ln.(*net.TCPListener)
+	if !ok {
+		return errors.New("Not a TCP listener")
+	}
+	rawConn, err := tcpListener.SyscallConn()
+	if err != nil {
+		return errors.Wrap(err, "Get raw listener failed")
+	}
+	var sockErr error
+	if err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, TCP_FASTOPEN, TCP_FASTOPEN_QLEN)
+	}); err != nil {
+		return errors.Wrap(err, "Control raw listener failed")
+	}
+	return errors.Wrap(sockErr, "Set sockopt TCP_FASTOPEN failed")
+}
+
+// DialTransparentTCP connects dst with source address of src, which needs IP_TRANSPARENT since src is not local
+func DialTransparentTCP(src net.IP, dst *net.TCPAddr, timeout time.Duration) (net.Conn, error) {
+	isIPv6 := dst.IP.To4() == nil
+	dialer := net.Dialer{
+		Timeout:   timeout,
+		LocalAddr: &net.TCPAddr{IP: src},
+		Control: func(network, address string, rawConn syscall.RawConn) error {
+			var sockErr error
+			if err := rawConn.Control(func(fd uintptr) {
+				if isIPv6 {
+					sockErr = syscall.SetsockoptInt(int(fd), SOL_IPV6, IPV6_TRANSPARENT, 1)
+				} else {
+					sockErr = syscall.SetsockoptInt(int(fd), SOL_IP, IP_TRANSPARENT, 1)
+				}
+			}); err != nil {
+				return err
+			}
+			return errors.Wrap(sockErr, "Set sockopt IP_TRANSPARENT failed")
+		},
+	}
+	return dialer.Dial("tcp", dst.String())
+}
+
+type happyEyeballsResult struct {
+	conn net.Conn
+	err  error
+	idx  int
+}
+
+// DialTCPHappyEyeballs dials addrs in order as RFC 8305, next attempt starts after delay or as soon as all started ones
+// failed, first connected wins and the others are closed, returns index of winner, timeout bounds the whole race
+func DialTCPHappyEyeballs(addrs []*net.TCPAddr, delay time.Duration, timeout time.Duration, opts *SocketOptions) (conn *net.TCPConn, idx int, err error) {
+	if len(addrs) == 0 {
+		return nil, -1, errors.New("No address to dial")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	}
+	defer cancel()
+	results := make(chan happyEyeballsResult, len(addrs))
+	started, failed := 0, 0
+	start := func() {
+		i := started
+		started++
+		go func() {
+			c, e := opts.Dialer(0, nil).DialContext(ctx, "tcp", addrs[i].String())
+			results <- happyEyeballsResult{conn: c, err: e, idx: i}
+		}()
+	}
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case res := <-results:
+			if res.err == nil {
+				// attempts still running are canceled by return, close any which connected meanwhile
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.err == nil {
+							r.conn.Close()
+						}
+					}
+				}(started - failed - 1)
+				return res.conn.(*net.TCPConn), res.idx, nil
+			}
+			failed++
+			err = res.err
+			if failed == len(addrs) {
+				return nil, -1, err
+			}
+			if failed == started {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				start()
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if started < len(addrs) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+}
+
 func ConvertShadowSocksAddr(addr string, isUDP bool) ([]byte, error) {
 	var ret []byte
 	host, port, err := net.SplitHostPort(addr)
@@ -331,6 +518,10 @@ func ConvertShadowSocksAddr(addr string, isUDP bool) ([]byte, error) {
 	if ip == nil {
 		return nil, errors.New("IP format invalid")
 	}
+	// destination synthesized by DNS64, so relay to the original ipv4 address
+	if ipv4 := NAT64Extract(GetNAT64Prefix(), ip); ipv4 != nil {
+		ip = ipv4
+	}
 	if ipv4 := ip.To4(); ipv4 != nil {
 		ret = make([]byte, 1+net.IPv4len+2)
 		if isUDP {
@@ -1,6 +1,12 @@
 package network
 
-import "testing"
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
 
 func TestParseIPv4(t *testing.T) {
 	if socketAddr, err := ParseIPv4("192.168.0.1:100"); err != nil {
@@ -17,3 +23,130 @@ func TestParseIPv6(t *testing.T) {
 		t.Logf("Parse ipv6 successful, %v:%d", socketAddr.Addr, socketAddr.Port)
 	}
 }
+
+func TestNAT64(t *testing.T) {
+	ipv4 := net.ParseIP("192.0.2.33")
+	cases := map[string]string{
+		"64:ff9b::/96":          "64:ff9b::c000:221",
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+	}
+	for prefixStr, expect := range cases {
+		_, prefix, _ := net.ParseCIDR(prefixStr)
+		ip := NAT64Embed(prefix, ipv4)
+		if !ip.Equal(net.ParseIP(expect)) {
+			t.Errorf("NAT64 embed with prefix %s got %s, expect %s", prefixStr, ip, expect)
+			continue
+		}
+		if extracted := NAT64Extract(prefix, ip); !extracted.Equal(ipv4) {
+			t.Errorf("NAT64 extract with prefix %s got %s", prefixStr, extracted)
+		}
+	}
+	_, prefix, _ := net.ParseCIDR("64:ff9b::/96")
+	if extracted := NAT64Extract(prefix, net.ParseIP("2001:db8::1")); extracted != nil {
+		t.Errorf("NAT64 extract outside prefix should be nil, got %s", extracted)
+	}
+}
+
+func TestTCPFastOpen(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if err = EnableTCPFastOpen(ln); err != nil {
+		t.Skipf("TCP fast open not supported: %s", err.Error())
+	}
+	accepted := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		defer conn.Close()
+		buffer := make([]byte, 5)
+		n, _ := conn.Read(buffer)
+		accepted <- buffer[:n]
+	}()
+	conn, err := DialTCPFastOpen(ln.Addr().(*net.TCPAddr), nil, time.Second)
+	if err != nil {
+		t.Skipf("TCP fast open dial not supported: %s", err.Error())
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-accepted; string(data) != "hello" {
+		t.Errorf("data over fast open conn got %q", data)
+	}
+}
+
+func TestDialTCPHappyEyeballs(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	// nothing listens on the first address, so the second one wins without waiting the delay
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().(*net.TCPAddr)
+	closed.Close()
+
+	start := time.Now()
+	conn, idx, err := DialTCPHappyEyeballs([]*net.TCPAddr{closedAddr, listener.Addr().(*net.TCPAddr)}, 5*time.Second, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if idx != 1 {
+		t.Errorf("expected second address to win, got %d", idx)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("failed attempt should start next one at once, took %v", time.Since(start))
+	}
+	if _, _, err = DialTCPHappyEyeballs([]*net.TCPAddr{closedAddr}, 10*time.Millisecond, time.Second, nil); err == nil {
+		t.Error("dial closed address should fail")
+	}
+}
+
+func TestParseOrigDst(t *testing.T) {
+	v4 := make([]byte, syscall.SizeofSockaddrInet4)
+	binary.LittleEndian.PutUint16(v4, syscall.AF_INET)
+	binary.BigEndian.PutUint16(v4[2:], 53)
+	copy(v4[4:], []byte{8, 8, 4, 4})
+	if dst, err := parseOrigDst(v4); err != nil || !dst.IP.Equal(net.ParseIP("8.8.4.4")) || dst.Port != 53 {
+		t.Errorf("ipv4 got %v, %v", dst, err)
+	}
+
+	v6 := make([]byte, syscall.SizeofSockaddrInet6)
+	binary.LittleEndian.PutUint16(v6, syscall.AF_INET6)
+	binary.BigEndian.PutUint16(v6[2:], 443)
+	copy(v6[8:], net.ParseIP("2001:db8::1"))
+	if dst, err := parseOrigDst(v6); err != nil || dst.String() != "[2001:db8::1]:443" {
+		t.Errorf("ipv6 got %v, %v", dst, err)
+	}
+	binary.LittleEndian.PutUint32(v6[24:], 2)
+	if dst, err := parseOrigDst(v6); err != nil || dst.Zone != "2" {
+		t.Errorf("ipv6 with scope got %v, %v", dst, err)
+	}
+
+	if _, err := parseOrigDst(v6[:16]); err == nil {
+		t.Error("truncated ipv6 should fail")
+	}
+}
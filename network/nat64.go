@@ -0,0 +1,71 @@
+package network
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// nat64Prefix is the NAT64 prefix used by DNS64 synthesis, destination inside it is mapped back to ipv4 before relay
+var nat64Prefix atomic.Value
+
+func SetNAT64Prefix(prefix *net.IPNet) {
+	nat64Prefix.Store(prefix)
+}
+
+func GetNAT64Prefix() *net.IPNet {
+	if prefix, ok := nat64Prefix.Load().(*net.IPNet); ok {
+		return prefix
+	}
+	return nil
+}
+
+// nat64Positions returns byte offsets of the embedded ipv4 address as RFC 6052, bits 64 to 71 are always skipped
+func nat64Positions(prefix *net.IPNet) []int {
+	ones, bits := prefix.Mask.Size()
+	if bits != 8*net.IPv6len {
+		return nil
+	}
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil
+	}
+	ret := make([]int, 0, net.IPv4len)
+	for i := ones / 8; len(ret) < net.IPv4len; i++ {
+		if i != 8 {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+// NAT64Embed synthesizes ipv6 address from ipv4 with NAT64 prefix, returns nil if prefix length is not supported
+func NAT64Embed(prefix *net.IPNet, ip net.IP) net.IP {
+	ipv4 := ip.To4()
+	positions := nat64Positions(prefix)
+	if ipv4 == nil || positions == nil {
+		return nil
+	}
+	ret := make(net.IP, net.IPv6len)
+	copy(ret, prefix.IP.To16())
+	for i, pos := range positions {
+		ret[pos] = ipv4[i]
+	}
+	return ret
+}
+
+// NAT64Extract returns embedded ipv4 address if ip is inside NAT64 prefix, otherwise nil
+func NAT64Extract(prefix *net.IPNet, ip net.IP) net.IP {
+	if prefix == nil || ip.To4() != nil || !prefix.Contains(ip) {
+		return nil
+	}
+	positions := nat64Positions(prefix)
+	if positions == nil {
+		return nil
+	}
+	ret := make(net.IP, net.IPv4len)
+	for i, pos := range positions {
+		ret[i] = ip[pos]
+	}
+	return ret
+}
@@ -0,0 +1,50 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	// version 2 with PROXY command
+	PROXY_PROTOCOL_V2_CMD = 0x21
+	// address family and transport, TCP over ipv4 or ipv6
+	PROXY_PROTOCOL_V2_TCP4 = 0x11
+	PROXY_PROTOCOL_V2_TCP6 = 0x21
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolV2Header builds PROXY protocol v2 header carrying src and dst of TCP connection, ipv4 is sent as ipv4
+// mapped ipv6 if the other side is ipv6, returns nil if either is not a TCP address
+func ProxyProtocolV2Header(src net.Addr, dst net.Addr) []byte {
+	srcAddr, ok := src.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	dstAddr, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	srcIP, dstIP := srcAddr.IP.To4(), dstAddr.IP.To4()
+	family := byte(PROXY_PROTOCOL_V2_TCP4)
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = srcAddr.IP.To16(), dstAddr.IP.To16()
+		family = PROXY_PROTOCOL_V2_TCP6
+	}
+	if srcIP == nil || dstIP == nil {
+		return nil
+	}
+	addrLen := 2*len(srcIP) + 4
+	ret := make([]byte, len(proxyProtocolV2Signature)+4+addrLen)
+	n := copy(ret, proxyProtocolV2Signature)
+	ret[n] = PROXY_PROTOCOL_V2_CMD
+	ret[n+1] = family
+	binary.BigEndian.PutUint16(ret[n+2:], uint16(addrLen))
+	n += 4
+	n += copy(ret[n:], srcIP)
+	n += copy(ret[n:], dstIP)
+	binary.BigEndian.PutUint16(ret[n:], uint16(srcAddr.Port))
+	binary.BigEndian.PutUint16(ret[n+2:], uint16(dstAddr.Port))
+	return ret
+}
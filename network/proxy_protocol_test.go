@@ -0,0 +1,30 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyProtocolV2Header(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.168.0.10"), Port: 51000}
+	dst := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 443}
+	expected := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x11, 0, 12,
+		192, 168, 0, 10, 1, 2, 3, 4, 0xc7, 0x38, 0x01, 0xbb)
+	if header := ProxyProtocolV2Header(src, dst); !bytes.Equal(header, expected) {
+		t.Errorf("ipv4 header got %v", header)
+	}
+
+	dst = &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	header := ProxyProtocolV2Header(src, dst)
+	if len(header) != 16+36 || header[13] != 0x21 || header[15] != 36 {
+		t.Errorf("ipv6 header got %v", header)
+	}
+	if !net.IP(header[16:32]).Equal(src.IP) {
+		t.Errorf("ipv4 source should be mapped, got %v", net.IP(header[16:32]))
+	}
+
+	if header := ProxyProtocolV2Header(&net.UDPAddr{}, dst); header != nil {
+		t.Errorf("non TCP address got header %v", header)
+	}
+}
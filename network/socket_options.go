@@ -0,0 +1,87 @@
+package network
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// SocketOptions are applied to outbound sockets before connect, nil or zero value changes nothing
+type SocketOptions struct {
+	// SO_BINDTODEVICE, needs CAP_NET_RAW
+	Interface string
+	// source address, dial of the other family fails
+	LocalIP net.IP
+	// SO_MARK, 0 leaves socket unmarked
+	Mark int
+}
+
+// NewSocketOptions parses bind settings, returns nil if none is set
+func NewSocketOptions(iface string, localIP string, mark int) (*SocketOptions, error) {
+	if len(iface) == 0 && len(localIP) == 0 && mark == 0 {
+		return nil, nil
+	}
+	ret := &SocketOptions{Interface: iface, Mark: mark}
+	if len(localIP) > 0 {
+		if ret.LocalIP = net.ParseIP(localIP); ret.LocalIP == nil {
+			return nil, errors.Errorf("Invalid bind address: %s", localIP)
+		}
+	}
+	return ret, nil
+}
+
+// Dialer returns dialer applying options, extra control runs after them, timeout 0 means none
+func (c *SocketOptions) Dialer(timeout time.Duration, extra func(fd int) error) *net.Dialer {
+	ret := &net.Dialer{Timeout: timeout, Control: c.control(extra)}
+	if c != nil && c.LocalIP != nil {
+		ret.LocalAddr = &net.TCPAddr{IP: c.LocalIP}
+	}
+	return ret
+}
+
+// DialTCP connects addr applying options
+func (c *SocketOptions) DialTCP(network string, addr *net.TCPAddr, timeout time.Duration) (*net.TCPConn, error) {
+	conn, err := c.Dialer(timeout, nil).Dial(network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+// ListenUDP opens unconnected UDP socket applying options
+func (c *SocketOptions) ListenUDP() (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: c.control(nil)}
+	addr := ""
+	if c != nil && c.LocalIP != nil {
+		addr = net.JoinHostPort(c.LocalIP.String(), "0")
+	}
+	return lc.ListenPacket(context.Background(), "udp", addr)
+}
+
+func (c *SocketOptions) control(extra func(fd int) error) func(network, address string, rawConn syscall.RawConn) error {
+	return func(network, address string, rawConn syscall.RawConn) error {
+		var sockErr error
+		if err := rawConn.Control(func(fd uintptr) {
+			if c != nil && len(c.Interface) > 0 {
+				if sockErr = syscall.BindToDevice(int(fd), c.Interface); sockErr != nil {
+					sockErr = errors.Wrapf(sockErr, "Bind to interface %s failed", c.Interface)
+					return
+				}
+			}
+			if c != nil && c.Mark != 0 {
+				if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, c.Mark); sockErr != nil {
+					sockErr = errors.Wrap(sockErr, "Set sockopt SO_MARK failed")
+					return
+				}
+			}
+			if extra != nil {
+				sockErr = extra(int(fd))
+			}
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
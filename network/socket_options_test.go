@@ -0,0 +1,60 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSocketOptions(t *testing.T) {
+	if opts, err := NewSocketOptions("", "", 0); err != nil || opts != nil {
+		t.Errorf("no bind settings should give nil options, got %v %v", opts, err)
+	}
+	if _, err := NewSocketOptions("", "not-an-ip", 0); err == nil {
+		t.Error("invalid bind address should fail")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	opts, err := NewSocketOptions("", "127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := opts.DialTCP("tcp4", listener.Addr().(*net.TCPAddr), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(opts.LocalIP) {
+		t.Errorf("expected source %s, got %s", opts.LocalIP, ip)
+	}
+	conn.Close()
+
+	udpConn, err := opts.ListenUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := udpConn.LocalAddr().(*net.UDPAddr).IP; !ip.Equal(opts.LocalIP) {
+		t.Errorf("expected udp bound to %s, got %s", opts.LocalIP, ip)
+	}
+	udpConn.Close()
+
+	// binding device and mark need CAP_NET_RAW and CAP_NET_ADMIN
+	loOpts := &SocketOptions{Interface: "lo", Mark: 0x100}
+	if conn, err = loOpts.DialTCP("tcp4", listener.Addr().(*net.TCPAddr), time.Second); err != nil {
+		t.Skipf("bind to device or mark not permitted: %s", err.Error())
+	}
+	conn.Close()
+}
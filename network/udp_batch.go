@@ -0,0 +1,112 @@
+package network
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr is struct mmsghdr of recvmmsg(2)
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// UDPBatchMessage is one datagram slot of a batch read, Buffer and Oob are provided by caller
+type UDPBatchMessage struct {
+	Buffer []byte
+	Oob    []byte
+	N      int
+	OobN   int
+	Addr   *net.UDPAddr
+}
+
+// UDPBatchReader reads multiple datagrams with a single recvmmsg syscall
+type UDPBatchReader struct {
+	rawConn syscall.RawConn
+	hdrs    []mmsghdr
+	iovs    []syscall.Iovec
+	names   []syscall.RawSockaddrInet6
+}
+
+func NewUDPBatchReader(conn *net.UDPConn, batch int) (*UDPBatchReader, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "Get UDP raw conn failed")
+	}
+	return &UDPBatchReader{rawConn: rawConn,
+		hdrs:  make([]mmsghdr, batch),
+		iovs:  make([]syscall.Iovec, batch),
+		names: make([]syscall.RawSockaddrInet6, batch)}, nil
+}
+
+// ReadBatch blocks until at least one datagram arrives, returns number of msgs filled
+func (c *UDPBatchReader) ReadBatch(msgs []UDPBatchMessage) (n int, err error) {
+	count := len(msgs)
+	if count > len(c.hdrs) {
+		count = len(c.hdrs)
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	for i := 0; i < count; i++ {
+		c.iovs[i].Base = &msgs[i].Buffer[0]
+		c.iovs[i].SetLen(len(msgs[i].Buffer))
+		hdr := &c.hdrs[i].hdr
+		hdr.Name = (*byte)(unsafe.Pointer(&c.names[i]))
+		hdr.Namelen = syscall.SizeofSockaddrInet6
+		hdr.Iov = &c.iovs[i]
+		hdr.Iovlen = 1
+		if len(msgs[i].Oob) > 0 {
+			hdr.Control = &msgs[i].Oob[0]
+			hdr.SetControllen(len(msgs[i].Oob))
+		} else {
+			hdr.Control = nil
+			hdr.SetControllen(0)
+		}
+		hdr.Flags = 0
+	}
+
+	var operr error
+	if err = c.rawConn.Read(func(fd uintptr) bool {
+		r, _, errno := syscall.Syscall6(syscall.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&c.hdrs[0])), uintptr(count), syscall.MSG_DONTWAIT, 0, 0)
+		if errno == syscall.EAGAIN || errno == syscall.EWOULDBLOCK {
+			// wait for readable by runtime poller
+			return false
+		}
+		if errno != 0 {
+			operr = errno
+		} else {
+			n = int(r)
+		}
+		return true
+	}); err != nil {
+		return 0, err
+	}
+	if operr != nil {
+		return 0, &net.OpError{Op: "recvmmsg", Net: "udp", Err: operr}
+	}
+
+	for i := 0; i < n; i++ {
+		msgs[i].N = int(c.hdrs[i].len)
+		msgs[i].OobN = int(c.hdrs[i].hdr.Controllen)
+		msgs[i].Addr = sockaddrToUDPAddr(&c.names[i])
+	}
+	return n, nil
+}
+
+func sockaddrToUDPAddr(name *syscall.RawSockaddrInet6) *net.UDPAddr {
+	switch name.Family {
+	case syscall.AF_INET:
+		pp := (*syscall.RawSockaddrInet4)(unsafe.Pointer(name))
+		p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		return &net.UDPAddr{IP: net.IPv4(pp.Addr[0], pp.Addr[1], pp.Addr[2], pp.Addr[3]), Port: int(p[0])<<8 + int(p[1])}
+	case syscall.AF_INET6:
+		p := (*[2]byte)(unsafe.Pointer(&name.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, name.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: int(p[0])<<8 + int(p[1])}
+	}
+	return nil
+}
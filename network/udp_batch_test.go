@@ -0,0 +1,48 @@
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+func TestUDPBatchReader(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen failed: %s", err.Error())
+	}
+	defer conn.Close()
+	sender, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial failed: %s", err.Error())
+	}
+	defer sender.Close()
+	for _, payload := range []string{"a", "bb", "ccc"} {
+		sender.Write([]byte(payload))
+	}
+
+	reader, err := NewUDPBatchReader(conn, 8)
+	if err != nil {
+		t.Fatalf("create batch reader failed: %s", err.Error())
+	}
+	msgs := make([]UDPBatchMessage, 8)
+	for i := range msgs {
+		msgs[i].Buffer = make([]byte, 64)
+		msgs[i].Oob = make([]byte, 64)
+	}
+	total := 0
+	for total < 3 {
+		n, err := reader.ReadBatch(msgs)
+		if err != nil {
+			t.Fatalf("read batch failed: %s", err.Error())
+		}
+		for i := 0; i < n; i++ {
+			if msgs[i].N != total+1 {
+				t.Errorf("message %d length got %d", total, msgs[i].N)
+			}
+			if msgs[i].Addr.String() != sender.LocalAddr().String() {
+				t.Errorf("message %d src got %s", total, msgs[i].Addr.String())
+			}
+			total++
+		}
+	}
+}
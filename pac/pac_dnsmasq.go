@@ -0,0 +1,44 @@
+package pac
+
+import (
+	"github.com/weishi258/redfrog-core/common"
+	"strings"
+)
+
+// parseDnsmasqLine adds rules of dnsmasq conf line, as gfwlist2dnsmasq and dnsmasq-china-list publish them, domain
+// forwarded to a server or whose answers fill an ipset is listed with its subdomains, as proxy rule, or as $direct rule
+// if list source is suffixed by "$direct" since dnsmasq-china-list forwards domains to resolve and connect directly,
+// and "server=/example.com/#", resolving by default servers, is an exception, ok is false for line not in dnsmasq syntax
+func (c *PacList) parseDnsmasqLine(line string) (ok bool) {
+	rule, ok := common.ParseDnsmasqRule(line)
+	if !ok {
+		return false
+	}
+	switch rule.Option {
+	case "server":
+		// "server=/lan/" is answered from local hosts only
+		if len(rule.Value) == 0 {
+			return true
+		}
+	case "ipset", "nftset":
+	default:
+		// e.g. address and local are answered by dnsmasq itself, nothing to route
+		return true
+	}
+	bDomainType := common.DOMAIN_BLACK_LIST
+	if rule.Option == "server" && rule.Value == "#" {
+		if c.direct {
+			// resolved by default servers, which direct list leaves to other lists
+			return true
+		}
+		bDomainType = common.DOMAIN_WHITE_LIST
+	}
+	for _, domain := range rule.Domains {
+		if strings.HasPrefix(domain, common.DOMAIN_WILDCARD_PREFIX) {
+			c.addDomain(domain[len(common.DOMAIN_WILDCARD_PREFIX):], DOMAIN_SCOPE_SUBDOMAINS, bDomainType, c.direct)
+		} else {
+			c.addDomain(domain, DOMAIN_SCOPE_BOTH, bDomainType, c.direct)
+		}
+	}
+	return true
+}
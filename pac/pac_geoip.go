@@ -0,0 +1,69 @@
+package pac
+
+import (
+	"github.com/weishi258/redfrog-core/common"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/geoip"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"net"
+	"strings"
+)
+
+// country rule, e.g. "GEOIP,US,PROXY" or "GEOIP,CN,DIRECT", evaluated against resolved ips of domains no domain rule
+// matches
+const regex_geoip_ = "(?i)^GEOIP,([A-Z]{2}),(PROXY|DIRECT)$"
+
+// LoadGeoIP opens MaxMind database country rules are looked up in, empty path disables country rules
+func (c *PacListMgr) LoadGeoIP(path string) error {
+	var reader *geoip.Reader
+	if len(path) > 0 {
+		var err error
+		if reader, err = geoip.Open(config.GetPathFromWorkingDir(path)); err != nil {
+			return err
+		}
+		log.GetLogger().Info("GeoIP database loaded", zap.String("file", path))
+	}
+	c.proxyMux.Lock()
+	list := *c.rules()
+	list.geoip = reader
+	c.proxyList.Store(&list)
+	c.proxyMux.Unlock()
+	return nil
+}
+
+// HasGeoIPRules tells whether country rules can be evaluated
+func (c *PacListMgr) HasGeoIPRules() bool {
+	list := c.rules()
+	return list.geoip != nil && len(list.geoIPs) > 0
+}
+
+// CheckGeoIP tells whether ip should be proxied by country rule, ok is false if no rule matches country of ip
+func (c *PacListMgr) CheckGeoIP(ip net.IP) (proxy bool, ok bool) {
+	return c.rules().checkGeoIP(ip)
+}
+
+// checkGeoIP is CheckGeoIP on rules of snapshot
+func (c *ProxyList) checkGeoIP(ip net.IP) (proxy bool, ok bool) {
+	if c.geoip == nil || len(c.geoIPs) == 0 || ip == nil {
+		return false, false
+	}
+	country, err := c.geoip.Country(ip)
+	if err != nil {
+		log.GetLogger().Debug("GeoIP lookup failed", zap.String("ip", ip.String()), zap.String("error", err.Error()))
+		return false, false
+	}
+	proxy, ok = c.geoIPs[strings.ToUpper(country)]
+	return
+}
+
+// IsListedDomain tells whether any domain rule, proxy or exception, matches domain, country rules only apply to
+// domains no rule matches
+func (c *PacListMgr) IsListedDomain(domain string) bool {
+	list := c.rules()
+	if _, ok := common.MatchDomainRule(list.exceptDomains, domain); ok {
+		return true
+	}
+	_, _, ok := list.matchProxyDomain(domain)
+	return ok
+}
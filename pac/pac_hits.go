@@ -0,0 +1,208 @@
+package pac
+
+import (
+	"github.com/weishi258/redfrog-core/common"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ip answered for a listed domain is attributed to its rule at least this long, as routing table keeps it
+	RULE_HIT_IP_TTL      = time.Hour
+	RULE_HIT_IP_SCAVENGE = 10 * time.Minute
+)
+
+// ruleCounter counts hits of one rule, only rules of pac lists have one, rules learned at runtime are not counted
+type ruleCounter struct {
+	queries uint64
+	conns   uint64
+}
+
+// RuleHits is hit count of a rule, keyed as merged rules are, e.g. "*.example.com", "1.2.3.0/24" or "GEOIP,US"
+type RuleHits struct {
+	Key     string     `json:"key"`
+	Origin  RuleOrigin `json:"origin"`
+	Queries uint64     `json:"queries"`
+	Conns   uint64     `json:"conns"`
+}
+
+type ipRule struct {
+	key    string
+	expire time.Time
+}
+
+// ruleIPs attributes ips answered for listed domains to rules matching the domains, so intercepted connections to
+// them are counted for domain rules
+type ruleIPs struct {
+	sync.RWMutex
+	ips       map[string]ipRule
+	scavenged time.Time
+}
+
+// composeCounters returns counter of each rule key, counters of rules in origin are kept so reload does not reset them
+func composeCounters(origins map[string]RuleOrigin, origin map[string]*ruleCounter) map[string]*ruleCounter {
+	ret := make(map[string]*ruleCounter, len(origins))
+	for key := range origins {
+		if counter, ok := origin[key]; ok {
+			ret[key] = counter
+		} else {
+			ret[key] = &ruleCounter{}
+		}
+	}
+	return ret
+}
+
+// countQuery counts query for rule of key
+func (c *ProxyList) countQuery(key string) {
+	if counter, ok := c.counters[key]; ok {
+		atomic.AddUint64(&counter.queries, 1)
+	}
+}
+
+// CheckQueryDomain is CheckDomain counting DNS query for rule matched
+func (c *PacListMgr) CheckQueryDomain(domain string) bool {
+	return c.checkDomain(domain, true)
+}
+
+// AttributeIPs remembers ips answered for domains, which intercepted connections are counted by, ips of domain
+// matching no list rule are skipped
+func (c *PacListMgr) AttributeIPs(domainIPs map[string][]net.IP, ttl time.Duration) {
+	if ttl < RULE_HIT_IP_TTL {
+		ttl = RULE_HIT_IP_TTL
+	}
+	now := time.Now()
+	list := c.rules()
+	keys := make(map[string]string, len(domainIPs))
+	for domain := range domainIPs {
+		if key, ok := list.domainRuleKey(domain); ok {
+			keys[domain] = key
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	c.ruleIPs.Lock()
+	defer c.ruleIPs.Unlock()
+	if c.ruleIPs.ips == nil {
+		c.ruleIPs.ips = make(map[string]ipRule)
+		c.ruleIPs.scavenged = now
+	}
+	if now.Sub(c.ruleIPs.scavenged) > RULE_HIT_IP_SCAVENGE {
+		for ip, rule := range c.ruleIPs.ips {
+			if now.After(rule.expire) {
+				delete(c.ruleIPs.ips, ip)
+			}
+		}
+		c.ruleIPs.scavenged = now
+	}
+	for domain, key := range keys {
+		for _, ip := range domainIPs[domain] {
+			c.ruleIPs.ips[ip.String()] = ipRule{key: key, expire: now.Add(ttl)}
+		}
+	}
+}
+
+// domainRuleKey returns key of list rule deciding domain, as CheckDomain and CheckDirectDomain match
+func (c *ProxyList) domainRuleKey(domain string) (string, bool) {
+	for _, rules := range []map[string]bool{c.directDomains, c.exceptDomains} {
+		if key, _, ok := common.MatchDomainRuleKey(rules, domain); ok {
+			_, counted := c.counters[key]
+			return key, counted
+		}
+	}
+	// learned domain has no counter
+	if key, _, ok := c.matchProxyDomain(domain); ok {
+		_, counted := c.counters[key]
+		return key, counted
+	}
+	return "", false
+}
+
+// CountConnection counts connection to host, domain or ip, for list rule deciding it, an ip is counted for domain
+// rule it was answered for, else for ip, CIDR or country rule matching it
+func (c *PacListMgr) CountConnection(host string) {
+	list := c.rules()
+	ip := net.ParseIP(host)
+	if ip == nil {
+		if key, ok := list.domainRuleKey(host); ok {
+			atomic.AddUint64(&list.counters[key].conns, 1)
+		}
+		return
+	}
+	key := ip.String()
+	c.ruleIPs.RLock()
+	rule, attributed := c.ruleIPs.ips[key]
+	c.ruleIPs.RUnlock()
+
+	if !attributed || time.Now().After(rule.expire) {
+		rule.key = list.ipRuleKey(ip)
+	}
+	if counter, ok := list.counters[rule.key]; ok {
+		atomic.AddUint64(&counter.conns, 1)
+	}
+}
+
+// ipRuleKey returns key of rule deciding ip as CheckIP and CheckDirectIP do
+func (c *ProxyList) ipRuleKey(ip net.IP) string {
+	key := ip.String()
+	if c.directIPs[key] {
+		return key
+	}
+	if _, ok := c.proxyIPs[key]; ok {
+		return key
+	}
+	for _, rules := range [][]ipNetRule{c.directNets, c.proxyNets} {
+		// exception wins as matchIPNets decides, else the first containing rule
+		matched := ""
+		for _, rule := range rules {
+			if rule.ipNet.Contains(ip) {
+				if !rule.flag {
+					return rule.ipNet.String()
+				}
+				if len(matched) == 0 {
+					matched = rule.ipNet.String()
+				}
+			}
+		}
+		if len(matched) > 0 {
+			return matched
+		}
+	}
+	if c.geoip != nil && len(c.geoIPs) > 0 {
+		if country, err := c.geoip.Country(ip); err == nil {
+			return "GEOIP," + strings.ToUpper(country)
+		}
+	}
+	return ""
+}
+
+// GetRuleHits returns hit counts of list rules, most hit first, or only rules never hit if unused is set
+func (c *PacListMgr) GetRuleHits(unused bool) []RuleHits {
+	list := c.rules()
+	ret := make([]RuleHits, 0, len(list.counters))
+	for key, counter := range list.counters {
+		hits := RuleHits{Key: key, Origin: list.origins[key], Queries: atomic.LoadUint64(&counter.queries),
+			Conns: atomic.LoadUint64(&counter.conns)}
+		if !unused || hits.Queries+hits.Conns == 0 {
+			ret = append(ret, hits)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Queries+ret[i].Conns != ret[j].Queries+ret[j].Conns {
+			return ret[i].Queries+ret[i].Conns > ret[j].Queries+ret[j].Conns
+		}
+		if ret[i].Origin.File != ret[j].Origin.File {
+			return ret[i].Origin.File < ret[j].Origin.File
+		}
+		if ret[i].Origin.Line != ret[j].Origin.Line {
+			return ret[i].Origin.Line < ret[j].Origin.Line
+		}
+		return ret[i].Key < ret[j].Key
+	})
+	return ret
+}
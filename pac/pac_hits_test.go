@@ -0,0 +1,71 @@
+package pac
+
+import (
+	"github.com/weishi258/redfrog-core/log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRuleHits(t *testing.T) {
+	log.InitLogger("", "error", false)
+	list := &PacList{Domains: make(map[string]bool), IPs: make(map[string]bool), DirectDomains: make(map[string]bool), DirectIPs: make(map[string]bool)}
+	for _, line := range []string{".google.com", "@@maps.google.com", "8.8.8.0/24", "1.1.1.1", ".unused.com"} {
+		if err := list.parsePacListLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	origins := make(map[string]RuleOrigin)
+	for _, key := range []string{"*.google.com", "maps.google.com", "8.8.8.0/24", "1.1.1.1", "*.unused.com"} {
+		origins[key] = RuleOrigin{File: "list.txt", Rule: key}
+	}
+	mgr := &PacListMgr{}
+	mgr.proxyList.Store(&ProxyList{
+		proxyDomains:  list.Domains,
+		exceptDomains: composeExceptions(list.Domains),
+		directDomains: list.DirectDomains,
+		proxyIPs:      list.IPs,
+		proxyNets:     composeIPNets(list.IPs),
+		origins:       origins,
+		counters:      composeCounters(origins, nil),
+	})
+
+	if !mgr.CheckQueryDomain("www.google.com") || mgr.CheckQueryDomain("maps.google.com") {
+		t.Fatal("unexpected domain check")
+	}
+	mgr.CheckDomain("mail.google.com")
+	mgr.AttributeIPs(map[string][]net.IP{"www.google.com": {net.ParseIP("142.250.1.1")}, "unlisted.com": {net.ParseIP("9.9.9.9")}}, time.Minute)
+	for _, host := range []string{"142.250.1.1", "8.8.8.8", "8.8.8.4", "1.1.1.1", "maps.google.com", "9.9.9.9"} {
+		mgr.CountConnection(host)
+	}
+
+	expected := map[string]RuleHits{
+		"8.8.8.0/24":      {Queries: 0, Conns: 2},
+		"*.google.com":    {Queries: 1, Conns: 1},
+		"maps.google.com": {Queries: 1, Conns: 1},
+		"1.1.1.1":         {Queries: 0, Conns: 1},
+		"*.unused.com":    {},
+	}
+	hits := mgr.GetRuleHits(false)
+	if len(hits) != len(expected) || hits[len(hits)-1].Key != "*.unused.com" {
+		t.Fatalf("unexpected hits %v", hits)
+	}
+	for _, hit := range hits {
+		if e := expected[hit.Key]; hit.Queries != e.Queries || hit.Conns != e.Conns {
+			t.Errorf("rule %s got %d queries %d conns, expected %d and %d", hit.Key, hit.Queries, hit.Conns, e.Queries, e.Conns)
+		}
+	}
+	if unused := mgr.GetRuleHits(true); len(unused) != 1 || unused[0].Key != "*.unused.com" {
+		t.Errorf("unexpected unused rules %v", unused)
+	}
+
+	// reload keeps counters of rules still listed
+	delete(origins, "1.1.1.1")
+	counters := composeCounters(origins, mgr.rules().counters)
+	if _, ok := counters["1.1.1.1"]; ok {
+		t.Error("counter of removed rule should be dropped")
+	}
+	if conns := counters["8.8.8.0/24"].conns; conns != 2 {
+		t.Errorf("counter should survive reload, got %d conns", conns)
+	}
+}
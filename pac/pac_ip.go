@@ -0,0 +1,65 @@
+package pac
+
+import "net"
+
+// ipNetRule is a CIDR rule of pac list, flag is false for "@@" exception
+type ipNetRule struct {
+	ipNet *net.IPNet
+	flag  bool
+}
+
+// parseIPRule returns normalized ip or CIDR rule, CIDR of a single address becomes the ip, ok is false for neither
+func parseIPRule(input string) (rule string, ok bool) {
+	if ip := net.ParseIP(input); ip != nil {
+		return ip.String(), true
+	}
+	_, ipNet, err := net.ParseCIDR(input)
+	if err != nil {
+		return "", false
+	}
+	if ones, bits := ipNet.Mask.Size(); ones == bits {
+		return ipNet.IP.String(), true
+	}
+	return ipNet.String(), true
+}
+
+// composeIPNets collects CIDR rules out of ip rules
+func composeIPNets(ips map[string]bool) []ipNetRule {
+	ret := make([]ipNetRule, 0)
+	for rule, flag := range ips {
+		if _, ipNet, err := net.ParseCIDR(rule); err == nil {
+			ret = append(ret, ipNetRule{ipNet: ipNet, flag: flag})
+		}
+	}
+	return ret
+}
+
+// matchIPNets tells whether ip is inside a CIDR rule, exception wins over overlapping proxy rule
+func matchIPNets(rules []ipNetRule, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	matched := false
+	for _, rule := range rules {
+		if rule.ipNet.Contains(ip) {
+			if !rule.flag {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// containsIPNets tells whether any CIDR rule, proxy or exception, covers ip
+func containsIPNets(rules []ipNetRule, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, rule := range rules {
+		if rule.ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package pac
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParsePacListLineIP(t *testing.T) {
+	list := &PacList{Domains: make(map[string]bool), IPs: make(map[string]bool), DirectDomains: make(map[string]bool), DirectIPs: make(map[string]bool)}
+	for _, line := range []string{"1.2.3.4", "91.108.4.0/22", "2001:db8::/32", "2001:db8::1", "@@91.108.4.0/24", "5.6.7.8/32",
+		"10.0.0.0/8$direct", "||8.8.8.8/dns-query"} {
+		if err := list.parsePacListLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, rule := range []string{"1.2.3.4", "91.108.4.0/22", "2001:db8::/32", "2001:db8::1", "5.6.7.8", "8.8.8.8"} {
+		if !list.IPs[rule] {
+			t.Errorf("%s should be proxied, got %v", rule, list.IPs)
+		}
+	}
+	if flag, ok := list.IPs["91.108.4.0/24"]; !ok || flag {
+		t.Errorf("CIDR exception not parsed, got %v", list.IPs)
+	}
+	if !list.DirectIPs["10.0.0.0/8"] {
+		t.Errorf("direct CIDR not parsed, got %v", list.DirectIPs)
+	}
+}
+
+func TestMatchIPNets(t *testing.T) {
+	rules := composeIPNets(map[string]bool{"91.108.4.0/22": true, "91.108.4.0/24": false, "2001:db8::/32": true, "1.2.3.4": true})
+	if len(rules) != 3 {
+		t.Fatalf("plain ip should not be composed, got %d rules", len(rules))
+	}
+	for ip, expected := range map[string]bool{"91.108.5.1": true, "91.108.4.1": false, "2001:db8::5": true, "8.8.8.8": false} {
+		if matchIPNets(rules, net.ParseIP(ip)) != expected {
+			t.Errorf("match %s should be %v", ip, expected)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package pac
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// learned domain not answered again for this long is forgotten
+	PAC_LEARNED_TTL      = 24 * time.Hour
+	PAC_LEARNED_SCAVENGE = 10 * time.Minute
+	PAC_LEARNED_MAX      = 65536
+)
+
+type learnedDomain struct {
+	flag   bool
+	expire time.Time
+}
+
+// learnedDomains are domains learned at runtime, e.g. CNAME of proxied domain, rules snapshot shares one until reload
+// drops it, so learning a domain changes it in place instead of copying the snapshot
+type learnedDomains struct {
+	sync.RWMutex
+	domains   map[string]learnedDomain
+	scavenged time.Time
+}
+
+func newLearnedDomains() *learnedDomains {
+	return &learnedDomains{domains: make(map[string]learnedDomain), scavenged: time.Now()}
+}
+
+// add learns domain or refreshes its expiry, false if it is not learned since PAC_LEARNED_MAX domains are learned
+func (c *learnedDomains) add(domain string, flag bool) bool {
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	if now.Sub(c.scavenged) > PAC_LEARNED_SCAVENGE {
+		for key, learned := range c.domains {
+			if now.After(learned.expire) {
+				delete(c.domains, key)
+			}
+		}
+		c.scavenged = now
+	}
+	if _, ok := c.domains[domain]; !ok && len(c.domains) >= PAC_LEARNED_MAX {
+		return false
+	}
+	c.domains[domain] = learnedDomain{flag: flag, expire: now.Add(PAC_LEARNED_TTL)}
+	return true
+}
+
+func (c *learnedDomains) get(domain string) (flag bool, ok bool) {
+	if c == nil {
+		return false, false
+	}
+	c.RLock()
+	learned, ok := c.domains[domain]
+	c.RUnlock()
+	if !ok || time.Now().After(learned.expire) {
+		return false, false
+	}
+	return learned.flag, true
+}
+
+// each calls fn on every domain not expired, fn must not learn domains
+func (c *learnedDomains) each(fn func(domain string, flag bool)) {
+	if c == nil {
+		return
+	}
+	now := time.Now()
+	c.RLock()
+	defer c.RUnlock()
+	for domain, learned := range c.domains {
+		if now.Before(learned.expire) {
+			fn(domain, learned.flag)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package pac
+
+import (
+	"fmt"
+	"github.com/weishi258/redfrog-core/log"
+	"testing"
+	"time"
+)
+
+func TestLearnedDomains(t *testing.T) {
+	log.InitLogger("", "error", false)
+	mgr := &PacListMgr{}
+	mgr.proxyList.Store(&ProxyList{learnedDomains: newLearnedDomains()})
+	snapshot := mgr.rules()
+	mgr.AddDomain("cdn.example.com", true)
+	if mgr.rules() != snapshot || !mgr.CheckDomain("cdn.example.com") {
+		t.Fatal("learned domain should be checked without copying snapshot")
+	}
+
+	learned := snapshot.learnedDomains
+	learned.Lock()
+	learned.domains["cdn.example.com"] = learnedDomain{flag: true, expire: time.Now().Add(-time.Second)}
+	learned.scavenged = time.Now().Add(-PAC_LEARNED_SCAVENGE - time.Second)
+	learned.Unlock()
+	if mgr.CheckDomain("cdn.example.com") {
+		t.Error("expired domain should not be checked")
+	}
+	mgr.AddDomain("www.example.com", true)
+	if _, ok := learned.domains["cdn.example.com"]; ok {
+		t.Error("expired domain should be scavenged")
+	}
+
+	for i := len(learned.domains); i < PAC_LEARNED_MAX; i++ {
+		learned.add(fmt.Sprintf("host%d.example.com", i), true)
+	}
+	if learned.add("new.example.com", true) || !learned.add("www.example.com", false) {
+		t.Error("new domain should be skipped when full, learned one still updated")
+	}
+	if flag, ok := learned.get("www.example.com"); !ok || flag {
+		t.Errorf("learned domain should be updated, got %v %v", flag, ok)
+	}
+}
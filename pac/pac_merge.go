@@ -0,0 +1,153 @@
+package pac
+
+import (
+	"fmt"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+)
+
+// conflicts beyond this many are only counted, not logged one by one, so a large list set does not flood the log
+const MAX_CONFLICTS_REPORTED = 20
+
+// action of a rule key, a key may carry only one of them after merge
+const (
+	RULE_ACTION_PROXY = iota
+	RULE_ACTION_EXCEPTION
+	RULE_ACTION_DIRECT
+)
+
+var ruleActionNames = []string{"proxy", "exception", "direct"}
+
+// RuleOrigin is where a rule comes from, for finding the line of a large merged list deciding a match
+type RuleOrigin struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+	Rule string `json:"rule"`
+}
+
+func (c RuleOrigin) String() string {
+	return fmt.Sprintf("%s:%d %s", c.File, c.Line, c.Rule)
+}
+
+type ruleOwner struct {
+	action int
+	source string
+	origin RuleOrigin
+}
+
+// mergedRules are rules of all pac lists composed by precedence
+type mergedRules struct {
+	proxyDomains  map[string]bool
+	proxyIPs      map[string]bool
+	directDomains map[string]bool
+	directIPs     map[string]bool
+	geoIPs        map[string]bool
+	// origin of rule kept for each key of maps above, country rules keyed as "GEOIP,US"
+	origins map[string]RuleOrigin
+	// same rule found again in a later list
+	duplicates int
+	// rule key given different actions
+	conflicts int
+}
+
+// mergePacLists composes lists in order of paths, for a key given different actions an exception always wins, else
+// the later list overrides the earlier one, a list with both proxy and $direct rule of a key keeps $direct
+func mergePacLists(paths []string, lists map[string]*PacList) *mergedRules {
+	ret := &mergedRules{}
+	domains := make(map[string]ruleOwner)
+	ips := make(map[string]ruleOwner)
+	geoIPs := make(map[string]ruleOwner)
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		list, ok := lists[path]
+		if !ok || seen[path] {
+			continue
+		}
+		seen[path] = true
+		for domain, flag := range list.Domains {
+			ret.merge(domains, domain, proxyAction(flag), path, list.Origins[domain])
+		}
+		for domain := range list.DirectDomains {
+			ret.merge(domains, domain, RULE_ACTION_DIRECT, path, list.DirectOrigins[domain])
+		}
+		for ip, flag := range list.IPs {
+			ret.merge(ips, ip, proxyAction(flag), path, list.Origins[ip])
+		}
+		for ip := range list.DirectIPs {
+			ret.merge(ips, ip, RULE_ACTION_DIRECT, path, list.DirectOrigins[ip])
+		}
+		for country, flag := range list.GeoIPs {
+			action := RULE_ACTION_DIRECT
+			if flag {
+				action = RULE_ACTION_PROXY
+			}
+			ret.merge(geoIPs, "GEOIP,"+country, action, path, list.Origins["GEOIP,"+country])
+		}
+	}
+
+	ret.proxyDomains, ret.directDomains = splitRules(domains)
+	ret.proxyIPs, ret.directIPs = splitRules(ips)
+	ret.geoIPs = make(map[string]bool)
+	ret.origins = make(map[string]RuleOrigin, len(domains)+len(ips)+len(geoIPs))
+	for key, owner := range geoIPs {
+		ret.geoIPs[key[len("GEOIP,"):]] = owner.action == RULE_ACTION_PROXY
+		ret.origins[key] = owner.origin
+	}
+	for _, owners := range []map[string]ruleOwner{domains, ips} {
+		for key, owner := range owners {
+			ret.origins[key] = owner.origin
+		}
+	}
+	if ret.conflicts > MAX_CONFLICTS_REPORTED {
+		log.GetLogger().Warn("More pac list conflicts not logged", zap.Int("count", ret.conflicts-MAX_CONFLICTS_REPORTED))
+	}
+	return ret
+}
+
+func proxyAction(flag bool) int {
+	if flag {
+		return RULE_ACTION_PROXY
+	}
+	return RULE_ACTION_EXCEPTION
+}
+
+func (c *mergedRules) merge(owners map[string]ruleOwner, key string, action int, source string, ruleOrigin RuleOrigin) {
+	origin, ok := owners[key]
+	if !ok {
+		owners[key] = ruleOwner{action, source, ruleOrigin}
+		return
+	}
+	if origin.action == action {
+		c.duplicates++
+		return
+	}
+	c.conflicts++
+	kept := ruleOwner{action, source, ruleOrigin}
+	dropped := origin
+	if origin.action == RULE_ACTION_EXCEPTION {
+		kept, dropped = origin, kept
+	}
+	owners[key] = kept
+	if c.conflicts <= MAX_CONFLICTS_REPORTED {
+		log.GetLogger().Warn("Pac list rule conflict", zap.String("rule", key),
+			zap.String("kept", ruleActionNames[kept.action]), zap.String("kept list", kept.source), zap.Stringer("kept rule", kept.origin),
+			zap.String("dropped", ruleActionNames[dropped.action]), zap.String("dropped list", dropped.source), zap.Stringer("dropped rule", dropped.origin))
+	}
+}
+
+// splitRules returns proxy rules with exceptions as false, and direct rules
+func splitRules(owners map[string]ruleOwner) (proxy map[string]bool, direct map[string]bool) {
+	proxy = make(map[string]bool)
+	direct = make(map[string]bool)
+	for key, owner := range owners {
+		switch owner.action {
+		case RULE_ACTION_PROXY:
+			proxy[key] = true
+		case RULE_ACTION_EXCEPTION:
+			proxy[key] = false
+		default:
+			direct[key] = true
+		}
+	}
+	return
+}
@@ -0,0 +1,97 @@
+package pac
+
+import (
+	"github.com/weishi258/redfrog-core/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func parseTestList(t *testing.T, lines ...string) *PacList {
+	list := &PacList{Domains: make(map[string]bool), IPs: make(map[string]bool), DirectDomains: make(map[string]bool),
+		DirectIPs: make(map[string]bool), GeoIPs: make(map[string]bool)}
+	for _, line := range lines {
+		if err := list.parsePacListLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return list
+}
+
+func TestMergePacLists(t *testing.T) {
+	log.InitLogger("", "error", false)
+	lists := map[string]*PacList{
+		"base.txt":   parseTestList(t, "google.com", "@@baidu.com", "example.com", "1.2.3.4", "GEOIP,JP,PROXY"),
+		"custom.txt": parseTestList(t, "google.com", "baidu.com", "example.com$direct", "1.2.3.4$direct", "GEOIP,JP,DIRECT"),
+	}
+	merged := mergePacLists([]string{"base.txt", "custom.txt", "base.txt"}, lists)
+	if merged.duplicates != 1 || merged.conflicts != 4 {
+		t.Errorf("got %d duplicates %d conflicts, expected 1 and 4", merged.duplicates, merged.conflicts)
+	}
+	if !merged.proxyDomains["google.com"] {
+		t.Error("google.com should be proxied")
+	}
+	if flag, ok := merged.proxyDomains["baidu.com"]; !ok || flag {
+		t.Error("exception of earlier list should win")
+	}
+	if _, ok := merged.proxyDomains["example.com"]; ok || !merged.directDomains["example.com"] {
+		t.Error("later $direct rule should override proxy rule")
+	}
+	if _, ok := merged.proxyIPs["1.2.3.4"]; ok || !merged.directIPs["1.2.3.4"] {
+		t.Error("later $direct ip rule should override proxy rule")
+	}
+	if proxy, ok := merged.geoIPs["JP"]; !ok || proxy {
+		t.Error("later country rule should win")
+	}
+
+	// order decides, not names
+	merged = mergePacLists([]string{"custom.txt", "base.txt"}, lists)
+	if !merged.proxyDomains["example.com"] || merged.directDomains["example.com"] || !merged.geoIPs["JP"] {
+		t.Errorf("later list should win, got %v %v %v", merged.proxyDomains, merged.directDomains, merged.geoIPs)
+	}
+}
+
+func TestRuleOrigin(t *testing.T) {
+	log.InitLogger("", "error", false)
+	dir, err := ioutil.TempDir("", "pac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "base.txt")
+	custom := filepath.Join(dir, "custom.txt")
+	if err = ioutil.WriteFile(base, []byte("! base\n||google.com\n\nexample.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(custom, []byte("@@maps.google.com\n||example.com$direct\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lists := make(map[string]*PacList)
+	for _, path := range []string{base, custom} {
+		if lists[path], err = parsePacList(path, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	merged := mergePacLists([]string{base, custom}, lists)
+	mgr := &PacListMgr{}
+	mgr.proxyList.Store(&ProxyList{
+		proxyDomains:  merged.proxyDomains,
+		directDomains: merged.directDomains,
+		exceptDomains: composeExceptions(merged.proxyDomains),
+		origins:       merged.origins,
+	})
+
+	state := mgr.GetDomainState("www.google.com")
+	if !state.Proxy || state.Rule == nil || *state.Rule != (RuleOrigin{base, 2, "||google.com"}) {
+		t.Errorf("unexpected state %+v rule %v", state, state.Rule)
+	}
+	state = mgr.GetDomainState("maps.google.com")
+	if state.Proxy || !state.Exception || state.Rule == nil || *state.Rule != (RuleOrigin{custom, 1, "@@maps.google.com"}) {
+		t.Errorf("unexpected state %+v rule %v", state, state.Rule)
+	}
+	state = mgr.GetDomainState("example.com")
+	if state.Listed || !state.Direct || state.DirectRule == nil || *state.DirectRule != (RuleOrigin{custom, 2, "||example.com$direct"}) {
+		t.Errorf("unexpected state %+v rule %v", state, state.DirectRule)
+	}
+}
@@ -3,20 +3,29 @@ package pac
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/weishi258/redfrog-core/common"
 	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/geoip"
 	"github.com/weishi258/redfrog-core/log"
 	"github.com/weishi258/redfrog-core/routing"
 	"go.uber.org/zap"
-	"os"
+	"io/ioutil"
+	"net"
 	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const MONITOR_INTERVAL = 5
 
+// header of AutoProxy list, e.g. "[AutoProxy 0.2.9]", which gfwlist publishes base64 encoded
+const AUTO_PROXY_HEADER = "[AutoProxy"
+
 const (
 	regex_pacVersion_   = "^\\[(.*)\\]$"
 	regex_commentRegex_ = "^!(.*)$"
@@ -25,47 +34,138 @@ const (
 	regex_domain_0_     = "^\\|\\|([^ /]+)(/.*)?$"
 	regex_domain_1_     = "^\\.([^ /]+)(/.*)?$"
 	regex_domain_2_     = "([^\\*\\.]*\\*\\.)([^ /]+)(/.*)?$"
+	regex_wildcard_     = "^\\*\\.([^ /\\*]+)(/.*)?$"
 	regex_ip_           = "^((25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\\.(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\\.(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\\.(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?))/?(.*)$"
 	regex_domain_last_  = "^([^ /\\*\\|]+)(/.*)?$"
 	regex_domain_regex_ = "^/(.+)/$"
+	regex_direct_       = "(?i)^(.+)\\$direct$"
+	// "!" exception outside AutoProxy list, where "!" starts comment, e.g. "!maps.google.com" or "!1.2.3.0/24", matched
+	// on line with spaces kept and domain needing a TLD with letter, so comment like "! Updated 2020.01.02" is not one
+	regex_bangExcept_ = "^!([\\*\\.\\|]*([A-Za-z0-9-]+\\.)+[A-Za-z0-9-]*[A-Za-z][A-Za-z0-9-]*|[0-9]{1,3}(\\.[0-9]{1,3}){3}(/[0-9]{1,2})?)$"
+)
+
+// scope of domain rule, stored in rule maps as "example.com" for exact and "*.example.com" for subdomains, a rule of
+// both scopes is stored under both keys
+const (
+	// "example.com", also "|http://example.com/" of AutoProxy
+	DOMAIN_SCOPE_EXACT = iota
+	// "*.example.com"
+	DOMAIN_SCOPE_SUBDOMAINS
+	// ".example.com", also "||example.com" of AutoProxy, and bare "example.com" inside AutoProxy list since AutoProxy
+	// matches it anywhere in URL
+	DOMAIN_SCOPE_BOTH
 )
 
 type PacList struct {
 	Domains map[string]bool
 	IPs     map[string]bool
+	// rules with $direct action, intercepted traffic to them is dialed by proxy client itself
+	DirectDomains map[string]bool
+	DirectIPs     map[string]bool
+	// country rules keyed by ISO code, false for DIRECT
+	GeoIPs map[string]bool
+	// where rules deciding keys of Domains, IPs and GeoIPs, as "GEOIP,US", come from, and those of direct rules
+	Origins       map[string]RuleOrigin
+	DirectOrigins map[string]RuleOrigin
+	// list started with AutoProxy header
+	autoProxy bool
+	// source is suffixed by "$direct", domains of its dnsmasq lines are $direct rules, e.g. dnsmasq-china-list
+	direct bool
+	// file and line being parsed, recorded into origins
+	path    string
+	lineNum int
+	rule    string
 }
+
+// ProxyList is a snapshot of rules, never changed once stored, a change is made to a copy which replaces it
 type ProxyList struct {
 	// for proxy_client
-	proxyDomains map[string]bool
-	proxyIPs     map[string]bool
-	sync.RWMutex
+	proxyDomains  map[string]bool
+	proxyIPs      map[string]bool
+	directDomains map[string]bool
+	directIPs     map[string]bool
+	// "@@" exceptions among proxyDomains, checked before proxy rules
+	exceptDomains map[string]bool
+	// CIDR rules, also kept in maps above by their CIDR string
+	proxyNets  []ipNetRule
+	directNets []ipNetRule
+	// country rules and database they are looked up in, nil if not loaded
+	geoIPs map[string]bool
+	geoip  *geoip.Reader
+	// where rules of maps above come from, rules learned at runtime have none
+	origins map[string]RuleOrigin
+	// hits of rules which have origin
+	counters map[string]*ruleCounter
+	// domains learned at runtime, e.g. CNAME of proxied domain, they win over proxyDomains and are dropped on reload
+	learnedDomains *learnedDomains
 }
 type PacListMgr struct {
 	// for reading paclist and compare
 	sync.Mutex
-	pacLists  map[string]*PacList
-	proxyList ProxyList
+	pacLists map[string]*PacList
+	// current *ProxyList, swapped as a whole so checks on DNS queries never wait for reload
+	proxyList atomic.Value
+	// serializes changes of proxyList
+	proxyMux sync.Mutex
 
 	// routing table
 	routingMgr *routing.RoutingMgr
+
+	// serializes loading by reload signal and remote list refresh
+	loadMux sync.Mutex
+	sources []string
+	// pac list sources given by URL, keyed by URL
+	remotes         map[string]*remoteList
+	cacheDir        string
+	refreshInterval time.Duration
+	refreshDone     chan struct{}
+	dialer          Dialer
+	// reloads lists when local list files change, nil if disabled
+	watcher *pacWatcher
+	// listed domains and ips go direct and all others are proxied
+	whitelist bool
+	// rules of listed domains answered ips are counted for
+	ruleIPs ruleIPs
 }
 
-func StartPacListMgr(routingMgr *routing.RoutingMgr) (ret *PacListMgr, err error) {
+// StartPacListMgr starts manager, pac list URLs are cached into cacheDir and downloaded again every refresh seconds,
+// local list files are reloaded on change if watch is set
+func StartPacListMgr(routingMgr *routing.RoutingMgr, cacheDir string, refresh int, watch bool) (ret *PacListMgr, err error) {
 	logger := log.GetLogger()
 	ret = &PacListMgr{}
 	if routingMgr == nil {
 		return nil, errors.New("routing manager is nil")
 	}
 	ret.routingMgr = routingMgr
+	ret.whitelist = routingMgr.IsWhitelist()
 	ret.pacLists = make(map[string]*PacList)
-	ret.proxyList.proxyDomains = make(map[string]bool)
-	ret.proxyList.proxyIPs = make(map[string]bool)
+	ret.proxyList.Store(&ProxyList{learnedDomains: newLearnedDomains()})
+	ret.remotes = make(map[string]*remoteList)
+	ret.cacheDir = cacheDir
+	ret.refreshDone = make(chan struct{})
+	if refresh > 0 {
+		ret.refreshInterval = time.Duration(refresh) * time.Second
+		go ret.startRefresh()
+	}
+	if watch {
+		if ret.watcher, err = newPacWatcher(); err != nil {
+			// falls back to reload signal
+			logger.Warn("Watch pac list files failed", zap.String("error", err.Error()))
+			ret.watcher, err = nil, nil
+		} else {
+			go ret.watcher.run(ret.reloadChanged)
+		}
+	}
 
 	logger.Info("Start pac List Manager successful")
 	return
 }
 func (c *PacListMgr) Stop() {
 	logger := log.GetLogger()
+	close(c.refreshDone)
+	if c.watcher != nil {
+		c.watcher.close()
+	}
 	logger.Info("Stop pac List Manager successful")
 }
 
@@ -78,19 +178,27 @@ func (c *PacListMgr) ReadPacList(paths []string) {
 }
 func (c *PacListMgr) loadPacLists(paths []string, reload bool) {
 	logger := log.GetLogger()
-	if reload {
-		c.Lock()
-		c.pacLists = make(map[string]*PacList)
-		c.Unlock()
-	}
+	c.loadMux.Lock()
+	defer c.loadMux.Unlock()
+	c.sources = paths
+	if c.watcher != nil {
+		c.watcher.watch(localFiles(paths))
+	}
+	// lists are parsed aside and swapped in at once, a list failing to parse on reload, e.g. while being written,
+	// keeps its previous rules
+	pacLists := make(map[string]*PacList)
 	for _, path := range paths {
-		if _, ok := c.pacLists[path]; !ok {
-			if ret, err := parsePacList(path); err != nil {
+		if _, ok := pacLists[path]; !ok {
+			source, direct := splitListSource(path)
+			if ret, err := parsePacList(c.localPath(source), direct); err != nil {
 				logger.Error("Parse Pac List file failed", zap.String("file", path), zap.String("error", err.Error()))
-			} else {
 				c.Lock()
-				c.pacLists[path] = ret
+				if origin, ok := c.pacLists[path]; ok && reload {
+					pacLists[path] = origin
+				}
 				c.Unlock()
+			} else {
+				pacLists[path] = ret
 				logger.Info("Parse Pac List file successful", zap.String("file", path))
 			}
 		} else {
@@ -98,46 +206,49 @@ func (c *PacListMgr) loadPacLists(paths []string, reload bool) {
 		}
 
 	}
-
-	proxyDomains := make(map[string]bool)
-	proxyIPs := make(map[string]bool)
-
-	func() {
-		c.Lock()
-		defer c.Unlock()
-		for _, pacList := range c.pacLists {
-			for domain, flag := range pacList.Domains {
-				proxyDomains[domain] = flag
-			}
-			for ip, flag := range pacList.IPs {
-				proxyIPs[ip] = flag
-			}
-		}
-	}()
-
-	c.proxyList.Lock()
-	defer c.proxyList.Unlock()
+	c.Lock()
+	c.pacLists = pacLists
+	c.Unlock()
+
+	c.Lock()
+	merged := mergePacLists(paths, c.pacLists)
+	c.Unlock()
+	logger.Info("Pac lists merged", zap.Int("lists", len(pacLists)), zap.Int("duplicates", merged.duplicates),
+		zap.Int("conflicts", merged.conflicts))
+	proxyDomains := merged.proxyDomains
+	proxyIPs := merged.proxyIPs
+
+	// new rules are composed aside, checks keep using current ones meanwhile
+	c.proxyMux.Lock()
+	origin := c.rules()
+	list := &ProxyList{proxyDomains: proxyDomains, proxyIPs: proxyIPs, directDomains: merged.directDomains,
+		directIPs: merged.directIPs, exceptDomains: composeExceptions(proxyDomains), proxyNets: composeIPNets(proxyIPs),
+		directNets: composeIPNets(merged.directIPs), geoIPs: merged.geoIPs, geoip: origin.geoip, origins: merged.origins,
+		counters: composeCounters(merged.origins, origin.counters), learnedDomains: newLearnedDomains()}
+	c.proxyList.Store(list)
+	c.proxyMux.Unlock()
 
 	if reload {
 		// reloading
 		ipListDelete := make([]string, 0)
-		for ip := range c.proxyList.proxyIPs {
-			if _, ok := proxyIPs[ip]; !ok {
+		// routed entry turned into exception is deleted too
+		for ip, flag := range origin.proxyIPs {
+			if flag && !proxyIPs[ip] {
 				ipListDelete = append(ipListDelete, ip)
 				logger.Debug("Ip delete list", zap.String("ip", ip))
 			}
 		}
 
-		c.proxyList.proxyDomains = proxyDomains
-		c.proxyList.proxyIPs = proxyIPs
+		domainsAdded, domainsRemoved := diffRules(origin.proxyDomains, proxyDomains)
+		ipsAdded, ipsRemoved := diffRules(origin.proxyIPs, proxyIPs)
+		logger.Info("Pac list reloaded", zap.Int("domains", len(proxyDomains)), zap.Int("domains added", domainsAdded),
+			zap.Int("domains removed", domainsRemoved), zap.Int("ips", len(proxyIPs)), zap.Int("ips added", ipsAdded),
+			zap.Int("ips removed", ipsRemoved))
 
 		c.routingMgr.ReloadPacList(proxyDomains, proxyIPs, ipListDelete)
 	} else {
 		// first time
 
-		c.proxyList.proxyDomains = proxyDomains
-		c.proxyList.proxyIPs = proxyIPs
-
 		logger.Info("Composing new proxy_client list finished, start to populate routing table")
 		// now lets re-populate routing table
 
@@ -148,58 +259,181 @@ func (c *PacListMgr) loadPacLists(paths []string, reload bool) {
 	return
 }
 
+// diffRules counts rules only in current as added and rules only in origin as removed, changed flag counts as both
+func diffRules(origin map[string]bool, current map[string]bool) (added int, removed int) {
+	for key, flag := range current {
+		if originFlag, ok := origin[key]; !ok || originFlag != flag {
+			added++
+		}
+	}
+	for key, flag := range origin {
+		if currentFlag, ok := current[key]; !ok || currentFlag != flag {
+			removed++
+		}
+	}
+	return
+}
+
+// composeExceptions collects "@@" exception rules out of domain rules
+func composeExceptions(domains map[string]bool) map[string]bool {
+	ret := make(map[string]bool)
+	for domain, flag := range domains {
+		if !flag {
+			ret[domain] = true
+		}
+	}
+	return ret
+}
+
+// AddDomain adds rule learned at runtime, e.g. CNAME of proxied domain, domain with exception is never proxied
 func (c *PacListMgr) AddDomain(domain string, flag bool) {
-	c.proxyList.Lock()
-	defer c.proxyList.Unlock()
-	c.proxyList.proxyDomains[domain] = flag
+	if c.whitelist {
+		// proxied domain is the one not listed
+		flag = !flag
+	} else if _, excepted := common.MatchDomainRule(c.rules().exceptDomains, domain); excepted && flag {
+		return
+	}
+	list := c.rules()
+	if list.learnedDomains == nil {
+		c.proxyMux.Lock()
+		if list = c.rules(); list.learnedDomains == nil {
+			next := *list
+			next.learnedDomains = newLearnedDomains()
+			list = &next
+			c.proxyList.Store(list)
+		}
+		c.proxyMux.Unlock()
+	}
+	if !list.learnedDomains.add(domain, flag) {
+		log.GetLogger().Debug("Too many domains learned, so skip", zap.String("domain", domain))
+	}
 }
 
+// rules returns current rules, which are never changed, so they are read without lock
+func (c *PacListMgr) rules() *ProxyList {
+	if ret, ok := c.proxyList.Load().(*ProxyList); ok {
+		return ret
+	}
+	return &ProxyList{}
+}
+
+// matchProxyDomain is MatchDomainRuleKey on proxy rules, learned domain included
+func (c *ProxyList) matchProxyDomain(domain string) (key string, flag bool, ok bool) {
+	if flag, ok = c.learnedDomains.get(domain); ok {
+		return domain, flag, ok
+	}
+	return common.MatchDomainRuleKey(c.proxyDomains, domain)
+}
+
+// CheckDomain tells whether domain should be proxied, exception rule is checked first, then rule of domain itself wins
+// over wildcard rule of a parent, and rule of a closer parent wins over that of a farther one, in whitelist mode
+// domain listed by that is not proxied and all others are
 func (c *PacListMgr) CheckDomain(domain string) bool {
+	return c.checkDomain(domain, false)
+}
+
+// checkDomain is CheckDomain counting query for rules matched, $direct one included, if count is set
+func (c *PacListMgr) checkDomain(domain string, count bool) bool {
 	logger := log.GetLogger()
-	stubs := common.GenerateDomainStubs(domain)
-	if stubs == nil {
-		return false
+	list := c.rules()
+
+	if count && len(list.directDomains) > 0 {
+		if key, _, ok := common.MatchDomainRuleKey(list.directDomains, domain); ok {
+			list.countQuery(key)
+		}
 	}
-	length := len(stubs)
-	if length == 0 {
-		return false
+	// exception matching domain at any level wins over proxy rules, even more specific ones
+	if key, _, ok := common.MatchDomainRuleKey(list.exceptDomains, domain); ok {
+		// origin is formatted only when debug is logged, domains are checked per DNS query
+		if ce := logger.Check(zap.DebugLevel, "Domain has exception in proxy_client list"); ce != nil {
+			ce.Write(zap.String("domain", domain), zap.String("key", key), zap.Stringer("rule", list.origins[key]))
+		}
+		if count {
+			list.countQuery(key)
+		}
+		return c.whitelist
+	}
+	if key, blacked, ok := list.matchProxyDomain(domain); ok {
+		if ce := logger.Check(zap.DebugLevel, "Domain is in proxy_client list"); ce != nil {
+			ce.Write(zap.String("domain", domain), zap.Bool("blacked", blacked), zap.String("key", key),
+				zap.Stringer("rule", list.origins[key]))
+		}
+		if count {
+			list.countQuery(key)
+		}
+		return blacked != c.whitelist
 	}
 
-	c.proxyList.RLock()
-	defer c.proxyList.RUnlock()
-	proxyList := c.proxyList.proxyDomains
+	logger.Debug("Domain is NOT in proxy_client list", zap.String("domain", domain))
+	return c.whitelist
+}
 
-	for i := 0; i < length; i++ {
-		if blacked, ok := proxyList[stubs[i]]; ok {
-			logger.Debug("Domain is in proxy_client list", zap.String("domain", domain), zap.Bool("blacked", blacked))
-			return blacked
+// CheckIP tells whether ip should be proxied, rule of the ip itself wins over CIDR rules, which win over country
+// rules, inverted in whitelist mode except for country rules which tell their action
+func (c *PacListMgr) CheckIP(ip string) bool {
+	list := c.rules()
+	if flag, ok := list.proxyIPs[ip]; ok {
+		return flag != c.whitelist
+	}
+	parsed := net.ParseIP(ip)
+	if !containsIPNets(list.proxyNets, parsed) {
+		if proxy, ok := list.checkGeoIP(parsed); ok {
+			return proxy
 		}
 	}
+	return matchIPNets(list.proxyNets, parsed) != c.whitelist
+}
 
-	logger.Debug("Domain is NOT in proxy_client list", zap.String("domain", domain))
-	return false
+// CheckExceptionDomain tells whether domain has "@@" exception, so it is never proxied
+func (c *PacListMgr) CheckExceptionDomain(domain string) bool {
+	_, ok := common.MatchDomainRule(c.rules().exceptDomains, domain)
+	return ok
 }
 
-func parsePacList(path string) (ret *PacList, err error) {
+// CheckDirectDomain tells whether domain or its parent has $direct rule
+func (c *PacListMgr) CheckDirectDomain(domain string) bool {
+	_, ok := common.MatchDomainRule(c.rules().directDomains, domain)
+	return ok
+}
+
+func (c *PacListMgr) CheckDirectIP(ip string) bool {
+	list := c.rules()
+	return list.directIPs[ip] || matchIPNets(list.directNets, net.ParseIP(ip))
+}
+
+// splitListSource returns path or URL of pac list source, and whether it is suffixed by "$direct" as rules are
+func splitListSource(source string) (string, bool) {
+	if re := regexp.MustCompile(regex_direct_); re.MatchString(source) {
+		return re.FindStringSubmatch(source)[1], true
+	}
+	return source, false
+}
 
-	file, err := os.Open(config.GetPathFromWorkingDir(path)) // For read access.
+func parsePacList(path string, direct bool) (ret *PacList, err error) {
+
+	content, err := ioutil.ReadFile(config.GetPathFromWorkingDir(path))
 	if err != nil {
 		return nil, errors.Wrapf(err, "Open config file %s failed", path)
 	}
-	defer file.Close()
 
-	ret = &PacList{}
+	ret = &PacList{path: path, direct: direct}
 	ret.Domains = make(map[string]bool)
 	ret.IPs = make(map[string]bool)
+	ret.DirectDomains = make(map[string]bool)
+	ret.DirectIPs = make(map[string]bool)
+	ret.GeoIPs = make(map[string]bool)
 
-	reader := bufio.NewReader(file)
+	reader := bufio.NewReader(bytes.NewReader(decodeAutoProxy(content)))
 
 	lineBuffer := make([]byte, 0)
 	for line, isPrefix, readError := reader.ReadLine(); readError == nil; line, isPrefix, readError = reader.ReadLine() {
 		if isPrefix {
 			lineBuffer = append(lineBuffer, line...)
-		} else if len(lineBuffer) > 0 {
-			if err = ret.parsePacListLine(lineBuffer); err != nil {
+			continue
+		}
+		ret.lineNum++
+		if len(lineBuffer) > 0 {
+			if err = ret.parsePacListLine(append(lineBuffer, line...)); err != nil {
 				return nil, err
 			}
 			lineBuffer = make([]byte, 0)
@@ -213,9 +447,28 @@ func parsePacList(path string) (ret *PacList, err error) {
 	return
 }
 
+// decodeAutoProxy returns AutoProxy list inside base64 content as gfwlist is published, other content is returned as is
+func decodeAutoProxy(content []byte) []byte {
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) == 0 || bytes.HasPrefix(trimmed, []byte(AUTO_PROXY_HEADER)) {
+		return content
+	}
+	// base64 of gfwlist is wrapped into lines
+	encoded := bytes.Join(bytes.Fields(trimmed), nil)
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+	n, err := base64.StdEncoding.Decode(decoded, encoded)
+	if err != nil || !bytes.HasPrefix(decoded[:n], []byte(AUTO_PROXY_HEADER)) {
+		return content
+	}
+	return decoded[:n]
+}
+
 func (c *PacList) equal(other *PacList) bool {
 	if len(c.Domains) != len(other.Domains) ||
-		len(c.IPs) != len(other.IPs) {
+		len(c.IPs) != len(other.IPs) ||
+		len(c.DirectDomains) != len(other.DirectDomains) ||
+		len(c.DirectIPs) != len(other.DirectIPs) ||
+		len(c.GeoIPs) != len(other.GeoIPs) {
 		return false
 	}
 	for key := range c.Domains {
@@ -228,16 +481,96 @@ func (c *PacList) equal(other *PacList) bool {
 			return false
 		}
 	}
+	for key := range c.DirectDomains {
+		if _, ok := other.DirectDomains[key]; !ok {
+			return false
+		}
+	}
+	for key := range c.DirectIPs {
+		if _, ok := other.DirectIPs[key]; !ok {
+			return false
+		}
+	}
+	for key, flag := range c.GeoIPs {
+		if otherFlag, ok := other.GeoIPs[key]; !ok || otherFlag != flag {
+			return false
+		}
+	}
 
 	return true
 }
 
+func (c *PacList) addIP(ip string, bDomainType bool, bDirect bool) {
+	if bDirect {
+		if !c.DirectIPs[ip] {
+			c.DirectIPs[ip] = true
+			c.recordOrigin(ip, true)
+		}
+	} else if originDomainType, ok := c.IPs[ip]; ok {
+		// "@@" exception wins over proxy rule
+		if originDomainType && !bDomainType {
+			c.IPs[ip] = false
+			c.recordOrigin(ip, false)
+		}
+	} else {
+		c.IPs[ip] = bDomainType
+		c.recordOrigin(ip, false)
+	}
+}
+
+func (c *PacList) addDomain(domain string, scope int, bDomainType bool, bDirect bool) {
+	if scope == DOMAIN_SCOPE_SUBDOMAINS || scope == DOMAIN_SCOPE_BOTH {
+		c.addDomainKey(common.DOMAIN_WILDCARD_PREFIX+domain, bDomainType, bDirect)
+	}
+	if scope == DOMAIN_SCOPE_EXACT || scope == DOMAIN_SCOPE_BOTH {
+		c.addDomainKey(domain, bDomainType, bDirect)
+	}
+}
+
+func (c *PacList) addDomainKey(domain string, bDomainType bool, bDirect bool) {
+	if bDirect {
+		if !c.DirectDomains[domain] {
+			c.DirectDomains[domain] = true
+			c.recordOrigin(domain, true)
+		}
+	} else if originDomainType, ok := c.Domains[domain]; ok {
+		// "@@" exception wins over proxy rule
+		if originDomainType && !bDomainType {
+			c.Domains[domain] = false
+			c.recordOrigin(domain, false)
+		}
+	} else {
+		c.Domains[domain] = bDomainType
+		c.recordOrigin(domain, false)
+	}
+}
+
+// recordOrigin remembers line being parsed as origin of key, the first line deciding a key is kept
+func (c *PacList) recordOrigin(key string, bDirect bool) {
+	origin := RuleOrigin{File: c.path, Line: c.lineNum, Rule: c.rule}
+	if bDirect {
+		if c.DirectOrigins == nil {
+			c.DirectOrigins = make(map[string]RuleOrigin)
+		}
+		c.DirectOrigins[key] = origin
+		return
+	}
+	if c.Origins == nil {
+		c.Origins = make(map[string]RuleOrigin)
+	}
+	c.Origins[key] = origin
+}
+
 func (c *PacList) parsePacListLine(line []byte) (err error) {
 	if len(line) == 0 {
 		return
 	}
 	//logger := log.GetLogger()
 	var re *regexp.Regexp
+	c.rule = string(bytes.TrimSpace(line))
+	if c.parseDnsmasqLine(c.rule) {
+		return
+	}
 
 	// replace all white space etc
 	line = bytes.Replace(line, []byte{' '}, []byte{}, -1)
@@ -248,9 +581,20 @@ func (c *PacList) parsePacListLine(line []byte) (err error) {
 	}
 	if re.Match(line) {
 		//logger.Debug("ParsePAC match pac version", zap.String("line", string(line[:])))
+		c.autoProxy = bytes.HasPrefix(line, []byte(AUTO_PROXY_HEADER))
 		return
 	}
 
+	// "!" exception is turned into "@@" one
+	if !c.autoProxy {
+		if re, err = regexp.Compile(regex_bangExcept_); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("Compile regex failed: %s", regex_bangExcept_))
+		}
+		if matches := re.FindStringSubmatch(c.rule); len(matches) > 0 {
+			line = []byte("@@" + matches[1])
+		}
+	}
+
 	// pac comment
 	if re, err = regexp.Compile(regex_commentRegex_); err != nil {
 		return errors.Wrap(err, fmt.Sprintf("Compile regex failed: %s", regex_commentRegex_))
@@ -260,6 +604,34 @@ func (c *PacList) parsePacListLine(line []byte) (err error) {
 		return
 	}
 
+	// country rule
+	if re, err = regexp.Compile(regex_geoip_); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Compile regex failed: %s", regex_geoip_))
+	}
+	if matches := re.FindAllSubmatch(line, -1); len(matches) > 0 {
+		country := strings.ToUpper(string(matches[0][1]))
+		bProxy := strings.EqualFold(string(matches[0][2]), "PROXY")
+		if origin, ok := c.GeoIPs[country]; ok {
+			// DIRECT wins as exception does
+			if !origin || bProxy {
+				return
+			}
+		}
+		c.GeoIPs[country] = bProxy
+		c.recordOrigin("GEOIP,"+country, false)
+		return
+	}
+
+	// direct action, e.g. "||example.com$direct"
+	bDirect := false
+	if re, err = regexp.Compile(regex_direct_); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Compile regex failed: %s", regex_direct_))
+	}
+	if matches := re.FindAllSubmatch(line, -1); len(matches) > 0 {
+		line = matches[0][1]
+		bDirect = true
+	}
+
 	// white domain
 	bDomainType := common.DOMAIN_BLACK_LIST
 	if re, err = regexp.Compile(regex_whiteRegex_); err != nil {
@@ -267,6 +639,10 @@ func (c *PacList) parsePacListLine(line []byte) (err error) {
 	}
 
 	matchByte := line
+	scope := DOMAIN_SCOPE_EXACT
+	if c.autoProxy {
+		scope = DOMAIN_SCOPE_BOTH
+	}
 	if matches := re.FindAllSubmatch(line, -1); len(matches) > 0 {
 		if len(matches[0][1]) > 0 {
 			// ignore white list
@@ -283,6 +659,7 @@ func (c *PacList) parsePacListLine(line []byte) (err error) {
 	}
 	if matches := re.FindAllSubmatch(matchByte, -1); len(matches) > 0 {
 		matchByte = matches[0][1]
+		scope = DOMAIN_SCOPE_EXACT
 	}
 
 	// domain 0
@@ -291,6 +668,7 @@ func (c *PacList) parsePacListLine(line []byte) (err error) {
 	}
 	if matches := re.FindAllSubmatch(matchByte, -1); len(matches) > 0 {
 		matchByte = matches[0][1]
+		scope = DOMAIN_SCOPE_BOTH
 	}
 
 	// domain 1
@@ -299,6 +677,16 @@ func (c *PacList) parsePacListLine(line []byte) (err error) {
 	}
 	if matches := re.FindAllSubmatch(matchByte, -1); len(matches) > 0 {
 		matchByte = matches[0][1]
+		scope = DOMAIN_SCOPE_BOTH
+	}
+
+	// subdomains only
+	if re, err = regexp.Compile(regex_wildcard_); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Compile regex failed: %s", regex_wildcard_))
+	}
+	if matches := re.FindAllSubmatch(matchByte, -1); len(matches) > 0 {
+		matchByte = matches[0][1]
+		scope = DOMAIN_SCOPE_SUBDOMAINS
 	}
 
 	// domain 2
@@ -309,17 +697,18 @@ func (c *PacList) parsePacListLine(line []byte) (err error) {
 		matchByte = matches[1][1]
 	}
 
+	// ip of either family or CIDR, e.g. "1.2.3.0/24" or "2001:db8::/32"
+	if rule, ok := parseIPRule(string(matchByte)); ok {
+		c.addIP(rule, bDomainType, bDirect)
+		return
+	}
+
 	// ip
 	if re, err = regexp.Compile(regex_ip_); err != nil {
 		return errors.Wrap(err, fmt.Sprintf("Compile regex failed: %s", regex_ip_))
 	}
 	if matches := re.FindAllSubmatch(matchByte, -1); len(matches) > 0 {
-		ip := string(matches[0][1][:])
-		if originDomainType, ok := c.IPs[ip]; ok {
-			c.IPs[ip] = bDomainType || originDomainType
-		} else {
-			c.IPs[ip] = bDomainType
-		}
+		c.addIP(string(matches[0][1][:]), bDomainType, bDirect)
 
 		//logger.Debug("ParsePAC find ip", zap.String("line", string(line[:])), zap.String("ip", ip), zap.Bool("black_list", bDomainType))
 		return
@@ -330,12 +719,11 @@ func (c *PacList) parsePacListLine(line []byte) (err error) {
 		return errors.Wrap(err, fmt.Sprintf("Compile regex failed: %s", regex_domain_last_))
 	}
 	if matches := re.FindAllSubmatch(matchByte, -1); len(matches) > 0 {
-		domain := string(matches[0][1][:])
-		if originDomainType, ok := c.Domains[domain]; ok {
-			c.Domains[domain] = bDomainType || originDomainType
-		} else {
-			c.Domains[domain] = bDomainType
+		// keyword rule without dot, e.g. "falun", matches any URL containing it and can not be routed by domain
+		if bytes.IndexByte(matches[0][1], '.') < 0 {
+			return
 		}
+		c.addDomain(string(matches[0][1][:]), scope, bDomainType, bDirect)
 		//logger.Debug("ParsePAC find domain", zap.String("line", string(line[:])), zap.String("domain", domain), zap.Bool("black_list", bDomainType))
 		return
 	}
@@ -345,12 +733,7 @@ func (c *PacList) parsePacListLine(line []byte) (err error) {
 		return errors.Wrap(err, fmt.Sprintf("Compile regex failed: %s", regex_domain_regex_))
 	}
 	if matches := re.FindAllSubmatch(matchByte, -1); len(matches) > 0 {
-		domain := string(matches[0][1][:])
-		if originDomainType, ok := c.Domains[domain]; ok {
-			c.Domains[domain] = bDomainType || originDomainType
-		} else {
-			c.Domains[domain] = bDomainType
-		}
+		c.addDomain(string(matches[0][1][:]), DOMAIN_SCOPE_EXACT, bDomainType, bDirect)
 		//logger.Debug("ParsePAC find domain", zap.String("line", string(line[:])), zap.String("domain", domain), zap.Bool("black_list", bDomainType))
 	} else {
 		//logger.Debug("ParsePAC can not find domain or ip", zap.String("line", string(line[:])))
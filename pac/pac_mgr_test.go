@@ -0,0 +1,301 @@
+package pac
+
+import (
+	"encoding/base64"
+	"github.com/weishi258/redfrog-core/log"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParsePacListLineDirect(t *testing.T) {
+	list := &PacList{Domains: make(map[string]bool), IPs: make(map[string]bool), DirectDomains: make(map[string]bool), DirectIPs: make(map[string]bool)}
+	for _, line := range []string{"||example.com$direct", "1.2.3.4$DIRECT", "google.com", "@@baidu.com"} {
+		if err := list.parsePacListLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !list.DirectDomains["example.com"] || !list.DirectIPs["1.2.3.4"] {
+		t.Errorf("direct rules not parsed, got %v %v", list.DirectDomains, list.DirectIPs)
+	}
+	if _, ok := list.Domains["example.com"]; ok {
+		t.Errorf("direct domain should not be in proxy list")
+	}
+	if !list.Domains["google.com"] || list.Domains["baidu.com"] {
+		t.Errorf("unexpected proxy list %v", list.Domains)
+	}
+}
+
+func TestParsePacListLineDnsmasq(t *testing.T) {
+	list := &PacList{Domains: make(map[string]bool), IPs: make(map[string]bool), DirectDomains: make(map[string]bool), DirectIPs: make(map[string]bool)}
+	for _, line := range []string{"# gfwlist for dnsmasq", "server=/google.com/127.0.0.1#5353", "ipset=/google.com/youtube.com/gfwlist",
+		"server=/*.sub.com/8.8.8.8", "server=/cn.google.com/#", "address=/ad.com/0.0.0.0", "server=/lan/"} {
+		if err := list.parsePacListLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := map[string]bool{"google.com": true, "*.google.com": true, "youtube.com": true, "*.youtube.com": true,
+		"*.sub.com": true, "cn.google.com": false, "*.cn.google.com": false}
+	if !reflect.DeepEqual(list.Domains, expected) {
+		t.Errorf("got %v, expected %v", list.Domains, expected)
+	}
+	if origin := list.Origins["youtube.com"]; origin.Rule != "ipset=/google.com/youtube.com/gfwlist" {
+		t.Errorf("unexpected origin %v", origin)
+	}
+}
+
+func TestParseDirectDnsmasqList(t *testing.T) {
+	if source, direct := splitListSource("https://example.com/accelerated-domains.china.conf$direct"); !direct || source != "https://example.com/accelerated-domains.china.conf" {
+		t.Errorf("unexpected source %s direct %v", source, direct)
+	}
+	if _, direct := splitListSource("gfw-list.txt"); direct {
+		t.Errorf("source without suffix should not be direct")
+	}
+	list := &PacList{Domains: make(map[string]bool), IPs: make(map[string]bool), DirectDomains: make(map[string]bool), DirectIPs: make(map[string]bool), direct: true}
+	for _, line := range []string{"server=/baidu.com/114.114.114.114", "ipset=/qq.com/china", "server=/google.cn/#"} {
+		if err := list.parsePacListLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(list.Domains) != 0 {
+		t.Errorf("direct list should not add proxy rules, got %v", list.Domains)
+	}
+	expected := map[string]bool{"baidu.com": true, "*.baidu.com": true, "qq.com": true, "*.qq.com": true}
+	if !reflect.DeepEqual(list.DirectDomains, expected) {
+		t.Errorf("got %v, expected %v", list.DirectDomains, expected)
+	}
+}
+
+func TestDecodeAutoProxy(t *testing.T) {
+	list := "[AutoProxy 0.2.9]\n! comment\n||google.com\n@@||cn.google.com\n"
+	encoded := base64.StdEncoding.EncodeToString([]byte(list))
+	// wrapped as gfwlist.txt
+	wrapped := encoded[:16] + "\n" + encoded[16:] + "\n"
+	if decoded := decodeAutoProxy([]byte(wrapped)); string(decoded) != list {
+		t.Errorf("base64 list decoded to %q", decoded)
+	}
+	if decoded := decodeAutoProxy([]byte(list)); string(decoded) != list {
+		t.Errorf("plain list changed to %q", decoded)
+	}
+	// plain list of bare domains is also valid base64 alphabet
+	if decoded := decodeAutoProxy([]byte("abcd")); string(decoded) != "abcd" {
+		t.Errorf("plain domain changed to %q", decoded)
+	}
+}
+
+func TestParsePacListLineAutoProxy(t *testing.T) {
+	list := &PacList{Domains: make(map[string]bool), IPs: make(map[string]bool), DirectDomains: make(map[string]bool), DirectIPs: make(map[string]bool)}
+	for _, line := range []string{"[AutoProxy 0.2.9]", "||google.com", "@@||cn.google.com", "|https://twitter.com/path",
+		".youtube.com", "wikipedia.org/wiki", "falun", "||blocked.com", "@@||blocked.com"} {
+		if err := list.parsePacListLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, domain := range []string{"google.com", "twitter.com", "youtube.com", "wikipedia.org"} {
+		if !list.Domains[domain] {
+			t.Errorf("%s should be proxied, got %v", domain, list.Domains)
+		}
+	}
+	if flag, ok := list.Domains["cn.google.com"]; !ok || flag {
+		t.Errorf("exception not parsed, got %v", list.Domains)
+	}
+	if list.Domains["blocked.com"] {
+		t.Errorf("exception should win over proxy rule")
+	}
+	if _, ok := list.Domains["falun"]; ok {
+		t.Errorf("keyword without dot should be skipped")
+	}
+}
+
+func TestCheckDomainScope(t *testing.T) {
+	log.InitLogger("", "error", false)
+	list := &PacList{Domains: make(map[string]bool), IPs: make(map[string]bool), DirectDomains: make(map[string]bool), DirectIPs: make(map[string]bool)}
+	for _, line := range []string{"exact.com", "*.sub.com", ".both.com", "||auto.com", "|https://url.com/path", "*.mixed.com", "@@mixed.com",
+		".google.com", "@@maps.google.com"} {
+		if err := list.parsePacListLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mgr := &PacListMgr{}
+	mgr.proxyList.Store(&ProxyList{proxyDomains: list.Domains})
+	for domain, expected := range map[string]bool{
+		"exact.com": true, "www.exact.com": false,
+		"sub.com": false, "www.sub.com": true, "a.b.sub.com": true,
+		"both.com": true, "www.both.com": true,
+		"auto.com": true, "www.auto.com": true,
+		"url.com": true, "www.url.com": false,
+		"mixed.com": false, "www.mixed.com": true,
+		"google.com": true, "maps.google.com": false, "www.google.com": true,
+		"other.com": false,
+	} {
+		if mgr.CheckDomain(domain) != expected {
+			t.Errorf("CheckDomain(%s) should be %v", domain, expected)
+		}
+	}
+}
+
+func TestCheckDomainAutoProxyBare(t *testing.T) {
+	log.InitLogger("", "error", false)
+	list := &PacList{Domains: make(map[string]bool), IPs: make(map[string]bool), DirectDomains: make(map[string]bool), DirectIPs: make(map[string]bool)}
+	// bare rule of AutoProxy list matches anywhere in URL, so subdomains are covered
+	for _, line := range []string{"[AutoProxy 0.2.9]", "bare.com"} {
+		if err := list.parsePacListLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mgr := &PacListMgr{}
+	mgr.proxyList.Store(&ProxyList{proxyDomains: list.Domains})
+	if !mgr.CheckDomain("bare.com") || !mgr.CheckDomain("www.bare.com") {
+		t.Errorf("bare rule of AutoProxy list should match domain and subdomains, got %v", list.Domains)
+	}
+}
+
+func TestCheckDomainException(t *testing.T) {
+	log.InitLogger("", "error", false)
+	list := &PacList{Domains: make(map[string]bool), IPs: make(map[string]bool), DirectDomains: make(map[string]bool), DirectIPs: make(map[string]bool)}
+	for _, line := range []string{"*.google.com", "!maps.google.com", "@@.cn.example.com", ".www.cn.example.com", "!Checksum:abc", "!1.2.3.0/24",
+		"! Updated 2020.01.02", "!2020.01.02", "!Expires: 4 days"} {
+		if err := list.parsePacListLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if flag, ok := list.IPs["1.2.3.0/24"]; !ok || flag {
+		t.Errorf("\"!\" ip exception not parsed, got %v", list.IPs)
+	}
+	// dated comment line is not an exception
+	for _, rule := range []string{"Updated2020.01.02", "2020.01.02"} {
+		if _, ok := list.Domains[rule]; ok {
+			t.Errorf("comment should be ignored, got %v", list.Domains)
+		}
+	}
+	if len(list.IPs) != 1 {
+		t.Errorf("comment should be ignored, got %v", list.IPs)
+	}
+	mgr := &PacListMgr{}
+	mgr.proxyList.Store(&ProxyList{
+		proxyDomains:  list.Domains,
+		exceptDomains: composeExceptions(list.Domains),
+	})
+	for domain, expected := range map[string]bool{"www.google.com": true, "maps.google.com": false, "a.maps.google.com": true,
+		"cn.example.com": false, "www.cn.example.com": false} {
+		if mgr.CheckDomain(domain) != expected {
+			t.Errorf("CheckDomain(%s) should be %v", domain, expected)
+		}
+	}
+	// learned CNAME can not override exception
+	mgr.AddDomain("maps.google.com", true)
+	if mgr.CheckDomain("maps.google.com") || !mgr.CheckExceptionDomain("maps.google.com") {
+		t.Errorf("exception should survive learned domain")
+	}
+}
+
+func TestBangCommentInAutoProxy(t *testing.T) {
+	list := &PacList{Domains: make(map[string]bool), IPs: make(map[string]bool), DirectDomains: make(map[string]bool), DirectIPs: make(map[string]bool)}
+	for _, line := range []string{"[AutoProxy 0.2.9]", "!comment.example.com"} {
+		if err := list.parsePacListLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(list.Domains) != 0 {
+		t.Errorf("\"!\" is comment in AutoProxy list, got %v", list.Domains)
+	}
+}
+
+func TestWhitelistMode(t *testing.T) {
+	log.InitLogger("", "error", false)
+	list := &PacList{Domains: make(map[string]bool), IPs: make(map[string]bool), DirectDomains: make(map[string]bool), DirectIPs: make(map[string]bool)}
+	for _, line := range []string{".baidu.com", "@@.pan.baidu.com", "114.114.114.0/24"} {
+		if err := list.parsePacListLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mgr := &PacListMgr{whitelist: true}
+	mgr.proxyList.Store(&ProxyList{
+		proxyDomains:  list.Domains,
+		exceptDomains: composeExceptions(list.Domains),
+		proxyIPs:      list.IPs,
+		proxyNets:     composeIPNets(list.IPs),
+	})
+	for domain, expected := range map[string]bool{"www.baidu.com": false, "pan.baidu.com": true, "google.com": true} {
+		if mgr.CheckDomain(domain) != expected {
+			t.Errorf("CheckDomain(%s) should be %v in whitelist mode", domain, expected)
+		}
+	}
+	if mgr.CheckIP("114.114.114.114") || !mgr.CheckIP("8.8.8.8") {
+		t.Errorf("listed ip should go direct and others proxied in whitelist mode")
+	}
+	// CNAME of proxied domain stays proxied
+	mgr.AddDomain("cdn.baidu.com", true)
+	if !mgr.CheckDomain("cdn.baidu.com") {
+		t.Errorf("learned proxied domain should be proxied in whitelist mode")
+	}
+}
+
+func TestParseGeoIPRule(t *testing.T) {
+	list := &PacList{Domains: make(map[string]bool), IPs: make(map[string]bool), DirectDomains: make(map[string]bool), DirectIPs: make(map[string]bool), GeoIPs: make(map[string]bool)}
+	for _, line := range []string{"GEOIP,US,PROXY", "geoip,cn,direct", "GEOIP,JP,PROXY", "GEOIP,JP,DIRECT", "GEOIP,USA,PROXY"} {
+		if err := list.parsePacListLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(list.GeoIPs) != 3 || !list.GeoIPs["US"] || list.GeoIPs["CN"] || list.GeoIPs["JP"] {
+		t.Errorf("country rules not parsed, DIRECT should win, got %v", list.GeoIPs)
+	}
+	if len(list.Domains) != 0 {
+		t.Errorf("country rule should not be taken as domain, got %v", list.Domains)
+	}
+	// no database loaded
+	mgr := &PacListMgr{}
+	mgr.proxyList.Store(&ProxyList{geoIPs: list.GeoIPs})
+	if _, ok := mgr.CheckGeoIP(net.ParseIP("8.8.8.8")); ok || mgr.HasGeoIPRules() {
+		t.Errorf("country rules should not match without database")
+	}
+}
+
+func TestRulesSnapshot(t *testing.T) {
+	log.InitLogger("", "error", false)
+	list := &PacList{Domains: make(map[string]bool), IPs: make(map[string]bool), DirectDomains: make(map[string]bool), DirectIPs: make(map[string]bool)}
+	for _, line := range []string{".google.com", "@@maps.google.com"} {
+		if err := list.parsePacListLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mgr := &PacListMgr{}
+	if mgr.CheckDomain("www.google.com") {
+		t.Errorf("no rule should match before lists are loaded")
+	}
+	mgr.proxyList.Store(&ProxyList{proxyDomains: list.Domains, exceptDomains: composeExceptions(list.Domains)})
+
+	// learned domain goes into a new snapshot, the one taken before is not changed
+	origin := mgr.rules()
+	mgr.AddDomain("cdn.example.com", true)
+	if _, ok := origin.learnedDomains.get("cdn.example.com"); ok || !mgr.CheckDomain("cdn.example.com") {
+		t.Errorf("learned domain should be checked in new snapshot only")
+	}
+	if _, ok := list.Domains["cdn.example.com"]; ok {
+		t.Errorf("learned domain should not be added to list rules")
+	}
+	current := mgr.rules()
+	mgr.AddDomain("cdn.example.com", true)
+	if mgr.rules() != current {
+		t.Errorf("learning domain again should keep snapshot")
+	}
+
+	// checks go on while rules are swapped
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			mgr.proxyMux.Lock()
+			next := *mgr.rules()
+			mgr.proxyList.Store(&next)
+			mgr.proxyMux.Unlock()
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		if !mgr.CheckDomain("www.google.com") || mgr.CheckDomain("maps.google.com") {
+			t.Fatal("check should see complete rules while they are swapped")
+		}
+	}
+	<-done
+}
@@ -0,0 +1,233 @@
+package pac
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PAC_FETCH_TIMEOUT = 60 * time.Second
+	// first refresh waits for proxy client so list can be downloaded through it
+	PAC_REFRESH_DELAY = 30 * time.Second
+	PAC_MAX_SIZE      = 32 << 20
+)
+
+// Dialer connects addr through proxy backend
+type Dialer func(network string, addr string) (net.Conn, error)
+
+func isRemoteSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// remoteList is a pac list downloaded from URL into cache file, which is parsed like a local one
+type remoteList struct {
+	// serializes downloads, refresh fetches without holding loadMux
+	sync.Mutex
+	url string
+	// relative to working dir, etag of cached content is kept next to it
+	cachePath string
+	etag      string
+}
+
+func newRemoteList(source string, cacheDir string) *remoteList {
+	sum := sha1.Sum([]byte(source))
+	ret := &remoteList{url: source, cachePath: filepath.Join(cacheDir, hex.EncodeToString(sum[:8])+".txt")}
+	if etag, err := ioutil.ReadFile(ret.etagPath()); err == nil {
+		ret.etag = string(etag)
+	}
+	return ret
+}
+
+func (c *remoteList) etagPath() string {
+	return config.GetPathFromWorkingDir(c.cachePath + ".etag")
+}
+
+func (c *remoteList) cached() bool {
+	_, err := os.Stat(config.GetPathFromWorkingDir(c.cachePath))
+	return err == nil
+}
+
+// fetch downloads list into cache file unless server tells cached one is still current, changed is false then
+func (c *remoteList) fetch(client *http.Client) (changed bool, err error) {
+	c.Lock()
+	defer c.Unlock()
+	path := config.GetPathFromWorkingDir(c.cachePath)
+	req, err := http.NewRequest(http.MethodGet, c.url, nil)
+	if err != nil {
+		return false, errors.Wrapf(err, "Invalid pac list url %s", c.url)
+	}
+	if info, statErr := os.Stat(path); statErr == nil {
+		if len(c.etag) > 0 {
+			req.Header.Set("If-None-Match", c.etag)
+		}
+		req.Header.Set("If-Modified-Since", info.ModTime().UTC().Format(http.TimeFormat))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, errors.Wrapf(err, "Download pac list %s failed", c.url)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, errors.Errorf("Download pac list %s failed: %s", c.url, resp.Status)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, PAC_MAX_SIZE))
+	if err != nil {
+		return false, errors.Wrapf(err, "Download pac list %s failed", c.url)
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, errors.Wrap(err, "Create pac cache dir failed")
+	}
+	// replaced by rename, so a crash never leaves half written list behind
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return false, errors.Wrapf(err, "Write pac cache %s failed", tmpPath)
+	}
+	if modified, parseErr := http.ParseTime(resp.Header.Get("Last-Modified")); parseErr == nil {
+		os.Chtimes(tmpPath, modified, modified)
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return false, errors.Wrapf(err, "Write pac cache %s failed", path)
+	}
+	c.etag = resp.Header.Get("ETag")
+	if len(c.etag) > 0 {
+		ioutil.WriteFile(c.etagPath(), []byte(c.etag), 0644)
+	} else {
+		os.Remove(c.etagPath())
+	}
+	return true, nil
+}
+
+func newPacHttpClient(dialer Dialer) *http.Client {
+	if dialer == nil {
+		return &http.Client{Timeout: PAC_FETCH_TIMEOUT}
+	}
+	return &http.Client{Timeout: PAC_FETCH_TIMEOUT, Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return dialer(network, addr)
+		},
+	}}
+}
+
+// SetDialer lets remote lists be downloaded through proxy backend, when their host is proxied or direct download fails
+func (c *PacListMgr) SetDialer(dialer Dialer) {
+	c.Lock()
+	defer c.Unlock()
+	c.dialer = dialer
+}
+
+func (c *PacListMgr) getDialer() Dialer {
+	c.Lock()
+	defer c.Unlock()
+	return c.dialer
+}
+
+func (c *PacListMgr) fetchRemote(remote *remoteList) (changed bool, err error) {
+	logger := log.GetLogger()
+	dialer := c.getDialer()
+	if dialer != nil {
+		if u, parseErr := url.Parse(remote.url); parseErr == nil && c.shouldProxyHost(u.Hostname()) {
+			return remote.fetch(newPacHttpClient(dialer))
+		}
+	}
+	if changed, err = remote.fetch(newPacHttpClient(nil)); err != nil && dialer != nil {
+		logger.Debug("Download pac list directly failed, retry through proxy", zap.String("url", remote.url), zap.String("error", err.Error()))
+		return remote.fetch(newPacHttpClient(dialer))
+	}
+	return
+}
+
+func (c *PacListMgr) shouldProxyHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return c.CheckIP(ip.String())
+	}
+	return c.CheckDomain(host)
+}
+
+// getRemote returns remote list of source, caller holds loadMux
+func (c *PacListMgr) getRemote(source string) *remoteList {
+	remote, ok := c.remotes[source]
+	if !ok {
+		remote = newRemoteList(source, c.cacheDir)
+		c.remotes[source] = remote
+	}
+	return remote
+}
+
+// localPath returns file to parse for source, remote list without cache is downloaded first, caller holds loadMux
+func (c *PacListMgr) localPath(source string) string {
+	if !isRemoteSource(source) {
+		return source
+	}
+	remote := c.getRemote(source)
+	if !remote.cached() {
+		if _, err := c.fetchRemote(remote); err != nil {
+			log.GetLogger().Error("Download pac list failed", zap.String("url", source), zap.String("error", err.Error()))
+		}
+	}
+	return remote.cachePath
+}
+
+func (c *PacListMgr) startRefresh() {
+	timer := time.NewTimer(PAC_REFRESH_DELAY)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			c.refreshRemotes()
+			timer.Reset(c.refreshInterval)
+		case <-c.refreshDone:
+			return
+		}
+	}
+}
+
+// refreshRemotes downloads remote lists in use and reloads all lists if any of them changed, downloads run without
+// loadMux so reload by signal or file change is not held up by them
+func (c *PacListMgr) refreshRemotes() {
+	logger := log.GetLogger()
+	c.loadMux.Lock()
+	remotes := make([]*remoteList, 0, len(c.sources))
+	for _, source := range c.sources {
+		if source, _ = splitListSource(source); isRemoteSource(source) {
+			remotes = append(remotes, c.getRemote(source))
+		}
+	}
+	c.loadMux.Unlock()
+
+	changed := false
+	for _, remote := range remotes {
+		if updated, err := c.fetchRemote(remote); err != nil {
+			logger.Error("Refresh pac list failed", zap.String("url", remote.url), zap.String("error", err.Error()))
+		} else if updated {
+			logger.Info("Pac list updated", zap.String("url", remote.url))
+			changed = true
+		}
+	}
+
+	if changed {
+		// sources may have been reloaded meanwhile, current ones are rebuilt
+		c.loadMux.Lock()
+		sources := c.sources
+		c.loadMux.Unlock()
+		c.ReloadPacList(sources)
+	}
+}
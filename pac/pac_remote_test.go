@@ -0,0 +1,98 @@
+package pac
+
+import (
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRemoteListFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.SetWorkingDir(dir)
+	defer config.SetWorkingDir("")
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("||google.com\n"))
+	}))
+	defer server.Close()
+
+	remote := newRemoteList(server.URL+"/list.txt", "cache")
+	if remote.cached() {
+		t.Fatal("cache should not exist yet")
+	}
+	if changed, err := remote.fetch(newPacHttpClient(nil)); err != nil || !changed {
+		t.Fatalf("first fetch changed=%v err=%v", changed, err)
+	}
+	if list, err := parsePacList(remote.cachePath, false); err != nil || !list.Domains["google.com"] {
+		t.Fatalf("cached list not parsed, err=%v", err)
+	}
+	// etag survives restart
+	remote = newRemoteList(server.URL+"/list.txt", "cache")
+	if changed, err := remote.fetch(newPacHttpClient(nil)); err != nil || changed {
+		t.Errorf("second fetch changed=%v err=%v", changed, err)
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+}
+
+func TestRefreshRemotesUnlocked(t *testing.T) {
+	log.InitLogger("", "error", false)
+	dir, err := ioutil.TempDir("", "pac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.SetWorkingDir(dir)
+	defer config.SetWorkingDir("")
+
+	mgr := &PacListMgr{remotes: make(map[string]*remoteList), cacheDir: "cache"}
+	locked := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// reload by signal takes loadMux while list is being downloaded
+		acquired := make(chan struct{})
+		go func() {
+			mgr.loadMux.Lock()
+			mgr.loadMux.Unlock()
+			close(acquired)
+		}()
+		select {
+		case <-acquired:
+			locked <- false
+		case <-time.After(time.Second):
+			locked <- true
+		}
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+	mgr.sources = []string{server.URL + "/list.txt$direct"}
+
+	mgr.refreshRemotes()
+	if <-locked {
+		t.Error("loadMux should not be held while downloading")
+	}
+}
+
+func TestIsRemoteSource(t *testing.T) {
+	for source, expected := range map[string]bool{"gfw-list.txt": false, "http://a.com/list": true, "https://a.com/list": true} {
+		if isRemoteSource(source) != expected {
+			t.Errorf("isRemoteSource(%s) should be %v", source, expected)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package pac
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	PAC_CONTENT_TYPE   = "application/x-ns-proxy-autoconfig"
+	PAC_SERVER_TIMEOUT = 30 * time.Second
+)
+
+// script deciding as CheckDomain and CheckIP do, rules are filled in as JSON, GEOIP rules can not be checked by
+// browser and ipv6 CIDR rules neither since isInNet takes ipv4 only
+const pacScript = `var proxy = %s;
+var whitelist = %t;
+var resolve = %t;
+var direct = %s;
+var directNets = %s;
+var exceptions = %s;
+var domains = %s;
+var ips = %s;
+var nets = %s;
+
+function hasRule(rules, key) {
+	return Object.prototype.hasOwnProperty.call(rules, key);
+}
+
+function matchDomain(rules, host) {
+	if (hasRule(rules, host)) {
+		return rules[host];
+	}
+	for (var i = host.indexOf("."); i >= 0; i = host.indexOf(".", i + 1)) {
+		var key = "*." + host.substring(i + 1);
+		if (hasRule(rules, key)) {
+			return rules[key];
+		}
+	}
+	return -1;
+}
+
+function matchNets(rules, ip) {
+	if (ip.indexOf(":") >= 0) {
+		return -1;
+	}
+	var matched = -1;
+	for (var i = 0; i < rules.length; i++) {
+		if (isInNet(ip, rules[i][0], rules[i][1])) {
+			if (!rules[i][2]) {
+				return 0;
+			}
+			matched = 1;
+		}
+	}
+	return matched;
+}
+
+function decide(matched) {
+	return (matched == 1) != whitelist ? proxy : "DIRECT";
+}
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (isPlainHostName(host) || matchDomain(direct, host) >= 0) {
+		return "DIRECT";
+	}
+	if (matchDomain(exceptions, host) >= 0) {
+		return decide(0);
+	}
+	var matched = matchDomain(domains, host);
+	if (matched >= 0) {
+		return decide(matched);
+	}
+	var ip = host;
+	if (!/^[0-9.]+$/.test(host) && host.indexOf(":") < 0) {
+		ip = resolve ? dnsResolve(host) : null;
+		if (!ip) {
+			return decide(-1);
+		}
+	}
+	if (hasRule(direct, ip) || matchNets(directNets, ip) >= 0) {
+		return "DIRECT";
+	}
+	if (hasRule(ips, ip)) {
+		return decide(ips[ip]);
+	}
+	return decide(matchNets(nets, ip));
+}
+`
+
+// PacServer serves proxy auto-config script of current pac lists, for devices which are not intercepted, e.g. phones
+// on other networks
+type PacServer struct {
+	server   *http.Server
+	listener net.Listener
+	mgr      *PacListMgr
+	proxy    string
+	resolve  bool
+}
+
+func (c *PacListMgr) StartPacServer(pacConfig config.PacServerConfig) (ret *PacServer, err error) {
+	logger := log.GetLogger()
+	if len(strings.TrimSpace(pacConfig.Proxy)) == 0 {
+		return nil, errors.New("Pac server requires proxy")
+	}
+	ret = &PacServer{mgr: c, proxy: pacConfig.Proxy, resolve: pacConfig.Resolve}
+	if ret.listener, err = net.Listen("tcp", pacConfig.ListenAddr); err != nil {
+		return nil, errors.Wrapf(err, "Pac server listen on %s failed", pacConfig.ListenAddr)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy.pac", ret.handle)
+	// WPAD clients fetch http://wpad.<search domain>/wpad.dat
+	mux.HandleFunc("/wpad.dat", ret.handle)
+	ret.server = &http.Server{Handler: mux, ReadTimeout: PAC_SERVER_TIMEOUT, WriteTimeout: PAC_SERVER_TIMEOUT}
+	go func() {
+		if err := ret.server.Serve(ret.listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("Pac server stopped", zap.String("error", err.Error()))
+		}
+	}()
+	logger.Info("Pac server start successful", zap.String("addr", pacConfig.ListenAddr), zap.String("proxy", pacConfig.Proxy))
+	return ret, nil
+}
+
+func (c *PacServer) Stop() {
+	if err := c.server.Close(); err != nil {
+		log.GetLogger().Error("Close pac server failed", zap.String("error", err.Error()))
+	}
+}
+
+func (c *PacServer) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	script, err := c.mgr.GeneratePac(proxyForHost(c.proxy, r.Host), c.resolve)
+	if err != nil {
+		log.GetLogger().Error("Generate pac failed", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", PAC_CONTENT_TYPE)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(script)
+}
+
+// proxyForHost replaces unspecified host of proxy entries, e.g. "PROXY 0.0.0.0:8118", by host of request, which
+// reaches this server and so the inbounds listening on all addresses too
+func proxyForHost(proxy string, requestHost string) string {
+	host := requestHost
+	if h, _, err := net.SplitHostPort(requestHost); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if len(host) == 0 {
+		return proxy
+	}
+	entries := strings.Split(proxy, ";")
+	for i, entry := range entries {
+		entries[i] = strings.TrimSpace(entry)
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			continue
+		}
+		if h, port, err := net.SplitHostPort(fields[1]); err == nil {
+			if ip := net.ParseIP(h); len(h) == 0 || (ip != nil && ip.IsUnspecified()) {
+				entries[i] = fields[0] + " " + net.JoinHostPort(host, port)
+			}
+		}
+	}
+	return strings.Join(entries, "; ")
+}
+
+// GeneratePac returns proxy auto-config script of current rules, proxied hosts get proxy as result
+func (c *PacListMgr) GeneratePac(proxy string, resolve bool) ([]byte, error) {
+	list := c.rules()
+	direct := make(map[string]int, len(list.directDomains)+len(list.directIPs))
+	for key := range list.directDomains {
+		direct[key] = 1
+	}
+	exceptions := make(map[string]int, len(list.exceptDomains))
+	for key := range list.exceptDomains {
+		exceptions[key] = 0
+	}
+	domains := make(map[string]int, len(list.proxyDomains))
+	for key, flag := range list.proxyDomains {
+		domains[key] = pacFlag(flag)
+	}
+	list.learnedDomains.each(func(key string, flag bool) {
+		domains[key] = pacFlag(flag)
+	})
+	// CIDR rules are kept by their CIDR string too, they are checked by nets
+	ips := make(map[string]int, len(list.proxyIPs))
+	for key, flag := range list.proxyIPs {
+		if !strings.Contains(key, "/") {
+			ips[key] = pacFlag(flag)
+		}
+	}
+	for key := range list.directIPs {
+		if !strings.Contains(key, "/") {
+			direct[key] = 1
+		}
+	}
+
+	var values [][]byte
+	for _, value := range []interface{}{proxy, direct, pacNets(list.directNets), exceptions, domains, ips,
+		pacNets(list.proxyNets)} {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, errors.Wrap(err, "Encode pac rules failed")
+		}
+		values = append(values, encoded)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, pacScript, values[0], c.whitelist, resolve, values[1], values[2], values[3], values[4], values[5], values[6])
+	return buf.Bytes(), nil
+}
+
+func pacFlag(flag bool) int {
+	if flag {
+		return 1
+	}
+	return 0
+}
+
+// pacNets returns ipv4 CIDR rules as [network, mask, flag] for isInNet
+func pacNets(rules []ipNetRule) [][]interface{} {
+	ret := make([][]interface{}, 0, len(rules))
+	for _, rule := range rules {
+		if ip := rule.ipNet.IP.To4(); ip != nil && len(rule.ipNet.Mask) == net.IPv4len {
+			ret = append(ret, []interface{}{ip.String(), net.IP(rule.ipNet.Mask).String(), pacFlag(rule.flag)})
+		}
+	}
+	return ret
+}
@@ -0,0 +1,68 @@
+package pac
+
+import (
+	"github.com/weishi258/redfrog-core/log"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyForHost(t *testing.T) {
+	for _, c := range []struct{ proxy, host, expected string }{
+		{"PROXY 0.0.0.0:8118; SOCKS5 0.0.0.0:1080", "192.168.1.1", "PROXY 192.168.1.1:8118; SOCKS5 192.168.1.1:1080"},
+		{"PROXY :8118", "router.lan:8080", "PROXY router.lan:8118"},
+		{"PROXY [::]:8118", "[fd00::1]:80", "PROXY [fd00::1]:8118"},
+		{"PROXY 10.0.0.1:8118; DIRECT", "192.168.1.1", "PROXY 10.0.0.1:8118; DIRECT"},
+	} {
+		if got := proxyForHost(c.proxy, c.host); got != c.expected {
+			t.Errorf("proxyForHost(%s, %s) got %s, expected %s", c.proxy, c.host, got, c.expected)
+		}
+	}
+}
+
+func TestGeneratePac(t *testing.T) {
+	log.InitLogger("", "error", false)
+	list := &PacList{Domains: make(map[string]bool), IPs: make(map[string]bool), DirectDomains: make(map[string]bool), DirectIPs: make(map[string]bool)}
+	for _, line := range []string{".google.com", "@@maps.google.com", "||lan.example.com$direct", "8.8.8.0/24", "@@8.8.8.8", "2001:db8::/32"} {
+		if err := list.parsePacListLine([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mgr := &PacListMgr{}
+	mgr.proxyList.Store(&ProxyList{
+		proxyDomains:  list.Domains,
+		exceptDomains: composeExceptions(list.Domains),
+		directDomains: list.DirectDomains,
+		proxyIPs:      list.IPs,
+		proxyNets:     composeIPNets(list.IPs),
+	})
+
+	server := httptest.NewServer(http.HandlerFunc((&PacServer{mgr: mgr, proxy: "PROXY 0.0.0.0:8118"}).handle))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/wpad.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != PAC_CONTENT_TYPE {
+		t.Errorf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	script := string(body)
+	for _, expected := range []string{
+		`var proxy = "PROXY 127.0.0.1:8118";`,
+		`var whitelist = false;`,
+		`var direct = {"*.lan.example.com":1,"lan.example.com":1};`,
+		`var exceptions = {"maps.google.com":0};`,
+		`"*.google.com":1`,
+		`var ips = {"8.8.8.8":0};`,
+		`var nets = [["8.8.8.0","255.255.255.0",1]];`,
+		"function FindProxyForURL(url, host)",
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("script should contain %s, got\n%s", expected, script)
+		}
+	}
+}
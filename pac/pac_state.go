@@ -0,0 +1,45 @@
+package pac
+
+import (
+	"github.com/weishi258/redfrog-core/common"
+)
+
+// DomainState tells which rules of pac lists match domain and what they decide
+type DomainState struct {
+	Domain string `json:"domain"`
+	// proxied as CheckDomain decides, whitelist mode included
+	Proxy bool `json:"proxy"`
+	// a proxy or exception rule matches
+	Listed    bool `json:"listed"`
+	Exception bool `json:"exception"`
+	// $direct rule matches, proxy client dials it itself when intercepted
+	Direct bool `json:"direct"`
+	// rules matched, nil if none matched or rule was learned at runtime
+	Rule       *RuleOrigin `json:"rule,omitempty"`
+	DirectRule *RuleOrigin `json:"direct-rule,omitempty"`
+}
+
+// GetDomainState returns rules matching domain, for telling why it is or is not proxied
+func (c *PacListMgr) GetDomainState(domain string) DomainState {
+	ret := DomainState{Domain: domain, Proxy: c.CheckDomain(domain)}
+	list := c.rules()
+	var key string
+	if key, _, ret.Exception = common.MatchDomainRuleKey(list.exceptDomains, domain); ret.Exception {
+		ret.Listed = true
+		ret.Rule = list.originOf(key)
+	} else if key, _, ret.Listed = list.matchProxyDomain(domain); ret.Listed {
+		ret.Rule = list.originOf(key)
+	}
+	if key, _, ret.Direct = common.MatchDomainRuleKey(list.directDomains, domain); ret.Direct {
+		ret.DirectRule = list.originOf(key)
+	}
+	return ret
+}
+
+// originOf returns where rule of key comes from
+func (c *ProxyList) originOf(key string) *RuleOrigin {
+	if origin, ok := c.origins[key]; ok {
+		return &origin
+	}
+	return nil
+}
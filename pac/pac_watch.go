@@ -0,0 +1,149 @@
+package pac
+
+import (
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// editors and downloaders often write a file in several steps, changes within this delay trigger one reload
+const PAC_WATCH_DELAY = time.Second
+
+// directory is watched instead of file, so list replaced by rename is still noticed
+const PAC_WATCH_MASK = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE
+
+// pacWatcher notifies changes of local pac list files with inotify
+type pacWatcher struct {
+	// Fd of file would turn it back to blocking, so raw fd is kept for adding watches
+	fd   int
+	file *os.File
+	sync.Mutex
+	// watch descriptor to directory
+	dirs map[int32]string
+	// full path of list files
+	files map[string]bool
+}
+
+func newPacWatcher() (*pacWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, errors.Wrap(err, "Init inotify failed")
+	}
+	// non-blocking fd goes to runtime poller, so close wakes up pending read
+	return &pacWatcher{fd: fd, file: os.NewFile(uintptr(fd), "inotify"), dirs: make(map[int32]string), files: make(map[string]bool)}, nil
+}
+
+// localFiles returns full path of local list files in sources
+func localFiles(sources []string) []string {
+	ret := make([]string, 0, len(sources))
+	for _, source := range sources {
+		if source, _ = splitListSource(source); !isRemoteSource(source) {
+			ret = append(ret, config.GetPathFromWorkingDir(source))
+		}
+	}
+	return ret
+}
+
+// watch replaces watched files, directory of a file already watched is not added again
+func (c *pacWatcher) watch(paths []string) {
+	logger := log.GetLogger()
+	c.Lock()
+	defer c.Unlock()
+	c.files = make(map[string]bool)
+	for _, path := range paths {
+		c.files[path] = true
+		dir := filepath.Dir(path)
+		watched := false
+		for _, watchedDir := range c.dirs {
+			if watchedDir == dir {
+				watched = true
+				break
+			}
+		}
+		if watched {
+			continue
+		}
+		if wd, err := syscall.InotifyAddWatch(c.fd, dir, PAC_WATCH_MASK); err != nil {
+			logger.Warn("Watch pac list dir failed", zap.String("dir", dir), zap.String("error", err.Error()))
+		} else {
+			c.dirs[int32(wd)] = dir
+		}
+	}
+}
+
+func (c *pacWatcher) changed(wd int32, name string) bool {
+	c.Lock()
+	defer c.Unlock()
+	dir, ok := c.dirs[wd]
+	return ok && c.files[filepath.Join(dir, name)]
+}
+
+// run calls onChange once changes of watched files settle, until watcher is closed
+func (c *pacWatcher) run(onChange func()) {
+	notify := make(chan struct{}, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-notify:
+				// collapse following events
+				time.Sleep(PAC_WATCH_DELAY)
+				select {
+				case <-notify:
+				default:
+				}
+				onChange()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, (syscall.SizeofInotifyEvent+syscall.NAME_MAX+1)*16)
+	for {
+		n, err := c.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+			name := string(nameBytes)
+			for i := 0; i < len(name); i++ {
+				// name is padded with zero
+				if name[i] == 0 {
+					name = name[:i]
+					break
+				}
+			}
+			if c.changed(event.Wd, name) {
+				select {
+				case notify <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (c *pacWatcher) close() {
+	c.file.Close()
+}
+
+// reloadChanged reloads lists in use after a watched file changed
+func (c *PacListMgr) reloadChanged() {
+	c.loadMux.Lock()
+	sources := c.sources
+	c.loadMux.Unlock()
+	log.GetLogger().Info("Pac list file changed, reloading")
+	c.ReloadPacList(sources)
+}
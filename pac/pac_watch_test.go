@@ -0,0 +1,68 @@
+package pac
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPacWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	watcher, err := newPacWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "list.txt")
+	watcher.watch([]string{path})
+	changed := make(chan struct{}, 10)
+	finished := make(chan struct{})
+	go func() {
+		watcher.run(func() { changed <- struct{}{} })
+		close(finished)
+	}()
+
+	// unrelated file in the same dir is ignored
+	if err = ioutil.WriteFile(filepath.Join(dir, "other.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// replaced by rename as editors do
+	if err = ioutil.WriteFile(path+".swp", []byte("||google.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(path+".swp", path); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("change not notified")
+	}
+	select {
+	case <-changed:
+		t.Error("changes should be collapsed into one notify")
+	case <-time.After(PAC_WATCH_DELAY + 200*time.Millisecond):
+	}
+
+	watcher.close()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close should stop watcher")
+	}
+}
+
+func TestDiffRules(t *testing.T) {
+	origin := map[string]bool{"a.com": true, "b.com": true, "c.com": true}
+	current := map[string]bool{"a.com": true, "b.com": false, "d.com": true, "e.com": true}
+	// b.com turned into exception counts as both
+	if added, removed := diffRules(origin, current); added != 3 || removed != 2 {
+		t.Errorf("expected 3 added 2 removed, got %d %d", added, removed)
+	}
+}
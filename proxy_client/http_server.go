@@ -0,0 +1,229 @@
+package proxy_client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/weishi258/redfrog-core/common"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	HTTP_PROXY_HANDSHAKE_TIMEOUT = 30 * time.Second
+	HTTP_PROXY_DIAL_TIMEOUT      = 10 * time.Second
+)
+
+// httpProxyServer accepts explicit HTTP proxy requests, black listed targets go through backends and others are
+// connected directly, the same decision as transparent proxy
+type httpProxyServer struct {
+	listener    net.Listener
+	auth        string
+	pacChecker  common.PacCheckerInterface
+	proxyClient *ProxyClient
+}
+
+// prefixConn reads from reader first, so bytes already buffered or rewritten are relayed before the rest of conn
+type prefixConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *ProxyClient) StartHttpProxyServer(httpConfig config.HttpInboundConfig, pacChecker common.PacCheckerInterface) (err error) {
+	logger := log.GetLogger()
+	server := &httpProxyServer{pacChecker: pacChecker, proxyClient: c}
+	if len(httpConfig.Username) > 0 {
+		server.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(httpConfig.Username+":"+httpConfig.Password))
+	}
+	if server.listener, err = net.Listen("tcp", httpConfig.ListenAddr); err != nil {
+		return errors.Wrapf(err, "HTTP proxy listen on %s failed", httpConfig.ListenAddr)
+	}
+	c.httpServer_ = server
+	go server.serve()
+	logger.Info("HTTP proxy inbound start successful", zap.String("addr", httpConfig.ListenAddr), zap.Bool("auth", len(httpConfig.Username) > 0))
+	return nil
+}
+
+func (c *httpProxyServer) stop() {
+	if err := c.listener.Close(); err != nil {
+		log.GetLogger().Error("Close HTTP proxy listener failed", zap.String("error", err.Error()))
+	}
+}
+
+func (c *httpProxyServer) serve() {
+	logger := log.GetLogger()
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			if ee, ok := err.(net.Error); ok && ee.Temporary() {
+				continue
+			}
+			logger.Info("HTTP proxy inbound stop listening", zap.String("addr", c.listener.Addr().String()))
+			return
+		}
+		go c.handle(conn)
+	}
+}
+
+func (c *httpProxyServer) handle(conn net.Conn) {
+	logger := log.GetLogger()
+	defer conn.Close()
+	if !c.proxyClient.acquireClientConn(conn) {
+		return
+	}
+	defer c.proxyClient.releaseClientConn(conn)
+
+	conn.SetDeadline(time.Now().Add(HTTP_PROXY_HANDSHAKE_TIMEOUT))
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		logger.Debug("HTTP proxy read request failed", zap.String("src", conn.RemoteAddr().String()), zap.String("error", err.Error()))
+		return
+	}
+	if !c.authorized(req) {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"redfrog\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return
+	}
+
+	var target string
+	var src net.Conn
+	if req.Method == http.MethodConnect {
+		target = req.Host
+		src = &prefixConn{Conn: conn, reader: reader}
+	} else {
+		if req.URL.Scheme != "http" || len(req.URL.Host) == 0 {
+			io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			return
+		}
+		target = req.URL.Host
+		src = &prefixConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(rewriteProxyRequest(req)), reader)}
+	}
+	if _, _, err = net.SplitHostPort(target); err != nil {
+		if req.Method == http.MethodConnect {
+			target = net.JoinHostPort(target, "443")
+		} else {
+			target = net.JoinHostPort(target, "80")
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	src = c.proxyClient.limitConn(src)
+
+	host, _, _ := net.SplitHostPort(target)
+	if c.shouldProxy(host) {
+		err = c.relayProxy(src, target, req.Method == http.MethodConnect)
+	} else {
+		err = c.relayDirect(src, target, req.Method == http.MethodConnect)
+	}
+	if err != nil {
+		if ee, ok := err.(net.Error); !ok || !ee.Timeout() {
+			logger.Debug("Relay HTTP proxy failed", zap.String("target", target), zap.String("error", err.Error()))
+		}
+	}
+}
+
+func (c *httpProxyServer) authorized(req *http.Request) bool {
+	if len(c.auth) == 0 {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(req.Header.Get("Proxy-Authorization")), []byte(c.auth)) == 1
+}
+
+func (c *httpProxyServer) shouldProxy(host string) bool {
+	if c.pacChecker == nil {
+		return true
+	}
+	c.pacChecker.CountConnection(host)
+	if ip := net.ParseIP(host); ip != nil {
+		return c.pacChecker.CheckIP(ip.String())
+	}
+	return c.pacChecker.CheckDomain(host)
+}
+
+func (c *httpProxyServer) relayProxy(src net.Conn, target string, isConnect bool) error {
+	addr := socks.ParseAddr(target)
+	if addr == nil {
+		return errors.Errorf("Invalid target %s", target)
+	}
+	backendProxy := c.proxyClient.getBackendProxyByTarget(addr)
+	if backendProxy == nil {
+		io.WriteString(src, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return errors.New("Can not get backend proxy")
+	}
+	if isConnect {
+		// reply before connecting backend, the same as SOCKS5 inbound
+		if _, err := io.WriteString(src, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			return err
+		}
+	}
+	start := time.Now()
+	transport, inboundSize, outboundSize, err := backendProxy.RelayTCPDataTo(src, addr)
+	c.proxyClient.accountTraffic(src, trafficHost(target), inboundSize, outboundSize)
+	c.proxyClient.logRelay(&relayRecord{network: "tcp", src: src.RemoteAddr().String(), dst: target, backend: backendProxy,
+		transport: transport, start: start, inbound: inboundSize, outbound: outboundSize, err: err})
+	return err
+}
+
+func (c *httpProxyServer) relayDirect(src net.Conn, target string, isConnect bool) error {
+	dst, err := net.DialTimeout("tcp", target, HTTP_PROXY_DIAL_TIMEOUT)
+	if err != nil {
+		io.WriteString(src, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return errors.Wrapf(err, "Dial %s failed", target)
+	}
+	defer dst.Close()
+	if isConnect {
+		if _, err = io.WriteString(src, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			return err
+		}
+	}
+
+	ch := make(chan error)
+	go func() {
+		_, err := copyBuffer(dst, src, c.proxyClient.tcpBuffer_)
+		dst.SetDeadline(time.Now())
+		src.SetDeadline(time.Now())
+		ch <- err
+	}()
+	_, err = copyBuffer(src, dst, c.proxyClient.tcpBuffer_)
+	dst.SetDeadline(time.Now())
+	src.SetDeadline(time.Now())
+	if ee := <-ch; err == nil {
+		err = ee
+	}
+	return err
+}
+
+// rewriteProxyRequest turns absolute form proxy request head into origin form, body is left in reader and relayed as is,
+// each connection carries one request only since following requests may target other hosts
+func rewriteProxyRequest(req *http.Request) []byte {
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	for _, header := range strings.Split(req.Header.Get("Connection"), ",") {
+		if header = strings.TrimSpace(header); len(header) > 0 {
+			req.Header.Del(header)
+		}
+	}
+	req.Header.Set("Connection", "close")
+	// request reader takes transfer encoding out of header
+	if len(req.TransferEncoding) > 0 {
+		req.Header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	req.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,38 @@
+package proxy_client
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRewriteProxyRequest(t *testing.T) {
+	raw := "POST http://www.example.com/path?q=1 HTTP/1.1\r\n" +
+		"Host: www.example.com\r\n" +
+		"Proxy-Authorization: Basic dXNlcjpwYXNz\r\n" +
+		"Proxy-Connection: keep-alive\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"5\r\nhello\r\n0\r\n\r\n"
+	reader := bufio.NewReader(strings.NewReader(raw))
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		t.Fatalf("read request failed: %s", err.Error())
+	}
+	head := string(rewriteProxyRequest(req))
+	if !strings.HasPrefix(head, "POST /path?q=1 HTTP/1.1\r\nHost: www.example.com\r\n") {
+		t.Errorf("request line not in origin form: %q", head)
+	}
+	if strings.Contains(head, "Proxy-") {
+		t.Errorf("proxy headers not removed: %q", head)
+	}
+	if !strings.Contains(head, "Transfer-Encoding: chunked\r\n") || !strings.Contains(head, "Connection: close\r\n") {
+		t.Errorf("headers wrong: %q", head)
+	}
+	// body must be left untouched for relay
+	if body, _ := ioutil.ReadAll(reader); string(body) != "5\r\nhello\r\n0\r\n\r\n" {
+		t.Errorf("body consumed: %q", body)
+	}
+}
@@ -0,0 +1,92 @@
+package proxy_client
+
+import (
+	"github.com/weishi258/kcp-go-ng"
+	"github.com/weishi258/redfrog-core/kcp_helper"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	KCP_ADAPT_INTERVAL = 30 * time.Second
+	// fewer segments sent in an interval tell nothing about the link
+	KCP_ADAPT_MIN_SEGS = 200
+	// retransmitted share of sent segments above which mode steps up, below which it steps down
+	KCP_LOSS_RAISE = 0.05
+	KCP_LOSS_LOWER = 0.01
+)
+
+// nextKCPMode steps mode index one preset toward the measured loss, kept within [lo, hi]
+func nextKCPMode(current int, lo int, hi int, loss float64) int {
+	next := current
+	if loss > KCP_LOSS_RAISE {
+		next++
+	} else if loss < KCP_LOSS_LOWER {
+		next--
+	}
+	if next > hi {
+		next = hi
+	}
+	if next < lo {
+		next = lo
+	}
+	return next
+}
+
+// adapt samples KCP statistics every interval, they are process wide so backends share the measurement
+func (c *KCPBackend) adapt() {
+	ticker := time.NewTicker(KCP_ADAPT_INTERVAL)
+	defer ticker.Stop()
+	last := kcp.DefaultSnmp.Copy()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.die:
+			return
+		}
+		now := kcp.DefaultSnmp.Copy()
+		outSegs := now.OutSegs - last.OutSegs
+		retrans := now.RetransSegs - last.RetransSegs
+		last = now
+		if outSegs < KCP_ADAPT_MIN_SEGS {
+			continue
+		}
+		c.switchMode(float64(retrans) / float64(outSegs))
+	}
+}
+
+// switchMode retunes live sessions, reload resets mode to configured one
+func (c *KCPBackend) switchMode(loss float64) {
+	c.Lock()
+	defer c.Unlock()
+	current := kcp_helper.ModeIndex(c.config.Mode)
+	if !c.config.Adaptive || current < 0 {
+		return
+	}
+	lo, hi := kcp_helper.ModeIndex(c.config.AdaptiveMin), kcp_helper.ModeIndex(c.config.AdaptiveMax)
+	if lo < 0 {
+		lo = 0
+	}
+	if hi < 0 {
+		hi = len(kcp_helper.KCP_MODES) - 1
+	}
+	next := nextKCPMode(current, lo, hi, loss)
+	if next == current {
+		return
+	}
+	old := c.config.Mode
+	c.config.Mode = kcp_helper.KCP_MODES[next]
+	c.config.Nodelay, c.config.Interval, c.config.Resend, c.config.NoCongestion = kcp_helper.GetModeSetting(c.config.Mode,
+		c.config.Nodelay,
+		c.config.Interval,
+		c.config.Resend,
+		c.config.NoCongestion)
+	for _, conn := range c.muxConns {
+		if conn.conn != nil {
+			conn.conn.SetNoDelay(c.config.Nodelay, c.config.Interval, c.config.Resend, c.config.NoCongestion)
+		}
+	}
+	log.GetLogger().Info("Kcp mode switched", zap.String("addr", c.config.Server), zap.String("old", old),
+		zap.String("new", c.config.Mode), zap.Float64("loss", loss))
+}
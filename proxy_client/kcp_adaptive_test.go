@@ -0,0 +1,25 @@
+package proxy_client
+
+import "testing"
+
+func TestNextKCPMode(t *testing.T) {
+	cases := []struct {
+		current, lo, hi int
+		loss            float64
+		expected        int
+	}{
+		{1, 0, 3, 0.10, 2},
+		{3, 0, 3, 0.10, 3},
+		{1, 0, 3, 0.001, 0},
+		{0, 0, 3, 0.001, 0},
+		{1, 0, 3, 0.03, 1},
+		{2, 1, 2, 0.10, 2},
+		// mode configured outside bounds is pulled back into them
+		{0, 1, 3, 0.03, 1},
+	}
+	for _, tc := range cases {
+		if got := nextKCPMode(tc.current, tc.lo, tc.hi, tc.loss); got != tc.expected {
+			t.Errorf("mode %d in [%d, %d] loss %v got %d expected %d", tc.current, tc.lo, tc.hi, tc.loss, got, tc.expected)
+		}
+	}
+}
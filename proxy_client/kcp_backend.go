@@ -10,16 +10,23 @@ import (
 	"github.com/xtaci/smux"
 	"go.uber.org/zap"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	SCAVENGER_COUNT = 128
+	// cap of sessions including those opened over max-streams, beyond it least loaded session takes the stream
+	KCP_MAX_SESSIONS = 64
 )
 
 type muxConn struct {
 	session *smux.Session
 	ttl     time.Time
+	// underlying KCP session, retuned in place by adaptive mode
+	conn *kcp.UDPSession
+	// smux frames read and written, watched for zombie session
+	carrier *kcpCarrier
 }
 
 type KCPBackend struct {
@@ -27,70 +34,112 @@ type KCPBackend struct {
 	config     config.KcptunConfig
 	cipher     kcp.AheadCipher
 
+	// first conns slots are configured ones, slots after them are opened when all reach max-streams
 	muxConns   []muxConn
+	conns      int
 	scavengers chan *smux.Session
 
 	sync.Mutex
 	connCount int
+	// bumped by Reload and Stop, sessions dialed in background for older generation are dropped
+	generation int
+	// closed by Stop
+	die chan struct{}
+	// sessions torn down by health check, accessed atomically
+	redials uint64
+	// seconds, read by scavenger without lock since sessions are handed to it under lock
+	scavengeTTL int64
+	// unix nano since every session failed and relays fall back, 0 while KCP works, accessed atomically
+	fallbackSince int64
+	fallbacks     uint64
 }
 
 func StartKCPBackend(config config.KcptunConfig, crypt string, password string) (ret *KCPBackend, err error) {
 	ret = &KCPBackend{}
-	ret.config = config
-	ret.smuxConfig = smux.DefaultConfig()
-	ret.smuxConfig.MaxReceiveBuffer = config.Sockbuf
-	ret.smuxConfig.KeepAliveInterval = time.Duration(config.KeepAliveInterval) * time.Second
-	ret.smuxConfig.KeepAliveTimeout = time.Duration(config.KeepAliveTimeout) * time.Second
-
-	ret.config.Nodelay, ret.config.Interval, ret.config.Resend, ret.config.NoCongestion = kcp_helper.GetModeSetting(ret.config.Mode,
-		ret.config.Nodelay,
-		ret.config.Interval,
-		ret.config.Resend,
-		ret.config.NoCongestion)
-
 	if ret.cipher, err = kcp_helper.GetCipher(crypt, password); err != nil {
 		err = errors.Wrap(err, "Create Kcp cipher failed")
 		return
 	}
+	if _, err = kcp_helper.GetSmuxConfig(config); err != nil {
+		return
+	}
+	ret.scavengers = make(chan *smux.Session, SCAVENGER_COUNT)
+	ret.die = make(chan struct{})
+
+	ret.Lock()
+	ret.setup(config)
+	ret.Unlock()
+
+	go ret.scavenger()
+	go ret.adapt()
+	go ret.health()
+
+	log.GetLogger().Info("Kcp client start successful")
+	return
+}
+
+// setup dials sessions of new config into fresh slots, config is validated by caller which holds lock
+func (c *KCPBackend) setup(config config.KcptunConfig) {
+	c.config = config
+	atomic.StoreInt64(&c.scavengeTTL, int64(config.ScavengeTTL))
+	c.smuxConfig, _ = kcp_helper.GetSmuxConfig(config)
+
+	c.config.Nodelay, c.config.Interval, c.config.Resend, c.config.NoCongestion = kcp_helper.GetModeSetting(c.config.Mode,
+		c.config.Nodelay,
+		c.config.Interval,
+		c.config.Resend,
+		c.config.NoCongestion)
 
 	if config.Conn > 0 {
-		ret.muxConns = make([]muxConn, config.Conn)
+		c.muxConns = make([]muxConn, config.Conn)
 	} else {
-		ret.muxConns = make([]muxConn, 1)
+		c.muxConns = make([]muxConn, 1)
 	}
+	c.conns = len(c.muxConns)
 
 	// we do not wait create kcp connection to block our main logic
 	// so try to create conn, if failed then spawn go routing to do the job
-	ret.Lock()
-	for idx := range ret.muxConns {
-		if conn, err := ret.createConn(); err != nil {
-			go func() {
-				newConn := ret.waitConn()
-				ret.Lock()
-				defer ret.Unlock()
-				ret.muxConns[idx].session = newConn
-				ret.muxConns[idx].ttl = time.Now().Add(time.Duration(config.AutoExpire) * time.Second)
-			}()
+	for idx := range c.muxConns {
+		if conn, err := c.createConn(c.config, c.smuxConfig); err != nil {
+			go c.redial(idx, c.generation, c.config, c.smuxConfig)
 		} else {
-			ret.muxConns[idx].session = conn
-			ret.muxConns[idx].ttl = time.Now().Add(time.Duration(config.AutoExpire) * time.Second)
+			c.muxConns[idx] = conn
 		}
-
 	}
-	ret.Unlock()
-
-	ret.scavengers = make(chan *smux.Session, SCAVENGER_COUNT)
-	go ret.scavenger()
+}
 
-	log.GetLogger().Info("Kcp client start successful")
-	return
+// Reload switches to new parameters without dropping streams, new streams open on sessions dialed with new config
+// while old sessions are handed to scavenger which closes them once their streams finish
+func (c *KCPBackend) Reload(config config.KcptunConfig) error {
+	if _, err := kcp_helper.GetSmuxConfig(config); err != nil {
+		return err
+	}
+	c.Lock()
+	c.generation++
+	old := c.muxConns
+	c.setup(config)
+	c.Unlock()
+	// scavenger takes lock, so hand over old sessions after releasing it
+	for _, conn := range old {
+		if conn.session != nil {
+			c.scavengers <- conn.session
+		}
+	}
+	log.GetLogger().Info("Kcp client reloaded", zap.String("addr", config.Server), zap.String("mode", config.Mode),
+		zap.Int("mtu", config.Mtu), zap.Int("sndwnd", config.Sndwnd), zap.Int("rcvwnd", config.Rcvwnd))
+	return nil
 }
 
 func (c *KCPBackend) Stop() {
 	logger := log.GetLogger()
 	c.Lock()
 	defer c.Unlock()
+	c.generation++
+	close(c.die)
 	for idx := range c.muxConns {
+		if c.muxConns[idx].session == nil {
+			continue
+		}
 		if err := c.muxConns[idx].session.Close(); err != nil {
 			logger.Error("Kcp close muxConn failed", zap.String("error", err.Error()))
 		}
@@ -100,20 +149,45 @@ func (c *KCPBackend) Stop() {
 
 }
 
-func (c *KCPBackend) waitConn() *smux.Session {
+// redial fills slot in background, gives up once generation is outdated by Reload or Stop
+func (c *KCPBackend) redial(idx int, generation int, config config.KcptunConfig, smuxConfig *smux.Config) {
+	conn := c.waitConn(generation, config, smuxConfig)
+	if conn.session == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if generation != c.generation || idx >= len(c.muxConns) {
+		conn.session.Close()
+		return
+	}
+	// adaptive mode may have moved on while dialing
+	conn.conn.SetNoDelay(c.config.Nodelay, c.config.Interval, c.config.Resend, c.config.NoCongestion)
+	c.muxConns[idx] = conn
+}
+
+func (c *KCPBackend) getGeneration() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.generation
+}
+
+// waitConn returns conn without session if generation is outdated while re-connecting
+func (c *KCPBackend) waitConn(generation int, config config.KcptunConfig, smuxConfig *smux.Config) muxConn {
 	logger := log.GetLogger()
-	for {
-		if session, err := c.createConn(); err != nil {
+	for c.getGeneration() == generation {
+		if conn, err := c.createConn(config, smuxConfig); err != nil {
 			logger.Info("Kcp re-connecting and sleep for 1 seconds", zap.String("error", err.Error()))
 			time.Sleep(time.Second)
 		} else {
-			return session
+			return conn
 		}
 	}
+	return muxConn{}
 }
 
-func (c *KCPBackend) createConn() (ret *smux.Session, err error) {
-	kcpConn, err := kcp.DialWithOptionsAhead(c.config.Server, c.cipher, c.config.ThreadCount, c.config.Datashard, c.config.Parityshard)
+func (c *KCPBackend) createConn(config config.KcptunConfig, smuxConfig *smux.Config) (ret muxConn, err error) {
+	kcpConn, err := kcp.DialWithOptionsAhead(config.Server, c.cipher, config.ThreadCount, config.Datashard, config.Parityshard)
 	if err != nil {
 		err = errors.Wrap(err, "Kcp create connection failed")
 		return
@@ -121,82 +195,109 @@ func (c *KCPBackend) createConn() (ret *smux.Session, err error) {
 
 	kcpConn.SetStreamMode(true)
 	kcpConn.SetWriteDelay(true)
-	kcpConn.SetNoDelay(c.config.Nodelay, c.config.Interval, c.config.Resend, c.config.NoCongestion)
-	kcpConn.SetWindowSize(c.config.Sndwnd, c.config.Rcvwnd)
-	kcpConn.SetMtu(c.config.Mtu)
-	kcpConn.SetACKNoDelay(c.config.Acknodelay)
+	kcpConn.SetNoDelay(config.Nodelay, config.Interval, config.Resend, config.NoCongestion)
+	kcpConn.SetWindowSize(config.Sndwnd, config.Rcvwnd)
+	kcpConn.SetMtu(config.Mtu)
+	kcpConn.SetACKNoDelay(config.Acknodelay)
 
 	//if err = kcpConn.SetDSCP(c.config.Dscp); err != nil {
 	//	log.GetLogger().Warn("Set DSCP failed", zap.String("error", err.Error()))
 	//}
 
-	if err = kcpConn.SetReadBuffer(c.config.Sockbuf); err != nil {
+	if err = kcpConn.SetReadBuffer(config.Sockbuf); err != nil {
 		err = errors.Wrap(err, "Set ReadBuffer failed")
 		return
 	}
-	if err = kcpConn.SetWriteBuffer(c.config.Sockbuf); err != nil {
+	if err = kcpConn.SetWriteBuffer(config.Sockbuf); err != nil {
 		err = errors.Wrap(err, "Set WriteBuffer failed")
 		return
 	}
 
-	if c.config.Nocomp {
-		if ret, err = smux.Client(kcpConn, c.smuxConfig); err != nil {
-			err = errors.Wrap(err, "Kcp create smux client failed")
-		}
+	if config.Nocomp {
+		ret.carrier = newKcpCarrier(kcpConn)
 	} else {
-		if ret, err = smux.Client(kcp_helper.NewCompStream(kcpConn), c.smuxConfig); err != nil {
-			err = errors.Wrap(err, "Kcp create smux client failed")
-		}
+		ret.carrier = newKcpCarrier(kcp_helper.NewCompStream(kcpConn))
 	}
-
+	if ret.session, err = smux.Client(ret.carrier, smuxConfig); err != nil {
+		err = errors.Wrap(err, "Kcp create smux client failed")
+		return
+	}
+	ret.conn = kcpConn
+	ret.ttl = time.Now().Add(time.Duration(config.AutoExpire) * time.Second)
 	return
 }
 
-func (c *KCPBackend) getSession() (sess *smux.Session, err error) {
+func (c *KCPBackend) getSession() (ret muxConn, err error) {
 	// modified for concurrence
 	c.Lock()
 	defer c.Unlock()
-	idx := c.connCount % c.config.Conn
+	idx := c.connCount % c.conns
 	c.connCount++
-	sess = c.muxConns[idx].session
-	ttl := c.muxConns[idx].ttl
+	ret = c.muxConns[idx]
+	sess := ret.session
+	ttl := ret.ttl
 
 	if sess != nil {
 		if sess.IsClosed() || (c.config.AutoExpire > 0 && time.Now().After(ttl)) {
 			c.scavengers <- sess
 			// set session to nil so this slot is un-usable until waitConn return newConn
-			c.muxConns[idx].session = nil
-			c.muxConns[idx].ttl = time.Now()
+			c.muxConns[idx] = muxConn{ttl: time.Now()}
 
-			if sess, err = c.createConn(); err != nil {
+			if ret, err = c.createConn(c.config, c.smuxConfig); err != nil {
 				// well, we do not wait to wait for new connection
-				go func() {
-					sess = c.waitConn()
-					c.Lock()
-					defer c.Unlock()
-					c.muxConns[idx].session = sess
-					c.muxConns[idx].ttl = time.Now().Add(time.Duration(c.config.AutoExpire) * time.Second)
-				}()
-				return nil, errors.Wrap(err, fmt.Sprintf("Kcp connection is re-connecting for slot %d", idx))
+				go c.redial(idx, c.generation, c.config, c.smuxConfig)
+				return ret, errors.Wrap(err, fmt.Sprintf("Kcp connection is re-connecting for slot %d", idx))
 			} else {
-				c.muxConns[idx].session = sess
-				c.muxConns[idx].ttl = time.Now().Add(time.Duration(c.config.AutoExpire) * time.Second)
+				c.muxConns[idx] = ret
 			}
 		}
-		return sess, nil
+		if c.config.MaxStreams > 0 && ret.session.NumStreams() >= c.config.MaxStreams {
+			return c.getSpareSession()
+		}
+		return ret, nil
+	}
+	return ret, errors.New(fmt.Sprintf("Kcp connection is re-connecting for slot %d", idx))
+}
+
+// getSpareSession returns session below max-streams, opening another one if all are full, caller holds lock
+func (c *KCPBackend) getSpareSession() (ret muxConn, err error) {
+	leastIdx := -1
+	for idx, conn := range c.muxConns {
+		if conn.session == nil || conn.session.IsClosed() {
+			continue
+		}
+		if conn.session.NumStreams() < c.config.MaxStreams {
+			return conn, nil
+		}
+		if leastIdx < 0 || conn.session.NumStreams() < c.muxConns[leastIdx].session.NumStreams() {
+			leastIdx = idx
+		}
+	}
+	if len(c.muxConns) >= KCP_MAX_SESSIONS {
+		if leastIdx < 0 {
+			return ret, errors.New("Kcp has no session available")
+		}
+		return c.muxConns[leastIdx], nil
+	}
+	if ret, err = c.createConn(c.config, c.smuxConfig); err != nil {
+		return ret, errors.Wrap(err, "Kcp open session over max streams failed")
 	}
-	return nil, errors.New(fmt.Sprintf("Kcp connection is re-connecting for slot %d", idx))
+	c.muxConns = append(c.muxConns, ret)
+	log.GetLogger().Info("Kcp sessions reach max streams, so open another", zap.String("addr", c.config.Server),
+		zap.Int("sessions", len(c.muxConns)))
+	return ret, nil
 }
 
-func (c *KCPBackend) GetKcpConn() (*smux.Stream, error) {
-	sess, err := c.getSession()
+func (c *KCPBackend) openStream() (*smux.Stream, error) {
+	conn, err := c.getSession()
 	if err != nil {
 		return nil, err
 	}
-	kcpConn, err := sess.OpenStream()
+	kcpConn, err := conn.session.OpenStream()
 	if err != nil {
 		return nil, errors.Wrap(err, "Kcp open stream failed")
 	}
+	conn.carrier.streamOpened()
 	return kcpConn, nil
 }
 
@@ -208,7 +309,7 @@ func (c *KCPBackend) scavenger() {
 	for {
 		select {
 		case sess := <-c.scavengers:
-			sessionList = append(sessionList, muxConn{sess, time.Now()})
+			sessionList = append(sessionList, muxConn{session: sess, ttl: time.Now()})
 			logger.Debug("Session marked as expired")
 		case <-ticker.C:
 			var newList []muxConn
@@ -217,7 +318,7 @@ func (c *KCPBackend) scavenger() {
 				if s.session.NumStreams() == 0 || s.session.IsClosed() {
 					logger.Debug("Session normally closed")
 					s.session.Close()
-				} else if c.config.ScavengeTTL >= 0 && time.Since(s.ttl) >= time.Duration(c.config.ScavengeTTL)*time.Second {
+				} else if ttl := atomic.LoadInt64(&c.scavengeTTL); ttl >= 0 && time.Since(s.ttl) >= time.Duration(ttl)*time.Second {
 					logger.Debug("Session reached scavenge ttl")
 					s.session.Close()
 				} else {
@@ -0,0 +1,84 @@
+package proxy_client
+
+import (
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/log"
+	"github.com/xtaci/smux"
+	"go.uber.org/zap"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// while KCP is down relays go straight to fallback transport, and a stream is tried this often to bring it back
+	KCP_PROBE_INTERVAL = 5 * time.Second
+)
+
+// GetKcpConn opens stream on first working session, once every session fails KCP is marked down and callers fall
+// back without trying until probe sees it working again
+func (c *KCPBackend) GetKcpConn() (*smux.Stream, error) {
+	if since := c.getFallbackSince(); !since.IsZero() {
+		return nil, errors.Errorf("Kcp is down since %s", since.Format(time.RFC3339))
+	}
+	var err error
+	for i := 0; i < c.getConns(); i++ {
+		var stream *smux.Stream
+		if stream, err = c.openStream(); err == nil {
+			return stream, nil
+		}
+	}
+	c.enterFallback(err)
+	return nil, err
+}
+
+func (c *KCPBackend) getConns() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.conns
+}
+
+// getFallbackSince returns zero time if KCP works
+func (c *KCPBackend) getFallbackSince() time.Time {
+	if since := atomic.LoadInt64(&c.fallbackSince); since > 0 {
+		return time.Unix(0, since)
+	}
+	return time.Time{}
+}
+
+func (c *KCPBackend) enterFallback(err error) {
+	if !atomic.CompareAndSwapInt64(&c.fallbackSince, 0, time.Now().UnixNano()) {
+		return
+	}
+	atomic.AddUint64(&c.fallbacks, 1)
+	log.GetLogger().Warn("Kcp is down, so fall back until it recovers", zap.String("addr", c.getServer()), zap.String("error", err.Error()))
+	go c.probe()
+}
+
+// probe opens a stream every interval until one succeeds, then relays use KCP again
+func (c *KCPBackend) probe() {
+	ticker := time.NewTicker(KCP_PROBE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.die:
+			return
+		}
+		stream, err := c.openStream()
+		if err != nil {
+			log.GetLogger().Debug("Kcp probe failed", zap.String("addr", c.getServer()), zap.String("error", err.Error()))
+			continue
+		}
+		stream.Close()
+		since := c.getFallbackSince()
+		atomic.StoreInt64(&c.fallbackSince, 0)
+		log.GetLogger().Info("Kcp recovered, so relays use it again", zap.String("addr", c.getServer()), zap.Duration("down", time.Since(since)))
+		return
+	}
+}
+
+func (c *KCPBackend) getServer() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.config.Server
+}
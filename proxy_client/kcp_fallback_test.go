@@ -0,0 +1,24 @@
+package proxy_client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKcpFallbackSkipsSessions(t *testing.T) {
+	// no session at all, so trying one would panic
+	backend := &KCPBackend{fallbackSince: time.Now().UnixNano()}
+	if _, err := backend.GetKcpConn(); err == nil {
+		t.Fatal("stream opened while kcp is down")
+	}
+	if backend.getFallbackSince().IsZero() {
+		t.Fatal("fallback state lost")
+	}
+	var stats transportStats
+	stats.used(TRANSPORT_KCP)
+	stats.used(TRANSPORT_TCP)
+	stats.used(TRANSPORT_TCP)
+	if stats.kcp != 1 || stats.mux != 0 || stats.tcp != 2 {
+		t.Errorf("transport counters got %+v", stats)
+	}
+}
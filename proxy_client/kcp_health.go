@@ -0,0 +1,186 @@
+package proxy_client
+
+import (
+	"github.com/weishi258/kcp-go-ng"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	KCP_HEALTH_INTERVAL = 5 * time.Second
+	// session is zombie when this many streams opened since it last delivered payload, the first of them this long ago
+	KCP_ZOMBIE_STREAMS = 3
+	KCP_ZOMBIE_TIMEOUT = 15 * time.Second
+	// smux reads frame header alone, any other read carries stream payload
+	SMUX_HEADER_SIZE = 8
+)
+
+// kcpCarrier sits between smux and KCP, so payload arriving can be told apart from keepalive frames
+type kcpCarrier struct {
+	io.ReadWriteCloser
+	created  time.Time
+	inBytes  uint64
+	outBytes uint64
+	// unix nano of last payload read, accessed atomically
+	lastData int64
+
+	sync.Mutex
+	// streams opened since payload was last seen, and when first of them opened
+	pending      int
+	firstPending time.Time
+}
+
+func newKcpCarrier(conn io.ReadWriteCloser) *kcpCarrier {
+	return &kcpCarrier{ReadWriteCloser: conn, created: time.Now()}
+}
+
+func (c *kcpCarrier) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	if n > 0 {
+		atomic.AddUint64(&c.inBytes, uint64(n))
+		if len(b) != SMUX_HEADER_SIZE {
+			atomic.StoreInt64(&c.lastData, time.Now().UnixNano())
+		}
+	}
+	return n, err
+}
+
+func (c *kcpCarrier) Write(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(b)
+	atomic.AddUint64(&c.outBytes, uint64(n))
+	return n, err
+}
+
+func (c *kcpCarrier) getLastData() time.Time {
+	if lastData := atomic.LoadInt64(&c.lastData); lastData > 0 {
+		return time.Unix(0, lastData)
+	}
+	return time.Time{}
+}
+
+func (c *kcpCarrier) streamOpened() {
+	c.Lock()
+	defer c.Unlock()
+	if c.pending == 0 || c.getLastData().After(c.firstPending) {
+		c.pending = 0
+		c.firstPending = time.Now()
+	}
+	c.pending++
+}
+
+func (c *kcpCarrier) isZombie(now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+	return isZombieSession(c.pending, c.firstPending, c.getLastData(), now)
+}
+
+// isZombieSession tells if streams keep opening on session while nothing comes back on any of them
+func isZombieSession(pending int, firstPending time.Time, lastData time.Time, now time.Time) bool {
+	return pending >= KCP_ZOMBIE_STREAMS && !lastData.After(firstPending) && now.Sub(firstPending) >= KCP_ZOMBIE_TIMEOUT
+}
+
+// health tears down zombie sessions and re-dials their slots, smux keepalive does not catch them since the link
+// itself still answers
+func (c *KCPBackend) health() {
+	ticker := time.NewTicker(KCP_HEALTH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.die:
+			return
+		}
+		c.checkHealth(time.Now())
+	}
+}
+
+func (c *KCPBackend) checkHealth(now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	for idx, conn := range c.muxConns {
+		if conn.session == nil || conn.carrier == nil || !conn.carrier.isZombie(now) {
+			continue
+		}
+		log.GetLogger().Warn("Kcp session carries no data, so re-dial it", zap.String("addr", c.config.Server), zap.Int("slot", idx),
+			zap.Int("streams", conn.session.NumStreams()))
+		conn.session.Close()
+		atomic.AddUint64(&c.redials, 1)
+		c.muxConns[idx] = muxConn{ttl: now}
+		// sessions over max-streams are opened again on demand
+		if idx < c.conns {
+			go c.redial(idx, c.generation, c.config, c.smuxConfig)
+		}
+	}
+	// drop idle sessions opened over max-streams, from the tail so slot index of others stays
+	for len(c.muxConns) > c.conns {
+		last := c.muxConns[len(c.muxConns)-1]
+		if last.session != nil && !last.session.IsClosed() && last.session.NumStreams() > 0 {
+			break
+		}
+		if last.session != nil {
+			last.session.Close()
+		}
+		c.muxConns = c.muxConns[:len(c.muxConns)-1]
+	}
+}
+
+// KcpSessionStats is a snapshot of one KCP session slot
+type KcpSessionStats struct {
+	Slot      int
+	Connected bool
+	Streams   int
+	Age       time.Duration
+	InBytes   uint64
+	OutBytes  uint64
+	// zero if no payload received yet
+	LastData time.Time
+}
+
+// KcpStats is a snapshot of KCP backend, segment counters are process wide since kcp-go keeps them globally and
+// it has no per session RTT or in-flight getter
+type KcpStats struct {
+	Server   string
+	Mode     string
+	Redials  uint64
+	Sessions []KcpSessionStats
+	Snmp     *kcp.Snmp
+}
+
+func (c *KCPBackend) GetStats() KcpStats {
+	c.Lock()
+	defer c.Unlock()
+	ret := KcpStats{Server: c.config.Server, Mode: c.config.Mode, Redials: atomic.LoadUint64(&c.redials),
+		Sessions: make([]KcpSessionStats, 0, len(c.muxConns)), Snmp: kcp.DefaultSnmp.Copy()}
+	for idx, conn := range c.muxConns {
+		stats := KcpSessionStats{Slot: idx}
+		if conn.session != nil && !conn.session.IsClosed() {
+			stats.Connected = true
+			stats.Streams = conn.session.NumStreams()
+		}
+		if conn.carrier != nil {
+			stats.Age = time.Since(conn.carrier.created)
+			stats.InBytes = atomic.LoadUint64(&conn.carrier.inBytes)
+			stats.OutBytes = atomic.LoadUint64(&conn.carrier.outBytes)
+			stats.LastData = conn.carrier.getLastData()
+		}
+		ret.Sessions = append(ret.Sessions, stats)
+	}
+	return ret
+}
+
+// GetKcpStats returns stats of every backend with kcptun enabled
+func (c *ProxyClient) GetKcpStats() []KcpStats {
+	c.backendMux.RLock()
+	defer c.backendMux.RUnlock()
+	ret := make([]KcpStats, 0)
+	for _, backend := range c.backends_ {
+		if backend.kcpBackend != nil {
+			ret = append(ret, backend.kcpBackend.GetStats())
+		}
+	}
+	return ret
+}
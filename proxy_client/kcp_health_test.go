@@ -0,0 +1,23 @@
+package proxy_client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsZombieSession(t *testing.T) {
+	now := time.Now()
+	first := now.Add(-2 * KCP_ZOMBIE_TIMEOUT)
+	if !isZombieSession(KCP_ZOMBIE_STREAMS, first, time.Time{}, now) {
+		t.Error("session without any data should be zombie")
+	}
+	if isZombieSession(KCP_ZOMBIE_STREAMS, first, first.Add(time.Second), now) {
+		t.Error("session with data after streams opened is healthy")
+	}
+	if isZombieSession(KCP_ZOMBIE_STREAMS-1, first, time.Time{}, now) {
+		t.Error("too few streams to judge")
+	}
+	if isZombieSession(KCP_ZOMBIE_STREAMS, now.Add(-time.Second), time.Time{}, now) {
+		t.Error("streams opened just now should get time to answer")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/weishi258/redfrog-core/common"
 	"github.com/weishi258/redfrog-core/config"
 	"github.com/weishi258/redfrog-core/log"
 	"github.com/weishi258/redfrog-core/network"
@@ -11,19 +12,57 @@ import (
 	"go.uber.org/zap"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
 type proxyBackend struct {
-	cipher_            core.Cipher
-	tcpAddr            net.TCPAddr
-	udpAddr            *net.UDPAddr
-	remoteServerConfig config.RemoteServerConfig
-
-	networkType_ string
-	tcpTimeout_  time.Duration
-	udpTimeout_  time.Duration
-	kcpBackend   *KCPBackend
+	cipher_ core.Cipher
+	// *config.RemoteServerConfig, replaced as a whole by update since relays read it without lock
+	remoteServerConfig atomic.Value
+	// *backendAddr
+	addr atomic.Value
+	// set if remote server is a hostname, which is resolved again by resolveLoop
+	serverHost   string
+	serverPort   int
+	resolver     *serverResolver
+	resolveNow   chan struct{}
+	resolveDone  chan struct{}
+	lastResolved int64
+	// accessed atomically, backoff in nanoseconds
+	dialRetry   int64
+	dialBackoff int64
+	breaker     circuitBreaker
+	// accessed atomically, 0 max means no cap, wait in nanoseconds
+	maxConns     int64
+	maxConnsWait int64
+	// nil if outbound sockets are not bound
+	sockOpts *network.SocketOptions
+	// accessed atomically, 0 means no limit
+	maxUdpSize      int64
+	udpOversizeDrop int32
+	// nanoseconds, accessed atomically since reload updates them in place
+	tcpTimeout_     int64
+	udpTimeout_     int64
+	connectTimeout_ int64
+	dnsTimeout_     int64
+	// 0 means flows expire by I/O timeout
+	udpIdleTimeout_ int64
+	kcpBackend      *KCPBackend
+	stats           backendStats
+	tcpBuffer_      *common.LeakyBuffer
+	// *backendLimiters
+	limiters atomic.Value
+	// stream is not encrypted, TCP relay can splice between sockets
+	plaintext bool
+	// nil if disabled
+	pool       *connPool
+	muxBackend *TCPMuxBackend
+	plugins    *pluginChain
+	// relays by transport
+	transport transportStats
+	// failed relays by category
+	relayErrors relayErrorStats
 
 	//dnsResolver *DnsSyncResolver
 }
@@ -32,6 +71,16 @@ const (
 	RELAY_TCP_RETRY = "Kcp relay tcp failed when write header"
 )
 
+// copyBuffer relays with buffer from pool, pool may be nil
+func copyBuffer(dst io.Writer, src io.Reader, pool *common.LeakyBuffer) (int64, error) {
+	if pool == nil {
+		return io.Copy(dst, src)
+	}
+	buffer := pool.Get()
+	defer pool.Put(buffer)
+	return io.CopyBuffer(dst, src, buffer)
+}
+
 func computeUDPKey(src *net.UDPAddr, dst *net.UDPAddr) string {
 	return fmt.Sprintf("%s->%s", src.String(), dst.String())
 }
@@ -39,31 +88,45 @@ func computeDnsKey(dst string) string {
 	return fmt.Sprintf("DNS->%s", dst)
 }
 
-func CreateProxyBackend(remoteServerConfig config.RemoteServerConfig) (ret *proxyBackend, err error) {
+func CreateProxyBackend(remoteServerConfig config.RemoteServerConfig, resolver *serverResolver, mark int, tcpBuffer *common.LeakyBuffer) (ret *proxyBackend, err error) {
 
 	ret = &proxyBackend{}
-	ret.remoteServerConfig = remoteServerConfig
-	ret.tcpTimeout_ = time.Second * time.Duration(remoteServerConfig.TcpTimeout)
-	ret.udpTimeout_ = time.Second * time.Duration(remoteServerConfig.UdpTimeout)
-	var isIPv6 bool
-	if isIPv6, err = network.CheckIPFamily(remoteServerConfig.RemoteServer); err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("Invalid IP format: %s", remoteServerConfig.RemoteServer))
+	ret.tcpBuffer_ = tcpBuffer
+	ret.limiters.Store(newBackendLimiters(remoteServerConfig.UploadLimit, remoteServerConfig.DownloadLimit))
+	ret.remoteServerConfig.Store(&remoteServerConfig)
+	ret.setTimeout(remoteServerConfig)
+	ret.setDialPolicy(remoteServerConfig)
+	ret.setConnCap(remoteServerConfig)
+	if !isValidUdpOversize(remoteServerConfig.UdpOversize) {
+		err = errors.New(fmt.Sprintf("Invalid udp-oversize action: %s", remoteServerConfig.UdpOversize))
 		return
 	}
-	if isIPv6 {
-		ret.networkType_ = "tcp6"
-	} else {
-		ret.networkType_ = "tcp4"
+	ret.setUDPSize(remoteServerConfig)
+	if ret.sockOpts, err = network.NewSocketOptions(remoteServerConfig.BindInterface, remoteServerConfig.BindAddress, mark); err != nil {
+		return
 	}
-	if ip, port, ee := network.ParseAddr(remoteServerConfig.RemoteServer, isIPv6); ee != nil {
-		err = errors.Wrap(ee, "Parse IPv4 failed")
+	var host string
+	var ip net.IP
+	if host, ip, ret.serverPort, err = splitServerAddr(remoteServerConfig.RemoteServer); err != nil {
 		return
+	}
+	if ip != nil {
+		ret.addr.Store(newBackendAddr([]net.IP{ip}, ret.serverPort))
 	} else {
-		ret.tcpAddr = net.TCPAddr{IP: ip, Port: port}
-		ret.udpAddr = &net.UDPAddr{IP: ip, Port: port}
+		ret.serverHost = host
+		ret.resolver = resolver
+		if err = ret.resolve(); err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("Resolve server failed: %s", remoteServerConfig.RemoteServer))
+			return
+		}
+		log.GetLogger().Info("Proxy backend server resolved", zap.String("server", host), zap.String("addr", ret.getAddr().tcp.IP.String()))
 	}
 
-	if ret.cipher_, err = core.PickCipher(remoteServerConfig.Crypt, []byte{}, remoteServerConfig.Password); err != nil {
+	crypt := remoteServerConfig.Crypt
+	if ret.plaintext = isPlaintextCipher(crypt); ret.plaintext {
+		crypt = "dummy"
+	}
+	if ret.cipher_, err = core.PickCipher(crypt, []byte{}, remoteServerConfig.Password); err != nil {
 		err = errors.Wrap(err, "Generate cipher failed")
 		return
 	}
@@ -73,16 +136,136 @@ func CreateProxyBackend(remoteServerConfig config.RemoteServerConfig) (ret *prox
 	//	return
 	//}
 	if remoteServerConfig.Kcptun.Enable {
-		if ret.kcpBackend, err = StartKCPBackend(remoteServerConfig.Kcptun, remoteServerConfig.Crypt, remoteServerConfig.Password); err != nil {
+		if ret.kcpBackend, err = StartKCPBackend(remoteServerConfig.Kcptun, crypt, remoteServerConfig.Password); err != nil {
 			err = errors.Wrap(err, "Create KCP backend failed")
 		}
+	} else {
+		if plugins := remoteServerConfig.GetPlugins(); len(plugins) > 0 {
+			// plugin is given server as configured, so it resolves hostname itself
+			if ret.plugins, err = startPluginChain(plugins, remoteServerConfig.RemoteServer); err != nil {
+				err = errors.Wrap(err, "Start SIP003 plugins failed")
+				return
+			}
+		}
+		// KCP backend multiplexes its own connections, pool only helps plain TCP
+		ret.pool = newConnPool(remoteServerConfig.PoolSize, time.Duration(remoteServerConfig.PoolIdle)*time.Second, ret.createTCPConn)
+		if remoteServerConfig.TcpMux.Enable {
+			ret.muxBackend = StartTCPMuxBackend(remoteServerConfig.TcpMux, ret.createTCPConn)
+		}
+	}
+	if len(ret.serverHost) > 0 && resolver.interval > 0 {
+		ret.resolveNow = make(chan struct{}, 1)
+		ret.resolveDone = make(chan struct{})
+		go ret.resolveLoop()
 	}
 
 	return
 }
 
+// getConfig returns current config of backend, which is never changed in place
+func (c *proxyBackend) getConfig() *config.RemoteServerConfig {
+	if ret, ok := c.remoteServerConfig.Load().(*config.RemoteServerConfig); ok {
+		return ret
+	}
+	return &config.RemoteServerConfig{}
+}
+
+func (c *proxyBackend) getName() string {
+	serverConfig := c.getConfig()
+	if len(serverConfig.Name) > 0 {
+		return serverConfig.Name
+	}
+	return serverConfig.RemoteServer
+}
+
+func (c *proxyBackend) getWeight() int {
+	if weight := c.getConfig().Weight; weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+func (c *proxyBackend) setTimeout(remoteServerConfig config.RemoteServerConfig) {
+	atomic.StoreInt64(&c.tcpTimeout_, int64(time.Second*time.Duration(remoteServerConfig.TcpTimeout)))
+	atomic.StoreInt64(&c.udpTimeout_, int64(time.Second*time.Duration(remoteServerConfig.UdpTimeout)))
+	atomic.StoreInt64(&c.connectTimeout_, int64(time.Second*time.Duration(remoteServerConfig.ConnectTimeout)))
+	atomic.StoreInt64(&c.dnsTimeout_, int64(time.Second*time.Duration(remoteServerConfig.DnsTimeout)))
+	atomic.StoreInt64(&c.udpIdleTimeout_, int64(time.Second*time.Duration(remoteServerConfig.UdpIdleTimeout)))
+}
+
+// update applies settings which do not need reconnect, caller holds backend lock of proxy client
+func (c *proxyBackend) update(remoteServerConfig config.RemoteServerConfig) {
+	current := *c.getConfig()
+	c.setTimeout(remoteServerConfig)
+	current.TcpTimeout = remoteServerConfig.TcpTimeout
+	current.UdpTimeout = remoteServerConfig.UdpTimeout
+	current.ConnectTimeout = remoteServerConfig.ConnectTimeout
+	current.DnsTimeout = remoteServerConfig.DnsTimeout
+	current.UdpIdleTimeout = remoteServerConfig.UdpIdleTimeout
+	if c.kcpBackend != nil && !current.Kcptun.Equal(&remoteServerConfig.Kcptun) {
+		// existing streams stay on old sessions until they finish
+		if err := c.kcpBackend.Reload(remoteServerConfig.Kcptun); err != nil {
+			log.GetLogger().Error("Invalid kcptun config, so keep current one", zap.String("server", c.getName()), zap.String("error", err.Error()))
+		} else {
+			current.Kcptun = remoteServerConfig.Kcptun
+		}
+	}
+	current.Weight = remoteServerConfig.Weight
+	current.Name = remoteServerConfig.Name
+	c.setDialPolicy(remoteServerConfig)
+	current.DialRetry = remoteServerConfig.DialRetry
+	current.DialBackoff = remoteServerConfig.DialBackoff
+	current.BreakerThreshold = remoteServerConfig.BreakerThreshold
+	current.BreakerCooldown = remoteServerConfig.BreakerCooldown
+	c.setConnCap(remoteServerConfig)
+	current.MaxConns = remoteServerConfig.MaxConns
+	current.MaxConnsWait = remoteServerConfig.MaxConnsWait
+	if isValidUdpOversize(remoteServerConfig.UdpOversize) {
+		c.setUDPSize(remoteServerConfig)
+		current.MaxUdpSize = remoteServerConfig.MaxUdpSize
+		current.UdpOversize = remoteServerConfig.UdpOversize
+	} else {
+		log.GetLogger().Error("Invalid udp-oversize action, so keep current one", zap.String("server", c.getName()), zap.String("action", remoteServerConfig.UdpOversize))
+	}
+	if current.UploadLimit != remoteServerConfig.UploadLimit || current.DownloadLimit != remoteServerConfig.DownloadLimit {
+		current.UploadLimit = remoteServerConfig.UploadLimit
+		current.DownloadLimit = remoteServerConfig.DownloadLimit
+		c.limiters.Store(newBackendLimiters(remoteServerConfig.UploadLimit, remoteServerConfig.DownloadLimit))
+	}
+	c.remoteServerConfig.Store(&current)
+}
+
+// getLimiters of nil backend, i.e. direct flow, limits nothing
+func (c *proxyBackend) getLimiters() *backendLimiters {
+	if c == nil {
+		return &backendLimiters{}
+	}
+	return c.limiters.Load().(*backendLimiters)
+}
+
+func (c *proxyBackend) GetTCPTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.tcpTimeout_))
+}
+
 func (c *proxyBackend) GetUDPTimeout() time.Duration {
-	return c.udpTimeout_
+	return time.Duration(atomic.LoadInt64(&c.udpTimeout_))
+}
+
+func (c *proxyBackend) GetConnectTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.connectTimeout_))
+}
+
+// GetUDPIdleTimeout returns how long flow may stay silent, default to its I/O timeout
+func (c *proxyBackend) GetUDPIdleTimeout(ioTimeout time.Duration) time.Duration {
+	if idle := time.Duration(atomic.LoadInt64(&c.udpIdleTimeout_)); idle > 0 {
+		return idle
+	}
+	return ioTimeout
+}
+
+// GetDNSTimeout returns 0 if backend does not override DNS timeout
+func (c *proxyBackend) GetDNSTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.dnsTimeout_))
 }
 
 func (c *proxyBackend) Stop() {
@@ -95,16 +278,85 @@ func (c *proxyBackend) Stop() {
 	if c.kcpBackend != nil {
 		c.kcpBackend.Stop()
 	}
-	logger.Info("Proxy backend stopped", zap.String("addr", c.tcpAddr.String()))
+	c.pool.stop()
+	if c.muxBackend != nil {
+		c.muxBackend.Stop()
+	}
+	c.plugins.stop()
+	if c.resolveDone != nil {
+		close(c.resolveDone)
+	}
+	logger.Info("Proxy backend stopped", zap.String("addr", c.getConfig().RemoteServer))
+}
+
+// getTCPConn takes a pre-dialed conn from pool, or dials one if pool is empty, retrying with backoff unless breaker
+// opened meanwhile, conn sending PROXY protocol header is always dialed since header is bound to one client
+func (c *proxyBackend) getTCPConn(header []byte) (conn net.Conn, err error) {
+	if header == nil {
+		if conn = c.pool.get(); conn != nil {
+			return conn, nil
+		}
+	}
+	retry := int(atomic.LoadInt64(&c.dialRetry))
+	backoff := time.Duration(atomic.LoadInt64(&c.dialBackoff))
+	for attempt := 0; ; attempt++ {
+		if conn, err = c.dialTCPConn(header); err == nil || attempt >= retry || !c.breaker.available() {
+			return
+		}
+		time.Sleep(retryBackoff(attempt, backoff))
+	}
 }
 
 func (c *proxyBackend) createTCPConn() (conn net.Conn, err error) {
+	return c.dialTCPConn(nil)
+}
+
+// dialTCPConn dials server and sends header, if any, in clear ahead of websocket and cipher
+func (c *proxyBackend) dialTCPConn(header []byte) (conn net.Conn, err error) {
 
-	conn, err = net.DialTCP(c.networkType_, nil, &c.tcpAddr)
+	start := time.Now()
+	var tcpConn *net.TCPConn
+	addr := c.getAddr()
+	tcpAddr := addr.tcp
+	if c.plugins != nil {
+		// plugin relays to server, udp still goes to server directly
+		tcpAddr = c.plugins.localAddr
+	}
+	if c.getConfig().TcpFastOpen {
+		// connect completes on first write, so rtt recorded here is only the local part
+		tcpConn, err = network.DialTCPFastOpen(tcpAddr, c.sockOpts, c.GetConnectTimeout())
+	} else if c.plugins != nil {
+		var pluginConn net.Conn
+		if pluginConn, err = net.DialTimeout("tcp", tcpAddr.String(), c.GetConnectTimeout()); err == nil {
+			tcpConn = pluginConn.(*net.TCPConn)
+		}
+	} else {
+		tcpConn, err = c.dialServer(addr)
+	}
 	if err != nil {
+		c.requestResolve()
+		c.dialFailed(err)
 		return
 	}
-	conn.(*net.TCPConn).SetKeepAlive(true)
+	if !c.getConfig().TcpFastOpen {
+		c.stats.recordRtt(time.Since(start))
+	}
+	tcpConn.SetKeepAlive(true)
+	if len(header) > 0 {
+		if _, err = tcpConn.Write(header); err != nil {
+			tcpConn.Close()
+			return nil, errors.Wrap(err, "Write PROXY protocol header failed")
+		}
+	}
+	conn = tcpConn
+	if serverConfig := c.getConfig(); serverConfig.Websocket.Enable {
+		if conn, err = dialWebsocket(tcpConn, serverConfig.Websocket, serverConfig.RemoteServer); err != nil {
+			tcpConn.Close()
+			c.dialFailed(err)
+			return nil, markRelayError(RELAY_ERROR_HANDSHAKE, err)
+		}
+	}
+	c.dialSucceeded()
 
 	conn = c.cipher_.StreamConn(conn)
 
@@ -115,9 +367,8 @@ func (c *proxyBackend) createTCPConn() (conn net.Conn, err error) {
 func (c *proxyBackend) relayKCPData(srcConn net.Conn, kcpConn *smux.Stream, header []byte) (inboundSize int64, outboundSize int64, err error) {
 	defer kcpConn.Close()
 
-	//srcConn.SetWriteDeadline(time.Now().Add(c.tcpTimeout_))
-	//kcpConn.SetWriteDeadline(time.Now().Add(c.tcpTimeout_))
-
+	idle := newRelayIdle(c.GetTCPTimeout())
+	kcpConn.SetWriteDeadline(idle.deadline())
 	if _, err = kcpConn.Write(header); err != nil {
 		log.GetLogger().Error(RELAY_TCP_RETRY, zap.String("err", err.Error()))
 		err = errors.New(RELAY_TCP_RETRY)
@@ -128,13 +379,15 @@ func (c *proxyBackend) relayKCPData(srcConn net.Conn, kcpConn *smux.Stream, head
 
 	go func() {
 		res := relayDataRes{}
-		res.outboundSize, res.Err = io.Copy(srcConn, kcpConn)
+		res.outboundSize, res.Err = copyBuffer(&idleConn{conn: srcConn, idle: idle}, &idleConn{conn: kcpConn, idle: idle}, c.tcpBuffer_)
+		idle.stop()
 		srcConn.SetDeadline(time.Now())
 		kcpConn.Close()
 		ch <- res
 	}()
 
-	inboundSize, err = io.Copy(kcpConn, srcConn)
+	inboundSize, err = copyBuffer(&idleConn{conn: kcpConn, idle: idle}, &idleConn{conn: srcConn, idle: idle}, c.tcpBuffer_)
+	idle.stop()
 	srcConn.SetDeadline(time.Now())
 	kcpConn.Close()
 	rs := <-ch
@@ -148,13 +401,28 @@ func (c *proxyBackend) relayKCPData(srcConn net.Conn, kcpConn *smux.Stream, head
 	return
 }
 
-func (c *proxyBackend) RelayTCPData(src net.Conn) (inboundSize int64, outboundSize int64, err error) {
-
+func (c *proxyBackend) RelayTCPData(src net.Conn) (transport string, inboundSize int64, outboundSize int64, err error) {
 	var originDst []byte
 	if originDst, err = network.ConvertShadowSocksAddr(src.LocalAddr().String(), false); err != nil {
 		err = errors.Wrap(err, "Parse origin dst failed")
 		return
 	}
+	return c.RelayTCPDataTo(src, originDst)
+}
+
+// RelayTCPDataTo relays src to target given in shadowsocks address format, which may also be a domain name, transport
+// is what relay went over, empty if none was reached
+func (c *proxyBackend) RelayTCPDataTo(src net.Conn, originDst []byte) (transport string, inboundSize int64, outboundSize int64, err error) {
+	if err = c.acquireRelay(); err != nil {
+		return
+	}
+	defer c.stats.release()
+	defer func() {
+		if err != nil {
+			c.countRelayError(err)
+		}
+	}()
+	src = c.getLimiters().limitConn(src)
 
 	// try relay data through KCP is enabled and working
 	if c.kcpBackend != nil {
@@ -168,22 +436,43 @@ func (c *proxyBackend) RelayTCPData(src net.Conn) (inboundSize int64, outboundSi
 					return
 				}
 			}
+			c.transport.used(TRANSPORT_KCP)
 			logger.Debug("Relay Kcp finished", zap.Int64("inbound", inboundSize), zap.Int64("outbound", outboundSize))
-			return inboundSize, outboundSize, nil
+			// relay error is returned so it is counted and logged as for plain TCP
+			return TRANSPORT_KCP, inboundSize, outboundSize, err
+		}
+	}
+
+	// the same for smux over TCP, stream header and relay are identical to KCP
+	if c.muxBackend != nil {
+		var muxConn *smux.Stream
+		if muxConn, err = c.muxBackend.GetMuxConn(); err == nil {
+			if inboundSize, outboundSize, err = c.relayKCPData(src, muxConn, originDst); err != nil && err.Error() == RELAY_TCP_RETRY {
+				return
+			}
+			c.transport.used(TRANSPORT_MUX)
+			log.GetLogger().Debug("Relay mux finished", zap.Int64("inbound", inboundSize), zap.Int64("outbound", outboundSize))
+			return TRANSPORT_MUX, inboundSize, outboundSize, err
 		}
+		log.GetLogger().Debug("Mux stream not available, so fall back to plain TCP", zap.String("error", err.Error()))
 	}
 
 	var dst net.Conn
-	if dst, err = c.createTCPConn(); err != nil {
-		err = errors.Wrap(err, "Create remote conn failed")
+	var header []byte
+	if c.getConfig().ProxyProtocol && c.plugins == nil {
+		header = network.ProxyProtocolV2Header(src.RemoteAddr(), src.LocalAddr())
+	}
+	if dst, err = c.getTCPConn(header); err != nil {
+		err = markRelayError(RELAY_ERROR_DIAL, errors.Wrap(err, "Create remote conn failed"))
 		return
 	}
 	defer dst.Close()
+	c.transport.used(TRANSPORT_TCP)
+	transport = TRANSPORT_TCP
 
-	// set deadline timeout
-	//dst.SetWriteDeadline(time.Now().Add(c.tcpTimeout_))
-	//src.SetWriteDeadline(time.Now().Add(c.tcpTimeout_))
-
+	// deadlines are pushed forward while data flows either way, so only idle relay times out
+	idle := newRelayIdle(c.GetTCPTimeout())
+	dst.SetWriteDeadline(idle.deadline())
 	if _, err = dst.Write(originDst); err != nil {
 		err = errors.Wrap(err, "Write to remote server failed")
 		return
@@ -192,13 +481,15 @@ func (c *proxyBackend) RelayTCPData(src net.Conn) (inboundSize int64, outboundSi
 
 	go func() {
 		res := relayDataRes{}
-		res.outboundSize, res.Err = io.Copy(dst, src)
+		res.outboundSize, res.Err = c.copyTCP(dst, src, idle)
+		idle.stop()
 		dst.SetDeadline(time.Now()) // wake up the other goroutine blocking on right
 		src.SetDeadline(time.Now()) // wake up the other goroutine blocking on left
 		ch <- res
 	}()
 
-	inboundSize, err = io.Copy(src, dst)
+	inboundSize, err = c.copyTCP(src, dst, idle)
+	idle.stop()
 	dst.SetDeadline(time.Now()) // wake up the other goroutine blocking on right
 	src.SetDeadline(time.Now()) // wake up the other goroutine blocking on left
 	rs := <-ch
@@ -212,49 +503,76 @@ func (c *proxyBackend) RelayTCPData(src net.Conn) (inboundSize int64, outboundSi
 }
 
 func (c *proxyBackend) GetUDPRelayEntry(dstAddr *net.UDPAddr) (entry *udpProxyEntry, err error) {
+	if entry, err = c.createUDPRelayEntry(dstAddr); entry != nil {
+		entry.idleTimeout = c.GetUDPIdleTimeout(entry.timeout)
+	}
+	return
+}
 
-	if c.remoteServerConfig.UdpOverTcp {
-		if c.kcpBackend != nil {
-			// try to get an KCP steam connection, if not fall back to default proxy mode
-			var kcpConn *smux.Stream
-			if kcpConn, err = c.kcpBackend.GetKcpConn(); err == nil {
-				if entry, err = createUDPOverKCPProxyEntry(kcpConn, dstAddr, c.udpAddr, c.tcpTimeout_); err == nil {
-					log.GetLogger().Debug("create udp over kcp relay entry successful", zap.String("dst", dstAddr.String()))
+// udpOverKcp tells if UDP flows try KCP first, which udp-over-tcp did before kcptun udp was added
+func (c *proxyBackend) udpOverKcp() bool {
+	serverConfig := c.getConfig()
+	return c.kcpBackend != nil && (serverConfig.Kcptun.Udp || serverConfig.UdpOverTcp)
+}
+
+func (c *proxyBackend) createUDPRelayEntry(dstAddr *net.UDPAddr) (entry *udpProxyEntry, err error) {
+	if c.udpOverKcp() {
+		// try to get an KCP steam connection, if not fall back to default proxy mode
+		var kcpConn *smux.Stream
+		if kcpConn, err = c.kcpBackend.GetKcpConn(); err == nil {
+			if entry, err = createUDPOverKCPProxyEntry(kcpConn, dstAddr, c.getAddr().udp, c.GetTCPTimeout()); err == nil {
+				entry.transport = TRANSPORT_KCP
+				log.GetLogger().Debug("create udp over kcp relay entry successful", zap.String("dst", dstAddr.String()))
+				return
+			}
+			kcpConn.Close()
+			err = errors.Wrap(err, "Create udp over tcp proxy entry failed")
+		}
+		log.GetLogger().Debug("UDP over kcp failed, so fall back", zap.String("dst", dstAddr.String()), zap.String("error", err.Error()))
+	}
+	if c.getConfig().UdpOverTcp {
+		if c.muxBackend != nil {
+			var muxConn *smux.Stream
+			if muxConn, err = c.muxBackend.GetMuxConn(); err == nil {
+				if entry, err = createUDPOverKCPProxyEntry(muxConn, dstAddr, c.getAddr().udp, c.GetTCPTimeout()); err == nil {
+					entry.transport = TRANSPORT_MUX
+					log.GetLogger().Debug("create udp over mux relay entry successful", zap.String("dst", dstAddr.String()))
 					return
-				} else {
-					kcpConn.Close()
-					err = errors.Wrap(err, "Create udp over tcp proxy entry failed")
 				}
+				muxConn.Close()
 			}
 		}
 		var dst net.Conn
-		if dst, err = c.createTCPConn(); err != nil {
+		if dst, err = c.getTCPConn(nil); err != nil {
 			err = errors.Wrap(err, "Create remote conn failed")
 			return
 		} else {
 			log.GetLogger().Debug("create udp over tcp relay entry successful", zap.String("dst", dstAddr.String()))
 		}
-		if entry, err = createUDPOverTCPProxyEntry(dst, dstAddr, c.udpAddr, c.tcpTimeout_); err != nil {
+		if entry, err = createUDPOverTCPProxyEntry(dst, dstAddr, c.getAddr().udp, c.GetTCPTimeout()); err != nil {
 			dst.Close()
 			err = errors.Wrap(err, "Create udp over tcp proxy entry failed")
+		} else {
+			entry.transport = TRANSPORT_TCP
 		}
 
 	} else {
 		var conn net.PacketConn
-		conn, err = net.ListenPacket("udp", "")
+		conn, err = c.sockOpts.ListenUDP()
 		if err != nil {
 			err = errors.Wrap(err, "UDP proxy listen local failed")
 			return
 		}
 		conn = c.cipher_.PacketConn(conn)
 
-		if entry, err = createUDPProxyEntry(conn, dstAddr, c.udpAddr, c.udpTimeout_); err != nil {
+		if entry, err = createUDPProxyEntry(conn, dstAddr, c.getAddr().udp, c.GetUDPTimeout()); err != nil {
 			conn.Close()
 			err = errors.Wrap(err, "Create udp proxy entry failed")
+			return
 		}
+		entry.transport = TRANSPORT_UDP
 		log.GetLogger().Debug("create udp relay entry successful", zap.String("dst", dstAddr.String()))
 	}
-
 	return
 }
 
@@ -0,0 +1,144 @@
+package proxy_client
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BALANCE_RANDOM      = "random"
+	BALANCE_ROUND_ROBIN = "round-robin"
+	BALANCE_WEIGHTED    = "weighted"
+	BALANCE_LEAST_CONN  = "least-conn"
+	BALANCE_LOWEST_RTT  = "lowest-rtt"
+	BALANCE_FASTEST     = "fastest"
+
+	// weight of newest sample in smoothed rtt, same as TCP srtt
+	RTT_SMOOTH_SHIFT = 3
+)
+
+// backendStats is connection and latency accounting of a backend used by balancer
+type backendStats struct {
+	activeConns int64
+	// smoothed dial rtt in nanoseconds, 0 means no sample yet
+	rtt int64
+}
+
+func (c *backendStats) acquire() {
+	atomic.AddInt64(&c.activeConns, 1)
+}
+
+// tryAcquire counts conn only if fewer than max are active, max 0 means no cap
+func (c *backendStats) tryAcquire(max int64) bool {
+	for {
+		active := atomic.LoadInt64(&c.activeConns)
+		if max > 0 && active >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&c.activeConns, active, active+1) {
+			return true
+		}
+	}
+}
+
+func (c *backendStats) release() {
+	atomic.AddInt64(&c.activeConns, -1)
+}
+
+func (c *backendStats) getActiveConns() int64 {
+	return atomic.LoadInt64(&c.activeConns)
+}
+
+func (c *backendStats) recordRtt(rtt time.Duration) {
+	for {
+		old := atomic.LoadInt64(&c.rtt)
+		srtt := int64(rtt)
+		if old != 0 {
+			srtt = old + (int64(rtt)-old)>>RTT_SMOOTH_SHIFT
+		}
+		if atomic.CompareAndSwapInt64(&c.rtt, old, srtt) {
+			return
+		}
+	}
+}
+
+func (c *backendStats) getRtt() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+type proxyBalancer struct {
+	strategy string
+	counter  uint32
+	// *proxyBackend elected by prober under fastest strategy
+	fastest atomic.Value
+}
+
+func isValidBalanceStrategy(strategy string) bool {
+	switch strategy {
+	case BALANCE_RANDOM, BALANCE_ROUND_ROBIN, BALANCE_WEIGHTED, BALANCE_LEAST_CONN, BALANCE_LOWEST_RTT, BALANCE_FASTEST:
+		return true
+	}
+	return false
+}
+
+// pick selects a backend by strategy, ties are broken by round robin so equal backends share the load
+func (c *proxyBalancer) pick(backends []*proxyBackend) *proxyBackend {
+	backends = availableBackends(backends)
+	length := len(backends)
+	if length == 0 {
+		return nil
+	} else if length == 1 {
+		return backends[0]
+	}
+	switch c.strategy {
+	case BALANCE_ROUND_ROBIN:
+		return backends[int(atomic.AddUint32(&c.counter, 1)-1)%length]
+	case BALANCE_WEIGHTED:
+		return c.pickWeighted(backends)
+	case BALANCE_LEAST_CONN:
+		return c.pickMin(backends, func(backend *proxyBackend) int64 {
+			return backend.stats.getActiveConns()
+		})
+	case BALANCE_LOWEST_RTT:
+		// backend without rtt sample ranks first so it gets probed
+		return c.pickMin(backends, func(backend *proxyBackend) int64 {
+			return int64(backend.stats.getRtt())
+		})
+	case BALANCE_FASTEST:
+		return c.pickFastest(backends)
+	default:
+		return backends[rand.Intn(length)]
+	}
+}
+
+// pickWeighted selects backend randomly in proportion to its configured weight
+func (c *proxyBalancer) pickWeighted(backends []*proxyBackend) *proxyBackend {
+	totalWeight := 0
+	for _, backend := range backends {
+		totalWeight += backend.getWeight()
+	}
+	n := rand.Intn(totalWeight)
+	for _, backend := range backends {
+		if n < backend.getWeight() {
+			return backend
+		}
+		n -= backend.getWeight()
+	}
+	return backends[len(backends)-1]
+}
+
+func (c *proxyBalancer) pickMin(backends []*proxyBackend, value func(*proxyBackend) int64) *proxyBackend {
+	length := len(backends)
+	start := int(atomic.AddUint32(&c.counter, 1)-1) % length
+	ret := backends[start]
+	min := value(ret)
+	for i := 1; i < length; i++ {
+		backend := backends[(start+i)%length]
+		if v := value(backend); v < min {
+			ret = backend
+			min = v
+		}
+	}
+	return ret
+}
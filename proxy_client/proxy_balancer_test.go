@@ -0,0 +1,70 @@
+package proxy_client
+
+import (
+	"github.com/weishi258/redfrog-core/config"
+	"testing"
+	"time"
+)
+
+func TestBalancerRoundRobin(t *testing.T) {
+	backends := []*proxyBackend{{}, {}, {}}
+	balancer := proxyBalancer{strategy: BALANCE_ROUND_ROBIN}
+	for i := 0; i < 6; i++ {
+		if backend := balancer.pick(backends); backend != backends[i%3] {
+			t.Errorf("round robin pick %d got wrong backend", i)
+		}
+	}
+}
+
+func TestBalancerLeastConn(t *testing.T) {
+	backends := []*proxyBackend{{}, {}, {}}
+	backends[0].stats.acquire()
+	backends[1].stats.acquire()
+	backends[1].stats.acquire()
+	balancer := proxyBalancer{strategy: BALANCE_LEAST_CONN}
+	if backend := balancer.pick(backends); backend != backends[2] {
+		t.Errorf("least conn should pick idle backend")
+	}
+	backends[2].stats.acquire()
+	backends[2].stats.acquire()
+	if backend := balancer.pick(backends); backend != backends[0] {
+		t.Errorf("least conn should pick backend with one conn")
+	}
+}
+
+func TestBalancerLowestRtt(t *testing.T) {
+	backends := []*proxyBackend{{}, {}}
+	backends[0].stats.recordRtt(50 * time.Millisecond)
+	balancer := proxyBalancer{strategy: BALANCE_LOWEST_RTT}
+	if backend := balancer.pick(backends); backend != backends[1] {
+		t.Errorf("lowest rtt should probe backend without sample first")
+	}
+	backends[1].stats.recordRtt(200 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		if backend := balancer.pick(backends); backend != backends[0] {
+			t.Errorf("lowest rtt should pick faster backend")
+		}
+	}
+	// smoothed rtt moves 1/8 toward new sample
+	backends[0].stats.recordRtt(130 * time.Millisecond)
+	if rtt := backends[0].stats.getRtt(); rtt != 60*time.Millisecond {
+		t.Errorf("smoothed rtt got %s", rtt)
+	}
+}
+
+func TestBalancerWeighted(t *testing.T) {
+	backends := []*proxyBackend{{}, {}}
+	backends[0].remoteServerConfig.Store(&config.RemoteServerConfig{Weight: 4})
+	backends[1].remoteServerConfig.Store(&config.RemoteServerConfig{Weight: 1})
+	balancer := proxyBalancer{strategy: BALANCE_WEIGHTED}
+	picked := 0
+	for i := 0; i < 10000; i++ {
+		if balancer.pick(backends) == backends[0] {
+			picked++
+		}
+	}
+	// expect 80% with generous margin
+	if picked < 7500 || picked > 8500 {
+		t.Errorf("weighted pick share got %d of 10000", picked)
+	}
+}
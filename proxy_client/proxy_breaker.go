@@ -0,0 +1,115 @@
+package proxy_client
+
+import (
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// cap of backoff between dial retries, client is waiting meanwhile
+	DIAL_BACKOFF_MAX = 2 * time.Second
+)
+
+// circuitBreaker opens after threshold consecutive dial failures, open backend is skipped by selection until cooldown
+// passed, then next dial decides, since failures stay over threshold one more failure opens it again
+type circuitBreaker struct {
+	sync.Mutex
+	// 0 disables
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func (c *circuitBreaker) setup(threshold int, cooldown int) {
+	c.Lock()
+	defer c.Unlock()
+	c.threshold = threshold
+	c.cooldown = time.Duration(cooldown) * time.Second
+}
+
+func (c *circuitBreaker) available() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.threshold <= 0 || c.failures < c.threshold || !time.Now().Before(c.openUntil)
+}
+
+func (c *circuitBreaker) success() {
+	c.Lock()
+	defer c.Unlock()
+	c.failures = 0
+}
+
+// failure returns true if breaker opens by this failure
+func (c *circuitBreaker) failure() bool {
+	c.Lock()
+	defer c.Unlock()
+	c.failures++
+	if c.threshold <= 0 || c.failures < c.threshold || time.Now().Before(c.openUntil) {
+		return false
+	}
+	c.openUntil = time.Now().Add(c.cooldown)
+	return true
+}
+
+// retryBackoff doubles base each attempt with jitter in [d/2, d], so clients failing together do not retry together
+func retryBackoff(attempt int, base time.Duration) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	d := base
+	for i := 0; i < attempt && d < DIAL_BACKOFF_MAX; i++ {
+		d *= 2
+	}
+	if d > DIAL_BACKOFF_MAX {
+		d = DIAL_BACKOFF_MAX
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (c *proxyBackend) setDialPolicy(remoteServerConfig config.RemoteServerConfig) {
+	atomic.StoreInt64(&c.dialRetry, int64(remoteServerConfig.DialRetry))
+	atomic.StoreInt64(&c.dialBackoff, int64(time.Duration(remoteServerConfig.DialBackoff)*time.Millisecond))
+	c.breaker.setup(remoteServerConfig.BreakerThreshold, remoteServerConfig.BreakerCooldown)
+}
+
+func (c *proxyBackend) dialSucceeded() {
+	c.breaker.success()
+}
+
+func (c *proxyBackend) dialFailed(err error) {
+	if c.breaker.failure() {
+		log.GetLogger().Warn("Proxy backend keeps failing, so skip it for a while", zap.String("server", c.getName()), zap.String("error", err.Error()))
+	}
+}
+
+// isAvailable tells if backend may be selected, nil is direct route which is always available
+func (c *proxyBackend) isAvailable() bool {
+	return c == nil || (c.breaker.available() && !c.isFull())
+}
+
+// availableBackends filters out backends with open breaker or full, all of them are returned if none is available since
+// failing backend is still better than no backend
+func availableBackends(backends []*proxyBackend) []*proxyBackend {
+	available := 0
+	for _, backend := range backends {
+		if backend.isAvailable() {
+			available++
+		}
+	}
+	if available == len(backends) || available == 0 {
+		return backends
+	}
+	ret := make([]*proxyBackend, 0, available)
+	for _, backend := range backends {
+		if backend.isAvailable() {
+			ret = append(ret, backend)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,80 @@
+package proxy_client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var breaker circuitBreaker
+	breaker.setup(3, 3600)
+	for i := 0; i < 2; i++ {
+		if breaker.failure() || !breaker.available() {
+			t.Fatalf("breaker should stay closed after %d failures", i+1)
+		}
+	}
+	if !breaker.failure() || breaker.available() {
+		t.Fatal("breaker should open at threshold")
+	}
+	if breaker.failure() {
+		t.Error("open breaker should not open again")
+	}
+	// cooldown passed, next dial decides
+	breaker.openUntil = time.Now()
+	if !breaker.available() {
+		t.Error("breaker should allow probe after cooldown")
+	}
+	if !breaker.failure() || breaker.available() {
+		t.Error("failed probe should open breaker again")
+	}
+	breaker.success()
+	if !breaker.available() {
+		t.Error("success should close breaker")
+	}
+
+	var disabled circuitBreaker
+	for i := 0; i < 10; i++ {
+		disabled.failure()
+	}
+	if !disabled.available() {
+		t.Error("breaker without threshold should never open")
+	}
+}
+
+func TestAvailableBackends(t *testing.T) {
+	backends := []*proxyBackend{{}, {}, {}}
+	for _, backend := range backends {
+		backend.breaker.setup(1, 3600)
+	}
+	backends[1].breaker.failure()
+	balancer := proxyBalancer{strategy: BALANCE_ROUND_ROBIN}
+	for i := 0; i < 4; i++ {
+		if backend := balancer.pick(backends); backend == backends[1] {
+			t.Errorf("pick %d got backend with open breaker", i)
+		}
+	}
+	backends[0].breaker.failure()
+	backends[2].breaker.failure()
+	if len(availableBackends(backends)) != 3 {
+		t.Error("all backends should be returned when none is available")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	if d := retryBackoff(3, 0); d != 0 {
+		t.Errorf("zero base should not wait, got %v", d)
+	}
+	for attempt := 0; attempt < 40; attempt++ {
+		d := retryBackoff(attempt, 100*time.Millisecond)
+		expected := DIAL_BACKOFF_MAX
+		if attempt < 5 {
+			expected = (100 * time.Millisecond) << uint(attempt)
+		}
+		if expected > DIAL_BACKOFF_MAX {
+			expected = DIAL_BACKOFF_MAX
+		}
+		if d < expected/2 || d > expected {
+			t.Errorf("attempt %d backoff %v out of [%v, %v]", attempt, d, expected/2, expected)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package proxy_client
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/config"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// how often relay queued on full backend checks for a free slot
+	BACKEND_QUEUE_INTERVAL = 20 * time.Millisecond
+)
+
+func (c *proxyBackend) setConnCap(remoteServerConfig config.RemoteServerConfig) {
+	atomic.StoreInt64(&c.maxConns, int64(remoteServerConfig.MaxConns))
+	atomic.StoreInt64(&c.maxConnsWait, int64(time.Duration(remoteServerConfig.MaxConnsWait)*time.Millisecond))
+}
+
+// isFull tells if backend carries max-conns relays, so selection spills to other backends
+func (c *proxyBackend) isFull() bool {
+	max := atomic.LoadInt64(&c.maxConns)
+	return max > 0 && c.stats.getActiveConns() >= max
+}
+
+// acquireRelay takes a relay slot, queueing up to max-conns-wait for one when backend is full
+func (c *proxyBackend) acquireRelay() error {
+	deadline := time.Now().Add(time.Duration(atomic.LoadInt64(&c.maxConnsWait)))
+	for {
+		max := atomic.LoadInt64(&c.maxConns)
+		if c.stats.tryAcquire(max) {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return errors.New(fmt.Sprintf("Backend %s reached max conns %d", c.getName(), max))
+		}
+		time.Sleep(BACKEND_QUEUE_INTERVAL)
+	}
+}
@@ -0,0 +1,31 @@
+package proxy_client
+
+import (
+	"testing"
+)
+
+func TestBackendConnCap(t *testing.T) {
+	backends := []*proxyBackend{{maxConns: 1}, {}}
+	if err := backends[0].acquireRelay(); err != nil {
+		t.Fatalf("first relay refused: %s", err.Error())
+	}
+	if !backends[0].isFull() || backends[0].isAvailable() {
+		t.Error("backend at max conns should be full")
+	}
+	balancer := proxyBalancer{strategy: BALANCE_ROUND_ROBIN}
+	for i := 0; i < 3; i++ {
+		if backend := balancer.pick(backends); backend != backends[1] {
+			t.Error("selection should spill to backend below cap")
+		}
+	}
+	if err := backends[0].acquireRelay(); err == nil {
+		t.Error("relay over max conns accepted")
+	}
+	backends[0].stats.release()
+	if err := backends[0].acquireRelay(); err != nil {
+		t.Errorf("released slot refused: %s", err.Error())
+	}
+	if !backends[1].stats.tryAcquire(0) || !backends[1].stats.tryAcquire(0) {
+		t.Error("uncapped backend refused conn")
+	}
+}
@@ -1,10 +1,12 @@
 package proxy_client
 
 import (
+	"container/list"
 	"encoding/binary"
 	"fmt"
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
 	"github.com/weishi258/redfrog-core/common"
 	"github.com/weishi258/redfrog-core/config"
 	"github.com/weishi258/redfrog-core/log"
@@ -12,9 +14,10 @@ import (
 	"github.com/xtaci/smux"
 	"go.uber.org/zap"
 	"io"
-	"math/rand"
 	"net"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,16 +34,46 @@ import (
 type ProxyClient struct {
 	backends_  []*proxyBackend
 	backendMux sync.RWMutex
+	balancer   proxyBalancer
+	// kbit/s, accessed atomically
+	connRateLimit int64
+	// per client caps, accessed atomically
+	clientConnLimit int64
+	clientUdpLimit  int64
+	clientConns     *clientCounter
+	policy          *backendPolicy
+	// bytes relayed per destination host and per LAN client
+	dstTraffic *trafficStats
+	srcTraffic *trafficStats
+	// destinations with $direct rule bypass backends
+	direct *directRoute
+	// nil if backends are not bonded
+	multipath *multipathGroup
+	// fwmark of backend sockets, applied on restart
+	outboundMark int
+	// 1 if UDP flows are full cone, accessed atomically
+	udpFullCone int32
+	// 1 if every finished relay is logged, accessed atomically
+	relayLog int32
+	// nanoseconds between probes of fastest strategy, accessed atomically
+	probeInterval int64
+	probeDone     chan struct{}
 
 	tcpListener net.Listener
-	udpListener *net.UDPConn
+	// TPROXY needs a listener of each address family, ipv6 one is optional
+	tcpListenerV6 net.Listener
+	udpListeners  []*net.UDPConn
 
 	udpBuffer_    *common.LeakyBuffer
+	tcpBuffer_    *common.LeakyBuffer
 	udpOOBBuffer_ *common.LeakyBuffer
 	addr          string
 
 	udpBackend_ *udpBackend
-	udpNatMap_  *udpNatMap
+	udpNatMap_  *udpNatTable
+
+	socks5Server_ *socks5Server
+	httpServer_   *httpProxyServer
 
 	dnsServer      common.DNSServerInterface
 	dnsMockTimeout int
@@ -48,6 +81,11 @@ type ProxyClient struct {
 	dnsSyncResolver common.DnsSyncResolver
 }
 
+const (
+	BACKEND_DRAIN_TIMEOUT  = 5 * time.Minute
+	BACKEND_DRAIN_INTERVAL = time.Second
+)
+
 // udp relay
 type relayDataRes struct {
 	outboundSize int64
@@ -61,7 +99,98 @@ type udpProxyEntry struct {
 	dstKcp_   *smux.Stream
 	header_   []byte
 	proxyAddr *net.UDPAddr
-	timeout   time.Duration
+	// bounds each write, read deadline follows idle timeout instead
+	timeout time.Duration
+	// flow expires after idle timeout without packet either way, lastActive is unix nano accessed atomically
+	idleTimeout time.Duration
+	lastActive  int64
+	// set by expire so read loop quits even though flow is active, accessed atomically
+	expired int32
+	// backend chosen when flow created, flow sticks to it until expired
+	backend *proxyBackend
+	// per flow rate limit, packets over limit are dropped
+	outLimiter *rateLimiter
+	inLimiter  *rateLimiter
+	// nil for DNS relay entry
+	dstTraffic *trafficCounter
+	srcTraffic *trafficCounter
+	// LAN client ip counted against client UDP limit, empty for DNS relay entry
+	client string
+	// set once oversize datagram is logged, accessed atomically
+	oversized int32
+	// keyed by client source only, destination of each datagram is in its own header
+	fullCone bool
+	// entries of other bonded backends, only for plain UDP flow, read loops of them quit when flow closes them
+	paths     []*udpProxyEntry
+	pathMode  string
+	pathCount uint32
+	// nil unless datagrams are duplicated over paths
+	dedup *udpDedup
+	// position in LRU list of NAT table, guarded by its lock
+	lruElem *list.Element
+	// what flow goes over, when it started and bytes it relayed accessed atomically, for relay log
+	transport string
+	start     time.Time
+	inbound   int64
+	outbound  int64
+}
+
+// account counts payload bytes of flow, and against its destination and client unless it is DNS relay
+func (c *udpProxyEntry) account(inbound int64, outbound int64) {
+	atomic.AddInt64(&c.inbound, inbound)
+	atomic.AddInt64(&c.outbound, outbound)
+	c.dstTraffic.add(inbound, outbound)
+	c.srcTraffic.add(inbound, outbound)
+}
+
+// expire wakes up the read loop of entry so it quits and cleans up itself
+func (c *udpProxyEntry) expire() {
+	atomic.StoreInt32(&c.expired, 1)
+	c.setReadDeadline(time.Now())
+}
+
+func (c *udpProxyEntry) setReadDeadline(t time.Time) {
+	if c.dstUdp_ != nil {
+		c.dstUdp_.SetReadDeadline(t)
+	} else if c.dstKcp_ != nil {
+		c.dstKcp_.SetReadDeadline(t)
+	} else if c.dstTcp_ != nil {
+		c.dstTcp_.SetReadDeadline(t)
+	}
+}
+
+// touch records packet of either direction, read deadline is moved lazily by keepAlive
+func (c *udpProxyEntry) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+func (c *udpProxyEntry) idleDeadline() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActive)).Add(c.idleTimeout)
+}
+
+// keepAlive is called when read deadline passed, it re-arms deadline and returns true if flow saw packet within idle
+// timeout, otherwise flow should expire
+func (c *udpProxyEntry) keepAlive() bool {
+	if atomic.LoadInt32(&c.expired) == 1 {
+		return false
+	}
+	deadline := c.idleDeadline()
+	if !time.Now().Before(deadline) {
+		return false
+	}
+	c.setReadDeadline(deadline)
+	return true
+}
+
+func (c *udpProxyEntry) close() error {
+	if c.dstUdp_ != nil {
+		return c.dstUdp_.Close()
+	} else if c.dstKcp_ != nil {
+		return c.dstKcp_.Close()
+	} else if c.dstTcp_ != nil {
+		return c.dstTcp_.Close()
+	}
+	return nil
 }
 
 func createProxyEntry(isUDPOverTcp bool, dstP net.PacketConn, dstT net.Conn, dstK *smux.Stream, dstAddr *net.UDPAddr, proxyAddr *net.UDPAddr, timeout time.Duration) (*udpProxyEntry, error) {
@@ -86,31 +215,16 @@ func createUDPOverKCPProxyEntry(dst *smux.Stream, dstAddr *net.UDPAddr, proxyAdd
 	return createProxyEntry(true, nil, nil, dst, dstAddr, proxyAddr, timeout)
 }
 
-type udpNatMap struct {
-	sync.RWMutex
-	entries map[string]*udpProxyEntry
-}
-
-func (c *udpNatMap) Add(key string, entry *udpProxyEntry) {
-	c.entries[key] = entry
-}
-func (c *udpNatMap) Del(key string) {
-	delete(c.entries, key)
-}
-func (c *udpNatMap) Get(key string) *udpProxyEntry {
-	if entry, ok := c.entries[key]; ok {
-		return entry
-	} else {
-		return nil
-	}
-}
-
 func StartProxyClient(dnsMockTimeout int, config config.ShadowsocksConfig, listenAddr string) (*ProxyClient, error) {
 	logger := log.GetLogger()
 
 	ret := &ProxyClient{}
 	ret.addr = listenAddr
+	ret.tcpBuffer_ = common.NewLeakyBuffer(config.Buffer.TcpPoolSize, config.Buffer.TcpBufferSize)
+	logger.Info("Proxy client buffers", zap.Int("udp size", config.Buffer.UdpBufferSize), zap.Int("udp pool", config.Buffer.UdpPoolSize),
+		zap.Int("tcp size", config.Buffer.TcpBufferSize), zap.Int("tcp pool", config.Buffer.TcpPoolSize))
 
+	ret.outboundMark = config.OutboundMark
 	if err := ret.StartBackend(config); err != nil {
 		return nil, err
 	}
@@ -124,19 +238,57 @@ func StartProxyClient(dnsMockTimeout int, config config.ShadowsocksConfig, liste
 		err = errors.Wrap(err, "TCP listen failed")
 		return nil, err
 	}
-	go ret.startListenTCP()
+	if config.TcpFastOpen {
+		if err = network.EnableTCPFastOpen(ret.tcpListener); err != nil {
+			logger.Warn("TCP fast open on listener failed", zap.String("error", err.Error()))
+		}
+	}
+	go ret.startListenTCP(ret.tcpListener)
+
+	if !isIPv6 {
+		if _, port, ee := net.SplitHostPort(listenAddr); ee == nil {
+			listenAddrV6 := net.JoinHostPort("::", port)
+			if ret.tcpListenerV6, ee = network.ListenTransparentTCP(listenAddrV6, true); ee != nil {
+				logger.Warn("TCP listen on ipv6 failed, so ipv6 TCP will not be intercepted", zap.String("addr", listenAddrV6), zap.String("error", ee.Error()))
+			} else {
+				if config.TcpFastOpen {
+					if ee = network.EnableTCPFastOpen(ret.tcpListenerV6); ee != nil {
+						logger.Warn("TCP fast open on ipv6 listener failed", zap.String("error", ee.Error()))
+					}
+				}
+				go ret.startListenTCP(ret.tcpListenerV6)
+			}
+		}
+	}
 
-	ret.udpBuffer_ = common.NewLeakyBuffer(common.UDP_BUFFER_POOL_SIZE, common.UDP_BUFFER_SIZE)
+	ret.udpBuffer_ = common.NewLeakyBuffer(config.Buffer.UdpPoolSize, config.Buffer.UdpBufferSize)
 	ret.udpOOBBuffer_ = common.NewLeakyBuffer(common.UDP_OOB_POOL_SIZE, common.UDP_OOB_BUFFER_SIZE)
 
-	if ret.udpListener, err = network.ListenTransparentUDP(listenAddr, isIPv6); err != nil {
+	if ret.udpListeners, err = listenUDP(listenAddr, isIPv6, config.UdpListeners); err != nil {
 		ret.tcpListener.Close()
+		if ret.tcpListenerV6 != nil {
+			ret.tcpListenerV6.Close()
+		}
 		err = errors.Wrap(err, "UDP listen failed")
 		return nil, err
 	}
+	if !isIPv6 {
+		if _, port, ee := net.SplitHostPort(listenAddr); ee == nil {
+			listenAddrV6 := net.JoinHostPort("::", port)
+			if udpListenersV6, ee := listenUDP(listenAddrV6, true, config.UdpListeners); ee != nil {
+				logger.Warn("UDP listen on ipv6 failed, so ipv6 UDP will not be intercepted", zap.String("addr", listenAddrV6), zap.String("error", ee.Error()))
+			} else {
+				ret.udpListeners = append(ret.udpListeners, udpListenersV6...)
+			}
+		}
+	}
 	ret.udpBackend_ = NewUDPBackend()
 	ret.dnsMockTimeout = dnsMockTimeout
-	ret.udpNatMap_ = &udpNatMap{entries: make(map[string]*udpProxyEntry)}
+	ret.udpNatMap_ = newUdpNatTable(UDP_NAT_SHARDS, config.UdpMaxFlows)
+	ret.dstTraffic = newTrafficStats()
+	ret.srcTraffic = newTrafficStats()
+	ret.clientConns = newClientCounter()
+	ret.direct = newDirectRoute()
 
 	// for dns proxy
 	//ret.dnsSyncResolver.dnsQueryMap = make(map[uint16]chan<- *dns.Msg)
@@ -146,7 +298,13 @@ func StartProxyClient(dnsMockTimeout int, config config.ShadowsocksConfig, liste
 	//}
 	ret.dnsSyncResolver.Start()
 
-	go ret.startListenUDP()
+	for _, udpListener := range ret.udpListeners {
+		if config.UdpBatch > 1 {
+			go ret.startListenUDPBatch(udpListener, config.UdpBatch)
+		} else {
+			go ret.startListenUDP(udpListener)
+		}
+	}
 
 	logger.Info("ProxyClient start successful", zap.String("addr", listenAddr))
 	return ret, nil
@@ -157,18 +315,45 @@ func (c *ProxyClient) StartBackend(serverConfig config.ShadowsocksConfig) (err e
 	c.backendMux.Lock()
 	defer c.backendMux.Unlock()
 
+	if !isValidBalanceStrategy(serverConfig.Balance) {
+		return errors.New(fmt.Sprintf("Invalid backend balance strategy: %s", serverConfig.Balance))
+	}
+	c.balancer.strategy = serverConfig.Balance
+	logger.Info("Proxy backend balance strategy", zap.String("strategy", serverConfig.Balance))
+	atomic.StoreInt64(&c.connRateLimit, int64(serverConfig.ConnRateLimit))
+	if serverConfig.ConnRateLimit > 0 {
+		logger.Info("Proxy connection rate limit", zap.Int("kbps", serverConfig.ConnRateLimit))
+	}
+	atomic.StoreInt64(&c.clientConnLimit, int64(serverConfig.ClientConnLimit))
+	atomic.StoreInt64(&c.clientUdpLimit, int64(serverConfig.ClientUdpLimit))
+	if serverConfig.ClientConnLimit > 0 || serverConfig.ClientUdpLimit > 0 {
+		logger.Info("Proxy client limit", zap.Int("tcp", serverConfig.ClientConnLimit), zap.Int("udp", serverConfig.ClientUdpLimit))
+	}
+	c.setUDPFullCone(serverConfig.UdpFullCone)
+	c.setRelayLog(serverConfig.RelayLog)
+	atomic.StoreInt64(&c.probeInterval, int64(time.Duration(serverConfig.ProbeInterval)*time.Second))
+	c.probeDone = make(chan struct{})
+	go c.probeBackends()
+	if c.multipath, err = newMultipathGroup(serverConfig.Multipath); err != nil {
+		return errors.Wrap(err, "Create multipath group failed")
+	}
+	if c.policy, err = newBackendPolicy(serverConfig.Policies); err != nil {
+		return errors.Wrap(err, "Create backend policy failed")
+	}
+
 	c.backends_ = make([]*proxyBackend, 0)
 
+	resolver := newServerResolver(serverConfig.ServerResolver, serverConfig.ServerResolveInterval)
 	for _, backendConfig := range serverConfig.Servers {
 		if backendConfig.Enable {
 			var backend *proxyBackend
-			if backend, err = CreateProxyBackend(backendConfig); err != nil {
+			if backend, err = CreateProxyBackend(backendConfig, resolver, c.outboundMark, c.tcpBuffer_); err != nil {
 				logger.Error("Proxy backend create failed", zap.String("addr", backendConfig.RemoteServer))
 				err = errors.Wrap(err, "Create proxy backend failed")
 				return
 			} else {
 				c.backends_ = append(c.backends_, backend)
-				logger.Info("Proxy backend create successful", zap.String("addr", backendConfig.RemoteServer))
+				logger.Info("Proxy backend create successful", zap.String("addr", backendConfig.RemoteServer), zap.Int("weight", backendConfig.Weight))
 			}
 		}
 	}
@@ -176,51 +361,99 @@ func (c *ProxyClient) StartBackend(serverConfig config.ShadowsocksConfig) (err e
 	if len(c.backends_) == 0 {
 		err = errors.New("No backend created !!!")
 	}
+	c.checkPolicyBackends(serverConfig.Policies)
+	c.checkMultipathBackends()
 	return
 }
 
 func (c *ProxyClient) ReloadBackend(dnsMockTimeout int, serverConfig config.ShadowsocksConfig) (err error) {
+	c.backendMux.Lock()
+	c.dnsMockTimeout = dnsMockTimeout
+	c.backendMux.Unlock()
+	return c.Reload(serverConfig)
+}
+
+// Reload diffs server list against running backends, backends with unchanged transport are kept so their connections
+// survive, timeouts weight and name are applied in place, removed backends are drained in background
+func (c *ProxyClient) Reload(serverConfig config.ShadowsocksConfig) (err error) {
 	logger := log.GetLogger()
 	newBackends := make([]*proxyBackend, 0)
 
+	if !isValidBalanceStrategy(serverConfig.Balance) {
+		return errors.New(fmt.Sprintf("Invalid backend balance strategy: %s", serverConfig.Balance))
+	}
+	policy, err := newBackendPolicy(serverConfig.Policies)
+	if err != nil {
+		return errors.Wrap(err, "Create backend policy failed")
+	}
+	multipath, err := newMultipathGroup(serverConfig.Multipath)
+	if err != nil {
+		return errors.Wrap(err, "Create multipath group failed")
+	}
+
 	c.backendMux.Lock()
 	defer c.backendMux.Unlock()
-	c.dnsMockTimeout = dnsMockTimeout
+	if c.balancer.strategy != serverConfig.Balance {
+		logger.Info("Proxy backend balance strategy changed", zap.String("old", c.balancer.strategy), zap.String("new", serverConfig.Balance))
+		c.balancer.strategy = serverConfig.Balance
+	}
+	policy.inherit(c.policy)
+	c.policy = policy
+	// existing flows keep their paths until expired
+	c.multipath = multipath
+	// applies to new connections only
+	if old := atomic.SwapInt64(&c.connRateLimit, int64(serverConfig.ConnRateLimit)); old != int64(serverConfig.ConnRateLimit) {
+		logger.Info("Proxy connection rate limit changed", zap.Int64("old", old), zap.Int("new", serverConfig.ConnRateLimit))
+	}
+	// existing connections over new cap are kept
+	if old := atomic.SwapInt64(&c.clientConnLimit, int64(serverConfig.ClientConnLimit)); old != int64(serverConfig.ClientConnLimit) {
+		logger.Info("Proxy client TCP limit changed", zap.Int64("old", old), zap.Int("new", serverConfig.ClientConnLimit))
+	}
+	if old := atomic.SwapInt64(&c.clientUdpLimit, int64(serverConfig.ClientUdpLimit)); old != int64(serverConfig.ClientUdpLimit) {
+		logger.Info("Proxy client UDP limit changed", zap.Int64("old", old), zap.Int("new", serverConfig.ClientUdpLimit))
+	}
+	// existing flows keep their mode until expired
+	c.setUDPFullCone(serverConfig.UdpFullCone)
+	c.udpNatMap_.setMaxEntries(serverConfig.UdpMaxFlows)
+	c.setRelayLog(serverConfig.RelayLog)
+	atomic.StoreInt64(&c.probeInterval, int64(time.Duration(serverConfig.ProbeInterval)*time.Second))
 	for _, backend := range c.backends_ {
 		shouldClosed := true
 		for _, backendConfig := range serverConfig.Servers {
-			if backend.remoteServerConfig.RemoteServer == backendConfig.RemoteServer {
+			if backend.getConfig().RemoteServer == backendConfig.RemoteServer {
 				// we have a match
-				if backend.remoteServerConfig.Equal(&backendConfig) {
+				if backend.getConfig().EqualTransport(&backendConfig) {
 					logger.Debug("Should not close backend", zap.String("server", backendConfig.RemoteServer))
 					shouldClosed = false
+					backend.update(backendConfig)
 				}
 				break
 			}
 		}
 		if shouldClosed {
-			logger.Debug("Closing backend", zap.String("server", backend.remoteServerConfig.RemoteServer))
-			backend.Stop()
+			logger.Info("Draining backend", zap.String("server", backend.getConfig().RemoteServer), zap.Int64("active", backend.stats.getActiveConns()))
+			go c.drainBackend(backend)
 		} else {
 			newBackends = append(newBackends, backend)
 		}
 	}
 
+	resolver := newServerResolver(serverConfig.ServerResolver, serverConfig.ServerResolveInterval)
 	for _, backendConfig := range serverConfig.Servers {
 		if backendConfig.Enable {
 			shouldStart := true
 			for _, backend := range newBackends {
-				if backendConfig.RemoteServer == backend.remoteServerConfig.RemoteServer {
+				if backendConfig.RemoteServer == backend.getConfig().RemoteServer {
 					shouldStart = false
 					break
 				}
 			}
 			if shouldStart {
-				if backend, err := CreateProxyBackend(backendConfig); err != nil {
+				if backend, err := CreateProxyBackend(backendConfig, resolver, c.outboundMark, c.tcpBuffer_); err != nil {
 					logger.Error("Proxy backend create failed", zap.String("addr", backendConfig.RemoteServer))
 				} else {
 					newBackends = append(newBackends, backend)
-					logger.Info("Proxy backend create successful", zap.String("addr", backendConfig.RemoteServer))
+					logger.Info("Proxy backend create successful", zap.String("addr", backendConfig.RemoteServer), zap.Int("weight", backendConfig.Weight))
 				}
 			}
 		}
@@ -232,61 +465,158 @@ func (c *ProxyClient) ReloadBackend(dnsMockTimeout int, serverConfig config.Shad
 	if len(c.backends_) == 0 {
 		err = errors.New("No backend created !!!")
 	}
+	c.checkPolicyBackends(serverConfig.Policies)
+	c.checkMultipathBackends()
 	return
 }
 
-func (c *ProxyClient) getBackendProxy() *proxyBackend {
+// drainBackend waits for flows on removed backend to finish before stopping it, new flows no longer pick it
+func (c *ProxyClient) drainBackend(backend *proxyBackend) {
+	deadline := time.Now().Add(BACKEND_DRAIN_TIMEOUT)
+	for backend.stats.getActiveConns() > 0 && time.Now().Before(deadline) {
+		time.Sleep(BACKEND_DRAIN_INTERVAL)
+	}
+	if active := backend.stats.getActiveConns(); active > 0 {
+		log.GetLogger().Info("Backend drain timeout, so force close", zap.String("server", backend.getConfig().RemoteServer), zap.Int64("active", active))
+	}
+	backend.Stop()
+	c.udpNatMap_.expireBackend(backend)
+}
+
+// checkPolicyBackends warns about policy referring backend which does not exist, such traffic falls back to balance strategy
+func (c *ProxyClient) checkPolicyBackends(policies []config.BackendPolicyConfig) {
+	for _, policy := range policies {
+		if c.getBackendProxyByName(policy.Backend) == nil {
+			log.GetLogger().Warn("Backend policy refers unknown backend", zap.String("backend", policy.Backend))
+		}
+	}
+}
+
+func (c *ProxyClient) getBackendProxyByName(name string) *proxyBackend {
+	for _, backend := range c.backends_ {
+		if backend.getName() == name {
+			return backend
+		}
+	}
+	return nil
+}
+
+// LearnDomainIP tags ip resolved for domain so its traffic goes to backend pinned by policy
+func (c *ProxyClient) LearnDomainIP(domain string, ip net.IP) {
+	c.backendMux.RLock()
+	policy := c.policy
+	c.backendMux.RUnlock()
+	if policy != nil {
+		policy.learn(domain, ip)
+	}
+}
+
+func (c *ProxyClient) getBackendProxy(dst net.IP) *proxyBackend {
 	c.backendMux.RLock()
 	defer c.backendMux.RUnlock()
-	length := len(c.backends_)
-	if length == 1 {
-		return c.backends_[0]
-	} else {
-		return c.backends_[rand.Int31n(int32(length))]
+	if c.policy != nil {
+		return c.bond(c.selectBackendProxy(c.policy.lookup(dst)))
 	}
-	return nil
+	return c.bond(c.balancer.pick(c.backends_))
+}
+
+func (c *ProxyClient) getBackendProxyByDomain(domain string) *proxyBackend {
+	c.backendMux.RLock()
+	defer c.backendMux.RUnlock()
+	if c.policy != nil {
+		return c.bond(c.selectBackendProxy(c.policy.matchDomain(domain)))
+	}
+	return c.bond(c.balancer.pick(c.backends_))
+}
+
+// getBackendProxyByTarget selects backend for explicit proxy target, which is either domain or ip
+func (c *ProxyClient) getBackendProxyByTarget(target socks.Addr) *proxyBackend {
+	if target[0] == socks.AtypDomainName {
+		return c.getBackendProxyByDomain(string(target[2 : 2+int(target[1])]))
+	}
+	host, _, _ := net.SplitHostPort(target.String())
+	return c.getBackendProxy(net.ParseIP(host))
+}
+
+// selectBackendProxy returns backend pinned by policy if exists, otherwise by balance strategy, caller holds backend lock
+func (c *ProxyClient) selectBackendProxy(name string) *proxyBackend {
+	if len(name) > 0 {
+		// pinned backend with open breaker falls back to others like a missing one
+		if backend := c.getBackendProxyByName(name); backend != nil && backend.isAvailable() {
+			return backend
+		}
+	}
+	return c.balancer.pick(c.backends_)
 }
 
 func (c *ProxyClient) getBackendProxyByAddr(addr string) *proxyBackend {
 	c.backendMux.RLock()
 	defer c.backendMux.RUnlock()
 	for _, backend := range c.backends_ {
-		if backend.udpAddr.String() == addr {
+		if backend.getAddr().udp.String() == addr {
 			return backend
 		}
 	}
 	return nil
 }
 
-func (c *ProxyClient) startListenTCP() {
+func (c *ProxyClient) startListenTCP(listener net.Listener) {
 	logger := log.GetLogger()
-	logger.Info("TCP start listening", zap.String("addr", c.addr))
+	logger.Info("TCP start listening", zap.String("addr", listener.Addr().String()))
 	for {
-		if conn, err := c.tcpListener.Accept(); err != nil {
+		if conn, err := listener.Accept(); err != nil {
 			if ee, ok := err.(*net.OpError); ok && ee != nil && ee.Err.Error() != "use of closed network connection" {
 				logger.Debug("Accept tcp conn failed", zap.String("error", err.Error()))
+			} else {
+				break
 			}
 		} else {
 			go c.handleTCP(conn)
 		}
 	}
-	logger.Info("TCP stop listening", zap.String("addr", c.addr))
+	logger.Info("TCP stop listening", zap.String("addr", listener.Addr().String()))
 }
 
 func (c *ProxyClient) handleTCP(conn net.Conn) {
 	logger := log.GetLogger()
 
 	defer conn.Close()
-
-	if backendProxy := c.getBackendProxy(); backendProxy == nil {
+	if !c.acquireClientConn(conn) {
+		return
+	}
+	defer c.releaseClientConn(conn)
+
+	var dst net.IP
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		dst = addr.IP
+		c.direct.count(dst)
+		if c.direct.check(dst) {
+			start := time.Now()
+			inboundSize, outboundSize, err := c.relayDirectTCP(c.limitConn(conn), addr)
+			if err != nil {
+				if ee, ok := err.(net.Error); !ok || !ee.Timeout() {
+					logger.Debug("Relay TCP direct failed", zap.String("dst", addr.String()), zap.String("error", err.Error()))
+				}
+			}
+			c.logRelay(&relayRecord{network: "tcp", src: conn.RemoteAddr().String(), dst: addr.String(),
+				transport: TRANSPORT_DIRECT, start: start, inbound: inboundSize, outbound: outboundSize, err: err})
+			return
+		}
+	}
+	if backendProxy := c.getBackendProxy(dst); backendProxy == nil {
 		logger.Error("Can not get backend proxy")
 	} else {
 
-		if outboundSize, inboundSize, err := backendProxy.RelayTCPData(conn); err != nil {
+		start := time.Now()
+		transport, inboundSize, outboundSize, err := backendProxy.RelayTCPData(c.limitConn(conn))
+		c.accountTraffic(conn, dst.String(), inboundSize, outboundSize)
+		c.logRelay(&relayRecord{network: "tcp", src: conn.RemoteAddr().String(), dst: conn.LocalAddr().String(),
+			backend: backendProxy, transport: transport, start: start, inbound: inboundSize, outbound: outboundSize, err: err})
+		if err != nil {
 			if ee, ok := err.(net.Error); ok && ee.Timeout() {
 				// do nothing for timeout
 			} else {
-				logger.Error("Relay TCP failed", zap.String("error", err.Error()))
+				logger.Error("Relay TCP failed", zap.String("category", classifyRelayError(err)), zap.String("error", err.Error()))
 			}
 		} else {
 			logger.Debug("Relay TCP successful", zap.Int64("outbound", outboundSize), zap.Int64("inbound", inboundSize))
@@ -294,19 +624,47 @@ func (c *ProxyClient) handleTCP(conn net.Conn) {
 	}
 }
 
-func (c *ProxyClient) startListenUDP() {
+// listenUDP opens count UDP sockets sharing listenAddr with SO_REUSEPORT, or a plain one if count is 1
+func listenUDP(listenAddr string, isIPv6 bool, count int) (ret []*net.UDPConn, err error) {
+	if count <= 0 {
+		count = runtime.NumCPU()
+	}
+	if count == 1 {
+		var udpListener *net.UDPConn
+		if udpListener, err = network.ListenTransparentUDP(listenAddr, isIPv6); err != nil {
+			return
+		}
+		return []*net.UDPConn{udpListener}, nil
+	}
+	ret = make([]*net.UDPConn, 0, count)
+	for i := 0; i < count; i++ {
+		var udpListener *net.UDPConn
+		if udpListener, err = network.ListenTransparentUDPReusePort(listenAddr, isIPv6); err != nil {
+			for _, opened := range ret {
+				opened.Close()
+			}
+			return nil, err
+		}
+		ret = append(ret, udpListener)
+	}
+	return
+}
+
+func (c *ProxyClient) startListenUDP(udpListener *net.UDPConn) {
 	logger := log.GetLogger()
 	logger.Info("UDP start listening", zap.String("addr", c.addr))
 	for {
 		buffer := c.udpBuffer_.Get()
 		oob := c.udpOOBBuffer_.Get()
 		//logger.Debug("start intercept udp")
-		if dataLen, oobLen, _, srcAddr, err := c.udpListener.ReadMsgUDP(buffer, oob); err != nil {
+		if dataLen, oobLen, _, srcAddr, err := udpListener.ReadMsgUDP(buffer, oob); err != nil {
 			c.udpBuffer_.Put(buffer)
 			c.udpOOBBuffer_.Put(oob)
 
 			if ee, ok := err.(*net.OpError); ok && ee != nil && ee.Err.Error() != "use of closed network connection" {
 				logger.Debug("Read from udp failed", zap.String("error", err.Error()))
+			} else {
+				break
 			}
 		} else {
 			//logger.Debug("got one udp")
@@ -323,6 +681,51 @@ func (c *ProxyClient) startListenUDP() {
 	logger.Info("UDP stop listening", zap.String("addr", c.addr))
 }
 
+// startListenUDPBatch reads up to batch datagrams per recvmmsg syscall, buffers of delivered datagrams are handed to
+// HandleUDP and replaced from the pool
+func (c *ProxyClient) startListenUDPBatch(udpListener *net.UDPConn, batch int) {
+	logger := log.GetLogger()
+	reader, err := network.NewUDPBatchReader(udpListener, batch)
+	if err != nil {
+		logger.Error("Create UDP batch reader failed, so fallback to single read", zap.String("error", err.Error()))
+		c.startListenUDP(udpListener)
+		return
+	}
+	msgs := make([]network.UDPBatchMessage, batch)
+	for i := range msgs {
+		msgs[i].Buffer = c.udpBuffer_.Get()
+		msgs[i].Oob = c.udpOOBBuffer_.Get()
+	}
+	defer func() {
+		for i := range msgs {
+			c.udpBuffer_.Put(msgs[i].Buffer)
+			c.udpOOBBuffer_.Put(msgs[i].Oob)
+		}
+	}()
+
+	logger.Info("UDP start listening", zap.String("addr", c.addr), zap.Int("batch", batch))
+	for {
+		n, err := reader.ReadBatch(msgs)
+		if err != nil {
+			if ee, ok := err.(*net.OpError); ok && ee != nil && ee.Err.Error() != "use of closed network connection" {
+				logger.Debug("Read from udp failed", zap.String("error", err.Error()))
+				continue
+			}
+			break
+		}
+		for i := 0; i < n; i++ {
+			msg := &msgs[i]
+			if dstAddr, err := network.ExtractOrigDstFromUDP(msg.OobN, msg.Oob); err != nil {
+				logger.Error("Failed to extract original dst from udp", zap.String("error", err.Error()))
+			} else {
+				go c.HandleUDP(msg.Buffer, msg.Addr, dstAddr, msg.N)
+				msg.Buffer = c.udpBuffer_.Get()
+			}
+		}
+	}
+	logger.Info("UDP stop listening", zap.String("addr", c.addr))
+}
+
 func (c *ProxyClient) GetUDPBuffer() []byte {
 	return c.udpBuffer_.Get()
 }
@@ -372,7 +775,7 @@ func (c *ProxyClient) relayDNS(srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, msg *
 	if c.dnsServer == nil {
 		return errors.New("No backend DNS server")
 	}
-	response, err := c.dnsServer.ServerDNSPacket(msg)
+	response, err := c.dnsServer.ServerDNSPacket(msg, srcAddr)
 	if err != nil {
 		return err
 	}
@@ -391,23 +794,34 @@ func (c *ProxyClient) Stop() {
 	if err := c.tcpListener.Close(); err != nil {
 		logger.Error("Close TCP listener failed", zap.String("error", err.Error()))
 	}
-	if err := c.udpListener.Close(); err != nil {
-		logger.Error("Close UDP listener failed", zap.String("error", err.Error()))
+	if c.tcpListenerV6 != nil {
+		if err := c.tcpListenerV6.Close(); err != nil {
+			logger.Error("Close ipv6 TCP listener failed", zap.String("error", err.Error()))
+		}
+	}
+	for _, udpListener := range c.udpListeners {
+		if err := udpListener.Close(); err != nil {
+			logger.Error("Close UDP listener failed", zap.String("error", err.Error()))
+		}
+	}
+	if c.probeDone != nil {
+		close(c.probeDone)
 	}
 	for _, backend := range c.backends_ {
 		backend.Stop()
 	}
 	c.dnsSyncResolver.Stop()
-
-	c.udpNatMap_.Lock()
-	defer c.udpNatMap_.Unlock()
-
-	for _, entry := range c.udpNatMap_.entries {
-		if err := entry.dstUdp_.Close(); err != nil {
-			logger.Error("Close UDP proxy failed", zap.String("error", err.Error()))
-		}
+	if c.socks5Server_ != nil {
+		c.socks5Server_.stop()
+	}
+	if c.httpServer_ != nil {
+		c.httpServer_.stop()
 	}
 
+	c.udpNatMap_.closeAll(func(err error) {
+		logger.Error("Close UDP proxy failed", zap.String("error", err.Error()))
+	})
+
 	c.udpBackend_.stop()
 
 	logger.Info("ProxyClient stopped")
@@ -416,75 +830,158 @@ func (c *ProxyClient) Stop() {
 
 func (c *ProxyClient) relayUDPData(udpKey string, srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, data []byte, dataLen int) error {
 	logger := log.GetLogger()
-	if dataLen > common.UDP_BUFFER_SIZE {
+	if dataLen > c.udpBuffer_.GetBufferSize() {
 		return errors.New(fmt.Sprintf("udp packet too big, so ignore: %d", dataLen))
 	}
-	c.udpNatMap_.Lock()
-	udpProxy := c.udpNatMap_.Get(udpKey)
+	direct := srcAddr != nil && c.direct.check(dstAddr.IP)
+	// full cone flow of client carries datagrams to every destination, $direct destinations never join it
+	coneKey := ""
+	if srcAddr != nil && !direct && c.isUDPFullCone() {
+		coneKey = computeConeKey(srcAddr)
+	}
+	// flows of a client share one shard, so cone key and flow key are looked up under the same lock
+	natMap := c.udpNatMap_.shard(udpKey)
+	natMap.Lock()
+	var udpProxy *udpProxyEntry
+	if len(coneKey) > 0 {
+		udpProxy = natMap.Get(coneKey)
+	}
 	if udpProxy == nil {
-		backendProxy := c.getBackendProxy()
-		if backendProxy == nil {
-			c.udpNatMap_.Unlock()
-			return errors.New("Can not get backend proxy")
+		udpProxy = natMap.Get(udpKey)
+	}
+	if udpProxy == nil {
+		if srcAddr != nil {
+			if limit := atomic.LoadInt64(&c.clientUdpLimit); limit > 0 && int64(natMap.clientEntries(srcAddr.IP.String())) >= limit {
+				natMap.Unlock()
+				// drop like a full NAT table, client gets no reply
+				return nil
+			}
 		}
 		var err error
-		if udpProxy, err = backendProxy.GetUDPRelayEntry(dstAddr); err != nil {
-			c.udpNatMap_.Unlock()
-			return errors.Wrap(err, "UDP proxy listen local failed ")
+		if srcAddr != nil {
+			c.direct.count(dstAddr.IP)
 		}
-		c.udpNatMap_.Add(udpKey, udpProxy)
+		if direct {
+			// $direct destination, flow has no backend
+			if udpProxy, err = newDirectUDPEntry(dstAddr); err != nil {
+				natMap.Unlock()
+				return errors.Wrap(err, "UDP direct listen local failed")
+			}
+		} else {
+			backendProxy := c.getBackendProxy(dstAddr.IP)
+			if backendProxy == nil {
+				natMap.Unlock()
+				return errors.New("Can not get backend proxy")
+			}
+			if udpProxy, err = backendProxy.GetUDPRelayEntry(dstAddr); err != nil {
+				natMap.Unlock()
+				backendProxy.countRelayError(markRelayError(RELAY_ERROR_DIAL, err))
+				return errors.Wrap(err, "UDP proxy listen local failed ")
+			}
+			udpProxy.backend = backendProxy
+			if udpProxy.dstUdp_ != nil {
+				c.addUDPPaths(udpProxy, dstAddr)
+			}
+			// UDP over TCP stream is bound to its destination, so only plain UDP flow can be full cone
+			if len(coneKey) > 0 && udpProxy.dstUdp_ != nil {
+				udpProxy.fullCone = true
+				udpKey = coneKey
+			}
+		}
+		udpProxy.outLimiter = newRateLimiter(c.getConnRateLimit())
+		udpProxy.inLimiter = newRateLimiter(c.getConnRateLimit())
+		if srcAddr != nil {
+			udpProxy.client = srcAddr.IP.String()
+			if udpProxy.backend != nil {
+				udpProxy.dstTraffic = c.dstTraffic.counter(dstAddr.IP.String())
+				udpProxy.srcTraffic = c.srcTraffic.counter(srcAddr.IP.String())
+			}
+		}
+		udpProxy.start = time.Now()
+		udpProxy.touch()
+		udpProxy.setReadDeadline(udpProxy.idleDeadline())
+		natMap.Add(udpKey, udpProxy)
 		udpProxy.Lock()
-		c.udpNatMap_.Unlock()
+		natMap.Unlock()
 		if udpProxy.dstUdp_ != nil {
 			udpProxy.Unlock()
 			// now lets run copy from dst
 			go func() {
+				var err error
 				// copy udp from remote
 				defer func() {
 					if srcAddr == nil {
 						logger.Debug("dns relay entry quit", zap.String("src", udpProxy.dstUdp_.LocalAddr().String()), zap.String("dst", dstAddr.String()))
 					} else {
 						logger.Debug("udp relay entry quit", zap.String("src", srcAddr.String()), zap.String("dst", dstAddr.String()))
+						c.logUDPRelay(udpProxy, srcAddr, dstAddr, err)
 					}
-					c.udpNatMap_.Lock()
-					c.udpNatMap_.Del(udpKey)
-					c.udpNatMap_.Unlock()
+					natMap.Lock()
+					natMap.Del(udpKey, udpProxy)
+					natMap.Unlock()
 					udpProxy.dstUdp_.Close()
+					for _, path := range udpProxy.paths {
+						path.dstUdp_.Close()
+					}
 
 				}()
 
+				// deliver writes reply read from any path back to client
+				deliver := func(data []byte) {
+					if udpProxy.dedup.seen(data) {
+						return
+					}
+					replyAddr := dstAddr
+					headerLen := len(udpProxy.header_)
+					if udpProxy.fullCone {
+						// reply may come from any peer, its address is in the header
+						if replyAddr, headerLen = parseConeReply(data); replyAddr == nil {
+							logger.Debug("UDP reply of full cone flow has invalid address, so drop it", zap.String("src", srcAddr.String()))
+							return
+						}
+					}
+					if len(data) <= headerLen {
+						logger.Info("UDP read from remote too small, so not write back", zap.Int("n", len(data)), zap.Int("headerLen", headerLen))
+						return
+					}
+					writeBuffer := make([]byte, len(data)-headerLen)
+					copy(writeBuffer, data[headerLen:])
+					if srcAddr == nil {
+						// its dns so deal accordingly
+						c.dnsSyncResolver.ProcessDnsResponse(logger, writeBuffer)
+						//c.processDNSResponse(writeBuffer)
+					} else {
+						// regular udp proxy, dropped if over rate limit
+						if udpProxy.inLimiter.allow(len(writeBuffer)) && udpProxy.backend.getLimiters().download.allow(len(writeBuffer)) {
+							c.udpBackend_.WriteBackUDPPayload(c, srcAddr, replyAddr, writeBuffer, udpProxy.idleTimeout)
+							udpProxy.account(int64(len(writeBuffer)), 0)
+						}
+					}
+				}
+				for _, path := range udpProxy.paths {
+					go c.readUDPPath(udpProxy, path, deliver)
+				}
+
 				buffer := c.udpBuffer_.Get()
 				defer c.udpBuffer_.Put(buffer)
 				var n int
 				for {
 					buffer = buffer[:cap(buffer)]
 					n, _, err = udpProxy.dstUdp_.ReadFrom(buffer)
-					udpProxy.dstUdp_.SetReadDeadline(time.Now().Add(udpProxy.timeout))
 					if err != nil {
 						// do not print timeout
 						if ee, ok := err.(net.Error); !ok || !ee.Timeout() {
+							udpProxy.backend.countRelayError(err)
 							logger.Error("Read udp from remote dst failed", zap.String("error", err.Error()))
+						} else if udpProxy.keepAlive() {
+							continue
 						}
 						return
 					}
+					udpProxy.touch()
 					//logger.Debug("Read from remote", zap.Int("size", n))
 					// now lets write back
-					headerLen := len(udpProxy.header_)
-					writeBuffer := make([]byte, n-headerLen)
-					copy(writeBuffer, buffer[headerLen:n])
-					if n > headerLen {
-						if srcAddr == nil {
-							// its dns so deal accordingly
-							c.dnsSyncResolver.ProcessDnsResponse(logger, writeBuffer)
-							//c.processDNSResponse(writeBuffer)
-						} else {
-							// regular udp proxy
-							c.udpBackend_.WriteBackUDPPayload(c, srcAddr, dstAddr, writeBuffer, udpProxy.timeout)
-						}
-					} else {
-						logger.Info("UDP read from remote too small, so not write back", zap.Int("n", n), zap.Int("headerLen", headerLen))
-					}
-
+					deliver(buffer[:n])
 				}
 
 			}()
@@ -498,15 +995,16 @@ func (c *ProxyClient) relayUDPData(udpKey string, srcAddr *net.UDPAddr, dstAddr
 			}
 			udpProxy.Unlock()
 			if err != nil {
+				udpProxy.backend.countRelayError(err)
 				if ee, ok := err.(net.Error); !ok || !ee.Timeout() {
 					logger.Info("write udp over tcp failed", zap.String("error", err.Error()))
 				} else {
 					logger.Info("write udp over tcp with timeout", zap.Duration("timeout", udpProxy.timeout))
 				}
 				// close the connection
-				c.udpNatMap_.Lock()
-				c.udpNatMap_.Del(udpKey)
-				c.udpNatMap_.Unlock()
+				natMap.Lock()
+				natMap.Del(udpKey, udpProxy)
+				natMap.Unlock()
 				if udpProxy.dstKcp_ != nil {
 					udpProxy.dstKcp_.Close()
 				} else {
@@ -516,6 +1014,7 @@ func (c *ProxyClient) relayUDPData(udpKey string, srcAddr *net.UDPAddr, dstAddr
 			}
 
 			go func() {
+				var err error
 				defer func() {
 					if srcAddr == nil {
 						if udpProxy.dstKcp_ != nil {
@@ -526,10 +1025,11 @@ func (c *ProxyClient) relayUDPData(udpKey string, srcAddr *net.UDPAddr, dstAddr
 
 					} else {
 						logger.Debug("udp relay entry quit", zap.String("src", srcAddr.String()), zap.String("dst", dstAddr.String()))
+						c.logUDPRelay(udpProxy, srcAddr, dstAddr, err)
 					}
-					c.udpNatMap_.Lock()
-					c.udpNatMap_.Del(udpKey)
-					c.udpNatMap_.Unlock()
+					natMap.Lock()
+					natMap.Del(udpKey, udpProxy)
+					natMap.Unlock()
 					if udpProxy.dstKcp_ != nil {
 						udpProxy.dstKcp_.Close()
 					} else {
@@ -544,19 +1044,22 @@ func (c *ProxyClient) relayUDPData(udpKey string, srcAddr *net.UDPAddr, dstAddr
 					buffer = buffer[:cap(buffer)]
 					if udpProxy.dstKcp_ != nil {
 						n, err = common.ReadUdpOverTcp(udpProxy.dstKcp_, buffer)
-						udpProxy.dstKcp_.SetReadDeadline(time.Now().Add(udpProxy.timeout))
 					} else {
 						n, err = common.ReadUdpOverTcp(udpProxy.dstTcp_, buffer)
-						udpProxy.dstTcp_.SetReadDeadline(time.Now().Add(udpProxy.timeout))
 					}
 					if err != nil {
 						if err != io.EOF {
 							if ee, ok := err.(net.Error); !ok || !ee.Timeout() {
+								udpProxy.backend.countRelayError(err)
 								logger.Error("Read udp over tcp from remote dst failed", zap.String("error", err.Error()))
+							} else if n == 0 && udpProxy.keepAlive() {
+								// timeout between frames, stream is still in sync
+								continue
 							}
 						}
 						return
 					}
+					udpProxy.touch()
 					if n > 0 {
 						writeBuffer := make([]byte, n)
 						copy(writeBuffer, buffer[:n])
@@ -564,8 +1067,11 @@ func (c *ProxyClient) relayUDPData(udpKey string, srcAddr *net.UDPAddr, dstAddr
 							// its dns so deal accordingly
 							c.dnsSyncResolver.ProcessDnsResponse(logger, writeBuffer)
 						} else {
-							// regular udp proxy
-							c.udpBackend_.WriteBackUDPPayload(c, srcAddr, dstAddr, writeBuffer, udpProxy.timeout)
+							// regular udp proxy, dropped if over rate limit
+							if udpProxy.inLimiter.allow(len(writeBuffer)) && udpProxy.backend.getLimiters().download.allow(len(writeBuffer)) {
+								c.udpBackend_.WriteBackUDPPayload(c, srcAddr, dstAddr, writeBuffer, udpProxy.idleTimeout)
+								udpProxy.account(int64(len(writeBuffer)), 0)
+							}
 						}
 					}
 				}
@@ -573,27 +1079,45 @@ func (c *ProxyClient) relayUDPData(udpKey string, srcAddr *net.UDPAddr, dstAddr
 		}
 
 	} else {
-		c.udpNatMap_.Unlock()
+		natMap.Unlock()
+	}
+
+	if !udpProxy.outLimiter.allow(dataLen) || !udpProxy.backend.getLimiters().upload.allow(dataLen) {
+		// drop like a congested link, udp sender is expected to back off
+		return nil
 	}
 
-	headerLen := len(udpProxy.header_)
+	header := udpProxy.header_
+	if udpProxy.fullCone {
+		// shared by all destinations of client, so header is built per datagram
+		var err error
+		if header, err = network.ConvertShadowSocksAddr(dstAddr.String(), false); err != nil {
+			return errors.Wrap(err, "Convert UDP destination failed")
+		}
+	}
+	headerLen := len(header)
 	totalLen := headerLen + dataLen
-	// we ignore udp packet which too big, which is 4096 bytes, well enough beyond any MTU
+	// we ignore udp packet which too big for buffer, default 4096 bytes is well enough beyond any MTU
 	if totalLen > c.udpBuffer_.GetBufferSize() {
-		return errors.New(fmt.Sprintf("udp packet too big: %d > %d", totalLen, common.UDP_BUFFER_SIZE))
+		return errors.New(fmt.Sprintf("udp packet too big: %d > %d", totalLen, c.udpBuffer_.GetBufferSize()))
 	}
 	if udpProxy.dstUdp_ != nil {
+		if udpProxy.backend != nil && !udpProxy.backend.checkUDPSize(udpProxy, totalLen) {
+			return nil
+		}
 		// get leaky buffer
 		newBuffer := c.udpBuffer_.Get()
 		defer c.udpBuffer_.Put(newBuffer)
-		copy(newBuffer, udpProxy.header_)
+		copy(newBuffer, header)
 		copy(newBuffer[headerLen:], data[:dataLen])
 		// set timeout for each send
 		// write to remote shadowsocks server
-		if _, err := udpProxy.dstUdp_.WriteTo(newBuffer[:totalLen], udpProxy.proxyAddr); err != nil {
+		if err := udpProxy.writeTo(newBuffer[:totalLen]); err != nil {
+			udpProxy.backend.countRelayError(err)
 			return err
 		}
-		udpProxy.dstUdp_.SetReadDeadline(time.Now().Add(udpProxy.timeout))
+		udpProxy.account(0, int64(dataLen))
+		udpProxy.touch()
 	} else {
 		var err error
 		udpProxy.Lock()
@@ -607,25 +1131,18 @@ func (c *ProxyClient) relayUDPData(udpKey string, srcAddr *net.UDPAddr, dstAddr
 		}
 
 		if err != nil {
+			udpProxy.backend.countRelayError(err)
 			if ee, ok := err.(net.Error); !ok || !ee.Timeout() {
 				logger.Info("write udp over tcp failed", zap.String("error", err.Error()))
 			} else {
 				logger.Info("write udp over tcp with timeout", zap.Duration("timeout", udpProxy.timeout))
 			}
 			// close the connection
-			if udpProxy.dstKcp_ != nil {
-				udpProxy.dstKcp_.SetReadDeadline(time.Now())
-			} else {
-				udpProxy.dstTcp_.SetReadDeadline(time.Now())
-			}
+			udpProxy.expire()
 			return err
 		}
-		if udpProxy.dstKcp_ != nil {
-			udpProxy.dstKcp_.SetReadDeadline(time.Now().Add(udpProxy.timeout))
-		} else {
-			udpProxy.dstTcp_.SetReadDeadline(time.Now().Add(udpProxy.timeout))
-		}
-
+		udpProxy.touch()
+		udpProxy.account(0, int64(dataLen))
 	}
 	return nil
 }
@@ -680,6 +1197,15 @@ func (c *ProxyClient) ExchangeDNS(dnsAddr string, data []byte, timeout time.Dura
 		c.dnsSyncResolver.PutDnsId(dnsId)
 		return nil, err
 	}
+	// backend relaying the query may be slower than others
+	natMap := c.udpNatMap_.shard(computeDnsKey(dnsAddr))
+	natMap.RLock()
+	if entry := natMap.peek(computeDnsKey(dnsAddr)); entry != nil && entry.backend != nil {
+		if backendTimeout := entry.backend.GetDNSTimeout(); backendTimeout > 0 {
+			timeout = backendTimeout
+		}
+	}
+	natMap.RUnlock()
 	return c.dnsSyncResolver.WaitResponse(dnsId, timeout)
 	//sig := make(chan *dns.Msg)
 	//c.dnsSyncResolver.dnsQueryMapMux.Lock()
@@ -0,0 +1,33 @@
+package proxy_client
+
+import (
+	"github.com/pkg/errors"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"net"
+)
+
+// DialTCP connects addr through a backend for redfrog's own requests, e.g. downloading pac list, returned conn is one
+// end of a pipe whose other end is relayed like an intercepted connection
+func (c *ProxyClient) DialTCP(network string, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errors.Errorf("Network %s is not supported by proxy dial", network)
+	}
+	target := socks.ParseAddr(addr)
+	if target == nil {
+		return nil, errors.Errorf("Invalid target %s", addr)
+	}
+	backendProxy := c.getBackendProxyByTarget(target)
+	if backendProxy == nil {
+		return nil, errors.New("Can not get backend proxy")
+	}
+	local, remote := net.Pipe()
+	go func() {
+		defer remote.Close()
+		if _, _, _, err := backendProxy.RelayTCPDataTo(remote, target); err != nil {
+			log.GetLogger().Debug("Proxy dial relay finished", zap.String("addr", addr), zap.String("error", err.Error()))
+		}
+	}()
+	return local, nil
+}
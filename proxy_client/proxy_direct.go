@@ -0,0 +1,134 @@
+package proxy_client
+
+import (
+	"github.com/weishi258/redfrog-core/common"
+	"github.com/weishi258/redfrog-core/log"
+	"github.com/weishi258/redfrog-core/network"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// learned ip outlives DNS answer TTL so connection opened just before refresh still goes direct
+	DIRECT_LEARN_TTL      = 2 * time.Hour
+	DIRECT_LEARN_SCAVENGE = 10 * time.Minute
+	DIRECT_DIAL_TIMEOUT   = 10 * time.Second
+	DIRECT_UDP_TIMEOUT    = 60 * time.Second
+)
+
+// directRoute decides which intercepted destinations bypass backends, by $direct ip rule or ip learned from DNS answer
+type directRoute struct {
+	sync.RWMutex
+	checker   common.PacCheckerInterface
+	learned   map[string]time.Time
+	scavenged time.Time
+}
+
+func newDirectRoute() *directRoute {
+	return &directRoute{learned: make(map[string]time.Time), scavenged: time.Now()}
+}
+
+func (c *directRoute) setChecker(checker common.PacCheckerInterface) {
+	c.Lock()
+	defer c.Unlock()
+	c.checker = checker
+}
+
+func (c *directRoute) learn(ip net.IP) {
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	if now.Sub(c.scavenged) > DIRECT_LEARN_SCAVENGE {
+		for k, expire := range c.learned {
+			if now.After(expire) {
+				delete(c.learned, k)
+			}
+		}
+		c.scavenged = now
+	}
+	c.learned[ip.String()] = now.Add(DIRECT_LEARN_TTL)
+}
+
+func (c *directRoute) check(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	key := ip.String()
+	c.RLock()
+	defer c.RUnlock()
+	if expire, ok := c.learned[key]; ok && time.Now().Before(expire) {
+		return true
+	}
+	return c.checker != nil && c.checker.CheckDirectIP(key)
+}
+
+// count counts intercepted connection to ip for pac rule deciding it
+func (c *directRoute) count(ip net.IP) {
+	c.RLock()
+	checker := c.checker
+	c.RUnlock()
+	if checker != nil && ip != nil {
+		checker.CountConnection(ip.String())
+	}
+}
+
+// SetPacChecker lets proxy client look up $direct ip rules of pac list
+func (c *ProxyClient) SetPacChecker(checker common.PacCheckerInterface) {
+	c.direct.setChecker(checker)
+}
+
+// LearnDirectIP marks ip resolved for a domain with $direct rule, its intercepted traffic is dialed directly
+func (c *ProxyClient) LearnDirectIP(ip net.IP) {
+	c.direct.learn(ip)
+}
+
+// dialDirect connects dst keeping LAN client as source if possible, which needs the reply to be diverted back to us
+func dialDirect(src net.Addr, dst *net.TCPAddr) (net.Conn, error) {
+	if srcAddr, ok := src.(*net.TCPAddr); ok && (srcAddr.IP.To4() == nil) == (dst.IP.To4() == nil) {
+		if conn, err := network.DialTransparentTCP(srcAddr.IP, dst, DIRECT_DIAL_TIMEOUT); err == nil {
+			return conn, nil
+		} else {
+			log.GetLogger().Debug("Dial direct with client source failed, so use own address", zap.String("dst", dst.String()), zap.String("error", err.Error()))
+		}
+	}
+	return net.DialTimeout("tcp", dst.String(), DIRECT_DIAL_TIMEOUT)
+}
+
+// relayDirectTCP relays intercepted connection to its original destination without backend
+func (c *ProxyClient) relayDirectTCP(src net.Conn, dst *net.TCPAddr) (inboundSize int64, outboundSize int64, err error) {
+	var dstConn net.Conn
+	if dstConn, err = dialDirect(src.RemoteAddr(), dst); err != nil {
+		return
+	}
+	defer dstConn.Close()
+
+	ch := make(chan relayDataRes)
+	go func() {
+		res := relayDataRes{}
+		res.outboundSize, res.Err = copyBuffer(dstConn, src, c.tcpBuffer_)
+		dstConn.SetDeadline(time.Now())
+		src.SetDeadline(time.Now())
+		ch <- res
+	}()
+	inboundSize, err = copyBuffer(src, dstConn, c.tcpBuffer_)
+	dstConn.SetDeadline(time.Now())
+	src.SetDeadline(time.Now())
+	rs := <-ch
+	if err == nil {
+		err = rs.Err
+	}
+	outboundSize = rs.outboundSize
+	return
+}
+
+// newDirectUDPEntry creates flow which sends payload as is to dst, so relay loop needs no special case
+func newDirectUDPEntry(dstAddr *net.UDPAddr) (entry *udpProxyEntry, err error) {
+	var conn *net.UDPConn
+	if conn, err = net.ListenUDP("udp", nil); err != nil {
+		return
+	}
+	return &udpProxyEntry{dstUdp_: conn, header_: []byte{}, proxyAddr: dstAddr, timeout: DIRECT_UDP_TIMEOUT, idleTimeout: DIRECT_UDP_TIMEOUT,
+		transport: TRANSPORT_DIRECT}, nil
+}
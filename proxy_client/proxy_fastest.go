@@ -0,0 +1,106 @@
+package proxy_client
+
+import (
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// challenger must be this much faster than current fastest backend to replace it, so close ones do not flap
+	FASTEST_HYSTERESIS = 0.2
+	// rtt recorded when probe fails or times out, if backend has no connect timeout
+	PROBE_FAIL_RTT = 10 * time.Second
+)
+
+// pickFastest returns backend elected by prober if selectable, otherwise lowest rtt one until next election
+func (c *proxyBalancer) pickFastest(backends []*proxyBackend) *proxyBackend {
+	if fastest, ok := c.fastest.Load().(*proxyBackend); ok {
+		for _, backend := range backends {
+			if backend == fastest {
+				return fastest
+			}
+		}
+	}
+	return c.pickMin(backends, func(backend *proxyBackend) int64 {
+		return int64(backend.stats.getRtt())
+	})
+}
+
+// electFastest keeps current fastest backend unless it is gone or another one beats it by hysteresis, returns
+// fastest backend and whether it changed
+func (c *proxyBalancer) electFastest(backends []*proxyBackend) (*proxyBackend, bool) {
+	var best *proxyBackend
+	for _, backend := range availableBackends(backends) {
+		if rtt := backend.stats.getRtt(); rtt > 0 && (best == nil || rtt < best.stats.getRtt()) {
+			best = backend
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	current, _ := c.fastest.Load().(*proxyBackend)
+	if current != nil && current.isAvailable() && current.stats.getRtt() > 0 {
+		for _, backend := range backends {
+			if backend == current {
+				if float64(best.stats.getRtt()) > float64(current.stats.getRtt())*(1-FASTEST_HYSTERESIS) {
+					return current, false
+				}
+				break
+			}
+		}
+	}
+	c.fastest.Store(best)
+	return best, best != current
+}
+
+// probe measures connect rtt to server, failure is recorded as timeout so slow or dead backend loses election
+func (c *proxyBackend) probe() {
+	start := time.Now()
+	conn, err := c.dialServer(c.getAddr())
+	if err != nil {
+		rtt := c.GetConnectTimeout()
+		if rtt <= 0 {
+			rtt = PROBE_FAIL_RTT
+		}
+		c.stats.recordRtt(rtt)
+		c.requestResolve()
+		log.GetLogger().Debug("Probe backend failed", zap.String("server", c.getName()), zap.String("error", err.Error()))
+		return
+	}
+	c.stats.recordRtt(time.Since(start))
+	conn.Close()
+}
+
+// probeBackends probes every backend each probe-interval while balance strategy is fastest, then elects fastest one
+func (c *ProxyClient) probeBackends() {
+	for {
+		select {
+		case <-c.probeDone:
+			return
+		case <-time.After(time.Duration(atomic.LoadInt64(&c.probeInterval))):
+		}
+		c.backendMux.RLock()
+		strategy := c.balancer.strategy
+		backends := c.backends_
+		c.backendMux.RUnlock()
+		if strategy != BALANCE_FASTEST {
+			continue
+		}
+		var wg sync.WaitGroup
+		for _, backend := range backends {
+			wg.Add(1)
+			go func(backend *proxyBackend) {
+				defer wg.Done()
+				backend.probe()
+			}(backend)
+		}
+		wg.Wait()
+		if fastest, changed := c.balancer.electFastest(backends); changed {
+			log.GetLogger().Info("Fastest backend changed", zap.String("server", fastest.getName()),
+				zap.Duration("rtt", fastest.stats.getRtt()))
+		}
+	}
+}
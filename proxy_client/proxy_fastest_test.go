@@ -0,0 +1,37 @@
+package proxy_client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestElectFastest(t *testing.T) {
+	backends := []*proxyBackend{{}, {}}
+	balancer := proxyBalancer{strategy: BALANCE_FASTEST}
+	if backend, changed := balancer.electFastest(backends); backend != nil || changed {
+		t.Error("no backend should be elected without rtt sample")
+	}
+	backends[0].stats.recordRtt(100 * time.Millisecond)
+	backends[1].stats.recordRtt(90 * time.Millisecond)
+	if backend, changed := balancer.electFastest(backends); backend != backends[1] || !changed {
+		t.Error("first election should pick lowest rtt")
+	}
+	// 10% faster is within hysteresis
+	backends[0].stats.rtt = int64(80 * time.Millisecond)
+	if backend, changed := balancer.electFastest(backends); backend != backends[1] || changed {
+		t.Error("fastest backend should stay within hysteresis")
+	}
+	for i := 0; i < 4; i++ {
+		if balancer.pick(backends) != backends[1] {
+			t.Error("pick should follow elected backend")
+		}
+	}
+	backends[0].stats.rtt = int64(50 * time.Millisecond)
+	if backend, changed := balancer.electFastest(backends); backend != backends[0] || !changed {
+		t.Error("much faster backend should take over")
+	}
+	// elected backend removed by reload
+	if balancer.pick(backends[1:]) != backends[1] {
+		t.Error("pick should fall back to remaining backend")
+	}
+}
@@ -0,0 +1,90 @@
+package proxy_client
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// relayIdle is shared by both directions of a TCP relay, relay ends once no byte moved either way for timeout, so
+// a quiet direction is kept alive while the other one still carries data
+type relayIdle struct {
+	timeout time.Duration
+	// unix nano, accessed atomically
+	lastActive int64
+	// set once relay is finishing, so deadline woken read is not extended again
+	done int32
+}
+
+// newRelayIdle returns idle tracker, timeout 0 never expires
+func newRelayIdle(timeout time.Duration) *relayIdle {
+	return &relayIdle{timeout: timeout, lastActive: time.Now().UnixNano()}
+}
+
+func (c *relayIdle) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+func (c *relayIdle) deadline() time.Time {
+	if c.timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.timeout)
+}
+
+// stop must be called before waking the other direction up with an expired deadline
+func (c *relayIdle) stop() {
+	atomic.StoreInt32(&c.done, 1)
+}
+
+func (c *relayIdle) stopped() bool {
+	return atomic.LoadInt32(&c.done) == 1
+}
+
+// extend tells whether timed out read should wait again because relay moved data within timeout
+func (c *relayIdle) extend() bool {
+	return !c.stopped() && time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive))) < c.timeout
+}
+
+// armRead pushes read deadline of conn forward unless relay is finishing, whose wake up must not be overridden
+func (c *relayIdle) armRead(conn net.Conn) {
+	conn.SetReadDeadline(c.deadline())
+	if c.stopped() {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+func isTimeout(err error) bool {
+	ee, ok := err.(net.Error)
+	return ok && ee.Timeout()
+}
+
+// idleConn refreshes deadline before every read and write of conn
+type idleConn struct {
+	conn net.Conn
+	idle *relayIdle
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	for {
+		c.idle.armRead(c.conn)
+		n, err := c.conn.Read(p)
+		if n > 0 {
+			c.idle.touch()
+			return n, err
+		}
+		if err != nil && isTimeout(err) && c.idle.extend() {
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.conn.SetWriteDeadline(c.idle.deadline())
+	n, err := c.conn.Write(p)
+	if n > 0 {
+		c.idle.touch()
+	}
+	return n, err
+}
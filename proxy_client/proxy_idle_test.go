@@ -0,0 +1,51 @@
+package proxy_client
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIdleConnExtend(t *testing.T) {
+	left, right := net.Pipe()
+	defer left.Close()
+	defer right.Close()
+	idle := newRelayIdle(100 * time.Millisecond)
+	start := time.Now()
+	go func() {
+		// the other direction keeps moving data for a while
+		for i := 0; i < 5; i++ {
+			time.Sleep(50 * time.Millisecond)
+			idle.touch()
+		}
+	}()
+	if _, err := (&idleConn{conn: left, idle: idle}).Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("read expired while relay was active, after %v", elapsed)
+	}
+}
+
+func TestIdleConnStop(t *testing.T) {
+	left, right := net.Pipe()
+	defer left.Close()
+	defer right.Close()
+	idle := newRelayIdle(time.Hour)
+	done := make(chan error)
+	go func() {
+		_, err := (&idleConn{conn: left, idle: idle}).Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	idle.stop()
+	left.SetDeadline(time.Now())
+	select {
+	case err := <-done:
+		if !isTimeout(err) {
+			t.Errorf("expect timeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("stopped relay was not woken up")
+	}
+}
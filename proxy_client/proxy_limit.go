@@ -0,0 +1,183 @@
+package proxy_client
+
+import (
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// bucket holds this long of traffic so short bursts are not delayed
+	RATE_LIMIT_BURST = 100 * time.Millisecond
+)
+
+// rateLimiter is a token bucket in bytes
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil if kbps is not positive, nil limiter allows everything
+func newRateLimiter(kbps int64) *rateLimiter {
+	if kbps <= 0 {
+		return nil
+	}
+	rate := float64(kbps) * 1000 / 8
+	burst := rate * RATE_LIMIT_BURST.Seconds()
+	if burst < 64*1024 {
+		burst = 64 * 1024
+	}
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (c *rateLimiter) refill(now time.Time) {
+	c.tokens += now.Sub(c.last).Seconds() * c.rate
+	if c.tokens > c.burst {
+		c.tokens = c.burst
+	}
+	c.last = now
+}
+
+// reserve takes n bytes and returns how long caller should wait, tokens may go negative for large n
+func (c *rateLimiter) reserve(n int) time.Duration {
+	c.Lock()
+	defer c.Unlock()
+	c.refill(time.Now())
+	c.tokens -= float64(n)
+	if c.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-c.tokens / c.rate * float64(time.Second))
+}
+
+func (c *rateLimiter) wait(n int) {
+	if c == nil {
+		return
+	}
+	if delay := c.reserve(n); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// allow takes n bytes only if available, for UDP which is dropped instead of delayed
+func (c *rateLimiter) allow(n int) bool {
+	if c == nil {
+		return true
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.refill(time.Now())
+	if c.tokens < float64(n) {
+		return false
+	}
+	c.tokens -= float64(n)
+	return true
+}
+
+// limitedConn caps each direction of conn separately
+type limitedConn struct {
+	net.Conn
+	readLimiter  *rateLimiter
+	writeLimiter *rateLimiter
+}
+
+func (c *limitedConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.readLimiter.wait(n)
+	return
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	c.writeLimiter.wait(len(b))
+	return c.Conn.Write(b)
+}
+
+// backendLimiters is shared by all flows of a backend, replaced as a whole on reload
+type backendLimiters struct {
+	upload   *rateLimiter
+	download *rateLimiter
+}
+
+func newBackendLimiters(uploadKbps int, downloadKbps int) *backendLimiters {
+	return &backendLimiters{upload: newRateLimiter(int64(uploadKbps)), download: newRateLimiter(int64(downloadKbps))}
+}
+
+// limitConn wraps client side conn, reading from it is upload and writing to it is download
+func (c *backendLimiters) limitConn(conn net.Conn) net.Conn {
+	if c.upload == nil && c.download == nil {
+		return conn
+	}
+	return &limitedConn{Conn: conn, readLimiter: c.upload, writeLimiter: c.download}
+}
+
+func (c *ProxyClient) getConnRateLimit() int64 {
+	return atomic.LoadInt64(&c.connRateLimit)
+}
+
+// limitConn wraps client side conn with per connection rate limit if configured
+func (c *ProxyClient) limitConn(conn net.Conn) net.Conn {
+	kbps := c.getConnRateLimit()
+	if kbps <= 0 {
+		return conn
+	}
+	return &limitedConn{Conn: conn, readLimiter: newRateLimiter(kbps), writeLimiter: newRateLimiter(kbps)}
+}
+
+// clientCounter counts simultaneous connections per client ip
+type clientCounter struct {
+	sync.Mutex
+	counts map[string]int
+}
+
+func newClientCounter() *clientCounter {
+	return &clientCounter{counts: make(map[string]int)}
+}
+
+// acquire returns false if client already has limit connections, limit 0 means unlimited
+func (c *clientCounter) acquire(client string, limit int64) bool {
+	c.Lock()
+	defer c.Unlock()
+	if limit > 0 && int64(c.counts[client]) >= limit {
+		return false
+	}
+	c.counts[client]++
+	return true
+}
+
+func (c *clientCounter) release(client string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.counts[client] <= 1 {
+		delete(c.counts, client)
+	} else {
+		c.counts[client]--
+	}
+}
+
+func (c *clientCounter) get(client string) int {
+	c.Lock()
+	defer c.Unlock()
+	return c.counts[client]
+}
+
+// acquireClientConn reserves a TCP connection slot of the client of conn, caller closes conn if refused
+func (c *ProxyClient) acquireClientConn(conn net.Conn) bool {
+	client := trafficHost(conn.RemoteAddr().String())
+	if c.clientConns.acquire(client, atomic.LoadInt64(&c.clientConnLimit)) {
+		return true
+	}
+	if logger := log.GetLogger(); logger != nil {
+		logger.Debug("Client connection limit reached, refused", zap.String("client", client))
+	}
+	return false
+}
+
+func (c *ProxyClient) releaseClientConn(conn net.Conn) {
+	c.clientConns.release(trafficHost(conn.RemoteAddr().String()))
+}
@@ -0,0 +1,60 @@
+package proxy_client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	// 8000 kbps is 1MB/s with 100KB burst
+	limiter := newRateLimiter(8000)
+	if delay := limiter.reserve(100 * 1000); delay != 0 {
+		t.Errorf("burst should pass without delay, got %s", delay)
+	}
+	delay := limiter.reserve(500 * 1000)
+	if delay < 450*time.Millisecond || delay > 550*time.Millisecond {
+		t.Errorf("500KB over burst at 1MB/s should wait about 500ms, got %s", delay)
+	}
+	if limiter.allow(1000) {
+		t.Errorf("allow should refuse while bucket is in debt")
+	}
+
+	var unlimited *rateLimiter
+	if !unlimited.allow(1 << 30) {
+		t.Errorf("nil limiter should allow everything")
+	}
+	if newRateLimiter(0) != nil {
+		t.Errorf("zero rate should disable limiter")
+	}
+}
+
+func TestBackendLimiters(t *testing.T) {
+	limiters := newBackendLimiters(0, 0)
+	if conn := limiters.limitConn(nil); conn != nil {
+		t.Errorf("unlimited backend should not wrap conn")
+	}
+	limiters = newBackendLimiters(8000, 0)
+	if limiters.upload == nil || limiters.download != nil {
+		t.Errorf("only upload limiter expected")
+	}
+	if _, ok := limiters.limitConn(nil).(*limitedConn); !ok {
+		t.Errorf("limited backend should wrap conn")
+	}
+}
+
+func TestClientCounter(t *testing.T) {
+	counter := newClientCounter()
+	if !counter.acquire("a", 2) || !counter.acquire("a", 2) {
+		t.Errorf("acquire under limit should pass")
+	}
+	if counter.acquire("a", 2) {
+		t.Errorf("acquire over limit should be refused")
+	}
+	if !counter.acquire("b", 2) || !counter.acquire("a", 0) {
+		t.Errorf("other client and unlimited should pass")
+	}
+	counter.release("a")
+	if n := counter.get("a"); n != 2 {
+		t.Errorf("client connections got %d", n)
+	}
+}
@@ -0,0 +1,195 @@
+package proxy_client
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MULTIPATH_UDP_DUPLICATE = "duplicate"
+	MULTIPATH_UDP_STRIPE    = "stripe"
+
+	// replies seen within window are dropped as duplicates from other paths
+	MULTIPATH_DEDUP_SIZE   = 128
+	MULTIPATH_DEDUP_WINDOW = 2 * time.Second
+)
+
+// multipathGroup is backends bonded by name, looked up on use since reload replaces backends
+type multipathGroup struct {
+	backends []string
+	udp      string
+}
+
+// newMultipathGroup returns nil if multipath is disabled
+func newMultipathGroup(multipathConfig config.MultipathConfig) (*multipathGroup, error) {
+	if !multipathConfig.Enable {
+		return nil, nil
+	}
+	if len(multipathConfig.Backends) < 2 {
+		return nil, errors.New("Multipath needs at least two backends")
+	}
+	switch multipathConfig.Udp {
+	case "", MULTIPATH_UDP_DUPLICATE, MULTIPATH_UDP_STRIPE:
+	default:
+		return nil, errors.New(fmt.Sprintf("Invalid multipath udp mode: %s", multipathConfig.Udp))
+	}
+	return &multipathGroup{backends: multipathConfig.Backends, udp: multipathConfig.Udp}, nil
+}
+
+func (c *multipathGroup) contains(name string) bool {
+	for _, backend := range c.backends {
+		if backend == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMultipathBackends warns about bonded backend which does not exist, caller holds backend lock
+func (c *ProxyClient) checkMultipathBackends() {
+	if c.multipath == nil {
+		return
+	}
+	for _, name := range c.multipath.backends {
+		if c.getBackendProxyByName(name) == nil {
+			log.GetLogger().Warn("Multipath refers unknown backend", zap.String("backend", name))
+		}
+	}
+}
+
+// multipathMembers returns available bonded backends if backend is one of them, caller holds backend lock
+func (c *ProxyClient) multipathMembers(backend *proxyBackend) []*proxyBackend {
+	if c.multipath == nil || backend == nil || !c.multipath.contains(backend.getName()) {
+		return nil
+	}
+	ret := make([]*proxyBackend, 0, len(c.multipath.backends))
+	for _, name := range c.multipath.backends {
+		if member := c.getBackendProxyByName(name); member != nil && member.isAvailable() {
+			ret = append(ret, member)
+		}
+	}
+	return ret
+}
+
+// bond moves flow picked for bonded backend to least loaded one of the bond, caller holds backend lock
+func (c *ProxyClient) bond(backend *proxyBackend) *proxyBackend {
+	if members := c.multipathMembers(backend); len(members) > 1 {
+		return c.balancer.pickMin(members, func(backend *proxyBackend) int64 {
+			return backend.stats.getActiveConns()
+		})
+	}
+	return backend
+}
+
+// addUDPPaths opens entries on other bonded backends for plain UDP flow of entry, backends not relaying plain UDP
+// are skipped
+func (c *ProxyClient) addUDPPaths(entry *udpProxyEntry, dstAddr *net.UDPAddr) {
+	c.backendMux.RLock()
+	var members []*proxyBackend
+	mode := ""
+	if c.multipath != nil && len(c.multipath.udp) > 0 {
+		members = c.multipathMembers(entry.backend)
+		mode = c.multipath.udp
+	}
+	c.backendMux.RUnlock()
+	for _, member := range members {
+		if member == entry.backend {
+			continue
+		}
+		path, err := member.GetUDPRelayEntry(dstAddr)
+		if err != nil {
+			log.GetLogger().Debug("UDP multipath entry failed", zap.String("server", member.getName()), zap.String("error", err.Error()))
+			continue
+		}
+		if path.dstUdp_ == nil {
+			path.close()
+			continue
+		}
+		path.backend = member
+		entry.paths = append(entry.paths, path)
+	}
+	if len(entry.paths) > 0 {
+		entry.pathMode = mode
+		if mode == MULTIPATH_UDP_DUPLICATE {
+			entry.dedup = &udpDedup{}
+		}
+	}
+}
+
+// writeTo sends datagram over primary path, and over other paths as multipath mode says
+func (c *udpProxyEntry) writeTo(b []byte) error {
+	if len(c.paths) == 0 {
+		_, err := c.dstUdp_.WriteTo(b, c.proxyAddr)
+		return err
+	}
+	if c.pathMode == MULTIPATH_UDP_STRIPE {
+		if idx := int(atomic.AddUint32(&c.pathCount, 1)-1) % (len(c.paths) + 1); idx > 0 {
+			path := c.paths[idx-1]
+			_, err := path.dstUdp_.WriteTo(b, path.proxyAddr)
+			return err
+		}
+		_, err := c.dstUdp_.WriteTo(b, c.proxyAddr)
+		return err
+	}
+	// duplicated datagram is sent if any path takes it
+	_, err := c.dstUdp_.WriteTo(b, c.proxyAddr)
+	for _, path := range c.paths {
+		if _, pathErr := path.dstUdp_.WriteTo(b, path.proxyAddr); pathErr == nil {
+			err = nil
+		}
+	}
+	return err
+}
+
+// readUDPPath relays replies of secondary path until flow closes it
+func (c *ProxyClient) readUDPPath(entry *udpProxyEntry, path *udpProxyEntry, deliver func(data []byte)) {
+	buffer := c.udpBuffer_.Get()
+	defer c.udpBuffer_.Put(buffer)
+	for {
+		buffer = buffer[:cap(buffer)]
+		n, _, err := path.dstUdp_.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		entry.touch()
+		deliver(buffer[:n])
+	}
+}
+
+// udpDedup remembers hashes of recent replies, nil remembers nothing
+type udpDedup struct {
+	sync.Mutex
+	hashes [MULTIPATH_DEDUP_SIZE]uint64
+	times  [MULTIPATH_DEDUP_SIZE]time.Time
+	next   int
+}
+
+// seen tells if same datagram arrived within window, otherwise remembers it
+func (c *udpDedup) seen(data []byte) bool {
+	if c == nil {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write(data)
+	sum := h.Sum64()
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	for i := range c.hashes {
+		if c.hashes[i] == sum && now.Sub(c.times[i]) < MULTIPATH_DEDUP_WINDOW {
+			return true
+		}
+	}
+	c.hashes[c.next] = sum
+	c.times[c.next] = now
+	c.next = (c.next + 1) % MULTIPATH_DEDUP_SIZE
+	return false
+}
@@ -0,0 +1,39 @@
+package proxy_client
+
+import (
+	"github.com/weishi258/redfrog-core/config"
+	"testing"
+)
+
+func TestNewMultipathGroup(t *testing.T) {
+	if group, err := newMultipathGroup(config.MultipathConfig{}); group != nil || err != nil {
+		t.Errorf("disabled multipath got %v %v", group, err)
+	}
+	if _, err := newMultipathGroup(config.MultipathConfig{Enable: true, Backends: []string{"a"}}); err == nil {
+		t.Error("single backend accepted")
+	}
+	if _, err := newMultipathGroup(config.MultipathConfig{Enable: true, Backends: []string{"a", "b"}, Udp: "bond"}); err == nil {
+		t.Error("invalid udp mode accepted")
+	}
+	group, err := newMultipathGroup(config.MultipathConfig{Enable: true, Backends: []string{"a", "b"}, Udp: MULTIPATH_UDP_STRIPE})
+	if err != nil || !group.contains("b") || group.contains("c") {
+		t.Errorf("multipath group got %v %v", group, err)
+	}
+}
+
+func TestUdpDedup(t *testing.T) {
+	var nilDedup *udpDedup
+	if nilDedup.seen([]byte("a")) {
+		t.Error("nil dedup should never drop")
+	}
+	dedup := &udpDedup{}
+	if dedup.seen([]byte("reply")) {
+		t.Error("first reply dropped")
+	}
+	if !dedup.seen([]byte("reply")) {
+		t.Error("duplicate reply passed")
+	}
+	if dedup.seen([]byte("other")) {
+		t.Error("different reply dropped")
+	}
+}
@@ -0,0 +1,195 @@
+package proxy_client
+
+import (
+	"container/list"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// NAT table is split into shards each with its own lock, so flows of different clients do not contend
+	UDP_NAT_SHARDS = 32
+)
+
+// udpNatMap is one shard of NAT table of UDP flows keyed by (src, dst), shared by all backends, all flows of a LAN
+// client are in the same shard
+type udpNatMap struct {
+	sync.RWMutex
+	entries map[string]*udpProxyEntry
+	// flows per LAN client
+	clients map[string]int
+	// keys from most to least recently used, least recently used flow is evicted beyond maxEntries, 0 means no cap
+	lru        *list.List
+	maxEntries int
+	// flows of whole table counted against maxEntries, accessed atomically, nil if shard stands alone
+	total *int64
+}
+
+func newUdpNatMap(total *int64, maxEntries int) *udpNatMap {
+	return &udpNatMap{entries: make(map[string]*udpProxyEntry), clients: make(map[string]int), lru: list.New(),
+		maxEntries: maxEntries, total: total}
+}
+
+// Add inserts flow as most recently used, evicting and closing least recently used ones over cap
+func (c *udpNatMap) Add(key string, entry *udpProxyEntry) {
+	if current, ok := c.entries[key]; ok {
+		c.Del(key, current)
+	}
+	if c.lru == nil {
+		c.lru = list.New()
+	}
+	c.entries[key] = entry
+	entry.lruElem = c.lru.PushFront(key)
+	if c.total != nil {
+		atomic.AddInt64(c.total, 1)
+	}
+	if entry.backend != nil {
+		entry.backend.stats.acquire()
+	}
+	if len(entry.client) > 0 {
+		c.clients[entry.client]++
+	}
+	c.evict(entry.lruElem)
+}
+
+// Del removes key only if it still maps to entry, since quitting flow may race with a new flow of the same key
+func (c *udpNatMap) Del(key string, entry *udpProxyEntry) {
+	if current, ok := c.entries[key]; ok && current == entry {
+		delete(c.entries, key)
+		c.lru.Remove(entry.lruElem)
+		if c.total != nil {
+			atomic.AddInt64(c.total, -1)
+		}
+		if entry.backend != nil {
+			entry.backend.stats.release()
+		}
+		if len(entry.client) > 0 {
+			if c.clients[entry.client] <= 1 {
+				delete(c.clients, entry.client)
+			} else {
+				c.clients[entry.client]--
+			}
+		}
+	}
+}
+
+// clientEntries returns number of flows of client, caller holds lock
+func (c *udpNatMap) clientEntries(client string) int {
+	return c.clients[client]
+}
+
+// expireBackend ends all flows relayed by backend, so their next packet is balanced to a live backend
+func (c *udpNatMap) expireBackend(backend *proxyBackend) {
+	c.RLock()
+	defer c.RUnlock()
+	for _, entry := range c.entries {
+		if entry.backend == backend {
+			entry.expire()
+		}
+	}
+}
+
+// size returns flows counted against cap
+func (c *udpNatMap) size() int {
+	if c.total != nil {
+		return int(atomic.LoadInt64(c.total))
+	}
+	return len(c.entries)
+}
+
+// evict closes least recently used flows of this shard until table is within cap, their read loops then quit, flow
+// of keep is spared, so table may exceed cap by one flow per shard, caller holds lock
+func (c *udpNatMap) evict(keep *list.Element) {
+	for c.maxEntries > 0 && c.size() > c.maxEntries && c.lru.Len() > 0 && c.lru.Back() != keep {
+		key := c.lru.Back().Value.(string)
+		entry := c.entries[key]
+		c.Del(key, entry)
+		entry.close()
+	}
+}
+
+// setMaxEntries changes cap, flows over new cap are evicted at once
+func (c *udpNatMap) setMaxEntries(maxEntries int) {
+	c.Lock()
+	defer c.Unlock()
+	c.maxEntries = maxEntries
+	c.evict(nil)
+}
+
+// peek returns flow of key without marking it used, so read lock is enough
+func (c *udpNatMap) peek(key string) *udpProxyEntry {
+	return c.entries[key]
+}
+
+// Get returns flow of key and marks it most recently used, caller holds write lock
+func (c *udpNatMap) Get(key string) *udpProxyEntry {
+	if entry, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(entry.lruElem)
+		return entry
+	} else {
+		return nil
+	}
+}
+
+// udpNatTable is NAT table of all UDP flows sharded by LAN client
+type udpNatTable struct {
+	shards []*udpNatMap
+	total  int64
+}
+
+func newUdpNatTable(shards int, maxEntries int) *udpNatTable {
+	ret := &udpNatTable{shards: make([]*udpNatMap, shards)}
+	for i := range ret.shards {
+		ret.shards[i] = newUdpNatMap(&ret.total, maxEntries)
+	}
+	return ret
+}
+
+// natShardKey returns client ip of flow key, so its plain, full cone and direct flows share a shard and client limit
+// is counted in one place, DNS relay keys have no client and are spread by whole key
+func natShardKey(key string) string {
+	if idx := strings.Index(key, "->"); idx > 0 {
+		if host, _, err := net.SplitHostPort(key[:idx]); err == nil {
+			return host
+		}
+	}
+	return key
+}
+
+// shard returns the shard holding key, which is locked by caller
+func (c *udpNatTable) shard(key string) *udpNatMap {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(natShardKey(key)))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+func (c *udpNatTable) expireBackend(backend *proxyBackend) {
+	for _, shard := range c.shards {
+		shard.expireBackend(backend)
+	}
+}
+
+func (c *udpNatTable) setMaxEntries(maxEntries int) {
+	for _, shard := range c.shards {
+		shard.setMaxEntries(maxEntries)
+	}
+}
+
+// closeAll closes every flow, errors are passed to onError
+func (c *udpNatTable) closeAll(onError func(err error)) {
+	for _, shard := range c.shards {
+		shard.Lock()
+		for _, entry := range shard.entries {
+			if err := entry.close(); err != nil {
+				onError(err)
+			}
+		}
+		shard.Unlock()
+	}
+}
@@ -0,0 +1,161 @@
+package proxy_client
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUdpNatMapDel(t *testing.T) {
+	backend := &proxyBackend{}
+	natMap := &udpNatMap{entries: make(map[string]*udpProxyEntry), clients: make(map[string]int)}
+	old := &udpProxyEntry{backend: backend}
+	natMap.Add("a->b", old)
+	natMap.Del("a->b", old)
+	fresh := &udpProxyEntry{backend: backend}
+	natMap.Add("a->b", fresh)
+	// late cleanup of old flow must not remove the new one
+	natMap.Del("a->b", old)
+	if natMap.Get("a->b") != fresh {
+		t.Errorf("new flow removed by old flow cleanup")
+	}
+	if conns := backend.stats.getActiveConns(); conns != 1 {
+		t.Errorf("backend active flows got %d", conns)
+	}
+	natMap.Del("a->b", fresh)
+	if conns := backend.stats.getActiveConns(); conns != 0 {
+		t.Errorf("backend active flows got %d after all removed", conns)
+	}
+}
+
+func TestUdpNatMapClients(t *testing.T) {
+	natMap := &udpNatMap{entries: make(map[string]*udpProxyEntry), clients: make(map[string]int)}
+	first := &udpProxyEntry{client: "192.168.1.2"}
+	second := &udpProxyEntry{client: "192.168.1.2"}
+	natMap.Add("a->b", first)
+	natMap.Add("a->c", second)
+	if n := natMap.clientEntries("192.168.1.2"); n != 2 {
+		t.Errorf("client flows got %d", n)
+	}
+	natMap.Del("a->b", first)
+	natMap.Del("a->b", first)
+	natMap.Del("a->c", second)
+	if n := natMap.clientEntries("192.168.1.2"); n != 0 || len(natMap.clients) != 0 {
+		t.Errorf("client flows got %d after all removed", n)
+	}
+}
+
+func TestUdpProxyEntryKeepAlive(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	entry := &udpProxyEntry{dstUdp_: conn, idleTimeout: 50 * time.Millisecond}
+	entry.touch()
+	if !entry.keepAlive() {
+		t.Fatal("active flow expired")
+	}
+	atomic.StoreInt64(&entry.lastActive, time.Now().Add(-time.Second).UnixNano())
+	if entry.keepAlive() {
+		t.Fatal("idle flow kept alive")
+	}
+	entry.touch()
+	entry.expire()
+	if entry.keepAlive() {
+		t.Fatal("expired flow kept alive")
+	}
+}
+
+func TestUdpNatMapEvict(t *testing.T) {
+	natMap := &udpNatMap{entries: make(map[string]*udpProxyEntry), clients: make(map[string]int), maxEntries: 2}
+	first := &udpProxyEntry{}
+	second := &udpProxyEntry{}
+	natMap.Add("a->b", first)
+	natMap.Add("a->c", second)
+	// using first makes second least recently used
+	natMap.Get("a->b")
+	natMap.Add("a->d", &udpProxyEntry{})
+	if natMap.Get("a->c") != nil || natMap.Get("a->b") != first || len(natMap.entries) != 2 {
+		t.Errorf("least recently used flow should be evicted, got %d flows", len(natMap.entries))
+	}
+	natMap.setMaxEntries(1)
+	if len(natMap.entries) != 1 || natMap.Get("a->b") != first || natMap.lru.Len() != 1 {
+		t.Errorf("lowered cap should evict at once, got %d flows", len(natMap.entries))
+	}
+}
+
+func TestUdpNatTableShard(t *testing.T) {
+	src := &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5000}
+	dst := &net.UDPAddr{IP: net.ParseIP("1.1.1.1"), Port: 443}
+	if key := natShardKey(computeUDPKey(src, dst)); key != "192.168.1.2" {
+		t.Errorf("shard key got %s", key)
+	}
+	table := newUdpNatTable(UDP_NAT_SHARDS, 0)
+	other := &net.UDPAddr{IP: src.IP, Port: 6000}
+	if table.shard(computeUDPKey(src, dst)) != table.shard(computeConeKey(other)) {
+		t.Error("flows of a client should share shard")
+	}
+	if key := natShardKey(computeDnsKey("8.8.8.8:53")); key != computeDnsKey("8.8.8.8:53") {
+		t.Errorf("dns shard key got %s", key)
+	}
+}
+
+func TestUdpNatTableCap(t *testing.T) {
+	table := newUdpNatTable(4, 2)
+	for i := 0; i < 8; i++ {
+		src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, byte(i)), Port: 5000}
+		key := computeUDPKey(src, src)
+		natMap := table.shard(key)
+		natMap.Lock()
+		natMap.Add(key, &udpProxyEntry{})
+		natMap.Unlock()
+	}
+	// each shard may keep its newest flow over cap
+	if total := atomic.LoadInt64(&table.total); total < 2 || total > 4 {
+		t.Errorf("table flows got %d", total)
+	}
+	table.setMaxEntries(1)
+	if total := atomic.LoadInt64(&table.total); total != 1 {
+		t.Errorf("table flows got %d after lowering cap", total)
+	}
+}
+
+// benchmarkUdpNatTable churns Add, Get and Del of many clients in parallel
+func benchmarkUdpNatTable(b *testing.B, shards int) {
+	table := newUdpNatTable(shards, 0)
+	var next uint32
+	b.RunParallel(func(pb *testing.PB) {
+		n := atomic.AddUint32(&next, 1)
+		src := &net.UDPAddr{IP: net.IPv4(10, byte(n>>8), byte(n), 1), Port: 5000}
+		keys := make([]string, 64)
+		for i := range keys {
+			keys[i] = computeUDPKey(src, &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 443 + i})
+		}
+		natMap := table.shard(keys[0])
+		for i := 0; pb.Next(); i++ {
+			key := keys[i%len(keys)]
+			natMap.Lock()
+			entry := natMap.Get(key)
+			if entry == nil {
+				entry = &udpProxyEntry{client: src.IP.String()}
+				natMap.Add(key, entry)
+			}
+			natMap.Unlock()
+			if i%4 == 3 {
+				natMap.Lock()
+				natMap.Del(key, entry)
+				natMap.Unlock()
+			}
+		}
+	})
+}
+
+func BenchmarkUdpNatTableSingle(b *testing.B) {
+	benchmarkUdpNatTable(b, 1)
+}
+
+func BenchmarkUdpNatTableSharded(b *testing.B) {
+	benchmarkUdpNatTable(b, UDP_NAT_SHARDS)
+}
@@ -0,0 +1,143 @@
+package proxy_client
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/network"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// learned ip is kept longer than DNS route dedup so it gets refreshed before expire
+	POLICY_LEARN_TTL      = 2 * time.Hour
+	POLICY_LEARN_SCAVENGE = 10 * time.Minute
+)
+
+type policyNet struct {
+	ipNet   *net.IPNet
+	backend string
+}
+
+type policyLearned struct {
+	domain string
+	expire time.Time
+}
+
+// backendPolicy pins destination to named backend, either by cidr or by ip learned from DNS answer of a domain
+type backendPolicy struct {
+	domains map[string]string
+	ipNets  []policyNet
+
+	learnedMux sync.RWMutex
+	learned    map[string]policyLearned
+	scavenged  time.Time
+}
+
+func newBackendPolicy(policies []config.BackendPolicyConfig) (*backendPolicy, error) {
+	ret := &backendPolicy{domains: make(map[string]string), ipNets: make([]policyNet, 0), learned: make(map[string]policyLearned), scavenged: time.Now()}
+	for _, policy := range policies {
+		if len(policy.Backend) == 0 {
+			return nil, errors.New("Backend policy without backend name")
+		}
+		for _, domain := range policy.Domains {
+			domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+			if len(domain) > 0 {
+				ret.domains[domain] = policy.Backend
+			}
+		}
+		for _, cidr := range policy.Cidr {
+			_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				return nil, errors.Wrapf(err, "Backend policy cidr %s invalid", cidr)
+			}
+			ret.ipNets = append(ret.ipNets, policyNet{ipNet: ipNet, backend: policy.Backend})
+		}
+	}
+	return ret, nil
+}
+
+// inherit keeps learned ips across reload, they are matched against new domain rules on lookup
+func (c *backendPolicy) inherit(old *backendPolicy) {
+	if old == nil {
+		return
+	}
+	old.learnedMux.RLock()
+	defer old.learnedMux.RUnlock()
+	for k, v := range old.learned {
+		c.learned[k] = v
+	}
+}
+
+// matchDomain returns backend of the domain or its nearest parent domain
+func (c *backendPolicy) matchDomain(domain string) string {
+	if len(c.domains) == 0 {
+		return ""
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for {
+		if backend, ok := c.domains[domain]; ok {
+			return backend
+		}
+		idx := strings.Index(domain, ".")
+		if idx < 0 {
+			return ""
+		}
+		domain = domain[idx+1:]
+	}
+}
+
+func (c *backendPolicy) learn(domain string, ip net.IP) {
+	if len(c.matchDomain(domain)) == 0 {
+		return
+	}
+	now := time.Now()
+	c.learnedMux.Lock()
+	defer c.learnedMux.Unlock()
+	if now.Sub(c.scavenged) > POLICY_LEARN_SCAVENGE {
+		for k, v := range c.learned {
+			if now.After(v.expire) {
+				delete(c.learned, k)
+			}
+		}
+		c.scavenged = now
+	}
+	c.learned[ip.String()] = policyLearned{domain: domain, expire: now.Add(POLICY_LEARN_TTL)}
+}
+
+// lookup returns backend name pinned for destination ip, empty if none
+func (c *backendPolicy) lookup(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	// NAT64 destination is matched by embedded ipv4 as well
+	ips := []net.IP{ip}
+	if ipv4 := network.NAT64Extract(network.GetNAT64Prefix(), ip); ipv4 != nil {
+		ips = append(ips, ipv4)
+	}
+	for _, ip := range ips {
+		for _, ipNet := range c.ipNets {
+			if ipNet.ipNet.Contains(ip) {
+				return ipNet.backend
+			}
+		}
+	}
+	now := time.Now()
+	c.learnedMux.RLock()
+	defer c.learnedMux.RUnlock()
+	for _, ip := range ips {
+		if learned, ok := c.learned[ip.String()]; ok && now.Before(learned.expire) {
+			if backend := c.matchDomain(learned.domain); len(backend) > 0 {
+				return backend
+			}
+		}
+	}
+	return ""
+}
+
+func (c *backendPolicy) String() string {
+	return fmt.Sprintf("%d domains, %d cidrs", len(c.domains), len(c.ipNets))
+}
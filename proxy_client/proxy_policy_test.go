@@ -0,0 +1,48 @@
+package proxy_client
+
+import (
+	"github.com/weishi258/redfrog-core/config"
+	"net"
+	"testing"
+)
+
+func TestBackendPolicy(t *testing.T) {
+	policy, err := newBackendPolicy([]config.BackendPolicyConfig{
+		{Backend: "us", Domains: []string{"netflix.com."}, Cidr: []string{"198.38.96.0/19"}},
+		{Backend: "hk", Domains: []string{"api.netflix.com"}},
+	})
+	if err != nil {
+		t.Fatalf("create policy failed: %s", err.Error())
+	}
+	if backend := policy.matchDomain("www.Netflix.com."); backend != "us" {
+		t.Errorf("sub domain should match parent rule, got %s", backend)
+	}
+	if backend := policy.matchDomain("v1.api.netflix.com"); backend != "hk" {
+		t.Errorf("nearest parent rule should win, got %s", backend)
+	}
+	if backend := policy.matchDomain("notnetflix.com"); backend != "" {
+		t.Errorf("unrelated domain should not match, got %s", backend)
+	}
+	if backend := policy.lookup(net.ParseIP("198.38.100.1")); backend != "us" {
+		t.Errorf("cidr should match, got %s", backend)
+	}
+
+	policy.learn("www.netflix.com", net.ParseIP("1.2.3.4"))
+	policy.learn("www.google.com", net.ParseIP("5.6.7.8"))
+	if backend := policy.lookup(net.ParseIP("1.2.3.4")); backend != "us" {
+		t.Errorf("learned ip should match, got %s", backend)
+	}
+	if backend := policy.lookup(net.ParseIP("5.6.7.8")); backend != "" {
+		t.Errorf("ip of domain without policy should not be learned, got %s", backend)
+	}
+
+	reloaded, _ := newBackendPolicy([]config.BackendPolicyConfig{{Backend: "jp", Domains: []string{"netflix.com"}}})
+	reloaded.inherit(policy)
+	if backend := reloaded.lookup(net.ParseIP("1.2.3.4")); backend != "jp" {
+		t.Errorf("learned ip should follow reloaded rule, got %s", backend)
+	}
+
+	if _, err := newBackendPolicy([]config.BackendPolicyConfig{{Backend: "us", Cidr: []string{"bad"}}}); err == nil {
+		t.Errorf("invalid cidr should fail")
+	}
+}
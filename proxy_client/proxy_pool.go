@@ -0,0 +1,165 @@
+package proxy_client
+
+import (
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// wait after a failed dial before refilling again, so a dead server is not hammered
+	POOL_RETRY_INTERVAL = 5 * time.Second
+)
+
+type pooledConn struct {
+	conn   net.Conn
+	dialed time.Time
+}
+
+// connPool keeps dialed backend connections ready, conn idle longer than idleTimeout is dropped since server may
+// have closed it already
+type connPool struct {
+	conns       chan pooledConn
+	idleTimeout time.Duration
+	dial        func() (net.Conn, error)
+	refill      chan struct{}
+	done        chan struct{}
+	stopOnce    sync.Once
+}
+
+func newConnPool(size int, idleTimeout time.Duration, dial func() (net.Conn, error)) *connPool {
+	if size <= 0 {
+		return nil
+	}
+	ret := &connPool{
+		conns:       make(chan pooledConn, size),
+		idleTimeout: idleTimeout,
+		dial:        dial,
+		refill:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	go ret.fillLoop()
+	return ret
+}
+
+// get returns a fresh pooled conn or nil if none, nil pool always returns nil
+func (c *connPool) get() net.Conn {
+	if c == nil {
+		return nil
+	}
+	defer c.signal()
+	for {
+		select {
+		case entry := <-c.conns:
+			if time.Since(entry.dialed) < c.idleTimeout {
+				return entry.conn
+			}
+			entry.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *connPool) signal() {
+	select {
+	case c.refill <- struct{}{}:
+	default:
+	}
+}
+
+func (c *connPool) fillLoop() {
+	// recycle before conns reach idle timeout
+	ticker := time.NewTicker(c.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		c.expire()
+		if !c.fill() {
+			select {
+			case <-time.After(POOL_RETRY_INTERVAL):
+			case <-c.done:
+				return
+			}
+		}
+		select {
+		case <-c.refill:
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// expire drops conns which would be too old by the time of next refill
+func (c *connPool) expire() {
+	for i := len(c.conns); i > 0; i-- {
+		select {
+		case entry := <-c.conns:
+			if time.Since(entry.dialed) < c.idleTimeout/2 {
+				c.put(entry)
+			} else {
+				entry.conn.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (c *connPool) put(entry pooledConn) {
+	select {
+	case c.conns <- entry:
+	default:
+		entry.conn.Close()
+	}
+}
+
+// fill dials until pool is full, returns false if dial failed
+func (c *connPool) fill() bool {
+	for len(c.conns) < cap(c.conns) {
+		select {
+		case <-c.done:
+			return true
+		default:
+		}
+		conn, err := c.dial()
+		if err != nil {
+			if logger := log.GetLogger(); logger != nil {
+				logger.Debug("Pre-dial backend conn failed", zap.String("error", err.Error()))
+			}
+			return false
+		}
+		c.put(pooledConn{conn: conn, dialed: time.Now()})
+		select {
+		case <-c.done:
+			// stopped while dialing, do not leak conn put after stop drained
+			c.drain()
+			return true
+		default:
+		}
+	}
+	return true
+}
+
+func (c *connPool) stop() {
+	if c == nil {
+		return
+	}
+	c.stopOnce.Do(func() {
+		close(c.done)
+		c.drain()
+	})
+}
+
+func (c *connPool) drain() {
+	for {
+		select {
+		case entry := <-c.conns:
+			entry.conn.Close()
+		default:
+			return
+		}
+	}
+}
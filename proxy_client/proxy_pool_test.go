@@ -0,0 +1,44 @@
+package proxy_client
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnPool(t *testing.T) {
+	var dialed int32
+	pool := newConnPool(2, time.Minute, func() (net.Conn, error) {
+		atomic.AddInt32(&dialed, 1)
+		conn, _ := net.Pipe()
+		return conn, nil
+	})
+	defer pool.stop()
+	deadline := time.Now().Add(time.Second)
+	for len(pool.conns) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if pool.get() == nil {
+		t.Fatalf("pool should hand out pre-dialed conn")
+	}
+	// taken conn is replaced in background
+	for atomic.LoadInt32(&dialed) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&dialed); n != 3 {
+		t.Errorf("pool should refill after get, dialed %d", n)
+	}
+
+	stale := &connPool{conns: make(chan pooledConn, 1), refill: make(chan struct{}, 1), idleTimeout: time.Second}
+	conn, _ := net.Pipe()
+	stale.conns <- pooledConn{conn: conn, dialed: time.Now().Add(-time.Minute)}
+	if stale.get() != nil {
+		t.Errorf("conn older than idle timeout should be dropped")
+	}
+
+	var disabled *connPool
+	if newConnPool(0, time.Minute, nil) != nil || disabled.get() != nil {
+		t.Errorf("zero size should disable pool")
+	}
+}
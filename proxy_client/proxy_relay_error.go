@@ -0,0 +1,143 @@
+package proxy_client
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	RELAY_ERROR_DIAL      = "dial"
+	RELAY_ERROR_HANDSHAKE = "handshake"
+	RELAY_ERROR_TIMEOUT   = "timeout"
+	RELAY_ERROR_RESET     = "reset"
+	RELAY_ERROR_OVERSIZE  = "oversize"
+	RELAY_ERROR_OTHER     = "other"
+)
+
+// categorizedError tags relay error with category where it is known, e.g. dial failure
+type categorizedError struct {
+	category string
+	error
+}
+
+func (c *categorizedError) Cause() error {
+	return c.error
+}
+
+func markRelayError(category string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &categorizedError{category: category, error: err}
+}
+
+// classifyRelayError returns innermost category tagged on err, otherwise guesses it from root cause, empty for nil
+func classifyRelayError(err error) string {
+	if err == nil {
+		return ""
+	}
+	category := ""
+	for e := err; e != nil; {
+		if tagged, ok := e.(*categorizedError); ok {
+			category = tagged.category
+		}
+		cause, ok := e.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		e = cause.Cause()
+	}
+	if len(category) > 0 {
+		return category
+	}
+	root := errors.Cause(err)
+	if ee, ok := root.(net.Error); ok && ee.Timeout() {
+		return RELAY_ERROR_TIMEOUT
+	}
+	if opErr, ok := root.(*net.OpError); ok {
+		root = opErr.Err
+	}
+	if sysErr, ok := root.(*os.SyscallError); ok {
+		root = sysErr.Err
+	}
+	switch root {
+	case syscall.ECONNRESET, syscall.EPIPE, syscall.ECONNABORTED, io.ErrUnexpectedEOF:
+		return RELAY_ERROR_RESET
+	}
+	// AEAD of shadowsocks fails on wrong password or cipher
+	if strings.Contains(root.Error(), "message authentication failed") {
+		return RELAY_ERROR_HANDSHAKE
+	}
+	return RELAY_ERROR_OTHER
+}
+
+// relayErrorStats counts failed relays of a backend by category
+type relayErrorStats struct {
+	dial      uint64
+	handshake uint64
+	timeout   uint64
+	reset     uint64
+	oversize  uint64
+	other     uint64
+}
+
+func (c *relayErrorStats) add(category string) {
+	switch category {
+	case RELAY_ERROR_DIAL:
+		atomic.AddUint64(&c.dial, 1)
+	case RELAY_ERROR_HANDSHAKE:
+		atomic.AddUint64(&c.handshake, 1)
+	case RELAY_ERROR_TIMEOUT:
+		atomic.AddUint64(&c.timeout, 1)
+	case RELAY_ERROR_RESET:
+		atomic.AddUint64(&c.reset, 1)
+	case RELAY_ERROR_OVERSIZE:
+		atomic.AddUint64(&c.oversize, 1)
+	case RELAY_ERROR_OTHER:
+		atomic.AddUint64(&c.other, 1)
+	}
+}
+
+// countRelayError counts err against backend and returns its category, nil backend is direct route and counts nothing
+func (c *proxyBackend) countRelayError(err error) string {
+	category := classifyRelayError(err)
+	if c != nil {
+		c.relayErrors.add(category)
+	}
+	return category
+}
+
+// RelayErrorStats is failed relays of one backend by category
+type RelayErrorStats struct {
+	Server    string
+	Dial      uint64
+	Handshake uint64
+	Timeout   uint64
+	Reset     uint64
+	Oversize  uint64
+	Other     uint64
+}
+
+// GetRelayErrorStats returns relay error counters of every backend
+func (c *ProxyClient) GetRelayErrorStats() []RelayErrorStats {
+	c.backendMux.RLock()
+	defer c.backendMux.RUnlock()
+	ret := make([]RelayErrorStats, 0, len(c.backends_))
+	for _, backend := range c.backends_ {
+		ret = append(ret, RelayErrorStats{
+			Server:    backend.getName(),
+			Dial:      atomic.LoadUint64(&backend.relayErrors.dial),
+			Handshake: atomic.LoadUint64(&backend.relayErrors.handshake),
+			Timeout:   atomic.LoadUint64(&backend.relayErrors.timeout),
+			Reset:     atomic.LoadUint64(&backend.relayErrors.reset),
+			Oversize:  atomic.LoadUint64(&backend.relayErrors.oversize),
+			Other:     atomic.LoadUint64(&backend.relayErrors.other),
+		})
+	}
+	return ret
+}
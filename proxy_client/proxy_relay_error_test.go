@@ -0,0 +1,84 @@
+package proxy_client
+
+import (
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"github.com/weishi258/redfrog-core/network"
+	"github.com/xtaci/smux"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyRelayError(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	cases := []struct {
+		err      error
+		category string
+	}{
+		{nil, ""},
+		{markRelayError(RELAY_ERROR_DIAL, errors.Wrap(reset, "Create remote conn failed")), RELAY_ERROR_DIAL},
+		// innermost tag wins, websocket handshake is part of dial
+		{markRelayError(RELAY_ERROR_DIAL, errors.Wrap(markRelayError(RELAY_ERROR_HANDSHAKE, io.EOF), "dial")), RELAY_ERROR_HANDSHAKE},
+		{errors.Wrap(timeoutError{}, "read"), RELAY_ERROR_TIMEOUT},
+		{reset, RELAY_ERROR_RESET},
+		{io.ErrUnexpectedEOF, RELAY_ERROR_RESET},
+		{errors.New("cipher: message authentication failed"), RELAY_ERROR_HANDSHAKE},
+		{errors.New("something else"), RELAY_ERROR_OTHER},
+	}
+	for _, c := range cases {
+		if category := classifyRelayError(c.err); category != c.category {
+			t.Errorf("classify %v got %s, expect %s", c.err, category, c.category)
+		}
+	}
+	backend := &proxyBackend{}
+	backend.countRelayError(reset)
+	var direct *proxyBackend
+	direct.countRelayError(reset)
+	if backend.relayErrors.reset != 1 {
+		t.Errorf("reset counter got %d", backend.relayErrors.reset)
+	}
+}
+
+func TestRelayMuxError(t *testing.T) {
+	log.InitLogger("", "error", false)
+	serverConfig := reloadTestServer("127.0.0.1:8388", "mux")
+	serverConfig.TcpTimeout = 1
+	backend, err := CreateProxyBackend(serverConfig, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Stop()
+	// server takes the stream but never answers, so relay times out
+	backend.muxBackend = StartTCPMuxBackend(config.TcpMuxConfig{Conn: 1, KeepAliveInterval: 10, KeepAliveTimeout: 30}, func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			header := make([]byte, 1)
+			server.Read(header)
+			if mux, err := smux.Server(server, smux.DefaultConfig()); err == nil {
+				for {
+					stream, err := mux.AcceptStream()
+					if err != nil {
+						return
+					}
+					go io.Copy(ioutil.Discard, stream)
+				}
+			}
+		}()
+		return client, nil
+	})
+	src, peer := net.Pipe()
+	defer peer.Close()
+	target, _ := network.ConvertShadowSocksAddr("192.0.2.1:80", false)
+	transport, _, _, err := backend.RelayTCPDataTo(src, target)
+	if transport != TRANSPORT_MUX || err == nil {
+		t.Fatalf("failed mux relay should return its error, got %s %v", transport, err)
+	}
+	if backend.relayErrors.timeout != 1 {
+		t.Errorf("mux relay timeout should be counted, got %+v", backend.relayErrors)
+	}
+}
@@ -0,0 +1,70 @@
+package proxy_client
+
+import (
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// relayRecord describes a finished TCP relay or UDP flow, backend is nil for direct route
+type relayRecord struct {
+	network   string
+	src       string
+	dst       string
+	backend   *proxyBackend
+	transport string
+	start     time.Time
+	inbound   int64
+	outbound  int64
+	err       error
+}
+
+func (c *ProxyClient) setRelayLog(enable bool) {
+	var value int32
+	if enable {
+		value = 1
+	}
+	atomic.StoreInt32(&c.relayLog, value)
+}
+
+// relayError tells why relay ended, empty if it ended normally by close or idle timeout
+func relayError(err error) string {
+	if err == nil || err == io.EOF {
+		return ""
+	}
+	if ee, ok := err.(net.Error); ok && ee.Timeout() {
+		return ""
+	}
+	return err.Error()
+}
+
+// logRelay writes record if relay log is enabled
+func (c *ProxyClient) logRelay(record *relayRecord) {
+	if atomic.LoadInt32(&c.relayLog) == 0 {
+		return
+	}
+	backend := TRANSPORT_DIRECT
+	if record.backend != nil {
+		backend = record.backend.getName()
+	}
+	log.GetLogger().Info("Relay finished",
+		zap.String("network", record.network),
+		zap.String("src", record.src),
+		zap.String("dst", record.dst),
+		zap.String("backend", backend),
+		zap.String("transport", record.transport),
+		zap.Int64("inbound", record.inbound),
+		zap.Int64("outbound", record.outbound),
+		zap.Duration("duration", time.Since(record.start)),
+		zap.String("error", relayError(record.err)))
+}
+
+// logUDPRelay logs flow which quits, full cone flow is logged with destination it started with
+func (c *ProxyClient) logUDPRelay(entry *udpProxyEntry, srcAddr *net.UDPAddr, dstAddr *net.UDPAddr, err error) {
+	c.logRelay(&relayRecord{network: "udp", src: srcAddr.String(), dst: dstAddr.String(), backend: entry.backend,
+		transport: entry.transport, start: entry.start, inbound: atomic.LoadInt64(&entry.inbound),
+		outbound: atomic.LoadInt64(&entry.outbound), err: err})
+}
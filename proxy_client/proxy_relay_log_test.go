@@ -0,0 +1,26 @@
+package proxy_client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRelayError(t *testing.T) {
+	var timeout net.Error = timeoutError{}
+	for _, err := range []error{nil, io.EOF, timeout} {
+		if msg := relayError(err); msg != "" {
+			t.Errorf("normal end got error %s", msg)
+		}
+	}
+	if msg := relayError(errors.New("connection reset")); msg != "connection reset" {
+		t.Errorf("relay error got %s", msg)
+	}
+}
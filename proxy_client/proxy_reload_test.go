@@ -0,0 +1,55 @@
+package proxy_client
+
+import (
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"testing"
+)
+
+func reloadTestServer(addr string, name string) config.RemoteServerConfig {
+	return config.RemoteServerConfig{Enable: true, Name: name, RemoteServer: addr, Crypt: "AEAD_CHACHA20_POLY1305",
+		Password: "secret", Weight: 1, PoolIdle: 30}
+}
+
+func TestReloadBackends(t *testing.T) {
+	log.InitLogger("", "error", false)
+	client := &ProxyClient{udpNatMap_: newUdpNatTable(UDP_NAT_SHARDS, 0)}
+	kept := reloadTestServer("127.0.0.1:8388", "kept")
+	changed := reloadTestServer("127.0.0.1:8389", "changed")
+	removed := reloadTestServer("127.0.0.1:8390", "removed")
+	if err := client.Reload(config.ShadowsocksConfig{Servers: []config.RemoteServerConfig{kept, changed, removed}, Balance: BALANCE_RANDOM}); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.backends_) != 3 {
+		t.Fatalf("expected 3 backends, got %d", len(client.backends_))
+	}
+	keptBackend, changedBackend := client.backends_[0], client.backends_[1]
+
+	// relays read name while reload updates it
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			keptBackend.getName()
+		}
+	}()
+	kept.Name, kept.Weight = "renamed", 3
+	changed.Password = "changed"
+	if err := client.Reload(config.ShadowsocksConfig{Servers: []config.RemoteServerConfig{kept, changed}, Balance: BALANCE_RANDOM}); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if len(client.backends_) != 2 {
+		t.Fatalf("expected 2 backends, got %d", len(client.backends_))
+	}
+	if client.backends_[0] != keptBackend || keptBackend.getName() != "renamed" || keptBackend.getWeight() != 3 {
+		t.Errorf("backend with same transport should be kept and updated in place, got %s", client.backends_[0].getName())
+	}
+	if client.backends_[1] == changedBackend || client.backends_[1].getConfig().Password != "changed" {
+		t.Errorf("backend with changed transport should be created again")
+	}
+	if client.getBackendProxyByName("removed") != nil {
+		t.Errorf("removed backend should be drained")
+	}
+}
@@ -0,0 +1,233 @@
+package proxy_client
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/log"
+	"github.com/weishi258/redfrog-core/network"
+	"go.uber.org/zap"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SERVER_RESOLVE_TIMEOUT = 5 * time.Second
+	// dial failures re-resolve at most this often, so a down server does not flood resolvers
+	SERVER_RESOLVE_MIN_INTERVAL = 30 * time.Second
+	// RFC 8305 connection attempt delay before racing the other address family
+	HAPPY_EYEBALLS_DELAY = 250 * time.Millisecond
+)
+
+// backendAddr is where backend currently dials, replaced as a whole when server hostname resolves to new ip
+type backendAddr struct {
+	tcp         *net.TCPAddr
+	udp         *net.UDPAddr
+	networkType string
+	// address of the other family if server has both, raced against tcp by happy eyeballs
+	alt *net.TCPAddr
+}
+
+// newBackendAddr prefers first ip, alt is first ip of the other family
+func newBackendAddr(ips []net.IP, port int) *backendAddr {
+	ip := ips[0]
+	ret := &backendAddr{tcp: &net.TCPAddr{IP: ip, Port: port}, udp: &net.UDPAddr{IP: ip, Port: port}, networkType: "tcp4"}
+	if ip.To4() == nil {
+		ret.networkType = "tcp6"
+	}
+	for _, other := range ips[1:] {
+		if (other.To4() == nil) != (ip.To4() == nil) {
+			ret.alt = &net.TCPAddr{IP: other, Port: port}
+			break
+		}
+	}
+	return ret
+}
+
+// swapped returns addr preferring alt, used once alt won the race so udp follows the family which works
+func (c *backendAddr) swapped() *backendAddr {
+	return newBackendAddr([]net.IP{c.alt.IP, c.tcp.IP}, c.tcp.Port)
+}
+
+// sameIPs tells if addr uses exactly ips, order aside
+func (c *backendAddr) sameIPs(ips []net.IP) bool {
+	if c == nil {
+		return false
+	}
+	current := []net.IP{c.tcp.IP}
+	if c.alt != nil {
+		current = append(current, c.alt.IP)
+	}
+	if len(current) != len(ips) {
+		return false
+	}
+	for _, ip := range ips {
+		if !ip.Equal(current[0]) && (len(current) == 1 || !ip.Equal(current[1])) {
+			return false
+		}
+	}
+	return true
+}
+
+// serverResolver resolves hostname of remote server with given nameservers directly, system resolver may point to our
+// own DNS server which needs a backend to answer
+type serverResolver struct {
+	resolvers []string
+	interval  time.Duration
+}
+
+func newServerResolver(resolvers []string, interval int) *serverResolver {
+	ret := &serverResolver{resolvers: make([]string, 0, len(resolvers)), interval: time.Duration(interval) * time.Second}
+	for _, resolver := range resolvers {
+		if strings.Index(resolver, ":") >= 0 {
+			ret.resolvers = append(ret.resolvers, resolver)
+		} else {
+			ret.resolvers = append(ret.resolvers, fmt.Sprintf("%s:53", resolver))
+		}
+	}
+	return ret
+}
+
+// splitServerAddr splits remote server into host and port, ip is nil if host is a hostname
+func splitServerAddr(addr string) (host string, ip net.IP, port int, err error) {
+	var portStr string
+	if host, portStr, err = net.SplitHostPort(addr); err != nil {
+		err = errors.Wrapf(err, "Invalid server address: %s", addr)
+		return
+	}
+	var portNum uint64
+	if portNum, err = strconv.ParseUint(portStr, 10, 16); err != nil {
+		err = errors.Wrap(err, "Port format invalid")
+		return
+	}
+	port = int(portNum)
+	ip = net.ParseIP(host)
+	if ip == nil && len(host) == 0 {
+		err = errors.Errorf("Invalid server address: %s", addr)
+	}
+	return
+}
+
+// lookup returns first IPv6 then first IPv4 address of host, IPv6 goes first as RFC 8305
+func (c *serverResolver) lookup(host string) ([]net.IP, error) {
+	if len(c.resolvers) == 0 {
+		return nil, errors.New("No server resolver configured")
+	}
+	var lastErr error
+	ret := make([]net.IP, 0, 2)
+	for _, qtype := range []uint16{dns.TypeAAAA, dns.TypeA} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(host), qtype)
+		client := &dns.Client{Net: "udp", Timeout: SERVER_RESOLVE_TIMEOUT}
+		for _, resolver := range c.resolvers {
+			res, _, err := client.Exchange(msg, resolver)
+			if err != nil {
+				lastErr = errors.Wrapf(err, "Query %s failed", resolver)
+				continue
+			}
+			if res.Rcode != dns.RcodeSuccess {
+				lastErr = errors.Errorf("Query %s failed: %s", resolver, dns.RcodeToString[res.Rcode])
+				continue
+			}
+			// no record of this type is a valid answer, try next type instead of other resolvers
+			if ip := firstAnswerIP(res, qtype); ip != nil {
+				ret = append(ret, ip)
+			}
+			break
+		}
+	}
+	if len(ret) > 0 {
+		return ret, nil
+	}
+	if lastErr != nil {
+		return nil, errors.Wrapf(lastErr, "Resolve %s failed", host)
+	}
+	return nil, errors.Errorf("Resolve %s failed: no address", host)
+}
+
+func firstAnswerIP(res *dns.Msg, qtype uint16) net.IP {
+	for _, answer := range res.Answer {
+		switch rr := answer.(type) {
+		case *dns.A:
+			if qtype == dns.TypeA {
+				return rr.A
+			}
+		case *dns.AAAA:
+			if qtype == dns.TypeAAAA {
+				return rr.AAAA
+			}
+		}
+	}
+	return nil
+}
+
+// resolve looks up server hostname again and switches new connections to its new address
+func (c *proxyBackend) resolve() error {
+	atomic.StoreInt64(&c.lastResolved, time.Now().UnixNano())
+	ips, err := c.resolver.lookup(c.serverHost)
+	if err != nil {
+		return err
+	}
+	old := c.getAddr()
+	// keep family preference learned by happy eyeballs
+	if old.sameIPs(ips) {
+		return nil
+	}
+	c.addr.Store(newBackendAddr(ips, c.serverPort))
+	if old != nil {
+		log.GetLogger().Info("Proxy backend server address changed", zap.String("server", c.serverHost), zap.String("old", old.tcp.IP.String()),
+			zap.String("new", ips[0].String()))
+	}
+	return nil
+}
+
+// dialServer connects server, racing both families if it has both
+func (c *proxyBackend) dialServer(addr *backendAddr) (*net.TCPConn, error) {
+	if addr.alt == nil {
+		return c.sockOpts.DialTCP(addr.networkType, addr.tcp, c.GetConnectTimeout())
+	}
+	conn, idx, err := network.DialTCPHappyEyeballs([]*net.TCPAddr{addr.tcp, addr.alt}, HAPPY_EYEBALLS_DELAY, c.GetConnectTimeout(), c.sockOpts)
+	if err == nil && idx == 1 && c.getAddr() == addr {
+		c.addr.Store(addr.swapped())
+		log.GetLogger().Debug("Proxy backend prefers other address family", zap.String("server", c.serverHost), zap.String("addr", addr.alt.IP.String()))
+	}
+	return conn, err
+}
+
+// resolveLoop re-resolves server hostname on timer or when dial failed
+func (c *proxyBackend) resolveLoop() {
+	ticker := time.NewTicker(c.resolver.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.resolveNow:
+		case <-c.resolveDone:
+			return
+		}
+		if err := c.resolve(); err != nil {
+			log.GetLogger().Warn("Proxy backend resolve server failed", zap.String("server", c.serverHost), zap.String("error", err.Error()))
+		}
+	}
+}
+
+// requestResolve asks resolve loop to look up server again after dial failure, no-op for ip servers
+func (c *proxyBackend) requestResolve() {
+	if c.resolveNow == nil || time.Since(time.Unix(0, atomic.LoadInt64(&c.lastResolved))) < SERVER_RESOLVE_MIN_INTERVAL {
+		return
+	}
+	select {
+	case c.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+func (c *proxyBackend) getAddr() *backendAddr {
+	if addr, ok := c.addr.Load().(*backendAddr); ok {
+		return addr
+	}
+	return nil
+}
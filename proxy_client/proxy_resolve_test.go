@@ -0,0 +1,81 @@
+package proxy_client
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestSplitServerAddr(t *testing.T) {
+	host, ip, port, err := splitServerAddr("ss.example.com:8388")
+	if err != nil || host != "ss.example.com" || ip != nil || port != 8388 {
+		t.Errorf("unexpected %s %v %d %v", host, ip, port, err)
+	}
+	if _, ip, port, err = splitServerAddr("[2001:db8::1]:443"); err != nil || !ip.Equal(net.ParseIP("2001:db8::1")) || port != 443 {
+		t.Errorf("unexpected %v %d %v", ip, port, err)
+	}
+	for _, addr := range []string{"ss.example.com", ":8388", "1.2.3.4:99999"} {
+		if _, _, _, err = splitServerAddr(addr); err == nil {
+			t.Errorf("%s should be invalid", addr)
+		}
+	}
+}
+
+func TestServerResolverLookup(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(r)
+		q := r.Question[0]
+		switch {
+		case q.Name == "v4.example.com." && q.Qtype == dns.TypeA:
+			res.Answer = append(res.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("1.2.3.4")})
+		case q.Name == "v6.example.com." && q.Qtype == dns.TypeAAAA:
+			res.Answer = append(res.Answer, &dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}, AAAA: net.ParseIP("2001:db8::1")})
+		case q.Name == "dual.example.com." && q.Qtype == dns.TypeA:
+			res.Answer = append(res.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("5.6.7.8")})
+		case q.Name == "dual.example.com." && q.Qtype == dns.TypeAAAA:
+			res.Answer = append(res.Answer, &dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}, AAAA: net.ParseIP("2001:db8::2")})
+		case q.Name == "missing.example.com.":
+			res.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(res)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	resolver := newServerResolver([]string{conn.LocalAddr().String()}, 0)
+	if ips, err := resolver.lookup("v4.example.com"); err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("1.2.3.4")) {
+		t.Errorf("v4 lookup got %v %v", ips, err)
+	}
+	if ips, err := resolver.lookup("v6.example.com"); err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("v6 lookup got %v %v", ips, err)
+	}
+	if ips, err := resolver.lookup("dual.example.com"); err != nil || len(ips) != 2 || !ips[0].Equal(net.ParseIP("2001:db8::2")) ||
+		!ips[1].Equal(net.ParseIP("5.6.7.8")) {
+		t.Errorf("dual lookup got %v %v", ips, err)
+	}
+	if _, err := resolver.lookup("missing.example.com"); err == nil {
+		t.Error("missing domain should fail")
+	}
+}
+
+func TestBackendAddr(t *testing.T) {
+	addr := newBackendAddr([]net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), net.ParseIP("1.2.3.4")}, 443)
+	if addr.networkType != "tcp6" || addr.alt == nil || !addr.alt.IP.Equal(net.ParseIP("1.2.3.4")) {
+		t.Fatalf("unexpected addr %v %v %s", addr.tcp, addr.alt, addr.networkType)
+	}
+	swapped := addr.swapped()
+	if swapped.networkType != "tcp4" || !swapped.udp.IP.Equal(net.ParseIP("1.2.3.4")) || !swapped.alt.IP.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("unexpected swapped addr %v %v %s", swapped.tcp, swapped.alt, swapped.networkType)
+	}
+	if !swapped.sameIPs([]net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("1.2.3.4")}) {
+		t.Error("same ips in other order should match")
+	}
+	if swapped.sameIPs([]net.IP{net.ParseIP("1.2.3.4")}) {
+		t.Error("lost ipv6 should not match")
+	}
+}
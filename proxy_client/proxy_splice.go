@@ -0,0 +1,66 @@
+package proxy_client
+
+import (
+	"io"
+	"net"
+	"strings"
+)
+
+const (
+	// bytes spliced between deadline refreshes, splice reports progress only when it returns
+	SPLICE_CHUNK = 1 << 20
+)
+
+// isPlaintextCipher reports whether crypt leaves shadowsocks stream unencrypted, "none" and "plain" are aliases of dummy
+func isPlaintextCipher(crypt string) bool {
+	switch strings.ToUpper(crypt) {
+	case "DUMMY", "NONE", "PLAIN":
+		return true
+	}
+	return false
+}
+
+// spliceCopy relays between two bare TCP sockets with TCPConn.ReadFrom, which uses splice(2) on Linux so payload
+// never enters user space, ok is false if either side is wrapped, e.g. by rate limiter, it splices in chunks so
+// deadlines are pushed forward while data flows
+func spliceCopy(dst net.Conn, src net.Conn, idle *relayIdle) (written int64, err error, ok bool) {
+	dstTCP, isTCP := dst.(*net.TCPConn)
+	if !isTCP {
+		return 0, nil, false
+	}
+	srcTCP, isTCP := src.(*net.TCPConn)
+	if !isTCP {
+		return 0, nil, false
+	}
+	for {
+		idle.armRead(srcTCP)
+		dstTCP.SetWriteDeadline(idle.deadline())
+		var n int64
+		n, err = dstTCP.ReadFrom(&io.LimitedReader{R: srcTCP, N: SPLICE_CHUNK})
+		written += n
+		if n > 0 {
+			idle.touch()
+		}
+		if err == nil {
+			if n < SPLICE_CHUNK {
+				// src reached EOF
+				return written, nil, true
+			}
+			continue
+		}
+		if isTimeout(err) && !idle.stopped() && (n > 0 || idle.extend()) {
+			continue
+		}
+		return written, err, true
+	}
+}
+
+// copyTCP relays one direction of TCP connection, zero copy if backend stream is plaintext
+func (c *proxyBackend) copyTCP(dst net.Conn, src net.Conn, idle *relayIdle) (int64, error) {
+	if c.plaintext {
+		if written, err, ok := spliceCopy(dst, src, idle); ok {
+			return written, err
+		}
+	}
+	return copyBuffer(&idleConn{conn: dst, idle: idle}, &idleConn{conn: src, idle: idle}, c.tcpBuffer_)
+}
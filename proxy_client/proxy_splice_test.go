@@ -0,0 +1,49 @@
+package proxy_client
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T, listener net.Listener) (net.Conn, net.Conn) {
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestSpliceCopy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	src, srcPeer := tcpPair(t, listener)
+	defer src.Close()
+	dst, dstPeer := tcpPair(t, listener)
+	defer dstPeer.Close()
+
+	if _, _, ok := spliceCopy(&limitedConn{Conn: dst}, src, newRelayIdle(0)); ok {
+		t.Errorf("wrapped conn should not be spliced")
+	}
+	srcPeer.Write([]byte("hello"))
+	srcPeer.Close()
+	if written, err, ok := spliceCopy(dst, src, newRelayIdle(0)); !ok || err != nil || written != 5 {
+		t.Errorf("bare tcp conns should be spliced, ok %t written %d err %v", ok, written, err)
+	}
+	dst.Close()
+	if data, _ := ioutil.ReadAll(dstPeer); string(data) != "hello" {
+		t.Errorf("spliced data got %q", data)
+	}
+
+	if !isPlaintextCipher("none") || !isPlaintextCipher("DUMMY") || isPlaintextCipher("AEAD_CHACHA20_POLY1305") {
+		t.Errorf("unexpected plaintext cipher detection")
+	}
+}
@@ -0,0 +1,138 @@
+package proxy_client
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// counters idle longer than this are dropped so the table does not grow with every destination ever visited
+	TRAFFIC_IDLE_TTL      = 24 * time.Hour
+	TRAFFIC_SCAVENGE_TIME = 10 * time.Minute
+)
+
+// TrafficInfo is bytes relayed for one key, inbound is from remote to LAN and outbound is from LAN to remote
+type TrafficInfo struct {
+	Key      string
+	Inbound  uint64
+	Outbound uint64
+}
+
+type trafficCounter struct {
+	inbound  uint64
+	outbound uint64
+	// unix nano of last update
+	lastSeen int64
+}
+
+func (c *trafficCounter) add(inbound int64, outbound int64) {
+	if c == nil {
+		return
+	}
+	if inbound > 0 {
+		atomic.AddUint64(&c.inbound, uint64(inbound))
+	}
+	if outbound > 0 {
+		atomic.AddUint64(&c.outbound, uint64(outbound))
+	}
+	atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
+}
+
+// trafficStats keeps byte counters by key, counter is handed out so long lived UDP flow updates it without map lookup
+type trafficStats struct {
+	sync.Mutex
+	counters  map[string]*trafficCounter
+	scavenged time.Time
+}
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{counters: make(map[string]*trafficCounter), scavenged: time.Now()}
+}
+
+func (c *trafficStats) counter(key string) *trafficCounter {
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	if now.Sub(c.scavenged) > TRAFFIC_SCAVENGE_TIME {
+		expire := now.Add(-TRAFFIC_IDLE_TTL).UnixNano()
+		for k, v := range c.counters {
+			if atomic.LoadInt64(&v.lastSeen) < expire {
+				delete(c.counters, k)
+			}
+		}
+		c.scavenged = now
+	}
+	ret, ok := c.counters[key]
+	if !ok {
+		ret = &trafficCounter{lastSeen: now.UnixNano()}
+		c.counters[key] = ret
+	}
+	return ret
+}
+
+func (c *trafficStats) add(key string, inbound int64, outbound int64) {
+	c.counter(key).add(inbound, outbound)
+}
+
+// snapshot returns counters merged by rename, which maps key to the name it is reported under, sorted by total bytes
+func (c *trafficStats) snapshot(rename func(key string) string) []TrafficInfo {
+	merged := make(map[string]*TrafficInfo)
+	c.Lock()
+	for k, v := range c.counters {
+		if rename != nil {
+			k = rename(k)
+		}
+		info, ok := merged[k]
+		if !ok {
+			info = &TrafficInfo{Key: k}
+			merged[k] = info
+		}
+		info.Inbound += atomic.LoadUint64(&v.inbound)
+		info.Outbound += atomic.LoadUint64(&v.outbound)
+	}
+	c.Unlock()
+	ret := make([]TrafficInfo, 0, len(merged))
+	for _, info := range merged {
+		ret = append(ret, *info)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		ti, tj := ret[i].Inbound+ret[i].Outbound, ret[j].Inbound+ret[j].Outbound
+		if ti != tj {
+			return ti > tj
+		}
+		return ret[i].Key < ret[j].Key
+	})
+	return ret
+}
+
+// trafficHost strips port from address so traffic is counted per host
+func trafficHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// accountTraffic counts bytes of a finished TCP relay against destination and the LAN client of src
+func (c *ProxyClient) accountTraffic(src net.Conn, dst string, inbound int64, outbound int64) {
+	c.dstTraffic.add(dst, inbound, outbound)
+	c.srcTraffic.add(trafficHost(src.RemoteAddr().String()), inbound, outbound)
+}
+
+// GetDestinationTraffic returns bytes relayed per destination, ip found in domains (ip to domain) is reported under the domain
+func (c *ProxyClient) GetDestinationTraffic(domains map[string]string) []TrafficInfo {
+	return c.dstTraffic.snapshot(func(key string) string {
+		if domain, ok := domains[key]; ok {
+			return domain
+		}
+		return key
+	})
+}
+
+// GetClientTraffic returns bytes relayed per LAN client ip
+func (c *ProxyClient) GetClientTraffic() []TrafficInfo {
+	return c.srcTraffic.snapshot(nil)
+}
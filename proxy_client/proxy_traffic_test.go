@@ -0,0 +1,31 @@
+package proxy_client
+
+import "testing"
+
+func TestTrafficStats(t *testing.T) {
+	stats := newTrafficStats()
+	stats.add("1.1.1.1", 100, 10)
+	stats.add("2.2.2.2", 50, 5)
+	stats.counter("2.2.2.2").add(100, 0)
+	stats.add("3.3.3.3", 1, 1)
+
+	ret := stats.snapshot(nil)
+	if len(ret) != 3 || ret[0].Key != "2.2.2.2" || ret[0].Inbound != 150 || ret[0].Outbound != 5 {
+		t.Errorf("unexpected snapshot %v", ret)
+	}
+
+	domains := map[string]string{"1.1.1.1": "example.com", "3.3.3.3": "example.com"}
+	ret = stats.snapshot(func(key string) string {
+		if domain, ok := domains[key]; ok {
+			return domain
+		}
+		return key
+	})
+	if len(ret) != 2 || ret[1].Key != "example.com" || ret[1].Inbound != 101 || ret[1].Outbound != 11 {
+		t.Errorf("unexpected merged snapshot %v", ret)
+	}
+
+	if trafficHost("example.com:443") != "example.com" || trafficHost("[::1]:53") != "::1" {
+		t.Errorf("trafficHost should strip port")
+	}
+}
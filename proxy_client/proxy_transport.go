@@ -0,0 +1,65 @@
+package proxy_client
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TRANSPORT_KCP = "kcp"
+	TRANSPORT_MUX = "mux"
+	TRANSPORT_TCP = "tcp"
+	// UDP flows only
+	TRANSPORT_UDP    = "udp"
+	TRANSPORT_DIRECT = "direct"
+)
+
+// transportStats counts TCP relays by transport they went over
+type transportStats struct {
+	kcp uint64
+	mux uint64
+	tcp uint64
+}
+
+func (c *transportStats) used(transport string) {
+	switch transport {
+	case TRANSPORT_KCP:
+		atomic.AddUint64(&c.kcp, 1)
+	case TRANSPORT_MUX:
+		atomic.AddUint64(&c.mux, 1)
+	case TRANSPORT_TCP:
+		atomic.AddUint64(&c.tcp, 1)
+	}
+}
+
+// TransportStats is TCP relays of one backend by transport, with kcptun state if enabled
+type TransportStats struct {
+	Server string
+	Kcp    uint64
+	Mux    uint64
+	Tcp    uint64
+	// times KCP went down, and since when it is down, zero if it works
+	KcpFallbacks     uint64
+	KcpFallbackSince time.Time
+}
+
+// GetTransportStats returns transport usage of every backend
+func (c *ProxyClient) GetTransportStats() []TransportStats {
+	c.backendMux.RLock()
+	defer c.backendMux.RUnlock()
+	ret := make([]TransportStats, 0, len(c.backends_))
+	for _, backend := range c.backends_ {
+		stats := TransportStats{
+			Server: backend.getName(),
+			Kcp:    atomic.LoadUint64(&backend.transport.kcp),
+			Mux:    atomic.LoadUint64(&backend.transport.mux),
+			Tcp:    atomic.LoadUint64(&backend.transport.tcp),
+		}
+		if backend.kcpBackend != nil {
+			stats.KcpFallbacks = atomic.LoadUint64(&backend.kcpBackend.fallbacks)
+			stats.KcpFallbackSince = backend.kcpBackend.getFallbackSince()
+		}
+		ret = append(ret, stats)
+	}
+	return ret
+}
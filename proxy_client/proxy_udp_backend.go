@@ -8,6 +8,7 @@ import (
 	"go.uber.org/zap"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,6 +22,8 @@ type udpBackendEntry struct {
 	addr    *net.UDPAddr
 	signal  chan udpBackendPayloadSignal
 	die     chan bool
+	// unix nano of last packet either way, accessed atomically
+	lastActive int64
 }
 
 type udpBackend struct {
@@ -89,8 +92,8 @@ func (c *udpBackendEntry) doWriteBackLoop(proxyClientUDPBackend common.ProxyClie
 
 	defer udpBackendHandler.removeEntry(c)
 
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
 	timer := time.NewTimer(c.timeout)
-	timeout := time.Now()
 	go c.doListenLoop(proxyClientUDPBackend)
 	for {
 		select {
@@ -106,12 +109,12 @@ func (c *udpBackendEntry) doWriteBackLoop(proxyClientUDPBackend common.ProxyClie
 					logger.Debug("UDP proxy backend write back successful",
 						zap.String("src", ch.srcAddr.String()),
 						zap.String("addr", c.addr.String()))
-					timeout = timeout.Add(c.timeout)
+					atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
 				}
 			}
 
 		case <-timer.C:
-			if diff := timeout.Sub(time.Now()); diff >= 0 {
+			if diff := time.Until(time.Unix(0, atomic.LoadInt64(&c.lastActive)).Add(c.timeout)); diff > 0 {
 				timer.Reset(diff)
 			} else {
 				logger.Debug("UDP proxy backend timeout", zap.String("addr", c.addr.String()))
@@ -135,6 +138,7 @@ func (c *udpBackendEntry) doListenLoop(proxyClientUDPBackend common.ProxyClientI
 				proxyClientUDPBackend.PutUDPBuffer(buffer)
 				return
 			} else {
+				atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
 				go proxyClientUDPBackend.HandleUDP(buffer, srcAddr, c.addr, dataLen)
 			}
 		}
@@ -0,0 +1,44 @@
+package proxy_client
+
+import (
+	"fmt"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+// computeConeKey is key of full cone flow, which is shared by every destination of client source port
+func computeConeKey(src *net.UDPAddr) string {
+	return fmt.Sprintf("%s->*", src.String())
+}
+
+// parseConeReply returns peer address and header length of datagram from server, nil if header is invalid, domain
+// name is never sent back by server so it is refused instead of resolved
+func parseConeReply(data []byte) (*net.UDPAddr, int) {
+	addr := socks.SplitAddr(data)
+	if addr == nil || addr[0] == socks.AtypDomainName {
+		return nil, 0
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, 0
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, 0
+	}
+	return &net.UDPAddr{IP: net.ParseIP(host), Port: portNum}, len(addr)
+}
+
+func (c *ProxyClient) setUDPFullCone(enable bool) {
+	var value int32
+	if enable {
+		value = 1
+	}
+	atomic.StoreInt32(&c.udpFullCone, value)
+}
+
+func (c *ProxyClient) isUDPFullCone() bool {
+	return atomic.LoadInt32(&c.udpFullCone) == 1
+}
@@ -0,0 +1,28 @@
+package proxy_client
+
+import (
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"net"
+	"testing"
+)
+
+func TestParseConeReply(t *testing.T) {
+	for _, peer := range []string{"1.2.3.4:53", "[2001:db8::1]:443"} {
+		header := socks.ParseAddr(peer)
+		data := append(append([]byte{}, header...), 'x', 'y')
+		addr, headerLen := parseConeReply(data)
+		if addr == nil || addr.String() != peer || headerLen != len(header) {
+			t.Fatalf("parse %s got %v %d", peer, addr, headerLen)
+		}
+	}
+	if addr, _ := parseConeReply(socks.ParseAddr("example.com:53")); addr != nil {
+		t.Fatalf("domain reply accepted: %v", addr)
+	}
+	if addr, _ := parseConeReply([]byte{socks.AtypIPv4, 1, 2}); addr != nil {
+		t.Fatalf("short reply accepted: %v", addr)
+	}
+	src := &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5000}
+	if computeConeKey(src) == computeUDPKey(src, &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 53}) {
+		t.Fatal("cone key collides with flow key")
+	}
+}
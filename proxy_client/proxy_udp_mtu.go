@@ -0,0 +1,64 @@
+package proxy_client
+
+import (
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"sync/atomic"
+)
+
+const (
+	// send oversize datagram anyway and let IP fragment it
+	UDP_OVERSIZE_FRAGMENT = "fragment"
+	// drop oversize datagram, sender sees loss instead of fragments black-holed on the path
+	UDP_OVERSIZE_DROP = "drop"
+
+	// bound of salt plus AEAD tag, also covers IV of stream ciphers
+	UDP_CIPHER_OVERHEAD = 48
+)
+
+func isValidUdpOversize(action string) bool {
+	switch action {
+	// empty is config built without yaml defaults
+	case "", UDP_OVERSIZE_FRAGMENT, UDP_OVERSIZE_DROP:
+		return true
+	}
+	return false
+}
+
+func (c *proxyBackend) setUDPSize(remoteServerConfig config.RemoteServerConfig) {
+	atomic.StoreInt64(&c.maxUdpSize, int64(remoteServerConfig.MaxUdpSize))
+	var drop int32
+	if remoteServerConfig.UdpOversize == UDP_OVERSIZE_DROP {
+		drop = 1
+	}
+	atomic.StoreInt32(&c.udpOversizeDrop, drop)
+}
+
+// udpWireSize is size of datagram sent to server for payload of size, without IP and UDP headers
+func (c *proxyBackend) udpWireSize(size int) int {
+	if c.plaintext {
+		return size
+	}
+	return size + UDP_CIPHER_OVERHEAD
+}
+
+// checkUDPSize tells if datagram with header of size may be sent to server, oversize is logged once per flow
+func (c *proxyBackend) checkUDPSize(entry *udpProxyEntry, size int) bool {
+	maxSize := int(atomic.LoadInt64(&c.maxUdpSize))
+	wireSize := c.udpWireSize(size)
+	if maxSize <= 0 || wireSize <= maxSize {
+		return true
+	}
+	c.relayErrors.add(RELAY_ERROR_OVERSIZE)
+	drop := atomic.LoadInt32(&c.udpOversizeDrop) == 1
+	if logger := log.GetLogger(); logger != nil && atomic.CompareAndSwapInt32(&entry.oversized, 0, 1) {
+		action := UDP_OVERSIZE_FRAGMENT
+		if drop {
+			action = UDP_OVERSIZE_DROP
+		}
+		logger.Warn("UDP datagram exceeds max size to server", zap.String("server", c.getName()), zap.String("client", entry.client),
+			zap.Int("size", wireSize), zap.Int("max", maxSize), zap.String("action", action))
+	}
+	return !drop
+}
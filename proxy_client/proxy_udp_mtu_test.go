@@ -0,0 +1,34 @@
+package proxy_client
+
+import (
+	"github.com/weishi258/redfrog-core/config"
+	"testing"
+)
+
+func TestCheckUDPSize(t *testing.T) {
+	backend := &proxyBackend{}
+	entry := &udpProxyEntry{}
+	backend.setUDPSize(config.RemoteServerConfig{MaxUdpSize: 1472, UdpOversize: UDP_OVERSIZE_DROP})
+	if !backend.checkUDPSize(entry, 1472-UDP_CIPHER_OVERHEAD) {
+		t.Error("datagram fitting max size should pass")
+	}
+	if backend.checkUDPSize(entry, 1473-UDP_CIPHER_OVERHEAD) {
+		t.Error("oversize datagram should be dropped")
+	}
+	backend.plaintext = true
+	if !backend.checkUDPSize(entry, 1472) {
+		t.Error("plaintext datagram has no cipher overhead")
+	}
+
+	backend.setUDPSize(config.RemoteServerConfig{MaxUdpSize: 1472, UdpOversize: UDP_OVERSIZE_FRAGMENT})
+	if !backend.checkUDPSize(entry, 4000) {
+		t.Error("oversize datagram should be sent to be fragmented")
+	}
+	backend.setUDPSize(config.RemoteServerConfig{UdpOversize: UDP_OVERSIZE_DROP})
+	if !backend.checkUDPSize(entry, 4000) {
+		t.Error("zero max size should disable check")
+	}
+	if isValidUdpOversize("split") {
+		t.Error("unknown action should be invalid")
+	}
+}
@@ -0,0 +1,95 @@
+package proxy_client
+
+import (
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"github.com/xtaci/smux"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPRelayTransport(t *testing.T) {
+	log.InitLogger("", "error", false)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	serverConfig := reloadTestServer(listener.Addr().String(), "udp")
+	backend, err := CreateProxyBackend(serverConfig, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Stop()
+	dstAddr := &net.UDPAddr{IP: net.ParseIP("8.8.8.8"), Port: 53}
+
+	transport := func(udpOverTcp bool) string {
+		current := *backend.getConfig()
+		current.UdpOverTcp = udpOverTcp
+		backend.remoteServerConfig.Store(&current)
+		entry, err := backend.createUDPRelayEntry(dstAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer entry.close()
+		return entry.transport
+	}
+	if got := transport(false); got != TRANSPORT_UDP {
+		t.Errorf("expected udp, got %s", got)
+	}
+	if got := transport(true); got != TRANSPORT_TCP {
+		t.Errorf("expected udp over tcp, got %s", got)
+	}
+	backend.muxBackend = StartTCPMuxBackend(config.TcpMuxConfig{Conn: 1, KeepAliveInterval: 10, KeepAliveTimeout: 30}, func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			header := make([]byte, 1)
+			server.Read(header)
+			if mux, err := smux.Server(server, smux.DefaultConfig()); err == nil {
+				for {
+					if _, err := mux.AcceptStream(); err != nil {
+						return
+					}
+				}
+			}
+		}()
+		return client, nil
+	})
+	if got := transport(true); got != TRANSPORT_MUX {
+		t.Errorf("expected udp over mux, got %s", got)
+	}
+	if got := transport(false); got != TRANSPORT_UDP {
+		t.Errorf("mux should not be used without udp-over-tcp, got %s", got)
+	}
+
+	// KCP is tried by udp-over-tcp or kcptun udp only, the one in fallback falls through to udp-over-tcp choice
+	backend.kcpBackend = &KCPBackend{fallbackSince: time.Now().UnixNano()}
+	defer func() {
+		backend.kcpBackend = nil
+	}()
+	for _, c := range []struct {
+		udp, udpOverTcp, expected bool
+	}{{false, false, false}, {true, false, true}, {false, true, true}, {true, true, true}} {
+		current := *backend.getConfig()
+		current.Kcptun.Udp, current.UdpOverTcp = c.udp, c.udpOverTcp
+		backend.remoteServerConfig.Store(&current)
+		if got := backend.udpOverKcp(); got != c.expected {
+			t.Errorf("kcptun udp %v udp-over-tcp %v, expected kcp %v", c.udp, c.udpOverTcp, c.expected)
+		}
+	}
+	if got := transport(false); got != TRANSPORT_UDP {
+		t.Errorf("expected udp after kcp fallback, got %s", got)
+	}
+}
@@ -0,0 +1,196 @@
+package proxy_client
+
+import (
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PLUGIN_START_TIMEOUT  = 5 * time.Second
+	PLUGIN_RESTART_DELAY  = 3 * time.Second
+	PLUGIN_START_INTERVAL = 100 * time.Millisecond
+)
+
+// sip003Plugin runs one SIP003 plugin process, restarting it if it exits
+type sip003Plugin struct {
+	plugin     config.PluginConfig
+	remoteAddr string
+	localAddr  string
+
+	sync.Mutex
+	cmd     *exec.Cmd
+	stopped bool
+}
+
+// pluginChain is plugins linked local to remote, backend dials localAddr of the first one
+type pluginChain struct {
+	plugins   []*sip003Plugin
+	localAddr *net.TCPAddr
+}
+
+// startPluginChain starts plugins from the one facing server, each one's local address is remote of the previous
+func startPluginChain(plugins []config.PluginConfig, remoteServer string) (ret *pluginChain, err error) {
+	ret = &pluginChain{plugins: make([]*sip003Plugin, len(plugins))}
+	remoteAddr := remoteServer
+	for i := len(plugins) - 1; i >= 0; i-- {
+		var localAddr string
+		if localAddr, err = freeLocalAddr(); err != nil {
+			ret.stop()
+			return nil, err
+		}
+		plugin := &sip003Plugin{plugin: plugins[i], remoteAddr: remoteAddr, localAddr: localAddr}
+		if err = plugin.start(); err != nil {
+			ret.stop()
+			return nil, errors.Wrapf(err, "Start plugin %s failed", plugins[i].Plugin)
+		}
+		ret.plugins[i] = plugin
+		go plugin.monitor()
+		remoteAddr = localAddr
+	}
+	if ret.localAddr, err = net.ResolveTCPAddr("tcp", remoteAddr); err != nil {
+		ret.stop()
+		return nil, errors.Wrap(err, "Resolve plugin local address failed")
+	}
+	waitPluginReady(remoteAddr)
+	return ret, nil
+}
+
+func (c *pluginChain) stop() {
+	if c == nil {
+		return
+	}
+	for _, plugin := range c.plugins {
+		if plugin != nil {
+			plugin.stop()
+		}
+	}
+}
+
+// freeLocalAddr picks a loopback port for plugin to listen on, SIP003 needs the port before plugin starts
+func freeLocalAddr() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", errors.Wrap(err, "Pick plugin local port failed")
+	}
+	defer listener.Close()
+	return listener.Addr().String(), nil
+}
+
+// waitPluginReady waits a while for plugin to listen, so the first flows do not fail, but never fails itself
+func waitPluginReady(addr string) {
+	deadline := time.Now().Add(PLUGIN_START_TIMEOUT)
+	for time.Now().Before(deadline) {
+		if conn, err := net.DialTimeout("tcp", addr, PLUGIN_START_INTERVAL); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(PLUGIN_START_INTERVAL)
+	}
+	log.GetLogger().Warn("Plugin is not listening yet", zap.String("addr", addr))
+}
+
+// pluginEnv builds SIP003 environment, plugin listens on local and forwards to remote
+func pluginEnv(remoteAddr string, localAddr string, opts string) ([]string, error) {
+	remoteHost, remotePort, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid plugin remote address")
+	}
+	localHost, localPort, err := net.SplitHostPort(localAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid plugin local address")
+	}
+	return []string{
+		"SS_REMOTE_HOST=" + remoteHost,
+		"SS_REMOTE_PORT=" + remotePort,
+		"SS_LOCAL_HOST=" + localHost,
+		"SS_LOCAL_PORT=" + localPort,
+		"SS_PLUGIN_OPTIONS=" + opts,
+	}, nil
+}
+
+func (c *sip003Plugin) start() error {
+	env, err := pluginEnv(c.remoteAddr, c.localAddr, c.plugin.PluginOpts)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(c.plugin.Plugin)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &pluginLogWriter{plugin: c.plugin.Plugin}
+	cmd.Stderr = cmd.Stdout
+	c.Lock()
+	defer c.Unlock()
+	if c.stopped {
+		return errors.New("Plugin stopped")
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	c.cmd = cmd
+	log.GetLogger().Info("Plugin started", zap.String("plugin", c.plugin.Plugin), zap.String("local", c.localAddr), zap.String("remote", c.remoteAddr),
+		zap.Int("pid", cmd.Process.Pid))
+	return nil
+}
+
+// pluginLogWriter forwards plugin stdout and stderr to our log
+type pluginLogWriter struct {
+	plugin string
+}
+
+func (c *pluginLogWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		log.GetLogger().Debug("Plugin output", zap.String("plugin", c.plugin), zap.String("line", line))
+	}
+	return len(p), nil
+}
+
+// monitor restarts plugin when it exits unexpectedly
+func (c *sip003Plugin) monitor() {
+	for {
+		c.Lock()
+		cmd := c.cmd
+		c.Unlock()
+		err := cmd.Wait()
+		c.Lock()
+		stopped := c.stopped
+		c.Unlock()
+		if stopped {
+			return
+		}
+		exit := "exited"
+		if err != nil {
+			exit = err.Error()
+		}
+		log.GetLogger().Warn("Plugin exited, so restart it", zap.String("plugin", c.plugin.Plugin), zap.String("exit", exit),
+			zap.Duration("delay", PLUGIN_RESTART_DELAY))
+		for {
+			time.Sleep(PLUGIN_RESTART_DELAY)
+			if err = c.start(); err == nil {
+				break
+			}
+			c.Lock()
+			stopped = c.stopped
+			c.Unlock()
+			if stopped {
+				return
+			}
+			log.GetLogger().Error("Restart plugin failed", zap.String("plugin", c.plugin.Plugin), zap.String("error", err.Error()))
+		}
+	}
+}
+
+func (c *sip003Plugin) stop() {
+	c.Lock()
+	defer c.Unlock()
+	c.stopped = true
+	if c.cmd != nil && c.cmd.Process != nil {
+		c.cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,30 @@
+package proxy_client
+
+import (
+	"testing"
+)
+
+func TestPluginEnv(t *testing.T) {
+	env, err := pluginEnv("[2001:db8::1]:8388", "127.0.0.1:10800", "tls;host=example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"SS_REMOTE_HOST=2001:db8::1",
+		"SS_REMOTE_PORT=8388",
+		"SS_LOCAL_HOST=127.0.0.1",
+		"SS_LOCAL_PORT=10800",
+		"SS_PLUGIN_OPTIONS=tls;host=example.com",
+	}
+	if len(env) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, env)
+	}
+	for i := range expected {
+		if env[i] != expected[i] {
+			t.Errorf("expected %s, got %s", expected[i], env[i])
+		}
+	}
+	if _, err = pluginEnv("1.2.3.4", "127.0.0.1:10800", ""); err == nil {
+		t.Error("address without port should fail")
+	}
+}
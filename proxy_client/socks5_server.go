@@ -0,0 +1,180 @@
+package proxy_client
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/weishi258/redfrog-core/common"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	SOCKS5_HANDSHAKE_TIMEOUT = 30 * time.Second
+)
+
+// socks5Server accepts explicit SOCKS5 CONNECT requests and relays them through the same backends as transparent proxy
+type socks5Server struct {
+	listener    net.Listener
+	username    string
+	password    string
+	proxyClient *ProxyClient
+}
+
+func (c *ProxyClient) StartSocks5Server(socks5Config config.Socks5InboundConfig) (err error) {
+	logger := log.GetLogger()
+	server := &socks5Server{username: socks5Config.Username, password: socks5Config.Password, proxyClient: c}
+	if server.listener, err = net.Listen("tcp", socks5Config.ListenAddr); err != nil {
+		return errors.Wrapf(err, "SOCKS5 listen on %s failed", socks5Config.ListenAddr)
+	}
+	c.socks5Server_ = server
+	go server.serve()
+	logger.Info("SOCKS5 inbound start successful", zap.String("addr", socks5Config.ListenAddr), zap.Bool("auth", len(socks5Config.Username) > 0))
+	return nil
+}
+
+func (c *socks5Server) stop() {
+	if err := c.listener.Close(); err != nil {
+		log.GetLogger().Error("Close SOCKS5 listener failed", zap.String("error", err.Error()))
+	}
+}
+
+func (c *socks5Server) serve() {
+	logger := log.GetLogger()
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			if ee, ok := err.(net.Error); ok && ee.Temporary() {
+				continue
+			}
+			logger.Info("SOCKS5 inbound stop listening", zap.String("addr", c.listener.Addr().String()))
+			return
+		}
+		go c.handle(conn)
+	}
+}
+
+func (c *socks5Server) handle(conn net.Conn) {
+	logger := log.GetLogger()
+	defer conn.Close()
+	if !c.proxyClient.acquireClientConn(conn) {
+		return
+	}
+	defer c.proxyClient.releaseClientConn(conn)
+
+	conn.SetDeadline(time.Now().Add(SOCKS5_HANDSHAKE_TIMEOUT))
+	target, err := c.handshake(conn)
+	if err != nil {
+		logger.Debug("SOCKS5 handshake failed", zap.String("src", conn.RemoteAddr().String()), zap.String("error", err.Error()))
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	backendProxy := c.proxyClient.getBackendProxyByTarget(target)
+	if backendProxy == nil {
+		writeSocks5Reply(conn, common.SOCKS5_REPLY_FAILURE)
+		logger.Error("Can not get backend proxy")
+		return
+	}
+	// reply before connecting backend, the same as shadowsocks local, failure shows up as closed connection
+	if err = writeSocks5Reply(conn, common.SOCKS5_REPLY_SUCCEEDED); err != nil {
+		return
+	}
+	start := time.Now()
+	transport, inboundSize, outboundSize, err := backendProxy.RelayTCPDataTo(c.proxyClient.limitConn(conn), target)
+	c.proxyClient.accountTraffic(conn, trafficHost(target.String()), inboundSize, outboundSize)
+	c.proxyClient.logRelay(&relayRecord{network: "tcp", src: conn.RemoteAddr().String(), dst: target.String(),
+		backend: backendProxy, transport: transport, start: start, inbound: inboundSize, outbound: outboundSize, err: err})
+	if err != nil {
+		if ee, ok := err.(net.Error); !ok || !ee.Timeout() {
+			logger.Error("Relay SOCKS5 failed", zap.String("target", target.String()), zap.String("error", err.Error()))
+		}
+	} else {
+		logger.Debug("Relay SOCKS5 successful", zap.String("target", target.String()), zap.Int64("outbound", outboundSize), zap.Int64("inbound", inboundSize))
+	}
+}
+
+// handshake negotiates auth method and reads CONNECT request as RFC 1928, returns target address
+func (c *socks5Server) handshake(conn net.Conn) (socks.Addr, error) {
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, errors.Wrap(err, "Read greeting failed")
+	}
+	if buf[0] != common.SOCKS5_VERSION {
+		return nil, errors.New(fmt.Sprintf("SOCKS version %d not supported", buf[0]))
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, errors.Wrap(err, "Read auth methods failed")
+	}
+	method := byte(common.SOCKS5_AUTH_NONE)
+	if len(c.username) > 0 {
+		method = common.SOCKS5_AUTH_PASSWORD
+	}
+	accepted := false
+	for _, m := range methods {
+		if m == method {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		conn.Write([]byte{common.SOCKS5_VERSION, common.SOCKS5_AUTH_NO_ACCEPT})
+		return nil, errors.New("No acceptable auth method")
+	}
+	if _, err := conn.Write([]byte{common.SOCKS5_VERSION, method}); err != nil {
+		return nil, errors.Wrap(err, "Write auth method failed")
+	}
+	if method == common.SOCKS5_AUTH_PASSWORD {
+		if err := c.authenticate(conn, buf); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+		return nil, errors.Wrap(err, "Read request failed")
+	}
+	target, err := socks.ReadAddr(conn)
+	if err != nil {
+		writeSocks5Reply(conn, common.SOCKS5_REPLY_HOST_UNREACHABLE)
+		return nil, errors.Wrap(err, "Read target address failed")
+	}
+	if buf[1] != common.SOCKS5_CMD_CONNECT {
+		writeSocks5Reply(conn, common.SOCKS5_REPLY_CMD_NOT_SUPPORTED)
+		return nil, errors.New(fmt.Sprintf("SOCKS5 command %d not supported", buf[1]))
+	}
+	return target, nil
+}
+
+func (c *socks5Server) authenticate(conn net.Conn, buf []byte) error {
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return errors.Wrap(err, "Read auth failed")
+	}
+	username := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return errors.Wrap(err, "Read auth username failed")
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return errors.Wrap(err, "Read auth failed")
+	}
+	password := make([]byte, buf[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return errors.Wrap(err, "Read auth password failed")
+	}
+	if subtle.ConstantTimeCompare(username, []byte(c.username)) != 1 || subtle.ConstantTimeCompare(password, []byte(c.password)) != 1 {
+		conn.Write([]byte{common.SOCKS5_AUTH_PASSWORD_V1, 1})
+		return errors.New(fmt.Sprintf("Auth failed for user %s", string(username)))
+	}
+	_, err := conn.Write([]byte{common.SOCKS5_AUTH_PASSWORD_V1, 0})
+	return err
+}
+
+func writeSocks5Reply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{common.SOCKS5_VERSION, reply, 0, socks.AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
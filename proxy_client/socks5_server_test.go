@@ -0,0 +1,65 @@
+package proxy_client
+
+import (
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSocks5Handshake(t *testing.T) {
+	server := &socks5Server{username: "user", password: "pass"}
+	client, conn := net.Pipe()
+	defer client.Close()
+	defer conn.Close()
+
+	done := make(chan socks.Addr)
+	go func() {
+		target, err := server.handshake(conn)
+		if err != nil {
+			t.Errorf("handshake failed: %s", err.Error())
+		}
+		done <- target
+	}()
+
+	reply := make([]byte, 2)
+	client.Write([]byte{5, 2, 0, 2})
+	io.ReadFull(client, reply)
+	if reply[1] != 2 {
+		t.Fatalf("server should choose password auth, got %d", reply[1])
+	}
+	client.Write([]byte{1, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'})
+	io.ReadFull(client, reply)
+	if reply[1] != 0 {
+		t.Fatalf("auth should succeed, got %d", reply[1])
+	}
+	client.Write(append([]byte{5, 1, 0}, socks.ParseAddr("www.example.com:443")...))
+	if target := <-done; target.String() != "www.example.com:443" {
+		t.Errorf("target got %s", target.String())
+	}
+}
+
+func TestSocks5HandshakeAuthRejected(t *testing.T) {
+	server := &socks5Server{username: "user", password: "pass"}
+	client, conn := net.Pipe()
+	defer client.Close()
+	defer conn.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := server.handshake(conn)
+		done <- err
+	}()
+
+	reply := make([]byte, 2)
+	client.Write([]byte{5, 1, 2})
+	io.ReadFull(client, reply)
+	client.Write([]byte{1, 4, 'u', 's', 'e', 'r', 5, 'w', 'r', 'o', 'n', 'g'})
+	io.ReadFull(client, reply)
+	if reply[1] == 0 {
+		t.Errorf("wrong password should be rejected")
+	}
+	if err := <-done; err == nil {
+		t.Errorf("handshake should fail")
+	}
+}
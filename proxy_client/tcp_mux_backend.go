@@ -0,0 +1,92 @@
+package proxy_client
+
+import (
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/common"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"github.com/xtaci/smux"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"time"
+)
+
+// TCPMuxBackend carries flows as smux streams over a few long lived shadowsocks TCP connections
+type TCPMuxBackend struct {
+	sync.Mutex
+	smuxConfig *smux.Config
+	dial       func() (net.Conn, error)
+	sessions   []*smux.Session
+	connCount  int
+}
+
+func StartTCPMuxBackend(muxConfig config.TcpMuxConfig, dial func() (net.Conn, error)) *TCPMuxBackend {
+	ret := &TCPMuxBackend{dial: dial, sessions: make([]*smux.Session, muxConfig.Conn)}
+	ret.smuxConfig = smux.DefaultConfig()
+	ret.smuxConfig.KeepAliveInterval = time.Duration(muxConfig.KeepAliveInterval) * time.Second
+	ret.smuxConfig.KeepAliveTimeout = time.Duration(muxConfig.KeepAliveTimeout) * time.Second
+	return ret
+}
+
+func (c *TCPMuxBackend) createSession() (*smux.Session, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, errors.Wrap(err, "Mux dial server failed")
+	}
+	// header tells server the rest of this connection is a smux session
+	if _, err = conn.Write([]byte{common.AtTypeMux}); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "Mux write header failed")
+	}
+	sess, err := smux.Client(conn, c.smuxConfig)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "Mux create smux client failed")
+	}
+	return sess, nil
+}
+
+// getSession returns session of next slot, closed session is replaced, so a dead server costs one dial per flow
+func (c *TCPMuxBackend) getSession() (*smux.Session, error) {
+	c.Lock()
+	defer c.Unlock()
+	idx := c.connCount % len(c.sessions)
+	c.connCount++
+	if sess := c.sessions[idx]; sess != nil && !sess.IsClosed() {
+		return sess, nil
+	}
+	sess, err := c.createSession()
+	if err != nil {
+		return nil, err
+	}
+	c.sessions[idx] = sess
+	return sess, nil
+}
+
+func (c *TCPMuxBackend) GetMuxConn() (*smux.Stream, error) {
+	sess, err := c.getSession()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := sess.OpenStream()
+	if err != nil {
+		sess.Close()
+		return nil, errors.Wrap(err, "Mux open stream failed")
+	}
+	return stream, nil
+}
+
+func (c *TCPMuxBackend) Stop() {
+	logger := log.GetLogger()
+	c.Lock()
+	defer c.Unlock()
+	for idx, sess := range c.sessions {
+		if sess != nil {
+			if err := sess.Close(); err != nil {
+				logger.Error("Mux close session failed", zap.String("error", err.Error()))
+			}
+			c.sessions[idx] = nil
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package proxy_client
+
+import (
+	"github.com/weishi258/redfrog-core/common"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/xtaci/smux"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestTCPMuxBackend(t *testing.T) {
+	dialed := 0
+	received := make(chan string, 2)
+	backend := StartTCPMuxBackend(config.TcpMuxConfig{Conn: 1, KeepAliveInterval: 10, KeepAliveTimeout: 30}, func() (net.Conn, error) {
+		dialed++
+		client, server := net.Pipe()
+		go func() {
+			header := make([]byte, 1)
+			if _, err := io.ReadFull(server, header); err != nil || header[0] != common.AtTypeMux {
+				server.Close()
+				return
+			}
+			mux, err := smux.Server(server, smux.DefaultConfig())
+			if err != nil {
+				return
+			}
+			for {
+				stream, err := mux.AcceptStream()
+				if err != nil {
+					return
+				}
+				buffer := make([]byte, 5)
+				io.ReadFull(stream, buffer)
+				received <- string(buffer)
+			}
+		}()
+		return client, nil
+	})
+	defer backend.Stop()
+
+	for _, data := range []string{"hello", "world"} {
+		stream, err := backend.GetMuxConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Write([]byte(data))
+		if got := <-received; got != data {
+			t.Errorf("stream data got %q", got)
+		}
+	}
+	if dialed != 1 {
+		t.Errorf("streams should share one connection, dialed %d", dialed)
+	}
+}
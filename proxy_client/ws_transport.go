@@ -0,0 +1,56 @@
+package proxy_client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/config"
+	"golang.org/x/net/websocket"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	WEBSOCKET_HANDSHAKE_TIMEOUT = 10 * time.Second
+)
+
+// dialWebsocket upgrades conn dialed to remote server into WebSocket, with TLS first if configured
+func dialWebsocket(conn net.Conn, wsConfig config.WebsocketConfig, addr string) (ret net.Conn, err error) {
+	host := wsConfig.Host
+	if len(host) == 0 {
+		host = addr
+	}
+	path := wsConfig.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	scheme, origin := "ws", "http"
+	conn.SetDeadline(time.Now().Add(WEBSOCKET_HANDSHAKE_TIMEOUT))
+	if wsConfig.Tls {
+		sni := wsConfig.Sni
+		if len(sni) == 0 {
+			sni, _, err = net.SplitHostPort(host)
+			if err != nil {
+				sni = host
+			}
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: sni, InsecureSkipVerify: wsConfig.Insecure})
+		if err = tlsConn.Handshake(); err != nil {
+			return nil, errors.Wrap(err, "TLS handshake failed")
+		}
+		conn = tlsConn
+		scheme, origin = "wss", "https"
+	}
+	wsConfigure, err := websocket.NewConfig(fmt.Sprintf("%s://%s%s", scheme, host, path), fmt.Sprintf("%s://%s/", origin, host))
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid websocket url")
+	}
+	wsConn, err := websocket.NewClient(wsConfigure, conn)
+	if err != nil {
+		return nil, errors.Wrap(err, "Websocket handshake failed")
+	}
+	wsConn.PayloadType = websocket.BinaryFrame
+	conn.SetDeadline(time.Time{})
+	return wsConn, nil
+}
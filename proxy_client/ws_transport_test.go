@@ -0,0 +1,43 @@
+package proxy_client
+
+import (
+	"github.com/weishi258/redfrog-core/config"
+	"golang.org/x/net/websocket"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDialWebsocket(t *testing.T) {
+	handler := http.NewServeMux()
+	handler.Handle("/ss", websocket.Server{Handler: func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		io.Copy(ws, ws)
+	}})
+	for _, isTls := range []bool{false, true} {
+		var server *httptest.Server
+		if isTls {
+			server = httptest.NewTLSServer(handler)
+		} else {
+			server = httptest.NewServer(handler)
+		}
+		addr := server.Listener.Addr().String()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wsConn, err := dialWebsocket(conn, config.WebsocketConfig{Host: "example.com", Path: "ss", Tls: isTls, Insecure: true}, addr)
+		if err != nil {
+			t.Fatalf("dial websocket tls %t failed: %s", isTls, err.Error())
+		}
+		wsConn.Write([]byte("hello"))
+		buffer := make([]byte, 5)
+		if _, err = io.ReadFull(wsConn, buffer); err != nil || string(buffer) != "hello" {
+			t.Errorf("echo over websocket tls %t got %q %v", isTls, buffer, err)
+		}
+		wsConn.Close()
+		server.Close()
+	}
+}
@@ -17,6 +17,7 @@ import (
 
 type KCPServer struct {
 	config         config.KcptunConfig
+	smuxConfig     *smux.Config
 	cipher         kcp.AheadCipher
 	listener       *kcp.Listener
 	tcpTimeout     time.Duration
@@ -36,6 +37,9 @@ func StartKCPServer(config config.KcptunConfig, crypt string, password string, u
 	ret.tcpTimeout = time.Second * time.Duration(tcpTimeoutValue)
 	ret.udpTimeout = time.Second * time.Duration(udpTimeoutValue)
 	ret.udpLeakyBuffer = udpLeakyBuffer
+	if ret.smuxConfig, err = kcp_helper.GetSmuxConfig(config); err != nil {
+		return
+	}
 
 	if ret.cipher, err = kcp_helper.GetCipher(crypt, password); err != nil {
 		err = errors.Wrap(err, "Create Kcp cipher failed")
@@ -99,12 +103,7 @@ func (c *KCPServer) startAccept() {
 func (c *KCPServer) handleConnection(conn io.ReadWriteCloser) {
 	logger := log.GetLogger()
 
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.MaxReceiveBuffer = c.config.Sockbuf
-	smuxConfig.KeepAliveInterval = time.Duration(c.config.KeepAliveInterval) * time.Second
-	smuxConfig.KeepAliveTimeout = time.Duration(c.config.KeepAliveTimeout) * time.Second
-
-	mux, err := smux.Server(conn, smuxConfig)
+	mux, err := smux.Server(conn, c.smuxConfig)
 	if err != nil {
 		logger.Error("Kcp server mux failed", zap.String("error", err.Error()))
 		return
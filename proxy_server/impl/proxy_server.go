@@ -8,9 +8,12 @@ import (
 	"github.com/weishi258/redfrog-core/common"
 	"github.com/weishi258/redfrog-core/config"
 	"github.com/weishi258/redfrog-core/log"
+	"github.com/xtaci/smux"
 	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
 	"io"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 )
@@ -26,6 +29,7 @@ type ProxyServer struct {
 	udpLeakyBuffer *common.LeakyBuffer
 	udpNatMap_     *udpNatMap
 	kcpServer      *KCPServer
+	wsServer       *http.Server
 }
 
 type res struct {
@@ -94,6 +98,14 @@ func StartProxyServer(config config.ServerConfig) (ret *ProxyServer, err error)
 		err = errors.Wrap(err, "UDP listener start failed")
 		return
 	}
+	if config.Websocket.Enable {
+		if err = ret.startWebsocketListener(config.Websocket); err != nil {
+			ret.tcpListener_.Close()
+			ret.udpListener_.Close()
+			err = errors.Wrap(err, "Websocket listener start failed")
+			return
+		}
+	}
 	//
 	if config.Kcptun.Enable {
 		if ret.kcpServer, err = StartKCPServer(config.Kcptun, config.Crypt, config.Password, ret.udpLeakyBuffer, config.TcpTimeout, config.UdpTimeout); err != nil {
@@ -119,6 +131,11 @@ func (c *ProxyServer) Stop() {
 	if c.kcpServer != nil {
 		c.kcpServer.Stop()
 	}
+	if c.wsServer != nil {
+		if err := c.wsServer.Close(); err != nil {
+			logger.Error("ProxyServer stop websocket failed", zap.String("listenAddr", c.listenAddr), zap.String("error", err.Error()))
+		}
+	}
 	logger.Info("ProxyServer stopped", zap.String("listenAddr", c.listenAddr))
 
 }
@@ -216,11 +233,33 @@ func (c *ProxyServer) handleUDPOverTCP(conn net.Conn, dstAddrBytes socks.Addr) {
 }
 
 func (c *ProxyServer) handleTCP(conn net.Conn) {
-	logger := log.GetLogger()
 	defer conn.Close()
 
 	conn.(*net.TCPConn).SetKeepAlive(true)
-	conn = c.cipher.StreamConn(conn)
+	c.handleStream(c.cipher.StreamConn(conn))
+}
+
+func (c *ProxyServer) startWebsocketListener(wsConfig config.ServerWebsocketConfig) (err error) {
+	logger := log.GetLogger()
+	var listener net.Listener
+	if listener, err = net.Listen("tcp", wsConfig.ListenAddr); err != nil {
+		return errors.Wrap(err, "Websocket listen failed")
+	}
+	mux := http.NewServeMux()
+	mux.Handle(wsConfig.Path, websocket.Server{Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+		ws.PayloadType = websocket.BinaryFrame
+		c.handleStream(c.cipher.StreamConn(ws))
+	}})
+	c.wsServer = &http.Server{Handler: mux}
+	go c.wsServer.Serve(listener)
+	logger.Info("Websocket Listener started", zap.String("listenAddr", wsConfig.ListenAddr), zap.String("path", wsConfig.Path))
+	return
+}
+
+// handleStream serves decrypted shadowsocks stream from plain TCP or WebSocket
+func (c *ProxyServer) handleStream(conn net.Conn) {
+	logger := log.GetLogger()
 	//conn.SetWriteDeadline(time.Now().Add(c.tcpTimeout_))
 
 	isUDP, dstAddr, err := common.ReadShadowsocksHeader(conn)
@@ -228,6 +267,44 @@ func (c *ProxyServer) handleTCP(conn net.Conn) {
 		logger.Error("TCP read dst addr failed", zap.String("error", err.Error()))
 		return
 	}
+	if len(dstAddr) == 1 && dstAddr[0] == common.AtTypeMux {
+		c.handleMux(conn)
+		return
+	}
+	c.relay(conn, isUDP, dstAddr)
+}
+
+// handleMux serves smux session from client tcp-mux, keep alive should match client defaults
+func (c *ProxyServer) handleMux(conn net.Conn) {
+	logger := log.GetLogger()
+	mux, err := smux.Server(conn, smux.DefaultConfig())
+	if err != nil {
+		logger.Error("Mux create smux server failed", zap.String("error", err.Error()))
+		return
+	}
+	defer mux.Close()
+	for {
+		stream, err := mux.AcceptStream()
+		if err != nil {
+			logger.Debug("Mux session closed", zap.String("error", err.Error()))
+			return
+		}
+		go c.handleMuxStream(stream)
+	}
+}
+
+func (c *ProxyServer) handleMuxStream(stream *smux.Stream) {
+	defer stream.Close()
+	isUDP, dstAddr, err := common.ReadShadowsocksHeader(stream)
+	if err != nil {
+		log.GetLogger().Error("Mux read dst addr failed", zap.String("error", err.Error()))
+		return
+	}
+	c.relay(stream, isUDP, dstAddr)
+}
+
+func (c *ProxyServer) relay(conn net.Conn, isUDP bool, dstAddr socks.Addr) {
+	logger := log.GetLogger()
 	if isUDP {
 		c.handleUDPOverTCP(conn, dstAddr)
 	} else {
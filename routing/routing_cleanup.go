@@ -0,0 +1,87 @@
+package routing
+
+import (
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/ipset"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"os"
+	"strings"
+)
+
+// all ipsets of redfrog share this prefix, including temporary ones of refresh
+const IPSET_RED_FROG_PREFIX = "RED_FROG_IPSET_"
+
+// chains of redfrog in mangle table, in the order they can be deleted, a chain is gone before those it jumps to
+var redFrogChains = []string{CHAIN_RED_FROG, CHAIN_DIVERT, CHAIN_TPROXY}
+
+// cleanupOrphanChains removes chains and PREROUTING jumps of family left by a run which did not stop cleanly, so
+// restarts converge to one set of rules, orphans are flushed rather than adopted since learned ips come back from
+// routing cache
+func (c *RoutingMgr) cleanupOrphanChains(iptbl iptablesHandler) error {
+	logger := log.GetLogger()
+	chains, err := iptbl.ListChains(TABLE_MANGLE)
+	if err != nil {
+		return errors.Wrapf(err, "List chains of %s failed", TABLE_MANGLE)
+	}
+	existing := make(map[string]bool)
+	for _, chain := range chains {
+		existing[chain] = true
+	}
+	if err = c.deletePrerouting(iptbl); err != nil {
+		return err
+	}
+	for _, chain := range redFrogChains {
+		if !existing[chain] {
+			continue
+		}
+		logger.Info("Orphaned chain removed", zap.String("table", TABLE_MANGLE), zap.String("chain", chain))
+		if err = iptbl.FlushChain(TABLE_MANGLE, chain); err != nil {
+			return errors.Wrapf(err, "Flush orphaned chain %s failed", chain)
+		}
+	}
+	// chains jump to each other, so none can be deleted before all are flushed
+	for _, chain := range redFrogChains {
+		if existing[chain] {
+			if err = iptbl.DeleteChain(TABLE_MANGLE, chain); err != nil {
+				return errors.Wrapf(err, "Delete orphaned chain %s failed", chain)
+			}
+		}
+	}
+	return nil
+}
+
+// cleanupOrphanIPSets destroys ipsets and BPF maps of redfrog, chains referencing them have to be gone already, sets of a type
+// changed since last run could not be created otherwise
+func (c *RoutingMgr) cleanupOrphanIPSets() {
+	logger := log.GetLogger()
+	if c.dryRun {
+		logDryRun("ipset destroy every set prefixed " + IPSET_RED_FROG_PREFIX)
+		logDryRun("rm -r " + BPF_PIN_DIR)
+		return
+	}
+	// BPF maps are freed with their pins once chains referencing their programs are gone
+	if _, err := os.Stat(BPF_PIN_DIR); err == nil {
+		if err = os.RemoveAll(BPF_PIN_DIR); err != nil {
+			logger.Warn("Remove orphaned BPF pins failed", zap.String("dir", BPF_PIN_DIR), zap.String("error", err.Error()))
+		} else {
+			logger.Info("Orphaned BPF pins removed", zap.String("dir", BPF_PIN_DIR))
+		}
+	}
+	names, err := ipset.ListNames()
+	if err != nil {
+		// nothing to clean without ipset
+		logger.Debug("List ipsets failed", zap.String("error", err.Error()))
+		return
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, IPSET_RED_FROG_PREFIX) {
+			continue
+		}
+		if err = ipset.DestroyByName(name); err != nil {
+			logger.Warn("Destroy orphaned ipset failed", zap.String("name", name), zap.String("error", err.Error()))
+		} else {
+			logger.Info("Orphaned ipset removed", zap.String("name", name))
+		}
+	}
+}
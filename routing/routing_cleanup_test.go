@@ -0,0 +1,59 @@
+package routing
+
+import (
+	"github.com/weishi258/redfrog-core/log"
+	"reflect"
+	"testing"
+)
+
+// recordIPTables answers listing with rules of a crashed run and records changes
+type recordIPTables struct {
+	dryRunIPTables
+	chains     []string
+	prerouting []string
+	ops        []string
+}
+
+func (c *recordIPTables) ListChains(table string) ([]string, error) {
+	return c.chains, nil
+}
+
+func (c *recordIPTables) List(table, chain string) ([]string, error) {
+	return c.prerouting, nil
+}
+
+func (c *recordIPTables) Delete(table, chain string, rulespec ...string) error {
+	c.ops = append(c.ops, "-D "+chain)
+	return nil
+}
+
+func (c *recordIPTables) FlushChain(table, chain string) error {
+	c.ops = append(c.ops, "-F "+chain)
+	return nil
+}
+
+func (c *recordIPTables) DeleteChain(table, chain string) error {
+	c.ops = append(c.ops, "-X "+chain)
+	return nil
+}
+
+func TestCleanupOrphanChains(t *testing.T) {
+	log.InitLogger("", "error", false)
+	iptbl := &recordIPTables{
+		chains:     []string{"PREROUTING", "INPUT", CHAIN_TPROXY, CHAIN_RED_FROG},
+		prerouting: []string{"-P PREROUTING ACCEPT", "-A PREROUTING -p tcp -j RED_FROG", "-A PREROUTING -p udp -j OTHER"},
+	}
+	mgr := &RoutingMgr{}
+	if err := mgr.cleanupOrphanChains(iptbl); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"-D PREROUTING", "-F " + CHAIN_RED_FROG, "-F " + CHAIN_TPROXY, "-X " + CHAIN_RED_FROG, "-X " + CHAIN_TPROXY}
+	if !reflect.DeepEqual(iptbl.ops, expected) {
+		t.Errorf("got %v, expected %v", iptbl.ops, expected)
+	}
+
+	clean := &recordIPTables{chains: []string{"PREROUTING"}}
+	if err := mgr.cleanupOrphanChains(clean); err != nil || len(clean.ops) != 0 {
+		t.Errorf("clean start should change nothing, got %v %v", clean.ops, err)
+	}
+}
@@ -0,0 +1,209 @@
+package routing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"io"
+	"math/bits"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// country of APNIC delegated records taken into direct list
+const DIRECT_COUNTRY = "CN"
+
+// ipRange is an inclusive range of 16 byte addresses, ipv4 is kept in its ipv6 mapped form
+type ipRange struct {
+	start net.IP
+	end   net.IP
+}
+
+// directTable holds sorted and merged ranges of direct list for lookup
+type directTable []ipRange
+
+func newDirectTable(nets []*net.IPNet) directTable {
+	ret := make(directTable, 0, len(nets))
+	for _, ipNet := range nets {
+		start := ipNet.IP.To16()
+		end := make(net.IP, len(start))
+		copy(end, start)
+		mask := ipNet.Mask
+		if len(mask) == net.IPv4len {
+			// mapped prefix of ipv4 is not part of mask
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range end {
+			end[i] |= ^mask[i]
+		}
+		ret = append(ret, ipRange{start, end})
+	}
+	sort.Slice(ret, func(i, j int) bool { return bytes.Compare(ret[i].start, ret[j].start) < 0 })
+	merged := ret[:0]
+	for _, r := range ret {
+		if last := len(merged) - 1; last >= 0 && bytes.Compare(r.start, merged[last].end) <= 0 {
+			if bytes.Compare(r.end, merged[last].end) > 0 {
+				merged[last].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func (c directTable) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	i := sort.Search(len(c), func(i int) bool { return bytes.Compare(c[i].end, ip) >= 0 })
+	return i < len(c) && bytes.Compare(c[i].start, ip) <= 0
+}
+
+// parseDirectList reads CIDR per line, as chnroute lists are, or APNIC delegated records of DIRECT_COUNTRY, invalid
+// lines are skipped
+func parseDirectList(reader io.Reader) (ret []*net.IPNet, err error) {
+	logger := log.GetLogger()
+	scanner := bufio.NewScanner(reader)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		if strings.Contains(line, "|") {
+			nets, ok := parseDelegatedRecord(line)
+			if !ok {
+				logger.Debug("Skip direct list record", zap.Int("line", lineNum), zap.String("record", line))
+			}
+			ret = append(ret, nets...)
+			continue
+		}
+		if ip := net.ParseIP(line); ip != nil {
+			bitLen := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bitLen = ip4, 8*net.IPv4len
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bitLen, bitLen)})
+		} else if _, ipNet, parseErr := net.ParseCIDR(line); parseErr == nil {
+			ret = append(ret, ipNet)
+		} else {
+			logger.Warn("Invalid direct list line", zap.Int("line", lineNum), zap.String("content", line))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		err = errors.Wrap(err, "Read direct list failed")
+	}
+	return
+}
+
+// parseDelegatedRecord parses "apnic|CN|ipv4|1.0.1.0|256|20110414|allocated", ok is false for records of other
+// countries, summaries and header
+func parseDelegatedRecord(record string) (ret []*net.IPNet, ok bool) {
+	fields := strings.Split(record, "|")
+	if len(fields) < 7 || fields[1] != DIRECT_COUNTRY || (fields[6] != "allocated" && fields[6] != "assigned") {
+		return nil, false
+	}
+	ip := net.ParseIP(fields[3])
+	count, err := strconv.ParseUint(fields[4], 10, 64)
+	if ip == nil || err != nil || count == 0 {
+		return nil, false
+	}
+	switch fields[2] {
+	case "ipv6":
+		// value of ipv6 record is prefix length
+		if ip.To4() != nil || count > 128 {
+			return nil, false
+		}
+		return []*net.IPNet{{IP: ip.Mask(net.CIDRMask(int(count), 128)), Mask: net.CIDRMask(int(count), 128)}}, true
+	case "ipv4":
+		// value of ipv4 record is address count, which is not always a power of 2
+		ip4 := ip.To4()
+		if ip4 == nil || count > 1<<32 {
+			return nil, false
+		}
+		start := uint64(binary.BigEndian.Uint32(ip4))
+		end := start + count
+		if end > 1<<32 {
+			return nil, false
+		}
+		for start < end {
+			size := uint(bits.TrailingZeros64(start | 1<<32))
+			for uint64(1)<<size > end-start {
+				size--
+			}
+			netIP := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(netIP, uint32(start))
+			ret = append(ret, &net.IPNet{IP: netIP, Mask: net.CIDRMask(32-int(size), 32)})
+			start += 1 << size
+		}
+		return ret, true
+	}
+	return nil, false
+}
+
+// LoadDirectList loads CIDR list whose destinations are never intercepted, even when DNS answers of proxied domain
+// point there, empty path clears it
+func (c *RoutingMgr) LoadDirectList(path string) (err error) {
+	logger := log.GetLogger()
+	var nets []*net.IPNet
+	if len(path) > 0 {
+		if c.directSetV4 == nil || c.directSetV6 == nil {
+			return errors.New("Direct list requires ipset or ebpf")
+		}
+		file, openErr := os.Open(config.GetPathFromWorkingDir(path))
+		if openErr != nil {
+			return errors.Wrapf(openErr, "Open direct list %s failed", path)
+		}
+		nets, err = parseDirectList(file)
+		file.Close()
+		if err != nil {
+			return
+		}
+	}
+
+	entriesV4 := make([]string, 0, len(nets))
+	entriesV6 := make([]string, 0)
+	for _, ipNet := range nets {
+		if ipNet.IP.To4() != nil {
+			entriesV4 = append(entriesV4, ipNet.String())
+		} else {
+			entriesV6 = append(entriesV6, ipNet.String())
+		}
+	}
+	if c.directSetV4 != nil {
+		if err = c.directSetV4.Refresh(entriesV4); err != nil {
+			return errors.Wrapf(err, "Refresh %s failed", IPSET_RED_FROG_DIRECT_V4)
+		}
+	}
+	if c.directSetV6 != nil {
+		if err = c.directSetV6.Refresh(entriesV6); err != nil {
+			return errors.Wrapf(err, "Refresh %s failed", IPSET_RED_FROG_DIRECT_V6)
+		}
+	}
+
+	table := newDirectTable(nets)
+	c.Lock()
+	c.direct = table
+	c.Unlock()
+	if len(path) > 0 {
+		logger.Info("Direct list loaded", zap.String("file", path), zap.Int("ipv4", len(entriesV4)), zap.Int("ipv6", len(entriesV6)))
+	}
+	return nil
+}
+
+// IsDirectIP tells whether ip is in direct list
+func (c *RoutingMgr) IsDirectIP(ip net.IP) bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.direct.contains(ip)
+}
@@ -0,0 +1,55 @@
+package routing
+
+import (
+	"github.com/weishi258/redfrog-core/log"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseDirectList(t *testing.T) {
+	log.InitLogger("", "error", false)
+	list := `# chnroute
+1.0.1.0/24
+1.0.2.0/23
+223.5.5.5
+240e::/20
+not-an-ip
+apnic|CN|ipv4|1.0.8.0|768|20110414|allocated
+apnic|JP|ipv4|1.0.16.0|4096|20110412|allocated
+apnic|CN|ipv6|2001:250::|35|20000426|allocated
+apnic|*|ipv4|*|43839|summary
+`
+	nets, err := parseDirectList(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(nets))
+	for _, ipNet := range nets {
+		got = append(got, ipNet.String())
+	}
+	// 768 addresses are not a power of 2
+	expected := "1.0.1.0/24,1.0.2.0/23,223.5.5.5/32,240e::/20,1.0.8.0/23,1.0.10.0/24,2001:250::/35"
+	if strings.Join(got, ",") != expected {
+		t.Errorf("got %s, expected %s", strings.Join(got, ","), expected)
+	}
+
+	table := newDirectTable(nets)
+	for ip, expected := range map[string]bool{
+		"1.0.1.1":        true,
+		"1.0.3.255":      true,
+		"1.0.4.0":        false,
+		"1.0.10.200":     true,
+		"1.0.16.1":       false,
+		"223.5.5.5":      true,
+		"223.5.5.4":      false,
+		"240e:1::1":      true,
+		"2001:250::1":    true,
+		"2001:251::1":    false,
+		"::ffff:1.0.1.1": true,
+	} {
+		if table.contains(net.ParseIP(ip)) != expected {
+			t.Errorf("contains(%s) should be %v", ip, expected)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package routing
+
+import (
+	"fmt"
+	"github.com/weishi258/go-iptables/iptables"
+	"github.com/weishi258/redfrog-core/ipset"
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"strings"
+)
+
+// iptablesHandler is what routing manager does to iptables, dry run logs it instead
+type iptablesHandler interface {
+	ClearChain(table, chain string) error
+	Append(table, chain string, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+	FlushChain(table, chain string) error
+	DeleteChain(table, chain string) error
+	List(table, chain string) ([]string, error)
+	ListChains(table string) ([]string, error)
+}
+
+// ipSetHandler is what routing manager does to an ipset, dry run logs it instead
+type ipSetHandler interface {
+	Add(entry string, timeout int) error
+	AddList(entries []string, timeout int) error
+	Del(entry string) error
+	DelList(entries []string) error
+	Refresh(entries []string) error
+	Destroy() error
+}
+
+func logDryRun(op string) {
+	log.GetLogger().Info("Routing dry run", zap.String("op", op))
+}
+
+// newIPTables returns handler of family, which only logs operations in dry run
+func (c *RoutingMgr) newIPTables(isIPv6 bool) (iptablesHandler, error) {
+	if c.dryRun {
+		command := "iptables"
+		if isIPv6 {
+			command = "ip6tables"
+		}
+		return &dryRunIPTables{command: command}, nil
+	}
+	if isIPv6 {
+		return iptables.NewWithProtocol(iptables.ProtocolIPv6)
+	}
+	return iptables.New()
+}
+
+// newIPSet creates set, or BPF map in ebpf mode, nil handler is returned with error so caller falls back to iptables
+// rules
+func (c *RoutingMgr) newIPSet(name string, hashType string, family string) (ipSetHandler, error) {
+	if c.dryRun {
+		logDryRun(fmt.Sprintf("ipset create %s %s family %s -exist", name, hashType, family))
+		return &dryRunIPSet{name: name}, nil
+	}
+	if c.ebpf {
+		set, err := newBPFSet(name, family == "inet6")
+		if err != nil {
+			return nil, err
+		}
+		return set, nil
+	}
+	set, err := ipset.New(name, hashType, &ipset.Params{Timeout: 0, HashFamily: family, MaxElem: 4294967295})
+	if err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+type dryRunIPTables struct {
+	command string
+}
+
+func (c *dryRunIPTables) log(table string, action string, chain string, rulespec []string) {
+	op := fmt.Sprintf("%s -t %s %s %s", c.command, table, action, chain)
+	if len(rulespec) > 0 {
+		op += " " + strings.Join(rulespec, " ")
+	}
+	logDryRun(op)
+}
+
+func (c *dryRunIPTables) ClearChain(table, chain string) error {
+	c.log(table, "-N", chain, nil)
+	c.log(table, "-F", chain, nil)
+	return nil
+}
+
+func (c *dryRunIPTables) Append(table, chain string, rulespec ...string) error {
+	c.log(table, "-A", chain, rulespec)
+	return nil
+}
+
+func (c *dryRunIPTables) Delete(table, chain string, rulespec ...string) error {
+	c.log(table, "-D", chain, rulespec)
+	return nil
+}
+
+func (c *dryRunIPTables) FlushChain(table, chain string) error {
+	c.log(table, "-F", chain, nil)
+	return nil
+}
+
+func (c *dryRunIPTables) DeleteChain(table, chain string) error {
+	c.log(table, "-X", chain, nil)
+	return nil
+}
+
+// List tells there is no rule yet, as a fresh firewall would
+func (c *dryRunIPTables) List(table, chain string) ([]string, error) {
+	return nil, nil
+}
+
+// ListChains tells there is no chain of redfrog yet
+func (c *dryRunIPTables) ListChains(table string) ([]string, error) {
+	return nil, nil
+}
+
+type dryRunIPSet struct {
+	name string
+}
+
+func (c *dryRunIPSet) Add(entry string, timeout int) error {
+	logDryRun(fmt.Sprintf("ipset add %s %s timeout %d -exist", c.name, entry, timeout))
+	return nil
+}
+
+func (c *dryRunIPSet) AddList(entries []string, timeout int) error {
+	logDryRun(fmt.Sprintf("ipset restore -exist: add %s timeout %d of %d entries: %s", c.name, timeout, len(entries), strings.Join(entries, ",")))
+	return nil
+}
+
+func (c *dryRunIPSet) Del(entry string) error {
+	logDryRun(fmt.Sprintf("ipset del %s %s -exist", c.name, entry))
+	return nil
+}
+
+func (c *dryRunIPSet) DelList(entries []string) error {
+	logDryRun(fmt.Sprintf("ipset restore -exist: del %s of %d entries: %s", c.name, len(entries), strings.Join(entries, ",")))
+	return nil
+}
+
+func (c *dryRunIPSet) Refresh(entries []string) error {
+	logDryRun(fmt.Sprintf("ipset refresh %s with %d entries through swap: %s", c.name, len(entries), strings.Join(entries, ",")))
+	return nil
+}
+
+func (c *dryRunIPSet) Destroy() error {
+	logDryRun("ipset destroy " + c.name)
+	return nil
+}
+
+// dryRunPolicy logs policy routing change of family, which is made by netlink when not in dry run
+func dryRunPolicy(isIPv6 bool, bAdd bool, object string, spec string) {
+	family := "-4"
+	if isIPv6 {
+		family = "-6"
+	}
+	action := "del"
+	if bAdd {
+		action = "add"
+	}
+	logDryRun(fmt.Sprintf("ip %s %s %s %s", family, object, action, spec))
+}
+
+// markSpec formats mark of ip rule
+func markSpec(mark int, mask int) string {
+	return fmt.Sprintf("0x%x/0x%x", mark, mask)
+}
@@ -0,0 +1,37 @@
+package routing
+
+import (
+	"github.com/weishi258/redfrog-core/config"
+	"github.com/weishi258/redfrog-core/log"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+// TestDryRun runs whole routing manager life cycle, which would fail without root if anything were applied
+func TestDryRun(t *testing.T) {
+	log.InitLogger("", "error", false)
+	dir, err := ioutil.TempDir("", "routing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.SetWorkingDir(dir)
+	defer config.SetWorkingDir("")
+
+	mgr, err := StartRoutingMgr(1090, "0x1/0x1", 0xff, 100, []string{"127.0.0.0/8"}, nil, nil, nil, true, false, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mgr.ipSetV4.(*dryRunIPSet); !ok {
+		t.Errorf("dry run ipset handler expected, got %T", mgr.ipSetV4)
+	}
+	if err = mgr.AddIps(map[string][]net.IP{"www.google.com": {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(mgr.ipListV4["www.google.com"]) != 1 || len(mgr.ipListV6["www.google.com"]) != 1 {
+		t.Errorf("learned ips expected, got %v %v", mgr.ipListV4, mgr.ipListV6)
+	}
+	mgr.Stop()
+}
@@ -0,0 +1,74 @@
+package routing
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// name of where an entry lives when ipset is not available
+const ROUTE_IN_IPTABLES = "iptables"
+
+// RouteState is one ip in routing table, learned from DNS answer of domain or added by ip rule of pac list
+type RouteState struct {
+	// learned domain, or ip or CIDR rule of pac list
+	Domain string `json:"domain"`
+	IP     string `json:"ip"`
+	// ipset the entry is in, or iptables in fallback mode
+	Set  string `json:"set"`
+	Rule bool   `json:"rule"`
+	// nil if the entry never expires
+	Expire *time.Time `json:"expire,omitempty"`
+}
+
+// DumpRoutes returns routing table sorted by domain, whitelist mode makes listed entries bypass interception
+func (c *RoutingMgr) DumpRoutes() []RouteState {
+	c.RLock()
+	defer c.RUnlock()
+	ret := make([]RouteState, 0)
+	for i, ipList := range []map[string][]net.IP{c.ipListV4, c.ipListV6} {
+		isIPv6 := i == 1
+		for domain, ips := range ipList {
+			if isPacIP(domain) {
+				ret = append(ret, RouteState{Domain: domain, IP: domain, Set: c.setNameFor(domain, isIPv6), Rule: true})
+				continue
+			}
+			for _, ip := range ips {
+				entry := ip.String()
+				state := RouteState{Domain: domain, IP: entry, Set: c.setNameFor(entry, isIPv6)}
+				if expire, ok := c.expire[entry]; ok {
+					state.Expire = &expire
+				}
+				ret = append(ret, state)
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Domain != ret[j].Domain {
+			return ret[i].Domain < ret[j].Domain
+		}
+		return ret[i].IP < ret[j].IP
+	})
+	return ret
+}
+
+// setNameFor returns name of ipset entry is added into, as ipSetFor picks it
+func (c *RoutingMgr) setNameFor(entry string, isIPv6 bool) string {
+	switch set := c.ipSetFor(entry, isIPv6).(type) {
+	case nil:
+		return ROUTE_IN_IPTABLES
+	case *bpfSet:
+		return set.name
+	}
+	isNet := strings.Contains(entry, "/")
+	switch {
+	case isIPv6 && isNet:
+		return IPSET_RED_FROG_NET_V6
+	case isIPv6:
+		return IPSET_RED_FROG_V6
+	case isNet:
+		return IPSET_RED_FROG_NET_V4
+	}
+	return IPSET_RED_FROG_V4
+}
@@ -0,0 +1,31 @@
+package routing
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDumpRoutes(t *testing.T) {
+	expire := time.Now().Add(time.Hour)
+	mgr := &RoutingMgr{ipListV4: make(map[string][]net.IP), ipListV6: make(map[string][]net.IP), expire: make(map[string]time.Time),
+		ipNetSetV4: &dryRunIPSet{name: IPSET_RED_FROG_NET_V4}}
+	mgr.ipListV4["www.google.com"] = []net.IP{net.ParseIP("192.0.2.1").To4()}
+	mgr.ipListV4["91.108.4.0/22"] = []net.IP{net.ParseIP("91.108.4.0").To4()}
+	mgr.ipListV6["www.google.com"] = []net.IP{net.ParseIP("2001:db8::1")}
+	mgr.expire["192.0.2.1"] = expire
+
+	routes := mgr.DumpRoutes()
+	if len(routes) != 3 {
+		t.Fatalf("3 routes expected, got %v", routes)
+	}
+	if route := routes[0]; route.Domain != "91.108.4.0/22" || !route.Rule || route.Set != IPSET_RED_FROG_NET_V4 || route.Expire != nil {
+		t.Errorf("unexpected rule route %+v", route)
+	}
+	if route := routes[1]; route.IP != "192.0.2.1" || route.Rule || route.Set != ROUTE_IN_IPTABLES || route.Expire == nil || !route.Expire.Equal(expire) {
+		t.Errorf("unexpected learned route %+v", route)
+	}
+	if route := routes[2]; route.IP != "2001:db8::1" || route.Expire != nil {
+		t.Errorf("unexpected learned route %+v", route)
+	}
+}
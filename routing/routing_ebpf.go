@@ -0,0 +1,382 @@
+package routing
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unsafe"
+)
+
+// experimental backend keeping destination sets in BPF LPM trie maps instead of ipsets, RED_FROG chain matches them
+// through xt_bpf by a socket filter program pinned for each map, so sets are updated by bpf syscall without ipset
+// binary and one lookup covers both ips and CIDRs
+
+// programs and maps are pinned here, bpffs has to be mounted on /sys/fs/bpf
+const BPF_PIN_DIR = "/sys/fs/bpf/redfrog"
+
+// LPM trie allocates entries on demand, so the limit costs nothing until used
+const BPF_MAP_MAX_ENTRIES = 1 << 20
+
+// bpf syscall commands, map and program types, helpers and instruction codes as defined by kernel ABI
+const (
+	bpfMapCreate     = 0
+	bpfMapUpdateElem = 2
+	bpfMapDeleteElem = 3
+	bpfMapGetNextKey = 4
+	bpfProgLoad      = 5
+	bpfObjPin        = 6
+
+	bpfMapTypeLPMTrie       = 11
+	bpfProgTypeSocketFilter = 1
+
+	bpfFuncMapLookupElem = 1
+	bpfFuncSkbLoadBytes  = 26
+
+	bpfLd    = 0x00
+	bpfSt    = 0x02
+	bpfJmp   = 0x05
+	bpfAlu64 = 0x07
+	bpfW     = 0x00
+	bpfDW    = 0x18
+	bpfImm   = 0x00
+	bpfMem   = 0x60
+	bpfK     = 0x00
+	bpfX     = 0x08
+	bpfAdd   = 0x00
+	bpfMov   = 0xb0
+	bpfJEQ   = 0x10
+	bpfJNE   = 0x50
+	bpfCall  = 0x80
+	bpfExit  = 0x90
+)
+
+type bpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+type bpfMapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+}
+
+type bpfMapElemAttr struct {
+	mapFd uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+}
+
+type bpfObjPinAttr struct {
+	pathname  uint64
+	bpfFd     uint32
+	fileFlags uint32
+}
+
+func bpfSyscall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	ret, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(ret), nil
+}
+
+// bigEndian tells register nibbles order of instruction, bit fields are laid out from the other end there
+var bigEndian = func() bool {
+	n := uint16(1)
+	return *(*byte)(unsafe.Pointer(&n)) == 0
+}()
+
+func insn(code uint8, dst uint8, src uint8, off int16, imm int32) bpfInsn {
+	regs := src<<4 | dst
+	if bigEndian {
+		regs = dst<<4 | src
+	}
+	return bpfInsn{code, regs, off, imm}
+}
+
+// bpfMatchProgram returns program matching packet whose destination is in LPM trie of mapFd, skb data of netfilter
+// hooks starts at network header
+func bpfMatchProgram(mapFd int, isIPv6 bool) []bpfInsn {
+	addrLen, daddrOffset := int32(net.IPv4len), int32(16)
+	if isIPv6 {
+		addrLen, daddrOffset = net.IPv6len, 24
+	}
+	// key is prefix length followed by address, on stack right below frame pointer
+	keyLen := 4 + addrLen
+	return []bpfInsn{
+		insn(bpfAlu64|bpfMov|bpfX, 6, 1, 0, 0),
+		insn(bpfSt|bpfMem|bpfW, 10, 0, int16(-keyLen), addrLen*8),
+		insn(bpfAlu64|bpfMov|bpfX, 1, 6, 0, 0),
+		insn(bpfAlu64|bpfMov|bpfK, 2, 0, 0, daddrOffset),
+		insn(bpfAlu64|bpfMov|bpfX, 3, 10, 0, 0),
+		insn(bpfAlu64|bpfAdd|bpfK, 3, 0, 0, -addrLen),
+		insn(bpfAlu64|bpfMov|bpfK, 4, 0, 0, addrLen),
+		insn(bpfJmp|bpfCall, 0, 0, 0, bpfFuncSkbLoadBytes),
+		// short packet does not match
+		insn(bpfJmp|bpfJNE|bpfK, 0, 0, 8, 0),
+		insn(bpfLd|bpfDW|bpfImm, 1, unix.BPF_PSEUDO_MAP_FD, 0, int32(mapFd)),
+		insn(0, 0, 0, 0, 0),
+		insn(bpfAlu64|bpfMov|bpfX, 2, 10, 0, 0),
+		insn(bpfAlu64|bpfAdd|bpfK, 2, 0, 0, -keyLen),
+		insn(bpfJmp|bpfCall, 0, 0, 0, bpfFuncMapLookupElem),
+		insn(bpfJmp|bpfJEQ|bpfK, 0, 0, 2, 0),
+		insn(bpfAlu64|bpfMov|bpfK, 0, 0, 0, 1),
+		insn(bpfJmp|bpfExit, 0, 0, 0, 0),
+		insn(bpfAlu64|bpfMov|bpfK, 0, 0, 0, 0),
+		insn(bpfJmp|bpfExit, 0, 0, 0, 0),
+	}
+}
+
+// bpfKey encodes ip or CIDR of family as LPM trie key
+func bpfKey(entry string, isIPv6 bool) ([]byte, error) {
+	var ip net.IP
+	var ones int
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid CIDR %s", entry)
+		}
+		ip = ipNet.IP
+		ones, _ = ipNet.Mask.Size()
+	} else if ip = net.ParseIP(entry); ip == nil {
+		return nil, errors.Errorf("Invalid ip %s", entry)
+	}
+	if isIPv6 {
+		if ip.To4() != nil {
+			return nil, errors.Errorf("%s is not ipv6", entry)
+		}
+		ip = ip.To16()
+	} else if ip = ip.To4(); ip == nil {
+		return nil, errors.Errorf("%s is not ipv4", entry)
+	}
+	if !strings.Contains(entry, "/") {
+		ones = len(ip) * 8
+	}
+	// prefix length is in host order, address in network order
+	key := make([]byte, 4+len(ip))
+	if bigEndian {
+		binary.BigEndian.PutUint32(key, uint32(ones))
+	} else {
+		binary.LittleEndian.PutUint32(key, uint32(ones))
+	}
+	copy(key[4:], ip)
+	return key, nil
+}
+
+// bpfSet is destination set of one family in LPM trie, matched by pinned program
+type bpfSet struct {
+	name     string
+	isIPv6   bool
+	mapFd    int
+	progFd   int
+	progPath string
+	mapPath  string
+}
+
+// newBPFSet creates map and matching program of set, and pins both under BPF_PIN_DIR
+func newBPFSet(name string, isIPv6 bool) (ret *bpfSet, err error) {
+	if err = os.MkdirAll(BPF_PIN_DIR, 0700); err != nil {
+		return nil, errors.Wrapf(err, "Create %s failed, is bpffs mounted", BPF_PIN_DIR)
+	}
+	ret = &bpfSet{name: name, isIPv6: isIPv6, mapFd: -1, progFd: -1}
+	ret.progPath = filepath.Join(BPF_PIN_DIR, name)
+	ret.mapPath = filepath.Join(BPF_PIN_DIR, name+"_map")
+	defer func() {
+		if err != nil {
+			ret.Destroy()
+			ret = nil
+		}
+	}()
+
+	addrLen := uint32(net.IPv4len)
+	if isIPv6 {
+		addrLen = net.IPv6len
+	}
+	mapAttr := bpfMapCreateAttr{mapType: bpfMapTypeLPMTrie, keySize: 4 + addrLen, valueSize: 1,
+		maxEntries: BPF_MAP_MAX_ENTRIES, mapFlags: unix.BPF_F_NO_PREALLOC}
+	if ret.mapFd, err = bpfSyscall(bpfMapCreate, unsafe.Pointer(&mapAttr), unsafe.Sizeof(mapAttr)); err != nil {
+		return ret, errors.Wrapf(err, "Create BPF map of %s failed", name)
+	}
+
+	program := bpfMatchProgram(ret.mapFd, isIPv6)
+	license := []byte("GPL\x00")
+	logBuf := make([]byte, 4096)
+	progAttr := bpfProgLoadAttr{progType: bpfProgTypeSocketFilter, insnCnt: uint32(len(program)),
+		insns: uint64(uintptr(unsafe.Pointer(&program[0]))), license: uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1, logSize: uint32(len(logBuf)), logBuf: uint64(uintptr(unsafe.Pointer(&logBuf[0])))}
+	ret.progFd, err = bpfSyscall(bpfProgLoad, unsafe.Pointer(&progAttr), unsafe.Sizeof(progAttr))
+	runtime.KeepAlive(program)
+	runtime.KeepAlive(license)
+	if err != nil {
+		return ret, errors.Wrapf(err, "Load BPF program of %s failed: %s", name, strings.TrimRight(string(logBuf), "\x00"))
+	}
+
+	if err = bpfPin(ret.progFd, ret.progPath); err != nil {
+		return
+	}
+	err = bpfPin(ret.mapFd, ret.mapPath)
+	return
+}
+
+func bpfPin(fd int, path string) error {
+	pathname := append([]byte(path), 0)
+	attr := bpfObjPinAttr{pathname: uint64(uintptr(unsafe.Pointer(&pathname[0]))), bpfFd: uint32(fd)}
+	_, err := bpfSyscall(bpfObjPin, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(pathname)
+	if err != nil {
+		return errors.Wrapf(err, "Pin BPF object to %s failed", path)
+	}
+	return nil
+}
+
+// match is iptables match of destinations in set
+func (c *bpfSet) match() []string {
+	return []string{"-m", "bpf", "--object-pinned", c.progPath}
+}
+
+func (c *bpfSet) elem(cmd int, key []byte, value []byte) error {
+	attr := bpfMapElemAttr{mapFd: uint32(c.mapFd), key: uint64(uintptr(unsafe.Pointer(&key[0])))}
+	if value != nil {
+		attr.value = uint64(uintptr(unsafe.Pointer(&value[0])))
+	}
+	_, err := bpfSyscall(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+// Add adds entry, map entries do not expire so timeout is left to expiry of routing manager
+func (c *bpfSet) Add(entry string, timeout int) error {
+	key, err := bpfKey(entry, c.isIPv6)
+	if err != nil {
+		return err
+	}
+	if err = c.elem(bpfMapUpdateElem, key, []byte{1}); err != nil {
+		return errors.Wrapf(err, "Add %s into BPF map %s failed", entry, c.name)
+	}
+	return nil
+}
+
+func (c *bpfSet) AddList(entries []string, timeout int) error {
+	for _, entry := range entries {
+		if err := c.Add(entry, timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *bpfSet) Del(entry string) error {
+	key, err := bpfKey(entry, c.isIPv6)
+	if err != nil {
+		return err
+	}
+	if err = c.elem(bpfMapDeleteElem, key, nil); err != nil && err != unix.ENOENT {
+		return errors.Wrapf(err, "Delete %s from BPF map %s failed", entry, c.name)
+	}
+	return nil
+}
+
+func (c *bpfSet) DelList(entries []string) error {
+	for _, entry := range entries {
+		if err := c.Del(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Refresh replaces content with entries, entries kept are never missing from map meanwhile
+func (c *bpfSet) Refresh(entries []string) error {
+	wanted := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		key, err := bpfKey(entry, c.isIPv6)
+		if err != nil {
+			return err
+		}
+		wanted[string(key)] = true
+	}
+	stale := make([][]byte, 0)
+	var key []byte
+	for {
+		next := make([]byte, c.keySize())
+		attr := bpfMapElemAttr{mapFd: uint32(c.mapFd), value: uint64(uintptr(unsafe.Pointer(&next[0])))}
+		if key != nil {
+			attr.key = uint64(uintptr(unsafe.Pointer(&key[0])))
+		}
+		_, err := bpfSyscall(bpfMapGetNextKey, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		runtime.KeepAlive(key)
+		if err == unix.ENOENT {
+			break
+		} else if err != nil {
+			return errors.Wrapf(err, "Iterate BPF map %s failed", c.name)
+		}
+		if !wanted[string(next)] {
+			stale = append(stale, next)
+		}
+		key = next
+	}
+	for _, key := range stale {
+		if err := c.elem(bpfMapDeleteElem, key, nil); err != nil && err != unix.ENOENT {
+			return errors.Wrapf(err, "Delete from BPF map %s failed", c.name)
+		}
+	}
+	return c.AddList(entries, 0)
+}
+
+func (c *bpfSet) keySize() int {
+	if c.isIPv6 {
+		return 4 + net.IPv6len
+	}
+	return 4 + net.IPv4len
+}
+
+// Destroy unpins and closes map and program, kernel frees them once iptables rule referencing program is gone, it
+// can be called again as one set serves both ips and CIDRs
+func (c *bpfSet) Destroy() error {
+	var err error
+	for _, path := range []string{c.progPath, c.mapPath} {
+		if removeErr := os.Remove(path); removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+			err = errors.Wrapf(removeErr, "Unpin %s failed", path)
+		}
+	}
+	for _, fd := range []*int{&c.progFd, &c.mapFd} {
+		if *fd >= 0 {
+			unix.Close(*fd)
+			*fd = -1
+		}
+	}
+	return err
+}
+
+// setMatch returns iptables match of destinations in set
+func setMatch(set ipSetHandler, name string) []string {
+	if matcher, ok := set.(interface{ match() []string }); ok {
+		return matcher.match()
+	}
+	return []string{"-m", "set", "--set", name, "dst"}
+}
@@ -0,0 +1,52 @@
+package routing
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBPFKey(t *testing.T) {
+	key, err := bpfKey("10.1.2.0/24", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := []byte{24, 0, 0, 0}
+	if bigEndian {
+		prefix = []byte{0, 0, 0, 24}
+	}
+	if expected := append(prefix, 10, 1, 2, 0); !bytes.Equal(key, expected) {
+		t.Errorf("got %v, expected %v", key, expected)
+	}
+	if key, err = bpfKey("2001:db8::1", true); err != nil {
+		t.Fatal(err)
+	} else if len(key) != 20 || key[4] != 0x20 || key[19] != 1 {
+		t.Errorf("unexpected ipv6 key %v", key)
+	}
+	if key, err = bpfKey("1.2.3.4", false); err != nil || len(key) != 8 || (key[0] != 32 && key[3] != 32) {
+		t.Errorf("unexpected host key %v, %v", key, err)
+	}
+	if _, err = bpfKey("1.2.3.4", true); err == nil {
+		t.Error("ipv4 entry in ipv6 set should fail")
+	}
+	if _, err = bpfKey("2001:db8::/32", false); err == nil {
+		t.Error("ipv6 entry in ipv4 set should fail")
+	}
+	if _, err = bpfKey("google.com", false); err == nil {
+		t.Error("invalid entry should fail")
+	}
+}
+
+func TestBPFMatchProgram(t *testing.T) {
+	prog := bpfMatchProgram(3, false)
+	// jumps must land inside program
+	for i, ins := range prog {
+		if ins.code&0x07 == bpfJmp && ins.off != 0 {
+			if target := i + 1 + int(ins.off); target < 0 || target >= len(prog) {
+				t.Errorf("jump at %d lands outside program at %d", i, target)
+			}
+		}
+	}
+	if last := prog[len(prog)-1]; last.code != bpfJmp|bpfExit {
+		t.Error("program should end with exit")
+	}
+}
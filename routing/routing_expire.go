@@ -0,0 +1,124 @@
+package routing
+
+import (
+	"github.com/weishi258/redfrog-core/log"
+	"go.uber.org/zap"
+	"net"
+	"time"
+)
+
+// learned ips past their expiry are removed from routing table this often, and learned mappings are checked for
+// periodic save
+const ROUTE_EXPIRE_INTERVAL = time.Minute
+
+// SetRouteTTLFloor makes learned ips expire after DNS TTL of their answer, but no sooner than floor seconds, 0 keeps
+// them until pac list reload drops their domain
+func (c *RoutingMgr) SetRouteTTLFloor(floor int) {
+	c.Lock()
+	defer c.Unlock()
+	c.routeTTLFloor = time.Duration(floor) * time.Second
+	if floor <= 0 {
+		c.expire = make(map[string]time.Time)
+	}
+}
+
+// RouteTTL returns how long ip learned from answer of ttl stays routed, 0 if forever
+func (c *RoutingMgr) RouteTTL(ttl time.Duration) time.Duration {
+	c.RLock()
+	defer c.RUnlock()
+	return c.routeTTL(ttl)
+}
+
+func (c *RoutingMgr) routeTTL(ttl time.Duration) time.Duration {
+	if c.routeTTLFloor <= 0 {
+		return 0
+	}
+	if ttl < c.routeTTLFloor {
+		return c.routeTTLFloor
+	}
+	return ttl
+}
+
+// touchExpire pushes expiry of ips further, an ip shared by domains expires with the latest of them, caller holds lock
+func (c *RoutingMgr) touchExpire(ips []string, ttl time.Duration) {
+	if ttl = c.routeTTL(ttl); ttl == 0 {
+		return
+	}
+	expire := time.Now().Add(ttl)
+	for _, ip := range ips {
+		if origin, ok := c.expire[ip]; !ok || origin.Before(expire) {
+			c.expire[ip] = expire
+		}
+	}
+}
+
+func (c *RoutingMgr) startExpire() {
+	ticker := time.NewTicker(ROUTE_EXPIRE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.expireRoutes(now)
+			c.persistIfDue(now)
+		case <-c.expireDone:
+			return
+		}
+	}
+}
+
+// expireRoutes removes learned ips past their expiry, ip also added by pac list ip rule stays in ipset
+func (c *RoutingMgr) expireRoutes(now time.Time) {
+	logger := log.GetLogger()
+	c.Lock()
+	expired := make(map[string]bool)
+	for ip, expire := range c.expire {
+		if now.After(expire) {
+			expired[ip] = true
+			delete(c.expire, ip)
+		}
+	}
+	if len(expired) == 0 {
+		c.Unlock()
+		return
+	}
+	ipv4List := make([]string, 0)
+	ipv6List := make([]string, 0)
+	for _, ipList := range []map[string][]net.IP{c.ipListV4, c.ipListV6} {
+		for domain, ips := range ipList {
+			if isPacIP(domain) {
+				continue
+			}
+			kept := ips[:0]
+			for _, ip := range ips {
+				if !expired[ip.String()] {
+					kept = append(kept, ip)
+				}
+			}
+			if len(kept) == 0 {
+				delete(ipList, domain)
+			} else {
+				ipList[domain] = kept
+			}
+		}
+	}
+	for ip := range expired {
+		if _, isIPv6, ok := parsePacIP(ip); ok && !isIPv6 {
+			if _, ruled := c.ipListV4[ip]; !ruled {
+				ipv4List = append(ipv4List, ip)
+			}
+		} else if ok {
+			if _, ruled := c.ipListV6[ip]; !ruled {
+				ipv6List = append(ipv6List, ip)
+			}
+		}
+	}
+	c.Unlock()
+
+	if err := c.addDelLearned(ipv4List, false, false); err != nil {
+		logger.Error("Expire ip from routing table failed", zap.String("error", err.Error()))
+	}
+	if err := c.addDelLearned(ipv6List, true, false); err != nil {
+		logger.Error("Expire ip from routing table failed", zap.String("error", err.Error()))
+	}
+	logger.Debug("Learned ips expired", zap.Int("ipv4", len(ipv4List)), zap.Int("ipv6", len(ipv6List)))
+}
@@ -0,0 +1,31 @@
+package routing
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTouchExpire(t *testing.T) {
+	mgr := &RoutingMgr{expire: make(map[string]time.Time)}
+	mgr.touchExpire([]string{"192.0.2.1"}, time.Hour)
+	if len(mgr.expire) != 0 {
+		t.Errorf("learned ip should not expire without floor")
+	}
+
+	mgr.SetRouteTTLFloor(600)
+	if ttl := mgr.RouteTTL(30 * time.Second); ttl != 600*time.Second {
+		t.Errorf("short TTL should be raised to floor, got %v", ttl)
+	}
+	if ttl := mgr.RouteTTL(2 * time.Hour); ttl != 2*time.Hour {
+		t.Errorf("long TTL should be kept, got %v", ttl)
+	}
+	mgr.touchExpire([]string{"192.0.2.1"}, time.Hour)
+	mgr.touchExpire([]string{"192.0.2.1"}, 0)
+	if remain := time.Until(mgr.expire["192.0.2.1"]); remain < 59*time.Minute {
+		t.Errorf("shorter TTL of another answer should not shorten expiry, got %v", remain)
+	}
+	mgr.SetRouteTTLFloor(0)
+	if len(mgr.expire) != 0 {
+		t.Errorf("disabling expiry should forget tracked ips")
+	}
+}
@@ -1,13 +1,12 @@
 package routing
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netlink"
-	"github.com/weishi258/go-iptables/iptables"
 	"github.com/weishi258/redfrog-core/common"
 	"github.com/weishi258/redfrog-core/config"
-	"github.com/weishi258/redfrog-core/ipset"
 	"github.com/weishi258/redfrog-core/log"
 	"go.uber.org/zap"
 	"golang.org/x/sys/unix"
@@ -18,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -29,6 +29,12 @@ const (
 
 	IPSET_RED_FROG_V4 = "RED_FROG_IPSET_V4"
 	IPSET_RED_FROG_V6 = "RED_FROG_IPSET_V6"
+	// CIDR rules of pac list
+	IPSET_RED_FROG_NET_V4 = "RED_FROG_IPSET_NET_V4"
+	IPSET_RED_FROG_NET_V6 = "RED_FROG_IPSET_NET_V6"
+	// direct list, e.g. chnroute, never intercepted
+	IPSET_RED_FROG_DIRECT_V4 = "RED_FROG_IPSET_DIRECT_V4"
+	IPSET_RED_FROG_DIRECT_V6 = "RED_FROG_IPSET_DIRECT_V6"
 
 	ROUTING_PRIORITY = 1
 )
@@ -46,22 +52,90 @@ type RoutingMgr struct {
 	ipListV4 map[string][]net.IP
 	ipListV6 map[string][]net.IP
 
-	ip4tbl *iptables.IPTables
-	ip6tbl *iptables.IPTables
+	ip4tbl iptablesHandler
+	ip6tbl iptablesHandler
 
 	ignoreIPNet []*net.IPNet
-	ipSetV4     *ipset.IPSet
-	ipSetV6     *ipset.IPSet
+	ipSetV4     ipSetHandler
+	ipSetV6     ipSetHandler
+	// nil makes CIDR rules go to iptables
+	ipNetSetV4 ipSetHandler
+	ipNetSetV6 ipSetHandler
+	// nil if ipset is not available, direct list can not be loaded then
+	directSetV4 ipSetHandler
+	directSetV6 ipSetHandler
+	direct      directTable
 
 	routingTableNum int
 	markMast        string
+	// packets of our backend sockets carry it, 0 if not marked
+	outboundMark int
+	// ipsets hold destinations bypassing interception, everything else is intercepted
+	whitelist bool
+	// iptables, ipset and policy routing operations are logged instead of applied
+	dryRun bool
+	// destination sets are BPF maps instead of ipsets, experimental
+	ebpf bool
+	// only traffic from includeSource is intercepted if not empty, traffic from excludeSource never is
+	includeSource []*net.IPNet
+	excludeSource []*net.IPNet
+
+	// learned ips expire after DNS TTL but no sooner than floor, 0 floor keeps them
+	routeTTLFloor time.Duration
+	expire        map[string]time.Time
+	expireDone    chan struct{}
+
+	// learned mappings are saved every persistInterval besides on stop, 0 saves on stop only
+	persistInterval time.Duration
+	persistMux      sync.Mutex
+	// content of cache file last saved or loaded
+	persisted   []byte
+	persistedAt time.Time
 }
 
-func StartRoutingMgr(port int, mark string, routingTableNum int, ignoreIP []string, interfaceName []string, bIPSet bool) (ret *RoutingMgr, err error) {
+// StartRoutingMgr sets up interception, with bWhitelist destinations in ipsets go direct and all others are intercepted,
+// which needs ipset or bEBPF, with bEBPF destination sets are BPF maps instead of ipsets, with bDryRun firewall and
+// policy routing are left untouched and changes are logged instead,
+// traffic of LAN devices not in includeSource, if given, or in excludeSource is never intercepted, DNS included
+func StartRoutingMgr(port int, mark string, outboundMark int, routingTableNum int, ignoreIP []string, interfaceName []string, includeSource []string, excludeSource []string, bIPSet bool, bEBPF bool, bWhitelist bool, bDryRun bool) (ret *RoutingMgr, err error) {
 	logger := log.GetLogger()
 	ret = &RoutingMgr{}
 	ret.routingTableNum = routingTableNum
 	ret.markMast = mark
+	ret.outboundMark = outboundMark
+	ret.whitelist = bWhitelist
+	ret.dryRun = bDryRun
+	ret.ebpf = bEBPF
+	if bEBPF {
+		// BPF maps take place of ipsets
+		bIPSet = true
+	}
+	if bWhitelist && !bIPSet {
+		return nil, errors.New("Whitelist mode requires ipset")
+	}
+	if ret.includeSource, err = parseSourceNets(includeSource); err != nil {
+		return nil, errors.Wrap(err, "Invalid include source")
+	}
+	if ret.excludeSource, err = parseSourceNets(excludeSource); err != nil {
+		return nil, errors.Wrap(err, "Invalid exclude source")
+	}
+
+	if ret.ip4tbl, err = ret.newIPTables(false); err != nil {
+		err = errors.Wrap(err, "Create IPTables handler failed")
+		return
+	}
+	if ret.ip6tbl, err = ret.newIPTables(true); err != nil {
+		err = errors.Wrap(err, "Create IPTables handler failed")
+		return
+	}
+	// a crashed run leaves its chains and sets behind, remove them before creating ours
+	if err = ret.cleanupOrphanChains(ret.ip4tbl); err != nil {
+		return
+	}
+	if err = ret.cleanupOrphanChains(ret.ip6tbl); err != nil {
+		return
+	}
+	ret.cleanupOrphanIPSets()
 
 	if err = ret.addDelRoutingRule(mark, routingTableNum, false, true); err != nil {
 		return
@@ -81,12 +155,33 @@ func StartRoutingMgr(port int, mark string, routingTableNum int, ignoreIP []stri
 	logger.Debug("Add routing route ipv6 successful")
 
 	if bIPSet {
-		if ret.ipSetV4, err = ipset.New(IPSET_RED_FROG_V4, "hash:ip", &ipset.Params{Timeout: 0, HashFamily: "inet", MaxElem: 4294967295}); err != nil {
+		if ret.ipSetV4, err = ret.newIPSet(IPSET_RED_FROG_V4, "hash:ip", "inet"); err != nil {
 			logger.Warn("IPSetV4 init failed, so fallback to using iptables", zap.String("error", err.Error()))
 		}
-		if ret.ipSetV6, err = ipset.New(IPSET_RED_FROG_V6, "hash:ip", &ipset.Params{Timeout: 0, HashFamily: "inet6", MaxElem: 4294967295}); err != nil {
+		if ret.ipSetV6, err = ret.newIPSet(IPSET_RED_FROG_V6, "hash:ip", "inet6"); err != nil {
 			logger.Warn("IPSetV6 init failed, so fallback to using ip6tables", zap.String("error", err.Error()))
 		}
+		if ret.ebpf {
+			// LPM trie matches CIDRs as well
+			ret.ipNetSetV4, ret.ipNetSetV6 = ret.ipSetV4, ret.ipSetV6
+		} else {
+			if ret.ipNetSetV4, err = ret.newIPSet(IPSET_RED_FROG_NET_V4, "hash:net", "inet"); err != nil {
+				logger.Warn("IPSetV4 for CIDR init failed, so fallback to using iptables", zap.String("error", err.Error()))
+			}
+			if ret.ipNetSetV6, err = ret.newIPSet(IPSET_RED_FROG_NET_V6, "hash:net", "inet6"); err != nil {
+				logger.Warn("IPSetV6 for CIDR init failed, so fallback to using ip6tables", zap.String("error", err.Error()))
+			}
+		}
+		if ret.directSetV4, err = ret.newIPSet(IPSET_RED_FROG_DIRECT_V4, "hash:net", "inet"); err != nil {
+			logger.Warn("IPSetV4 for direct list init failed, direct list is disabled", zap.String("error", err.Error()))
+		}
+		if ret.directSetV6, err = ret.newIPSet(IPSET_RED_FROG_DIRECT_V6, "hash:net", "inet6"); err != nil {
+			logger.Warn("IPSetV6 for direct list init failed, direct list is disabled", zap.String("error", err.Error()))
+		}
+		if bWhitelist && (ret.ipSetV4 == nil || ret.ipSetV6 == nil || ret.ipNetSetV4 == nil || ret.ipNetSetV6 == nil) {
+			// iptables rule appended after catch-all would never match
+			return nil, errors.New("Whitelist mode requires ipset")
+		}
 	}
 
 	if ignoreIP != nil {
@@ -101,12 +196,10 @@ func StartRoutingMgr(port int, mark string, routingTableNum int, ignoreIP []stri
 	}
 	ret.ipListV4 = make(map[string][]net.IP)
 	ret.ipListV6 = make(map[string][]net.IP)
+	ret.expire = make(map[string]time.Time)
+	ret.expireDone = make(chan struct{})
 
 	// lets create new iptabls chains
-	if ret.ip4tbl, err = iptables.New(); err != nil {
-		err = errors.Wrap(err, "Create IPTables handler failed")
-		return
-	}
 	if err = ret.createTProxyMarkChain(port, mark, false); err != nil {
 		return
 	}
@@ -121,11 +214,6 @@ func StartRoutingMgr(port int, mark string, routingTableNum int, ignoreIP []stri
 	}
 	logger.Info("IPTables v4 successful created")
 
-	if ret.ip6tbl, err = iptables.NewWithProtocol(iptables.ProtocolIPv6); err != nil {
-		err = errors.Wrap(err, "Create IPTables handler failed")
-		return
-	}
-
 	if err = ret.createTProxyMarkChain(port, mark, true); err != nil {
 		return
 	}
@@ -139,6 +227,7 @@ func StartRoutingMgr(port int, mark string, routingTableNum int, ignoreIP []stri
 		return
 	}
 	logger.Info("IPTables v6 successful created")
+	go ret.startExpire()
 	logger.Info("Start routing manager successful")
 	return
 }
@@ -197,6 +286,22 @@ func (c *RoutingMgr) createRedFrogChain(isIPv6 bool) (err error) {
 		err = errors.Wrap(err, fmt.Sprintf("Create/Flush %s chain failed", CHAIN_RED_FROG))
 	}
 
+	// tunnel traffic looped back by policy routing must not be intercepted again
+	if c.outboundMark != 0 {
+		if err = handler.Append(TABLE_MANGLE, CHAIN_RED_FROG, "-m", "mark", "--mark", fmt.Sprintf("0x%x", c.outboundMark), "-j", "RETURN"); err != nil {
+			err = errors.Wrap(err, "Append into RED_FROG chain to return outbound marked packet failed")
+			return
+		}
+	}
+
+	// excluded devices never reach tunnel, not even by DNS
+	for _, source := range sourcesOf(c.excludeSource, isIPv6) {
+		if err = handler.Append(TABLE_MANGLE, CHAIN_RED_FROG, "-s", source, "-j", "RETURN"); err != nil {
+			err = errors.Wrap(err, "Append into RED_FROG chain to return excluded source failed")
+			return
+		}
+	}
+
 	// add divert
 	if err = handler.Append(TABLE_MANGLE, CHAIN_RED_FROG, "-m", "socket", "-j", CHAIN_DIVERT); err != nil {
 		err = errors.Wrap(err, "Append into RED_FROG chain to avoid double tap for TProxy")
@@ -222,13 +327,26 @@ func (c *RoutingMgr) createRedFrogChain(isIPv6 bool) (err error) {
 			err = errors.Wrap(err, "Append into RED_FROG chain for DNS filter failed")
 			return
 		}
+		if c.directSetV6 != nil {
+			if err = handler.Append(TABLE_MANGLE, CHAIN_RED_FROG, append(setMatch(c.directSetV6, IPSET_RED_FROG_DIRECT_V6), "-j", "RETURN")...); err != nil {
+				err = errors.Wrapf(err, "Append into RED_FROG chain %s filter failed", IPSET_RED_FROG_DIRECT_V6)
+				return
+			}
+		}
 		if c.ipSetV6 != nil {
 			// add ipset filter
-			if err = handler.Append(TABLE_MANGLE, CHAIN_RED_FROG, "-m", "set", "--set", IPSET_RED_FROG_V6, "dst", "-j", CHAIN_TPROXY); err != nil {
+			if err = handler.Append(TABLE_MANGLE, CHAIN_RED_FROG, append(setMatch(c.ipSetV6, IPSET_RED_FROG_V6), "-j", c.ipSetTarget())...); err != nil {
 				err = errors.Wrapf(err, "Append into RED_FROG chain %s filter failed", IPSET_RED_FROG_V6)
 				return
 			}
 		}
+		// one BPF map holds both ips and CIDRs
+		if c.ipNetSetV6 != nil && c.ipNetSetV6 != c.ipSetV6 {
+			if err = handler.Append(TABLE_MANGLE, CHAIN_RED_FROG, append(setMatch(c.ipNetSetV6, IPSET_RED_FROG_NET_V6), "-j", c.ipSetTarget())...); err != nil {
+				err = errors.Wrapf(err, "Append into RED_FROG chain %s filter failed", IPSET_RED_FROG_NET_V6)
+				return
+			}
+		}
 	} else {
 		for _, ipNet := range c.ignoreIPNet {
 			if ipNet.IP.To4() != nil {
@@ -243,20 +361,52 @@ func (c *RoutingMgr) createRedFrogChain(isIPv6 bool) (err error) {
 			err = errors.Wrap(err, "Append into RED_FROG chain for DNS filter failed")
 			return
 		}
+		if c.directSetV4 != nil {
+			if err = handler.Append(TABLE_MANGLE, CHAIN_RED_FROG, append(setMatch(c.directSetV4, IPSET_RED_FROG_DIRECT_V4), "-j", "RETURN")...); err != nil {
+				err = errors.Wrapf(err, "Append into RED_FROG chain for %s filter failed", IPSET_RED_FROG_DIRECT_V4)
+				return
+			}
+		}
 
 		if c.ipSetV4 != nil {
 			// add ipset filter
-			if err = handler.Append(TABLE_MANGLE, CHAIN_RED_FROG, "-m", "set", "--set", IPSET_RED_FROG_V4, "dst", "-j", CHAIN_TPROXY); err != nil {
+			if err = handler.Append(TABLE_MANGLE, CHAIN_RED_FROG, append(setMatch(c.ipSetV4, IPSET_RED_FROG_V4), "-j", c.ipSetTarget())...); err != nil {
 				err = errors.Wrapf(err, "Append into RED_FROG chain for %s filter failed", IPSET_RED_FROG_V4)
 				return
 			}
 		}
+		if c.ipNetSetV4 != nil && c.ipNetSetV4 != c.ipSetV4 {
+			if err = handler.Append(TABLE_MANGLE, CHAIN_RED_FROG, append(setMatch(c.ipNetSetV4, IPSET_RED_FROG_NET_V4), "-j", c.ipSetTarget())...); err != nil {
+				err = errors.Wrapf(err, "Append into RED_FROG chain for %s filter failed", IPSET_RED_FROG_NET_V4)
+				return
+			}
+		}
+	}
+
+	if c.whitelist {
+		if err = handler.Append(TABLE_MANGLE, CHAIN_RED_FROG, "-j", CHAIN_TPROXY); err != nil {
+			err = errors.Wrap(err, "Append into RED_FROG chain to intercept the rest failed")
+			return
+		}
 	}
 
 	return
 }
 
-func (c *RoutingMgr) deletePrerouting(iptbl *iptables.IPTables) error {
+// ipSetTarget is where packets to destinations in ipsets go
+func (c *RoutingMgr) ipSetTarget() string {
+	if c.whitelist {
+		return "RETURN"
+	}
+	return CHAIN_TPROXY
+}
+
+// IsWhitelist tells whether ip added is bypassing interception instead of being intercepted
+func (c *RoutingMgr) IsWhitelist() bool {
+	return c.whitelist
+}
+
+func (c *RoutingMgr) deletePrerouting(iptbl iptablesHandler) error {
 	if rules, err := iptbl.List(TABLE_MANGLE, CHAIN_PREROUTING); err != nil {
 		err = errors.Wrapf(err, "List chain %s -> %s failed", TABLE_MANGLE, CHAIN_PREROUTING)
 		return err
@@ -287,28 +437,12 @@ func (c *RoutingMgr) initPreRoutingChain(isIPv6 bool, interfaceName []string) (e
 		return
 	}
 
-	interfaceAdded := false
-	if len(interfaceName) > 0 {
-		for _, name := range interfaceName {
-			if len(name) > 0 {
-				if err = handler.Append(TABLE_MANGLE, CHAIN_PREROUTING, "-p", "tcp", "-i", name, "-j", CHAIN_RED_FROG); err != nil {
-					err = errors.Wrap(err, "Append into PREROUTING chain failed")
-					return
-				}
-				if err = handler.Append(TABLE_MANGLE, CHAIN_PREROUTING, "-p", "udp", "-i", name, "-j", CHAIN_RED_FROG); err != nil {
-					err = errors.Wrap(err, "Append into PREROUTING chain failed")
-					return
-				}
-				interfaceAdded = true
-			}
-		}
+	specs := c.preroutingSpecs(isIPv6, interfaceName)
+	if len(specs) == 0 {
+		log.GetLogger().Info("No included source of family, nothing is intercepted", zap.Bool("ipv6", isIPv6))
 	}
-	if !interfaceAdded {
-		if err = handler.Append(TABLE_MANGLE, CHAIN_PREROUTING, "-p", "tcp", "-j", CHAIN_RED_FROG); err != nil {
-			err = errors.Wrap(err, "Append into PREROUTING chain failed")
-			return
-		}
-		if err = handler.Append(TABLE_MANGLE, CHAIN_PREROUTING, "-p", "udp", "-j", CHAIN_RED_FROG); err != nil {
+	for _, spec := range specs {
+		if err = handler.Append(TABLE_MANGLE, CHAIN_PREROUTING, append(spec, "-j", CHAIN_RED_FROG)...); err != nil {
 			err = errors.Wrap(err, "Append into PREROUTING chain failed")
 			return
 		}
@@ -317,7 +451,8 @@ func (c *RoutingMgr) initPreRoutingChain(isIPv6 bool, interfaceName []string) (e
 	return
 }
 
-func (c *RoutingMgr) clearIPTables(iptbl *iptables.IPTables) {
+// clearIPTables removes chains, ipsets and policy routing of one family
+func (c *RoutingMgr) clearIPTables(iptbl iptablesHandler, isIPv6 bool) {
 	logger := log.GetLogger()
 
 	if err := c.deletePrerouting(iptbl); err != nil {
@@ -340,48 +475,42 @@ func (c *RoutingMgr) clearIPTables(iptbl *iptables.IPTables) {
 		logger.Error("Delete chain failed", zap.String("table", TABLE_MANGLE), zap.String("chain", CHAIN_TPROXY), zap.String("error", err.Error()))
 	}
 
-	if c.ipSetV4 != nil {
-		if err := c.ipSetV4.Destroy(); err != nil {
-			logger.Error("Destroy IPSetV4 failed", zap.String("name", IPSET_RED_FROG_V4), zap.String("error", err.Error()))
-		}
+	// sets of a family are referenced only by its own chains, which are gone now
+	sets := map[string]ipSetHandler{IPSET_RED_FROG_V4: c.ipSetV4, IPSET_RED_FROG_NET_V4: c.ipNetSetV4, IPSET_RED_FROG_DIRECT_V4: c.directSetV4}
+	if isIPv6 {
+		sets = map[string]ipSetHandler{IPSET_RED_FROG_V6: c.ipSetV6, IPSET_RED_FROG_NET_V6: c.ipNetSetV6, IPSET_RED_FROG_DIRECT_V6: c.directSetV6}
 	}
-	if c.ipSetV6 != nil {
-		if err := c.ipSetV6.Destroy(); err != nil {
-			logger.Error("Destroy IPSetV6 failed", zap.String("name", IPSET_RED_FROG_V4), zap.String("error", err.Error()))
+	for name, set := range sets {
+		if set != nil {
+			if err := set.Destroy(); err != nil {
+				logger.Error("Destroy IPSet failed", zap.String("name", name), zap.String("error", err.Error()))
+			}
 		}
 	}
 
-	if err := c.addDelRoutingRoute(c.routingTableNum, false, false); err != nil {
-		logger.Error("Delete routing route failed", zap.String("error", err.Error()))
-	}
-	if err := c.addDelRoutingRule(c.markMast, c.routingTableNum, false, false); err != nil {
-		logger.Error("Delete routing rule failed", zap.String("error", err.Error()))
-	}
-
-	if err := c.addDelRoutingRoute(c.routingTableNum, true, false); err != nil {
-		logger.Error("Delete routing route failed", zap.String("error", err.Error()))
+	if err := c.addDelRoutingRoute(c.routingTableNum, isIPv6, false); err != nil {
+		logger.Error("Delete routing route failed", zap.Bool("ipv6", isIPv6), zap.String("error", err.Error()))
 	}
-	if err := c.addDelRoutingRule(c.markMast, c.routingTableNum, true, false); err != nil {
-		logger.Error("Delete routing rule failed", zap.String("error", err.Error()))
+	if err := c.addDelRoutingRule(c.markMast, c.routingTableNum, isIPv6, false); err != nil {
+		logger.Error("Delete routing rule failed", zap.Bool("ipv6", isIPv6), zap.String("error", err.Error()))
 	}
 }
 
 func (c *RoutingMgr) Stop() {
 	logger := log.GetLogger()
-	c.serializeRoutingTable()
+	close(c.expireDone)
+	if err := c.serializeRoutingTable(); err != nil {
+		logger.Error("Save routing cache failed", zap.String("error", err.Error()))
+	}
 
-	c.clearIPTables(c.ip4tbl)
-	c.clearIPTables(c.ip6tbl)
+	c.clearIPTables(c.ip4tbl, false)
+	c.clearIPTables(c.ip6tbl, true)
 	logger.Info("Routing manager stopped")
 }
 
+// serializeRoutingTable saves learned mappings, file is replaced by rename so a crash never leaves it half written,
+// and left untouched if nothing changed since last save to spare flash of routers
 func (c *RoutingMgr) serializeRoutingTable() (err error) {
-	file, err := os.Create(config.GetPathFromWorkingDir(CACHE_PATH)) // For read access.
-	if err != nil {
-		err = errors.Wrapf(err, "Create routing cache file %s failed", CACHE_PATH)
-		return
-	}
-	defer file.Close()
 	c.Lock()
 	// strip empty ip
 	ipListV4 := make(map[string][]net.IP)
@@ -389,7 +518,7 @@ func (c *RoutingMgr) serializeRoutingTable() (err error) {
 	for domain, ips := range c.ipListV4 {
 		if ips != nil && len(ips) > 0 {
 			// make sure its not ip addrs
-			if tempIP := net.ParseIP(domain); tempIP == nil {
+			if !isPacIP(domain) {
 				ipListV4[domain] = ips
 			}
 		}
@@ -398,7 +527,7 @@ func (c *RoutingMgr) serializeRoutingTable() (err error) {
 	for domain, ips := range c.ipListV6 {
 		if ips != nil && len(ips) > 0 {
 			// make sure its not ip addrs
-			if tempIP := net.ParseIP(domain); tempIP == nil {
+			if !isPacIP(domain) {
 				ipListV6[domain] = ips
 			}
 		}
@@ -411,14 +540,47 @@ func (c *RoutingMgr) serializeRoutingTable() (err error) {
 		err = errors.Wrap(err, "Marshal routing cache failed")
 		return
 	}
+	c.persistMux.Lock()
+	defer c.persistMux.Unlock()
+	if bytes.Equal(data, c.persisted) {
+		return
+	}
 
-	if _, err = file.Write(data); err != nil {
+	path := config.GetPathFromWorkingDir(CACHE_PATH)
+	if err = ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
 		err = errors.Wrapf(err, "Write to routing cache file %s failed", CACHE_PATH)
+		return
 	}
-
+	if err = os.Rename(path+".tmp", path); err != nil {
+		err = errors.Wrapf(err, "Write to routing cache file %s failed", CACHE_PATH)
+		return
+	}
+	c.persisted = data
 	return
 }
 
+// SetPersistInterval saves learned mappings every interval seconds, so a crash or power loss of router does not lose
+// them, 0 saves on stop only
+func (c *RoutingMgr) SetPersistInterval(interval int) {
+	c.persistMux.Lock()
+	defer c.persistMux.Unlock()
+	c.persistInterval = time.Duration(interval) * time.Second
+}
+
+func (c *RoutingMgr) persistIfDue(now time.Time) {
+	c.persistMux.Lock()
+	due := c.persistInterval > 0 && now.Sub(c.persistedAt) >= c.persistInterval
+	if due {
+		c.persistedAt = now
+	}
+	c.persistMux.Unlock()
+	if due {
+		if err := c.serializeRoutingTable(); err != nil {
+			log.GetLogger().Error("Save routing cache failed", zap.String("error", err.Error()))
+		}
+	}
+}
+
 func (c *RoutingMgr) deserializeRoutingTable() (ret *RoutingMgrCache, err error) {
 	file, err := os.Open(config.GetPathFromWorkingDir(CACHE_PATH)) // For read access.
 	if err != nil {
@@ -436,11 +598,33 @@ func (c *RoutingMgr) deserializeRoutingTable() (ret *RoutingMgrCache, err error)
 	ret = &RoutingMgrCache{}
 	if err = yaml.Unmarshal(data, ret); err != nil {
 		err = errors.Wrapf(err, "Create routing cache file %s failed", CACHE_PATH)
-
+		return
 	}
+	c.persistMux.Lock()
+	c.persisted = data
+	c.persistedAt = time.Now()
+	c.persistMux.Unlock()
 	return
 }
 
+// GetIPDomains returns learned ip to domain mapping, ip entries added by pac list itself are skipped
+func (c *RoutingMgr) GetIPDomains() map[string]string {
+	c.RLock()
+	defer c.RUnlock()
+	ret := make(map[string]string)
+	for _, ipList := range []map[string][]net.IP{c.ipListV4, c.ipListV6} {
+		for domain, ips := range ipList {
+			if isPacIP(domain) {
+				continue
+			}
+			for _, ip := range ips {
+				ret[ip.String()] = domain
+			}
+		}
+	}
+	return ret
+}
+
 func (c *RoutingMgr) AddIPStr(domain string, input string) (err error) {
 	return c.AddIp(domain, net.ParseIP(input))
 }
@@ -474,18 +658,82 @@ func (c *RoutingMgr) isChanged(domain string, ip net.IP, isIPv6 bool) bool {
 	return true
 }
 func (c *RoutingMgr) AddIp(domain string, ip net.IP) error {
-	isIPv6 := ip.To4() == nil
-	if c.isChanged(domain, ip, isIPv6) {
-		if isIPv6 {
-			if err := c.routingTableAddIPV6(ip); err != nil {
-				log.GetLogger().Error("Add IP to routing table failed", zap.String("ip", ip.String()), zap.String("error", err.Error()))
+	return c.AddIps(map[string][]net.IP{domain: {ip}}, 0)
+}
+
+// AddIps adds ips learned for domains, e.g. answers of one DNS response whose TTL is ttl, new ones go into ipsets in
+// one batch
+func (c *RoutingMgr) AddIps(domainIPs map[string][]net.IP, ttl time.Duration) error {
+	logger := log.GetLogger()
+	ipv4List := make([]string, 0)
+	ipv6List := make([]string, 0)
+	learned := make([]string, 0)
+	for domain, ips := range domainIPs {
+		for _, ip := range ips {
+			if c.IsDirectIP(ip) {
+				// would be returned by direct set anyway
+				logger.Debug("Skip routing ip in direct list", zap.String("domain", domain), zap.String("ip", ip.String()))
+				continue
 			}
-		} else {
-			if err := c.routingTableAddIPV4(ip); err != nil {
-				log.GetLogger().Error("Add IP to routing table failed", zap.String("ip", ip.String()), zap.String("error", err.Error()))
+			isIPv6 := ip.To4() == nil
+			learned = append(learned, ip.String())
+			if !c.isChanged(domain, ip, isIPv6) {
+				continue
+			}
+			if isIPv6 {
+				ipv6List = append(ipv6List, ip.String())
+			} else {
+				ipv4List = append(ipv4List, ip.String())
 			}
 		}
 	}
+	c.Lock()
+	c.touchExpire(learned, ttl)
+	c.Unlock()
+	if err := c.addDelLearned(ipv4List, false, true); err != nil {
+		logger.Error("Add IP to routing table failed", zap.String("ip", strings.Join(ipv4List, ",")), zap.String("error", err.Error()))
+	}
+	if err := c.addDelLearned(ipv6List, true, true); err != nil {
+		logger.Error("Add IP to routing table failed", zap.String("ip", strings.Join(ipv6List, ",")), zap.String("error", err.Error()))
+	}
+	return nil
+}
+
+// addDelLearned adds or deletes learned ips, in one batch with ipset, otherwise one iptables rule each so they can
+// expire one by one
+func (c *RoutingMgr) addDelLearned(ips []string, isIPv6 bool, bAdd bool) error {
+	if len(ips) == 0 {
+		return nil
+	}
+	if (!isIPv6 && c.ipSetV4 != nil) || (isIPv6 && c.ipSetV6 != nil) {
+		switch {
+		case bAdd && isIPv6:
+			return c.routingTableAddIPV6List(ips)
+		case bAdd:
+			return c.routingTableAddIPV4List(ips)
+		case isIPv6:
+			return c.routingTableDelIPv6List(ips)
+		default:
+			return c.routingTableDelIPv4List(ips)
+		}
+	}
+	for _, ipStr := range ips {
+		ip := net.ParseIP(ipStr)
+		var err error
+		switch {
+		case bAdd && isIPv6:
+			err = c.routingTableAddIPV6(ip)
+		case bAdd:
+			err = c.routingTableAddIPV4(ip)
+		case isIPv6:
+			err = c.routingTableDelIPv6(ip)
+		default:
+			err = c.routingTableDelIPv4(ip)
+		}
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -529,18 +777,21 @@ func (c *RoutingMgr) ReloadPacList(domains map[string]bool, ips map[string]bool,
 	ipv4tablesList := make(map[string]bool)
 	ipv6tablesList := make(map[string]bool)
 
-	// find out which ip need to be added
-	for ipInput := range ips {
-		ip := net.ParseIP(ipInput)
-		if isIPv4 := ip.To4(); isIPv4 != nil {
+	// find out which ip need to be added, exceptions are not routed
+	for ipInput, flag := range ips {
+		ip, isIPv6, ok := parsePacIP(ipInput)
+		if !ok || !flag {
+			continue
+		}
+		if !isIPv6 {
 			if _, ok := c.ipListV4[ipInput]; !ok {
 				c.ipListV4[ipInput] = []net.IP{ip}
-				ipv4tablesList[ip.String()] = true
+				ipv4tablesList[ipInput] = true
 			}
 		} else {
 			if _, ok := c.ipListV6[ipInput]; !ok {
 				c.ipListV6[ipInput] = []net.IP{ip}
-				ipv6tablesList[ip.String()] = true
+				ipv6tablesList[ipInput] = true
 			}
 		}
 	}
@@ -550,7 +801,9 @@ func (c *RoutingMgr) ReloadPacList(domains map[string]bool, ips map[string]bool,
 
 	// delete ip according to delete list
 	for _, ipInput := range ipDeleteList {
-		if ip := net.ParseIP(ipInput); ip.To4() != nil {
+		if _, isIPv6, ok := parsePacIP(ipInput); !ok {
+			continue
+		} else if !isIPv6 {
 			ipv4tablesDeleteList[ipInput] = true
 			delete(c.ipListV4, ipInput)
 		} else {
@@ -562,16 +815,8 @@ func (c *RoutingMgr) ReloadPacList(domains map[string]bool, ips map[string]bool,
 	domainDeleteList := make([]string, 0)
 	for domain, ips := range c.ipListV4 {
 		// make sure its not ip address
-		if isIP := net.ParseIP(domain); isIP == nil {
-			keep := false
-			if stubs := common.GenerateDomainStubs(domain); stubs != nil && len(stubs) > 0 {
-				for _, stub := range stubs {
-					if flag, ok := domains[stub]; ok {
-						keep = flag
-						break
-					}
-				}
-			}
+		if !isPacIP(domain) {
+			keep, _ := common.MatchDomainRule(domains, domain)
 			if !keep {
 				domainDeleteList = append(domainDeleteList, domain)
 				for _, ip := range ips {
@@ -588,16 +833,8 @@ func (c *RoutingMgr) ReloadPacList(domains map[string]bool, ips map[string]bool,
 
 	domainDeleteList = make([]string, 0)
 	for domain, ips := range c.ipListV6 {
-		if isIP := net.ParseIP(domain); isIP == nil {
-			keep := false
-			if stubs := common.GenerateDomainStubs(domain); stubs != nil && len(stubs) > 0 {
-				for _, stub := range stubs {
-					if flag, ok := domains[stub]; ok {
-						keep = flag
-						break
-					}
-				}
-			}
+		if !isPacIP(domain) {
+			keep, _ := common.MatchDomainRule(domains, domain)
 			if !keep {
 				domainDeleteList = append(domainDeleteList, domain)
 				for _, ip := range ips {
@@ -650,14 +887,17 @@ func (c *RoutingMgr) LoadPacList(domains map[string]bool, ips map[string]bool) {
 	c.Lock()
 	ipv4tablesList := make(map[string]bool)
 	ipv6tablesList := make(map[string]bool)
-	for ipInput := range ips {
-		ip := net.ParseIP(ipInput)
-		if isIPv4 := ip.To4(); isIPv4 != nil {
+	for ipInput, flag := range ips {
+		ip, isIPv6, ok := parsePacIP(ipInput)
+		if !ok || !flag {
+			continue
+		}
+		if !isIPv6 {
 			c.ipListV4[ipInput] = []net.IP{ip}
-			ipv4tablesList[ip.String()] = true
+			ipv4tablesList[ipInput] = true
 		} else {
 			c.ipListV6[ipInput] = []net.IP{ip}
-			ipv6tablesList[ip.String()] = true
+			ipv6tablesList[ipInput] = true
 		}
 	}
 
@@ -666,31 +906,23 @@ func (c *RoutingMgr) LoadPacList(domains map[string]bool, ips map[string]bool) {
 	} else {
 		for domain, ips := range cache.IPv4 {
 			if ips != nil && len(ips) > 0 {
-				if stubs := common.GenerateDomainStubs(domain); stubs != nil && len(stubs) > 0 {
-					for _, stub := range stubs {
-						if _, ok := domains[stub]; ok {
-							c.ipListV4[domain] = ips
-							for _, ip := range ips {
-								ipv4tablesList[ip.String()] = true
-							}
-						}
+				if flag, _ := common.MatchDomainRule(domains, domain); flag {
+					c.ipListV4[domain] = ips
+					for _, ip := range ips {
+						ipv4tablesList[ip.String()] = true
 					}
-
+					c.touchExpire(composeIPs(ips), 0)
 				}
 			}
 		}
 		for domain, ips := range cache.IPv6 {
 			if ips != nil && len(ips) > 0 {
-				if stubs := common.GenerateDomainStubs(domain); stubs != nil && len(stubs) > 0 {
-					for _, stub := range stubs {
-						if _, ok := c.ipListV6[stub]; ok {
-							c.ipListV6[domain] = ips
-							for _, ip := range ips {
-								ipv6tablesList[ip.String()] = true
-							}
-						}
+				if flag, _ := common.MatchDomainRule(domains, domain); flag {
+					c.ipListV6[domain] = ips
+					for _, ip := range ips {
+						ipv6tablesList[ip.String()] = true
 					}
-
+					c.touchExpire(composeIPs(ips), 0)
 				}
 			}
 
@@ -714,6 +946,72 @@ func (c *RoutingMgr) LoadPacList(domains map[string]bool, ips map[string]bool) {
 	}
 
 }
+
+// parsePacIP parses ip or CIDR rule of pac list, ip is network address for CIDR
+func parsePacIP(input string) (ip net.IP, isIPv6 bool, ok bool) {
+	if ip = net.ParseIP(input); ip == nil {
+		_, ipNet, err := net.ParseCIDR(input)
+		if err != nil {
+			return nil, false, false
+		}
+		ip = ipNet.IP
+	}
+	return ip, ip.To4() == nil, true
+}
+
+// isPacIP tells routing entry added by pac list ip rule apart from domain learned by DNS
+func isPacIP(key string) bool {
+	_, _, ok := parsePacIP(key)
+	return ok
+}
+
+// ipSetFor returns set entry is added to, CIDR goes to hash:net set, nil if iptables rule is used instead
+func (c *RoutingMgr) ipSetFor(entry string, isIPv6 bool) ipSetHandler {
+	isNet := strings.Contains(entry, "/")
+	if isIPv6 {
+		if isNet {
+			return c.ipNetSetV6
+		}
+		return c.ipSetV6
+	}
+	if isNet {
+		return c.ipNetSetV4
+	}
+	return c.ipSetV4
+}
+
+// addDelIPSets adds or deletes entries in one batch per ipset, entries without ipset are returned for iptables rule
+func (c *RoutingMgr) addDelIPSets(ips []string, isIPv6 bool, bAdd bool) (rules []string, err error) {
+	batches := make(map[ipSetHandler][]string)
+	rules = make([]string, 0)
+	for _, ip := range ips {
+		if set := c.ipSetFor(ip, isIPv6); set != nil {
+			batches[set] = append(batches[set], ip)
+		} else {
+			rules = append(rules, ip)
+		}
+	}
+	for set, entries := range batches {
+		if bAdd {
+			err = set.AddList(entries, 0)
+		} else {
+			err = set.DelList(entries)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func composeIPs(ips []net.IP) []string {
+	ret := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		ret = append(ret, ip.String())
+	}
+	return ret
+}
+
 func composeIPList(ips map[string]bool) []string {
 	temp := make([]string, 0)
 	for ip := range ips {
@@ -737,15 +1035,15 @@ func (c *RoutingMgr) routingTableAddIPV4(ip net.IP) error {
 	return nil
 }
 func (c *RoutingMgr) routingTableAddIPV4List(ips []string) error {
-	if c.ipSetV4 != nil {
-		for _, ip := range ips {
-			if err := c.ipSetV4.Add(ip, 0); err != nil {
-				return errors.Wrap(err, "Routing table add IPSetV4 failed")
-			}
-		}
+	rules, err := c.addDelIPSets(ips, false, true)
+	if err != nil {
+		return errors.Wrap(err, "Routing table add IPSetV4 failed")
+	}
+	if len(rules) < len(ips) {
 		log.GetLogger().Debug("Routing table add IPSetV4 successful", zap.String("ip", strings.Join(ips, ",")))
-	} else {
-		ipsStr := strings.Join(ips, ",")
+	}
+	if len(rules) > 0 {
+		ipsStr := strings.Join(rules, ",")
 		if err := c.ip4tbl.Append(TABLE_MANGLE, CHAIN_RED_FROG, "-d", ipsStr, "-j", CHAIN_TPROXY); err != nil {
 			return errors.Wrapf(err, "Routing table add IPv4 failed: %s", ipsStr)
 		}
@@ -771,15 +1069,15 @@ func (c *RoutingMgr) routingTableAddIPV6(ip net.IP) error {
 	return nil
 }
 func (c *RoutingMgr) routingTableAddIPV6List(ips []string) error {
-	if c.ipSetV6 != nil {
-		for _, ip := range ips {
-			if err := c.ipSetV6.Add(ip, 0); err != nil {
-				return errors.Wrap(err, "Routing table add IPSetV6 failed")
-			}
-		}
+	rules, err := c.addDelIPSets(ips, true, true)
+	if err != nil {
+		return errors.Wrap(err, "Routing table add IPSetV6 failed")
+	}
+	if len(rules) < len(ips) {
 		log.GetLogger().Debug("Routing table add IPSetV6 successful", zap.String("ip", strings.Join(ips, ",")))
-	} else {
-		ipsStr := strings.Join(ips, ",")
+	}
+	if len(rules) > 0 {
+		ipsStr := strings.Join(rules, ",")
 		if err := c.ip6tbl.Append(TABLE_MANGLE, CHAIN_RED_FROG, "-d", ipsStr, "-j", CHAIN_TPROXY); err != nil {
 			return errors.Wrapf(err, "Routing table add IPv6 failed: %s", ipsStr)
 		}
@@ -806,15 +1104,15 @@ func (c *RoutingMgr) routingTableDelIPv4(ip net.IP) error {
 }
 
 func (c *RoutingMgr) routingTableDelIPv4List(ips []string) error {
-	if c.ipSetV4 != nil {
-		for _, ip := range ips {
-			if err := c.ipSetV4.Del(ip); err != nil {
-				return errors.Wrap(err, "Routing table del IPSetV4 failed")
-			}
-		}
+	rules, err := c.addDelIPSets(ips, false, false)
+	if err != nil {
+		return errors.Wrap(err, "Routing table del IPSetV4 failed")
+	}
+	if len(rules) < len(ips) {
 		log.GetLogger().Debug("Routing table del IPSetV4 successful", zap.String("ip", strings.Join(ips, ",")))
-	} else {
-		ipsStr := strings.Join(ips, ",")
+	}
+	if len(rules) > 0 {
+		ipsStr := strings.Join(rules, ",")
 		if err := c.ip4tbl.Delete(TABLE_MANGLE, CHAIN_RED_FROG, "-d", ipsStr, "-j", CHAIN_TPROXY); err != nil {
 			return errors.Wrapf(err, "Routing table delete IPv4 failed: %s", ipsStr)
 		}
@@ -841,15 +1139,15 @@ func (c *RoutingMgr) routingTableDelIPv6(ip net.IP) error {
 }
 
 func (c *RoutingMgr) routingTableDelIPv6List(ips []string) error {
-	if c.ipSetV6 != nil {
-		for _, ip := range ips {
-			if err := c.ipSetV6.Del(ip); err != nil {
-				return errors.Wrap(err, "Routing table del IPSetV6 failed")
-			}
-		}
+	rules, err := c.addDelIPSets(ips, true, false)
+	if err != nil {
+		return errors.Wrap(err, "Routing table del IPSetV6 failed")
+	}
+	if len(rules) < len(ips) {
 		log.GetLogger().Debug("Routing table del IPSetV6 successful", zap.String("ip", strings.Join(ips, ",")))
-	} else {
-		ipsStr := strings.Join(ips, ",")
+	}
+	if len(rules) > 0 {
+		ipsStr := strings.Join(rules, ",")
 		if err := c.ip6tbl.Delete(TABLE_MANGLE, CHAIN_RED_FROG, "-d", ipsStr, "-j", CHAIN_TPROXY); err != nil {
 			return errors.Wrapf(err, "Routing table delete IPv6 failed: %s", ipsStr)
 		}
@@ -879,6 +1177,10 @@ func (c *RoutingMgr) addDelRoutingRule(markMask string, routingTableNum int, isI
 	rule.Mask = int(mask)
 
 	rule.Priority = ROUTING_PRIORITY
+	if c.dryRun {
+		dryRunPolicy(isIPv6, bAdd, "rule", fmt.Sprintf("fwmark %s lookup %d priority %d", markSpec(rule.Mark, rule.Mask), rule.Table, rule.Priority))
+		return nil
+	}
 	var rules []netlink.Rule
 
 	if isIPv6 {
@@ -915,6 +1217,14 @@ func (c *RoutingMgr) addDelRoutingRule(markMask string, routingTableNum int, isI
 }
 
 func (c *RoutingMgr) addDelRoutingRoute(routingTableNum int, isIPv6 bool, bAdd bool) error {
+	if c.dryRun {
+		dst := "0.0.0.0/0"
+		if isIPv6 {
+			dst = "::/0"
+		}
+		dryRunPolicy(isIPv6, bAdd, "route", fmt.Sprintf("local %s dev lo table %d", dst, routingTableNum))
+		return nil
+	}
 	link, err := netlink.LinkByName("lo")
 	if err != nil {
 		return errors.Wrapf(err, "Get loop back dev failed")
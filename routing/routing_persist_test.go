@@ -0,0 +1,57 @@
+package routing
+
+import (
+	"github.com/weishi258/redfrog-core/config"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPersistRoutingTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.SetWorkingDir(dir)
+	defer config.SetWorkingDir("")
+
+	mgr := &RoutingMgr{ipListV4: make(map[string][]net.IP), ipListV6: make(map[string][]net.IP)}
+	mgr.ipListV4["www.google.com"] = []net.IP{net.ParseIP("192.0.2.1").To4()}
+	mgr.ipListV4["91.108.4.0/22"] = []net.IP{net.ParseIP("91.108.4.0").To4()}
+	mgr.ipListV6["www.google.com"] = []net.IP{net.ParseIP("2001:db8::1")}
+	mgr.SetPersistInterval(60)
+	mgr.persistIfDue(time.Now())
+
+	restored := &RoutingMgr{}
+	cache, err := restored.deserializeRoutingTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.IPv4) != 1 || !cache.IPv4["www.google.com"][0].Equal(net.ParseIP("192.0.2.1")) || len(cache.IPv6) != 1 {
+		t.Errorf("learned mappings should be restored without pac ip entries, got %v %v", cache.IPv4, cache.IPv6)
+	}
+
+	// not due yet
+	path := filepath.Join(dir, CACHE_PATH)
+	os.Remove(path)
+	mgr.ipListV4["www.youtube.com"] = []net.IP{net.ParseIP("192.0.2.2").To4()}
+	mgr.persistIfDue(time.Now())
+	if _, err = os.Stat(path); err == nil {
+		t.Errorf("cache should not be saved before interval")
+	}
+	// unchanged content is not written again
+	delete(mgr.ipListV4, "www.youtube.com")
+	mgr.persistIfDue(time.Now().Add(time.Hour))
+	if _, err = os.Stat(path); err == nil {
+		t.Errorf("unchanged cache should not be written")
+	}
+	mgr.ipListV4["www.youtube.com"] = []net.IP{net.ParseIP("192.0.2.2").To4()}
+	mgr.persistIfDue(time.Now().Add(2 * time.Hour))
+	if _, err = os.Stat(path); err != nil {
+		t.Errorf("changed cache should be saved when due")
+	}
+}
@@ -0,0 +1,73 @@
+package routing
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"strings"
+)
+
+// parseSourceNets parses source policy list of CIDRs or bare ips, an invalid entry fails as skipping it could send a
+// device which must stay out of the tunnel into it
+func parseSourceNets(list []string) (ret []*net.IPNet, err error) {
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bitLen := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bitLen = ip4, 8*net.IPv4len
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bitLen, bitLen)})
+		} else if _, ipNet, parseErr := net.ParseCIDR(entry); parseErr == nil {
+			ret = append(ret, ipNet)
+		} else {
+			return nil, errors.Errorf("Source %s is neither ip nor CIDR", entry)
+		}
+	}
+	return
+}
+
+// sourcesOf returns CIDRs of family
+func sourcesOf(nets []*net.IPNet, isIPv6 bool) (ret []string) {
+	for _, ipNet := range nets {
+		if (ipNet.IP.To4() == nil) == isIPv6 {
+			ret = append(ret, ipNet.String())
+		}
+	}
+	return
+}
+
+// preroutingSpecs returns match part of PREROUTING jumps into RED_FROG, one per interface, included source and
+// protocol, none when sources are included but not of this family so it is not intercepted at all
+func (c *RoutingMgr) preroutingSpecs(isIPv6 bool, interfaceName []string) (ret [][]string) {
+	interfaces := make([]string, 0, len(interfaceName))
+	for _, name := range interfaceName {
+		if len(name) > 0 {
+			interfaces = append(interfaces, name)
+		}
+	}
+	if len(interfaces) == 0 {
+		interfaces = append(interfaces, "")
+	}
+	sources := []string{""}
+	if len(c.includeSource) > 0 {
+		sources = sourcesOf(c.includeSource, isIPv6)
+	}
+	for _, name := range interfaces {
+		for _, source := range sources {
+			for _, proto := range []string{"tcp", "udp"} {
+				spec := []string{"-p", proto}
+				if len(name) > 0 {
+					spec = append(spec, "-i", name)
+				}
+				if len(source) > 0 {
+					spec = append(spec, "-s", source)
+				}
+				ret = append(ret, spec)
+			}
+		}
+	}
+	return
+}
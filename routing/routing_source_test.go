@@ -0,0 +1,35 @@
+package routing
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPreroutingSpecs(t *testing.T) {
+	if _, err := parseSourceNets([]string{"192.168.0.1", "guest"}); err == nil {
+		t.Error("invalid source should fail")
+	}
+	include, err := parseSourceNets([]string{"192.168.0.100", "192.168.0.104/30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr := &RoutingMgr{includeSource: include}
+	expected := [][]string{
+		{"-p", "tcp", "-i", "br0", "-s", "192.168.0.100/32"},
+		{"-p", "udp", "-i", "br0", "-s", "192.168.0.100/32"},
+		{"-p", "tcp", "-i", "br0", "-s", "192.168.0.104/30"},
+		{"-p", "udp", "-i", "br0", "-s", "192.168.0.104/30"},
+	}
+	if specs := mgr.preroutingSpecs(false, []string{"", "br0"}); !reflect.DeepEqual(specs, expected) {
+		t.Errorf("got %v, expected %v", specs, expected)
+	}
+	if specs := mgr.preroutingSpecs(true, nil); len(specs) != 0 {
+		t.Errorf("family without included source should not be intercepted, got %v", specs)
+	}
+
+	mgr = &RoutingMgr{}
+	expected = [][]string{{"-p", "tcp"}, {"-p", "udp"}}
+	if specs := mgr.preroutingSpecs(true, nil); !reflect.DeepEqual(specs, expected) {
+		t.Errorf("got %v, expected %v", specs, expected)
+	}
+}